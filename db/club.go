@@ -22,6 +22,16 @@ func IsClubMember(clubId, uid int64) bool {
 	return has
 }
 
+// 是否是俱乐部部长
+func IsClubOwner(clubId, uid int64) bool {
+	c := model.Club{ClubId: clubId}
+	has, err := database.Get(&c)
+	if err != nil || !has {
+		return false
+	}
+	return c.OwnerUid > 0 && c.OwnerUid == uid
+}
+
 func IsBalanceEnough(clubId int64) bool {
 	c := model.Club{ClubId: clubId}
 	has, err := database.Get(&c)
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/errutil"
+
+	"github.com/go-xorm/xorm"
+)
+
+// SettleGold 在同一个事务中修改所有玩家的金币并写入流水, 任何一个玩家余额不足时全部回滚
+func SettleGold(ledgers []*model.GoldLedger) error {
+	session := database.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		logger.Error(err.Error())
+		return errutil.ErrDBOperation
+	}
+
+	for _, l := range ledgers {
+		if err := changeGold(session, l); err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+
+	return session.Commit()
+}
+
+// 在事务中修改玩家的金币并写入流水, 余额记录在流水中
+func changeGold(session *xorm.Session, l *model.GoldLedger) error {
+	u := &model.User{}
+	has, err := session.Where("id=?", l.Uid).ForUpdate().Get(u)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return errutil.ErrUserNotFound
+	}
+	if u.Gold+l.Change < 0 {
+		return errutil.ErrGoldNotEnough
+	}
+
+	u.Gold += l.Change
+	if _, err := session.Cols("gold").Where("id=?", l.Uid).Update(u); err != nil {
+		return err
+	}
+
+	l.Balance = u.Gold
+	_, err = session.Insert(l)
+	return err
+}
@@ -27,7 +27,21 @@ func QueryHistory(id int64) (*model.History, error) {
 		return nil, err
 	}
 	if !has {
-		return nil, errutil.ErrOrderNotFound
+		return nil, errutil.ErrHistoryNotFound
+	}
+	return h, nil
+}
+
+//QueryHistoryByCode 按回放码查询历史记录
+func QueryHistoryByCode(code string) (*model.History, error) {
+	h := &model.History{}
+	has, err := database.Where("replay_code=?", code).Get(h)
+	if err != nil {
+		log.Error(err)
+		return nil, errutil.ErrDBOperation
+	}
+	if !has {
+		return nil, errutil.ErrHistoryNotFound
 	}
 	return h, nil
 }
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"strings"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/go-xorm/xorm"
+)
+
+//InsertMail 发送邮件
+func InsertMail(m *model.Mail) error {
+	if _, err := database.Insert(m); err != nil {
+		logger.Error(err.Error())
+		return errutil.ErrDBOperation
+	}
+	return nil
+}
+
+//QueryMails 玩家可以看到的邮件, 不包括已经过期和已经删除的邮件, 新邮件在前
+func QueryMails(uid, now int64, limit int) ([]*model.Mail, error) {
+	clubs := []model.UserClub{}
+	if err := database.Find(&clubs, &model.UserClub{Uid: uid, Status: model.UserClubStatusAgree}); err != nil {
+		return nil, errutil.ErrDBOperation
+	}
+
+	cond := "(`scope` = ? AND `target` = ?) OR `scope` = ?"
+	args := []interface{}{protocol.MailScopeUser, uid, protocol.MailScopeAll}
+	if len(clubs) > 0 {
+		cond += " OR (`scope` = ? AND `target` IN (" + strings.TrimSuffix(strings.Repeat("?,", len(clubs)), ",") + "))"
+		args = append(args, protocol.MailScopeClub)
+		for _, c := range clubs {
+			args = append(args, c.ClubId)
+		}
+	}
+
+	list := []*model.Mail{}
+	err := database.Where("expire_at > ?", now).And(cond, args...).
+		And("NOT EXISTS (SELECT 1 FROM `mail_state` WHERE `mail_state`.`mail_id` = `mail`.`id` AND `mail_state`.`uid` = ? AND `mail_state`.`deleted_at` > 0)", uid).
+		Desc("id").Limit(limit).Find(&list)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, errutil.ErrDBOperation
+	}
+	return list, nil
+}
+
+//QueryMailStates 玩家的邮件状态, 没有操作过的邮件没有记录
+func QueryMailStates(uid int64, ids []int64) ([]*model.MailState, error) {
+	list := []*model.MailState{}
+	if len(ids) == 0 {
+		return list, nil
+	}
+	if err := database.Where("uid=?", uid).In("mail_id", ids).Find(&list); err != nil {
+		return nil, errutil.ErrDBOperation
+	}
+	return list, nil
+}
+
+//ReadMails 标记为已读
+func ReadMails(uid int64, ids []int64, now int64) error {
+	return updateMailStates(uid, ids, "read_at", now)
+}
+
+//DeleteMails 删除邮件, 只对当前玩家删除
+func DeleteMails(uid int64, ids []int64, now int64) error {
+	return updateMailStates(uid, ids, "deleted_at", now)
+}
+
+//ClaimMail 领取附件并增加房卡, 已经领取过时返回false, 多次领取只增加一次
+func ClaimMail(uid int64, m *model.Mail, now int64) (bool, int64, error) {
+	session := database.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		logger.Error(err.Error())
+		return false, 0, errutil.ErrDBOperation
+	}
+
+	claimed, err := setMailState(session, uid, m.Id, "claimed_at", now)
+	if err != nil {
+		session.Rollback()
+		return false, 0, err
+	}
+	if !claimed {
+		session.Rollback()
+		return false, 0, nil
+	}
+	if _, err := setMailState(session, uid, m.Id, "read_at", now); err != nil {
+		session.Rollback()
+		return false, 0, err
+	}
+	coin, err := addCoin(session, uid, m.Coin)
+	if err != nil {
+		session.Rollback()
+		return false, 0, err
+	}
+
+	return true, coin, session.Commit()
+}
+
+func updateMailStates(uid int64, ids []int64, col string, now int64) error {
+	session := database.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		logger.Error(err.Error())
+		return errutil.ErrDBOperation
+	}
+
+	for _, id := range ids {
+		if _, err := setMailState(session, uid, id, col, now); err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+
+	return session.Commit()
+}
+
+// 在事务中设置邮件状态的时间, 只有之前没有设置过时返回true
+func setMailState(session *xorm.Session, uid, mailId int64, col string, now int64) (bool, error) {
+	if _, err := session.Exec("INSERT IGNORE INTO `mail_state` (`mail_id`, `uid`) VALUES (?, ?)", mailId, uid); err != nil {
+		return false, err
+	}
+	ret, err := session.Exec("UPDATE `mail_state` SET `"+col+"` = ? WHERE `mail_id` = ? AND `uid` = ? AND `"+col+"` = 0", now, mailId, uid)
+	if err != nil {
+		return false, err
+	}
+	n, err := ret.RowsAffected()
+	return n > 0, err
+}
@@ -49,23 +49,27 @@ func ShowSQL(show bool) ModelOption {
 	}
 }
 
-func envInit() {
-	// async task
+func envInit(done chan struct{}) {
+	// async task, 通道关闭后写完剩余的数据再退出
 	go func() {
-		for {
+		defer close(done)
+		write, update := chWrite, chUpdate
+		for write != nil || update != nil {
 			select {
-			case t, ok := <-chWrite:
+			case t, ok := <-write:
 				if !ok {
-					return
+					write = nil
+					continue
 				}
 
 				if _, err := database.Insert(t); err != nil {
 					logger.Error(err)
 				}
 
-			case t, ok := <-chUpdate:
+			case t, ok := <-update:
 				if !ok {
-					return
+					update = nil
+					continue
 				}
 
 				if _, err := database.Update(t); err != nil {
@@ -122,11 +126,13 @@ func MustStartup(dsn string, opts ...ModelOption) func() {
 	database.ShowSQL(settings.showSQL)
 
 	syncSchema()
-	envInit()
+	done := make(chan struct{})
+	envInit(done)
 
 	closer := func() {
 		close(chWrite)
 		close(chUpdate)
+		<-done
 		database.Close()
 		logger.Info("stopped")
 	}
@@ -139,17 +145,42 @@ func syncSchema() {
 		new(model.Agent),
 		new(model.CardConsume),
 		new(model.Desk),
+		new(model.GoldLedger),
 		new(model.History),
 		new(model.Login),
+		new(model.Mail),
+		new(model.MailState),
 		new(model.Online),
 		new(model.Order),
+		new(model.RankStat),
 		new(model.Recharge),
 		new(model.Register),
 		new(model.ThirdAccount),
+		new(model.Tournament),
+		new(model.TournamentPlayer),
 		new(model.Trade),
 		new(model.User),
 		new(model.Uuid),
 		new(model.Club),
 		new(model.UserClub),
 	)
+
+	widenHistorySnapshot()
+}
+
+// Sync2不修改已有列的类型, 之前创建的history表的snapshot列从TEXT扩大为MEDIUMTEXT
+func widenHistorySnapshot() {
+	ret, err := database.Query("SELECT `DATA_TYPE` FROM `information_schema`.`COLUMNS` WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = 'history' AND `COLUMN_NAME` = 'snapshot'")
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if len(ret) == 0 || string(ret[0]["DATA_TYPE"]) != "text" {
+		return
+	}
+	if _, err := database.Exec("ALTER TABLE `history` MODIFY `snapshot` MEDIUMTEXT NOT NULL"); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	logger.Info("history.snapshot已经修改为MEDIUMTEXT")
 }
@@ -4,3 +4,13 @@ const (
 	UserClubStatusApply = 1
 	UserClubStatusAgree = 2
 )
+
+// 金币流水类型
+const (
+	GoldLedgerTypeSettle           = 1 // 金币场每局结算
+	GoldLedgerTypeTournamentFee    = 2 // 比赛报名费
+	GoldLedgerTypeTournamentRefund = 3 // 比赛取消退还报名费
+	GoldLedgerTypeTournamentPrize  = 4 // 比赛奖励
+	GoldLedgerTypeRecharge         = 5 // 后台充值
+	GoldLedgerTypeMatchFee         = 6 // 快速匹配开局扣除的金币
+)
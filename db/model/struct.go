@@ -69,6 +69,62 @@ type Desk struct {
 	Extras       string `xorm:"not null TEXT default"`
 }
 
+// 金币流水, 金币的每一次变化对应一条记录
+type GoldLedger struct {
+	Id        int64
+	Uid       int64  `xorm:"not null index BIGINT(20) default 0"`
+	Type      int    `xorm:"not null TINYINT(3) default 0"`
+	Change    int64  `xorm:"not null BIGINT(20) default 0"` // 金币变化, 已经扣除抽水
+	Rake      int64  `xorm:"not null BIGINT(20) default 0"` // 抽水
+	Balance   int64  `xorm:"not null BIGINT(20) default 0"` // 变化后的余额
+	DeskId    int64  `xorm:"not null index BIGINT(20) default 0"`
+	DeskNo    string `xorm:"not null VARCHAR(32) default"`
+	Round     int    `xorm:"not null INT(11) default 0"`
+	CreatedAt int64  `xorm:"not null index BIGINT(20) default 0"`
+
+	TournamentId int64 `xorm:"not null index BIGINT(20) default 0"` // 比赛报名费, 退款和奖励关联的比赛
+}
+
+// 每日比赛, 每个等级每天一场
+type Tournament struct {
+	Id         int64
+	Level      int    `xorm:"not null INT(11) default 0"`
+	Day        string `xorm:"not null index VARCHAR(8) default"` // 比赛日期, 例如20060102
+	Status     int    `xorm:"not null index TINYINT(3) default 1"`
+	Stage      int    `xorm:"not null INT(11) default 0"` // 已经开始的轮数
+	Fee        int64  `xorm:"not null BIGINT(20) default 0"`
+	Pool       int64  `xorm:"not null BIGINT(20) default 0"` // 报名费总额
+	StartAt    int64  `xorm:"not null BIGINT(20) default 0"`
+	FinishedAt int64  `xorm:"not null BIGINT(20) default 0"`
+	CreatedAt  int64  `xorm:"not null BIGINT(20) default 0"`
+}
+
+// 参赛玩家
+type TournamentPlayer struct {
+	Id           int64
+	TournamentId int64  `xorm:"not null index BIGINT(20) default 0"`
+	Uid          int64  `xorm:"not null index BIGINT(20) default 0"`
+	Name         string `xorm:"not null VARCHAR(64) default"`
+	Status       int    `xorm:"not null TINYINT(3) default 1"`
+	Score        int    `xorm:"not null INT(11) default 0"` // 累计分数
+	Stage        int    `xorm:"not null INT(11) default 0"` // 已经完成的轮数
+	Rank         int    `xorm:"not null INT(11) default 0"`
+	Prize        int64  `xorm:"not null BIGINT(20) default 0"`
+	CreatedAt    int64  `xorm:"not null BIGINT(20) default 0"`
+}
+
+// 排行榜统计, 牌局结束时增量累加, 查询时按数值排序
+type RankStat struct {
+	Id        int64
+	Uid       int64  `xorm:"not null unique(rank_stat) BIGINT(20) default 0"`
+	Name      string `xorm:"not null VARCHAR(255) default"`
+	ClubId    int64  `xorm:"not null unique(rank_stat) index(rank_value) BIGINT(20) default 0"` // 0表示全服
+	Period    string `xorm:"not null unique(rank_stat) index(rank_value) VARCHAR(16) default"`  // 统计周期, 例如d20060102, w200601, all
+	Metric    int    `xorm:"not null unique(rank_stat) index(rank_value) INT(11) default 0"`
+	Value     int64  `xorm:"not null index(rank_value) BIGINT(20) default 0"`
+	UpdatedAt int64  `xorm:"not null BIGINT(20) default 0"`
+}
+
 type History struct {
 	Id           int64
 	DeskId       int64  `xorm:"not null index BIGINT(20) default 0"`
@@ -83,7 +139,11 @@ type History struct {
 	ScoreChange1 int    `xorm:"not null INT(255) default 0"`
 	ScoreChange2 int    `xorm:"not null INT(255) default 0"`
 	ScoreChange3 int    `xorm:"not null INT(255) default 0"`
-	Snapshot     string `xorm:"not null TEXT default"`
+	Snapshot     string `xorm:"not null MEDIUMTEXT default"` //回放快照, 一局的操作较多时超过TEXT的64KB
+	EventVersion int    `xorm:"not null INT(11) default 0"`
+	Events       []byte `xorm:"MEDIUMBLOB"` //gzip压缩的事件日志
+
+	ReplayCode string `xorm:"not null index VARCHAR(16) default"` //随机生成的回放码, 不能从ID推算
 }
 
 type Login struct {
@@ -100,6 +160,29 @@ type Login struct {
 	LogoutAt  int64  `xorm:"not null BIGINT(11) default"`
 }
 
+// 邮件, 每个玩家的已读/领取/删除状态记录在MailState中
+type Mail struct {
+	Id        int64
+	Kind      int    `xorm:"not null TINYINT(3) default 1"`
+	Sender    int64  `xorm:"not null BIGINT(20) default 0"` // 管理员UID, 系统邮件为0
+	Scope     int    `xorm:"not null index(mail_scope) TINYINT(3) default 1"`
+	Target    int64  `xorm:"not null index(mail_scope) BIGINT(20) default 0"` // 玩家UID或者俱乐部ID
+	Title     string `xorm:"not null VARCHAR(64) default"`
+	Content   string `xorm:"not null VARCHAR(1024) default"`
+	Coin      int64  `xorm:"not null BIGINT(20) default 0"` // 附件: 房卡数量
+	CreatedAt int64  `xorm:"not null BIGINT(20) default 0"`
+	ExpireAt  int64  `xorm:"not null index BIGINT(20) default 0"`
+}
+
+type MailState struct {
+	Id        int64
+	MailId    int64 `xorm:"not null unique(mail_state) BIGINT(20) default 0"`
+	Uid       int64 `xorm:"not null unique(mail_state) BIGINT(20) default 0"`
+	ReadAt    int64 `xorm:"not null BIGINT(20) default 0"`
+	ClaimedAt int64 `xorm:"not null BIGINT(20) default 0"` // 领取附件的时间, 只能领取一次
+	DeletedAt int64 `xorm:"not null BIGINT(20) default 0"`
+}
+
 type Online struct {
 	Id        int64
 	Time      int64 `xorm:"not null BIGINT(20) default"`
@@ -201,6 +284,8 @@ type User struct {
 	RegisterAt      int64  `xorm:"not null index BIGINT(20) default 0"`
 	FirstRechargeAt int64  `xorm:"not null index BIGINT(20) default 0"`
 	Debug           int    `xorm:"not null index TINYINT(1) default 0"`
+	Rating          int    `xorm:"not null INT(11) default 0"`    // 匹配分, 初始为0
+	Gold            int64  `xorm:"not null BIGINT(20) default 0"` // 金币场的金币, 与房卡分开
 }
 
 type Uuid struct {
@@ -216,6 +301,7 @@ type Club struct {
 	Balance   int64  `xorm:"not null BIGINT(20) default 0"`
 	ClubId    int64  `xorm:"not null index BIGINT(20) default 0"`
 	AgentId   int64  `xorm:"not null index BIGINT(20) default 0"`
+	OwnerUid  int64  `xorm:"not null index BIGINT(20) default 0"` //部长UID
 	Name      string `xorm:"not null VARCHAR(128) default"`
 	Desc      string `xorm:"not null VARCHAR(512) default"`
 	Member    int    `xorm:"not null INT(11) default"`
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/errutil"
+)
+
+//IncrRankStats 增量累加排行榜统计, 不存在时插入. 使用唯一索引合并插入和累加, 并发写入同一行时不会冲突
+func IncrRankStats(stats []*model.RankStat) error {
+	session := database.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		logger.Error(err.Error())
+		return errutil.ErrDBOperation
+	}
+
+	for _, st := range stats {
+		_, err := session.Exec("INSERT INTO `rank_stat` (`uid`, `name`, `club_id`, `period`, `metric`, `value`, `updated_at`) VALUES (?, ?, ?, ?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE `value` = `value` + VALUES(`value`), `name` = VALUES(`name`), `updated_at` = VALUES(`updated_at`)",
+			st.Uid, st.Name, st.ClubId, st.Period, st.Metric, st.Value, st.UpdatedAt)
+		if err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+
+	return session.Commit()
+}
+
+// 排序方向: RankingDesc数值大的在前, RankingNormal数值小的在前, 数值相同时先上榜的在前
+func rankOrder(order int) (by, cmp string) {
+	if order == RankingNormal {
+		return "`value` ASC, `id` ASC", "<"
+	}
+	return "`value` DESC, `id` ASC", ">"
+}
+
+//QueryRanks 排行榜列表
+func QueryRanks(metric int, period string, clubId int64, order, offset, limit int) ([]*model.RankStat, error) {
+	if limit <= 0 {
+		limit = DefaultTopN
+	}
+	by, _ := rankOrder(order)
+	list := []*model.RankStat{}
+	err := database.Where("metric=? AND period=? AND club_id=?", metric, period, clubId).
+		OrderBy(by).Limit(limit, offset).Find(&list)
+	if err != nil {
+		return nil, errutil.ErrDBOperation
+	}
+	return list, nil
+}
+
+//QueryRankStat 玩家的排行榜统计, 没有上榜时返回nil
+func QueryRankStat(uid int64, metric int, period string, clubId int64) (*model.RankStat, error) {
+	st := &model.RankStat{}
+	has, err := database.Where("uid=? AND metric=? AND period=? AND club_id=?", uid, metric, period, clubId).Get(st)
+	if err != nil {
+		return nil, errutil.ErrDBOperation
+	}
+	if !has {
+		return nil, nil
+	}
+	return st, nil
+}
+
+//RankOf 名次, 从1开始
+func RankOf(st *model.RankStat, order int) (int, error) {
+	_, cmp := rankOrder(order)
+	count, err := database.Where("metric=? AND period=? AND club_id=?", st.Metric, st.Period, st.ClubId).
+		And("(`value` "+cmp+" ? OR (`value` = ? AND `id` < ?))", st.Value, st.Value, st.Id).
+		Count(&model.RankStat{})
+	if err != nil {
+		return 0, errutil.ErrDBOperation
+	}
+	return int(count) + 1, nil
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/go-xorm/xorm"
+)
+
+//InsertTournament 创建比赛
+func InsertTournament(t *model.Tournament) error {
+	_, err := database.Insert(t)
+	return err
+}
+
+//UpdateTournament 更新比赛状态
+func UpdateTournament(t *model.Tournament) error {
+	_, err := database.Where("id=?", t.Id).Cols("status", "stage", "finished_at").Update(t)
+	return err
+}
+
+//QueryTournaments 指定日期的比赛以及之前未结束的比赛
+func QueryTournaments(day string) ([]*model.Tournament, error) {
+	list := []*model.Tournament{}
+	err := database.Where("day=?", day).
+		Or("status IN (?, ?)", protocol.TournamentStatusSignUp, protocol.TournamentStatusRunning).
+		Asc("id").Find(&list)
+	return list, err
+}
+
+//QueryTournamentPlayers 比赛的所有参赛玩家
+func QueryTournamentPlayers(tid int64) ([]*model.TournamentPlayer, error) {
+	list := []*model.TournamentPlayer{}
+	err := database.Where("tournament_id=?", tid).Asc("id").Find(&list)
+	return list, err
+}
+
+//SignUpTournament 报名比赛, 扣除报名费, 报名费计入奖池
+func SignUpTournament(tp *model.TournamentPlayer, l *model.GoldLedger) error {
+	session := database.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		logger.Error(err.Error())
+		return errutil.ErrDBOperation
+	}
+
+	if err := changeGold(session, l); err != nil {
+		session.Rollback()
+		return err
+	}
+	if _, err := session.Insert(tp); err != nil {
+		session.Rollback()
+		return err
+	}
+	if _, err := session.Where("id=?", tp.TournamentId).Incr("pool", -l.Change).Update(&model.Tournament{}); err != nil {
+		session.Rollback()
+		return err
+	}
+
+	return session.Commit()
+}
+
+//UpdateTournamentPlayers 更新参赛玩家的分数, 轮数和名次
+func UpdateTournamentPlayers(players []*model.TournamentPlayer) error {
+	session := database.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		logger.Error(err.Error())
+		return errutil.ErrDBOperation
+	}
+
+	if err := updateTournamentPlayers(session, players); err != nil {
+		session.Rollback()
+		return err
+	}
+
+	return session.Commit()
+}
+
+//SettleTournament 比赛结束或者取消, 在同一个事务中发放奖励(或退还报名费)并更新比赛状态
+func SettleTournament(t *model.Tournament, players []*model.TournamentPlayer, ledgers []*model.GoldLedger) error {
+	session := database.NewSession()
+	defer session.Close()
+
+	if err := session.Begin(); err != nil {
+		logger.Error(err.Error())
+		return errutil.ErrDBOperation
+	}
+
+	for _, l := range ledgers {
+		if err := changeGold(session, l); err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+	if err := updateTournamentPlayers(session, players); err != nil {
+		session.Rollback()
+		return err
+	}
+	if _, err := session.Where("id=?", t.Id).Cols("status", "stage", "finished_at").Update(t); err != nil {
+		session.Rollback()
+		return err
+	}
+
+	return session.Commit()
+}
+
+func updateTournamentPlayers(session *xorm.Session, players []*model.TournamentPlayer) error {
+	for _, tp := range players {
+		if _, err := session.Where("id=?", tp.Id).Cols("status", "score", "stage", "rank", "prize").Update(tp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
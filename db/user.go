@@ -9,6 +9,8 @@ import (
 	"go-mahjong-server/db/model"
 	"go-mahjong-server/pkg/errutil"
 	"go-mahjong-server/protocol"
+
+	"github.com/go-xorm/xorm"
 )
 
 //QueryUser get the user by id
@@ -32,6 +34,15 @@ func QueryUser(id int64) (*model.User, error) {
 
 }
 
+//IsAdmin 是否是管理员账号
+func IsAdmin(uid int64) bool {
+	u, err := QueryUser(uid)
+	if err != nil {
+		return false
+	}
+	return u.Role == RoleTypeAdmin
+}
+
 //UpdateUser update user's info
 func UpdateUser(u *model.User) error {
 	if u == nil {
@@ -66,21 +77,28 @@ func UserAddCoin(uid int64, coin int64) error {
 	if err != nil {
 		return errutil.ErrDBOperation
 	}
-	u := &model.User{Id: uid}
-	has, err := session.Get(u)
-	if err != nil {
+	if _, err := addCoin(session, uid, coin); err != nil {
+		session.Rollback()
 		return err
 	}
+	return session.Commit()
+}
+
+// 在事务中增加玩家房卡, 返回增加之后的数量
+func addCoin(session *xorm.Session, uid int64, coin int64) (int64, error) {
+	u := &model.User{}
+	has, err := session.Where("id=?", uid).ForUpdate().Get(u)
+	if err != nil {
+		return 0, err
+	}
 	if !has {
-		return errutil.ErrNotFound
+		return 0, errutil.ErrNotFound
 	}
 	u.Coin += coin
-	_, err = session.Where("uid=?", uid).Update(u)
-	if err != nil {
-		session.Rollback()
-		return err
+	if _, err := session.Cols("coin").Where("id=?", uid).Update(u); err != nil {
+		return 0, err
 	}
-	return session.Commit()
+	return u.Coin, nil
 }
 
 func UserLoseCoin(id int64, coin int64) error {
@@ -132,6 +150,12 @@ func UserLoseCoinByUID(uid int64, coin int64) error {
 	return session.Commit()
 }
 
+// UserAddRating 修改玩家的匹配分
+func UserAddRating(uid int64, delta int) error {
+	_, err := database.Exec("UPDATE `user` SET `rating` = `rating` + ? WHERE `id` = ?", delta, uid)
+	return err
+}
+
 func InsertRegister(reg *model.Register) {
 	chWrite <- reg
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"go-mahjong-server/internal/game/history/mjlog"
+	"go-mahjong-server/internal/web"
+	"go-mahjong-server/pkg/errutil"
+
+	"github.com/urfave/cli"
+)
+
+// 导出牌谱, 例如: mahjong export --desk 1024 --format csv --output scores.csv
+var exportCommand = cli.Command{
+	Name:  "export",
+	Usage: "export game records as json logs or csv score summaries",
+	Flags: []cli.Flag{
+		cli.Int64Flag{
+			Name:  "id",
+			Usage: "history id",
+		},
+		cli.Int64Flag{
+			Name:  "desk",
+			Usage: "desk id, export all rounds of the desk",
+		},
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: mjlog.OutputJSON,
+			Usage: "output format, json or csv",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "write to `FILE` instead of stdout",
+		},
+	},
+	Action: export,
+}
+
+func export(c *cli.Context) error {
+	if c.Int64("id") <= 0 && c.Int64("desk") <= 0 {
+		return errutil.ErrIllegalParameter
+	}
+
+	loadConfig(c.GlobalString("config"))
+	closer := web.StartupDatabase()
+	defer closer()
+
+	list, err := mjlog.Query(c.Int64("id"), c.Int64("desk"))
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if name := c.String("output"); name != "" {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return mjlog.Write(w, c.String("format"), list)
+}
@@ -0,0 +1,59 @@
+package game
+
+import (
+	"fmt"
+	"strings"
+
+	"go-mahjong-server/db"
+	"go-mahjong-server/pkg/token"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/session"
+)
+
+// 从数据库中读取的玩家资料
+type profile struct {
+	name   string
+	head   string
+	sex    int
+	coin   int64
+	rating int
+	gold   int64
+}
+
+// 校验登录token, 并从数据库加载玩家资料和房卡
+func authenticate(uid int64, tk string) (*profile, error) {
+	if err := token.Verify(tk, uid); err != nil {
+		return nil, err
+	}
+
+	u, err := db.QueryUser(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	pf := &profile{
+		name:   fmt.Sprintf("G%d", uid),
+		head:   protocol.DefaultHeadUrl,
+		sex:    protocol.SexTypeMale,
+		coin:   u.Coin,
+		rating: u.Rating,
+		gold:   u.Gold,
+	}
+
+	// 绑定了三方账号的玩家使用三方平台的资料
+	if acc, err := db.QueryThirdAccountByUid(uid); err == nil {
+		pf.name = acc.ThirdName
+		pf.head = acc.HeadUrl
+		pf.sex = acc.Sex
+	}
+
+	return pf, nil
+}
+
+func remoteIP(s *session.Session) string {
+	if parts := strings.Split(s.RemoteAddr().String(), ":"); len(parts) > 0 {
+		return parts[0]
+	}
+	return ""
+}
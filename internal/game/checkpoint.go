@@ -0,0 +1,419 @@
+package game
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 牌桌检查点: 服务器重启或者崩溃后, 使用检查点重建未完成的牌桌, 玩家通过ReConnect/ReEnter回到牌局
+//
+// 检查点只在牌桌状态完整的时刻保存: 每局开始, 打牌阶段每一轮摸牌之前, 每局结束, 其他阶段定时保存.
+// 打牌阶段从最近一次摸牌之前继续, 恢复后还没有重新连接的玩家按照断线处理, 操作超时后进入托管
+
+// 定时保存检查点的间隔
+var checkpointInterval = 30 * time.Second
+
+type scoreChangeCheckpoint struct {
+	Uid    int64           `json:"uid"`
+	Score  int             `json:"score"`
+	TileID int             `json:"tileId"`
+	Type   ScoreChangeType `json:"type"`
+}
+
+type historyCheckpoint struct {
+	Meta     history.Meta            `json:"meta"`
+	SnapShot history.SnapShot        `json:"snapshot"`
+	Events   *protocol.HistoryEvents `json:"events,omitempty"`
+}
+
+type dissolveCheckpoint struct {
+	Status     map[int64]bool   `json:"status"`
+	Desc       map[int64]string `json:"desc"`
+	Dissolving bool             `json:"dissolving"`
+	RestTime   int32            `json:"restTime"`
+}
+
+type tournamentCheckpoint struct {
+	ID    int64 `json:"id"`
+	Stage int   `json:"stage"`
+	Final bool  `json:"final"`
+}
+
+type playerCheckpoint struct {
+	Uid         int64            `json:"uid"`
+	Name        string           `json:"name"`
+	Head        string           `json:"head"`
+	IP          string           `json:"ip"`
+	Sex         int              `json:"sex"`
+	Robot       bool             `json:"robot"`
+	Score       int              `json:"score"`
+	Trusteeship bool             `json:"trusteeship"`
+	OnHand      mahjong.Tiles    `json:"onHand"`
+	PongKong    mahjong.Tiles    `json:"pongKong"`
+	ChiTiles    mahjong.Tiles    `json:"chiTiles"`
+	ChuPai      mahjong.Tiles    `json:"chuPai"`
+	HuTiles     []int            `json:"huTiles"`
+	Ctx         *mahjong.Context `json:"ctx"`
+}
+
+type deskCheckpoint struct {
+	RoomNo    string                `json:"roomNo"`
+	DeskID    int64                 `json:"deskId"`
+	ClubID    int64                 `json:"clubId"`
+	Opts      *protocol.DeskOptions `json:"opts"`
+	Status    constant.DeskStatus   `json:"status"`
+	Round     uint32                `json:"round"`
+	Creator   int64                 `json:"creator"`
+	CreatedAt int64                 `json:"createdAt"`
+	SavedAt   int64                 `json:"savedAt"`
+	Classic   *int                  `json:"classic,omitempty"` // 金币场等级
+
+	Tournament *tournamentCheckpoint `json:"tournament,omitempty"` // 比赛牌桌
+
+	Wall          mahjong.Tiles  `json:"wall"`
+	NextTileIndex int            `json:"nextTileIndex"`
+	BankerTurn    int            `json:"bankerTurn"`
+	CurTurn       int            `json:"curTurn"`
+	IsNewRound    bool           `json:"isNewRound"`
+	IsFirstRound  bool           `json:"isFirstRound"`
+	IsMakerSet    bool           `json:"isMakerSet"`
+	KnownTiles    map[int]int    `json:"knownTiles"`
+	WonPlayers    map[int64]bool `json:"wonPlayers"`
+	PaoPlayer     int64          `json:"paoPlayer"`
+
+	ScoreChanges map[int64][]scoreChangeCheckpoint `json:"scoreChanges"`
+	RoundStats   history.RoundStats                `json:"roundStats"`
+	MatchStats   history.MatchStats                `json:"matchStats"`
+	History      *historyCheckpoint                `json:"history,omitempty"`
+
+	Seed          string                    `json:"seed"`
+	RandPos       uint64                    `json:"randPos"`
+	Dice          [2]int                    `json:"dice"`
+	LastTileID    int                       `json:"lastTileId"`
+	LastChuPaiUid int64                     `json:"lastChuPaiUid"`
+	LastHintUid   int64                     `json:"lastHintUid"`
+	LatestEnter   *protocol.PlayerEnterDesk `json:"latestEnter,omitempty"`
+
+	Ready        map[int64]bool      `json:"ready"`
+	Sorted       map[int64]bool      `json:"sorted"`
+	HuanSanZhang map[int64][]int     `json:"huanSanZhang"`
+	Dissolve     dissolveCheckpoint  `json:"dissolve"`
+	Players      []*playerCheckpoint `json:"players"`
+}
+
+// 保存检查点, 在牌桌协程中调用
+func (d *Desk) checkpoint() {
+	if d.checkpoints == nil || d.isDestroy() {
+		return
+	}
+
+	data, err := json.Marshal(d.makeCheckpoint())
+	if err != nil {
+		d.logger.Errorf("序列化牌桌检查点失败, Error=%v", err)
+		return
+	}
+	d.checkpoints.save(d.roomNo, data)
+}
+
+// 定时保存检查点, 打牌阶段的状态只在每一轮摸牌之前完整, 由play保存
+func (d *Desk) periodicCheckpoint() {
+	if d.playing {
+		return
+	}
+	d.checkpoint()
+}
+
+func (d *Desk) makeCheckpoint() *deskCheckpoint {
+	c := &deskCheckpoint{
+		RoomNo:    d.roomNo.String(),
+		DeskID:    d.deskID,
+		ClubID:    d.clubId,
+		Opts:      d.opts,
+		Status:    d.status(),
+		Round:     d.round,
+		Creator:   d.creator,
+		CreatedAt: d.createdAt,
+		SavedAt:   time.Now().Unix(),
+
+		Wall:          d.allTiles.Ids(),
+		NextTileIndex: d.nextTileIndex,
+		BankerTurn:    d.bankerTurn,
+		CurTurn:       d.curTurn,
+		IsNewRound:    d.isNewRound,
+		IsFirstRound:  d.isFirstRound,
+		IsMakerSet:    d.isMakerSet,
+		KnownTiles:    d.knownTiles,
+		WonPlayers:    d.wonPlayers,
+		PaoPlayer:     d.paoPlayer,
+
+		ScoreChanges: map[int64][]scoreChangeCheckpoint{},
+		RoundStats:   d.roundStats,
+		MatchStats:   d.matchStats,
+
+		Seed:          d.rand.Seed(),
+		RandPos:       d.rand.Pos(),
+		Dice:          [2]int{d.dice.dice1, d.dice.dice2},
+		LastTileID:    d.lastTileId,
+		LastChuPaiUid: d.lastChuPaiUid,
+		LastHintUid:   d.lastHintUid,
+		LatestEnter:   d.latestEnter,
+
+		Ready:        d.prepare.readyStatus,
+		Sorted:       d.prepare.sortedStatus,
+		HuanSanZhang: d.huanSanZhang.chosen,
+		Dissolve: dissolveCheckpoint{
+			Status:     d.dissolve.status,
+			Desc:       d.dissolve.desc,
+			Dissolving: d.dissolve.isDissolving(),
+			RestTime:   d.dissolve.restTime,
+		},
+	}
+
+	if d.classic != nil {
+		level := d.classic.level
+		c.Classic = &level
+	}
+	if t := d.tournament; t != nil {
+		c.Tournament = &tournamentCheckpoint{ID: t.id, Stage: t.stage, Final: t.final}
+	}
+
+	for uid, changes := range d.scoreChanges {
+		for _, sc := range changes {
+			c.ScoreChanges[uid] = append(c.ScoreChanges[uid], scoreChangeCheckpoint{
+				Uid:    sc.uid,
+				Score:  sc.score,
+				TileID: sc.tileID,
+				Type:   sc.typ,
+			})
+		}
+	}
+
+	if d.snapshot != nil {
+		c.History = &historyCheckpoint{Meta: d.snapshot.Meta(), SnapShot: d.snapshot.SnapShot, Events: d.snapshot.Events()}
+	}
+
+	for _, p := range d.players {
+		// 牌桌选项在恢复时重新设置
+		ctx := *p.ctx
+		ctx.Opts = nil
+		c.Players = append(c.Players, &playerCheckpoint{
+			Uid:         p.Uid(),
+			Name:        p.name,
+			Head:        p.head,
+			IP:          p.ip,
+			Sex:         p.sex,
+			Robot:       p.isRobot(),
+			Score:       p.score,
+			Trusteeship: p.isTrusteeship(),
+			OnHand:      p.onHand.Ids(),
+			PongKong:    p.pongKong.Ids(),
+			ChiTiles:    p.chiTiles.Ids(),
+			ChuPai:      p.chupai.Ids(),
+			HuTiles:     p.huTiles,
+			Ctx:         &ctx,
+		})
+	}
+
+	return c
+}
+
+// 使用检查点重建牌桌, 牌局由resume继续
+func restoreDesk(data []byte) (*Desk, error) {
+	c := &deskCheckpoint{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if !verifyOptions(c.Opts) || len(c.Players) > c.Opts.Mode {
+		return nil, errutil.ErrIllegalParameter
+	}
+
+	// 局与局之间的结算状态是短暂的, 不会出现在检查点中
+	switch c.Status {
+	case constant.DeskStatusCreate,
+		constant.DeskStatusDuanPai,
+		constant.DeskStatusHuanSanZhang,
+		constant.DeskStatusQiPai,
+		constant.DeskStatusPlaying,
+		constant.DeskStatusCleaned:
+	default:
+		return nil, errutil.ErrIllegalDeskStatus
+	}
+
+	d := NewDesk(room.Number(c.RoomNo), c.Opts, c.ClubID)
+	d.do(func() { d.restore(c) })
+	return d, nil
+}
+
+// 恢复牌桌状态, 在牌桌协程中调用
+func (d *Desk) restore(c *deskCheckpoint) {
+	d.deskID = c.DeskID
+	d.creator = c.Creator
+	d.createdAt = c.CreatedAt
+	d.setStatus(c.Status)
+	if c.Classic != nil {
+		if lv, ok := classicLevels[*c.Classic]; ok {
+			d.classic = &deskClassic{level: *c.Classic, base: lv.base, min: lv.min}
+		}
+	}
+	if t := c.Tournament; t != nil {
+		d.tournament = &deskTournament{id: t.ID, stage: t.Stage, final: t.Final}
+	}
+	atomic.StoreUint32(&d.round, c.Round)
+
+	d.allTiles = mahjong.FromID(c.Wall)
+	d.nextTileIndex = c.NextTileIndex
+	d.bankerTurn = c.BankerTurn
+	d.curTurn = c.CurTurn
+	d.isNewRound = c.IsNewRound
+	d.isFirstRound = c.IsFirstRound
+	d.isMakerSet = c.IsMakerSet
+	d.knownTiles = c.KnownTiles
+	d.wonPlayers = c.WonPlayers
+	d.paoPlayer = c.PaoPlayer
+
+	for uid, changes := range c.ScoreChanges {
+		for _, sc := range changes {
+			d.scoreChangeForUid(uid, &scoreChangeInfo{uid: sc.Uid, score: sc.Score, tileID: sc.TileID, typ: sc.Type})
+		}
+	}
+	d.roundStats = c.RoundStats
+	d.matchStats = c.MatchStats
+	if c.History != nil {
+		d.snapshot = history.Restore(c.History.Meta, c.History.SnapShot, c.History.Events)
+	}
+
+	d.rand = rng.NewAt(c.Seed, c.RandPos)
+	d.dice.dice1, d.dice.dice2 = c.Dice[0], c.Dice[1]
+	d.lastTileId = c.LastTileID
+	d.lastChuPaiUid = c.LastChuPaiUid
+	d.lastHintUid = c.LastHintUid
+	d.latestEnter = c.LatestEnter
+
+	d.prepare.readyStatus = c.Ready
+	d.prepare.sortedStatus = c.Sorted
+	d.huanSanZhang.chosen = c.HuanSanZhang
+	d.dissolve.status = c.Dissolve.Status
+	d.dissolve.desc = c.Dissolve.Desc
+
+	for i, pc := range c.Players {
+		p := restorePlayer(pc)
+		d.players = append(d.players, p)
+		p.setDesk(d, i)
+
+		// 真实玩家重新连接之前都是离线状态
+		if !p.isRobot() {
+			d.dissolve.pause[p.Uid()] = true
+		}
+	}
+
+	if c.Dissolve.Dissolving {
+		d.dissolve.start(c.Dissolve.RestTime)
+	}
+
+	d.logger.Infof("从检查点恢复牌桌: 状态=%s 局数=%d/%d 保存时间=%s",
+		d.status().String(), c.Round, d.opts.MaxRound, time.Unix(c.SavedAt, 0).Format("2006-01-02 15:04:05"))
+}
+
+// 恢复的玩家没有session, 重新连接时绑定
+func restorePlayer(c *playerCheckpoint) *Player {
+	p := &Player{
+		uid:      c.Uid,
+		name:     c.Name,
+		head:     c.Head,
+		ip:       c.IP,
+		sex:      c.Sex,
+		score:    c.Score,
+		robot:    c.Robot,
+		onHand:   mahjong.FromID(c.OnHand),
+		pongKong: mahjong.FromID(c.PongKong),
+		chiTiles: mahjong.FromID(c.ChiTiles),
+		chupai:   mahjong.FromID(c.ChuPai),
+		huTiles:  c.HuTiles,
+		ctx:      c.Ctx,
+
+		logger: log.WithField(fieldPlayer, c.Uid),
+
+		chOperation: make(chan *protocol.OpChoosed, 1),
+	}
+
+	if p.ctx == nil {
+		p.ctx = &mahjong.Context{Uid: c.Uid}
+		p.ctx.Reset()
+	}
+	if c.Trusteeship {
+		p.trusteeship = 1
+	}
+
+	// 新的机器人UID不能与恢复的机器人重复
+	if c.Robot {
+		for {
+			seq := atomic.LoadInt64(&robotUidSeq)
+			if seq <= c.Uid || atomic.CompareAndSwapInt64(&robotUidSeq, seq, c.Uid) {
+				break
+			}
+		}
+	}
+	return p
+}
+
+// 恢复后继续牌局, 在牌桌协程中调用
+func (d *Desk) resume() {
+	switch d.status() {
+	case constant.DeskStatusDuanPai:
+		// 理牌只是客户端动画, 直接完成
+		for _, p := range d.players {
+			if err := d.qiPaiFinished(p.Uid()); err != nil {
+				d.logger.Error(err)
+				return
+			}
+		}
+
+	case constant.DeskStatusHuanSanZhang:
+		d.huanSanZhang.startTimer()
+
+	case constant.DeskStatusPlaying:
+		d.play()
+	}
+}
+
+// 从检查点恢复服务器重启之前未完成的牌桌
+func (manager *DeskManager) restoreDesks(st checkpointStore) {
+	all, err := st.load()
+	if err != nil {
+		logger.Errorf("读取牌桌检查点失败, Error=%v", err)
+		return
+	}
+
+	count := 0
+	for no, data := range all {
+		d, err := restoreDesk(data)
+		if err != nil {
+			logger.Errorf("恢复牌桌失败: 房号=%s, Error=%v", no, err)
+			st.remove(no)
+			continue
+		}
+
+		// 玩家重新登录或者重新连接时使用恢复的玩家数据
+		for _, p := range d.players {
+			if !p.isRobot() {
+				defaultManager.setPlayer(p.Uid(), p)
+			}
+		}
+		manager.setDesk(d.roomNo, d)
+		d.post(d.resume)
+		count++
+	}
+
+	logger.Infof("从检查点恢复牌桌数量: %d", count)
+}
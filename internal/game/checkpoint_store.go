@@ -0,0 +1,120 @@
+package game
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go-mahjong-server/pkg/room"
+)
+
+const (
+	checkpointBacklog = 256
+	checkpointExt     = ".json"
+)
+
+// 牌桌检查点的存储, 每张牌桌只保留最新的检查点
+type checkpointStore interface {
+	save(no room.Number, data []byte)
+	remove(no room.Number)
+	load() (map[room.Number][]byte, error)
+	flush() // 等待之前的写入完成
+}
+
+// 检查点存储, 在Startup中根据配置创建, 为nil时不保存检查点
+var checkpoints checkpointStore
+
+// 本地文件存储, 每张牌桌一个文件
+// 写文件在单独的协程中按顺序执行, 不阻塞牌桌协程, 先写临时文件再重命名, 进程崩溃时不会留下不完整的检查点
+type fileCheckpointStore struct {
+	dir    string
+	chTask chan func()
+}
+
+func newFileCheckpointStore(dir string) (*fileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &fileCheckpointStore{
+		dir:    dir,
+		chTask: make(chan func(), checkpointBacklog),
+	}
+	go s.loop()
+	return s, nil
+}
+
+func (s *fileCheckpointStore) loop() {
+	for task := range s.chTask {
+		task()
+	}
+}
+
+func (s *fileCheckpointStore) path(no room.Number) string {
+	return filepath.Join(s.dir, no.String()+checkpointExt)
+}
+
+func (s *fileCheckpointStore) save(no room.Number, data []byte) {
+	s.chTask <- func() {
+		if err := writeFileSync(s.path(no), data); err != nil {
+			logger.Errorf("保存牌桌检查点失败: 房号=%s, Error=%v", no, err)
+		}
+	}
+}
+
+func (s *fileCheckpointStore) remove(no room.Number) {
+	s.chTask <- func() {
+		if err := os.Remove(s.path(no)); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("删除牌桌检查点失败: 房号=%s, Error=%v", no, err)
+		}
+	}
+}
+
+func (s *fileCheckpointStore) flush() {
+	done := make(chan struct{})
+	s.chTask <- func() { close(done) }
+	<-done
+}
+
+func (s *fileCheckpointStore) load() (map[room.Number][]byte, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[room.Number][]byte{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, checkpointExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		result[room.Number(strings.TrimSuffix(name, checkpointExt))] = data
+	}
+	return result, nil
+}
+
+// 写入临时文件并同步到磁盘后重命名
+func writeFileSync(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,144 @@
+package game
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/session"
+)
+
+type memCheckpointStore struct {
+	mu   sync.Mutex
+	data map[room.Number][]byte
+}
+
+func newMemCheckpointStore() *memCheckpointStore {
+	return &memCheckpointStore{data: map[room.Number][]byte{}}
+}
+
+func (m *memCheckpointStore) save(no room.Number, data []byte) {
+	m.mu.Lock()
+	m.data[no] = data
+	m.mu.Unlock()
+}
+
+func (m *memCheckpointStore) remove(no room.Number) {
+	m.mu.Lock()
+	delete(m.data, no)
+	m.mu.Unlock()
+}
+
+func (m *memCheckpointStore) flush() {}
+
+func (m *memCheckpointStore) load() (map[room.Number][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := map[room.Number][]byte{}
+	for no, data := range m.data {
+		result[no] = data
+	}
+	return result, nil
+}
+
+func (m *memCheckpointStore) get(no room.Number) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[no]
+}
+
+func decodeCheckpoint(t *testing.T, data []byte) *deskCheckpoint {
+	c := &deskCheckpoint{}
+	if err := json.Unmarshal(data, c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// 打牌阶段的检查点恢复后状态不变, 牌局继续进行, 玩家重新进入后回到牌局
+func TestDeskCheckpointRestore(t *testing.T) {
+	ms := setupLoopTest(t)
+	cs := newMemCheckpointStore()
+	checkpoints = cs
+	t.Cleanup(func() { checkpoints = nil })
+
+	d, _, _, _ := newPlayingDesk(t, "100006", 4)
+
+	// 取得打牌阶段的检查点后模拟服务器崩溃
+	var data []byte
+	waitFor(t, "检查点", func() bool {
+		data = cs.get(d.roomNo)
+		if data == nil {
+			return false
+		}
+		c := decodeCheckpoint(t, data)
+		return c.Status == constant.DeskStatusPlaying && c.NextTileIndex > 53
+	})
+	d.do(d.destroy)
+	histories := len(ms.deskHistories(d.roomNo))
+	c := decodeCheckpoint(t, data)
+
+	// 恢复后再次保存的检查点与原检查点相同
+	rd, err := restoreDesk(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again []byte
+	rd.do(func() {
+		rc := rd.makeCheckpoint()
+		rc.SavedAt = c.SavedAt
+		again, err = json.Marshal(rc)
+	})
+	rd.do(rd.destroy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Fatalf("restored checkpoint differs:\n%s\n%s", again, data)
+	}
+
+	// 服务器重启, 牌桌管理器从检查点恢复牌桌并继续牌局
+	restarted := newMemCheckpointStore()
+	restarted.save(d.roomNo, data)
+	defaultDeskManager.restoreDesks(restarted)
+	rd, ok := defaultDeskManager.desk(d.roomNo)
+	if !ok || rd == d {
+		t.Fatal("desk should be restored")
+	}
+	t.Cleanup(func() {
+		destroyDesk(rd)
+		defaultManager.offline(1)
+	})
+
+	p, ok := defaultManager.player(1)
+	if !ok || p.currentDesk() != rd {
+		t.Fatal("player should be restored into the desk")
+	}
+
+	waitFor(t, "恢复的牌局结束", func() bool { return rd.status() == constant.DeskStatusCleaned })
+	if n := len(ms.deskHistories(d.roomNo)) - histories; n != 1 {
+		t.Fatalf("history count=%d, expected 1", n)
+	}
+	if h := ms.deskHistories(d.roomNo); h[len(h)-1].Seed != c.Seed {
+		t.Fatalf("seed=%s, expected %s", h[len(h)-1].Seed, c.Seed)
+	}
+
+	// 玩家重新连接后进入恢复的牌桌, 并开始下一局
+	e := newTestEntity()
+	s := session.New(e)
+	s.Bind(p.Uid())
+	p.bindSession(s)
+	if err := defaultDeskManager.ReEnter(s, &protocol.ReEnterDeskRequest{DeskNo: string(rd.roomNo)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "重新进入", func() bool { return e.pushCount("onDeskBasicInfo") > 0 })
+	waitFor(t, "下一局", func() bool {
+		data := cs.get(rd.roomNo)
+		return data != nil && decodeCheckpoint(t, data).Round == 2
+	})
+}
@@ -0,0 +1,426 @@
+package game
+
+import (
+	"fmt"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/async"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/component"
+	"github.com/lonng/nano/session"
+	"github.com/spf13/viper"
+)
+
+// 金币场: 按底注分为初级到大师五个等级, 每个等级的牌桌常驻, 玩家进入时服务器选择有空位的牌桌入座.
+// 每局结束后按分数乘以底注结算金币, 赢家的收入按比例抽水, 金币不足入场条件或者离线的玩家离开牌桌.
+// 金币场不消耗房卡, 不能通过房间号加入, 也不能申请解散, 所有玩家离开后牌桌销毁.
+// 牌桌列表和座位数只在nano逻辑协程中访问
+
+type classicLevel struct {
+	key   string // 配置文件中的名字
+	title string
+	base  int64 // 底注
+	min   int64 // 入场最低金币
+}
+
+var (
+	classicLevels = map[int]*classicLevel{
+		protocol.ClassicLevelJunior: {key: "junior", title: "初级场", base: 100, min: 2000},
+		protocol.ClassicLevelMiddle: {key: "middle", title: "中级场", base: 500, min: 10000},
+		protocol.ClassicLevelSenior: {key: "senior", title: "高级场", base: 2000, min: 40000},
+		protocol.ClassicLevelElite:  {key: "elite", title: "精英场", base: 5000, min: 100000},
+		protocol.ClassicLevelMaster: {key: "master", title: "大师场", base: 20000, min: 400000},
+	}
+	classicRake = 5 // 抽水比例(%), 从赢家的收入中扣除
+)
+
+const (
+	classicGoldNotEnoughMessage = "金币不足%d, 不能进入该场次"
+	classicDeskNotFoundMessage  = "你当前不在金币场中"
+	classicInRoundMessage       = "牌局进行中, 本局结束后才能换桌"
+	classicJoinByNumberMessage  = "金币场牌桌不能通过房间号加入"
+	classicJoinFailedMessage    = "进入金币场失败, 请稍后重试"
+)
+
+// 金币场的牌桌
+type deskClassic struct {
+	level int
+	base  int64
+	min   int64
+}
+
+type classicTable struct {
+	desk   *Desk
+	seated int // 已经分配的座位, 玩家离开牌桌后由牌桌协程通知释放
+}
+
+type ClassicManager struct {
+	component.Base
+	tables map[int][]*classicTable // 等级 -> 牌桌
+}
+
+var defaultClassicManager = NewClassicManager()
+
+func NewClassicManager() *ClassicManager {
+	return &ClassicManager{
+		tables: map[int][]*classicTable{},
+	}
+}
+
+// 从检查点恢复的金币场牌桌重新加入牌桌列表, DeskManager.AfterInit已经完成恢复
+func (m *ClassicManager) AfterInit() {
+	for _, d := range defaultDeskManager.desks {
+		if d.classic == nil {
+			continue
+		}
+		var seated int
+		if !d.do(func() { seated = len(d.players) }) {
+			continue
+		}
+		m.tables[d.classic.level] = append(m.tables[d.classic.level], &classicTable{desk: d, seated: seated})
+	}
+}
+
+// 读取金币场配置, 未配置的项使用默认值
+func loadClassicConfig() {
+	if viper.Get("classic.rake") != nil {
+		if rake := viper.GetInt("classic.rake"); rake >= 0 && rake <= 100 {
+			classicRake = rake
+		} else {
+			logger.Warnf("金币场抽水比例错误: %d, 使用默认比例: %d", rake, classicRake)
+		}
+	}
+	for _, lv := range classicLevels {
+		if base := viper.GetInt64("classic." + lv.key + ".base"); base > 0 {
+			lv.base = base
+		}
+		if min := viper.GetInt64("classic." + lv.key + ".min"); min > 0 {
+			lv.min = min
+		}
+	}
+}
+
+// 金币场牌桌的选项, 局数不限, MaxRound只用于通过选项校验
+func classicOptions() *protocol.DeskOptions {
+	return &protocol.DeskOptions{
+		Mode:     ModeFours,
+		Rule:     RuleXueZhan,
+		MaxRound: 1,
+		MaxFan:   3,
+		Pinghu:   true,
+	}
+}
+
+// Levels 金币场的所有等级和正在游戏的人数
+func (m *ClassicManager) Levels(s *session.Session, _ []byte) error {
+	resp := &protocol.ClassicLevelsResponse{Rake: classicRake, Levels: []protocol.ClassicLevelInfo{}}
+	for level := protocol.ClassicLevelJunior; level <= protocol.ClassicLevelMaster; level++ {
+		lv := classicLevels[level]
+		players := 0
+		for _, t := range m.tables[level] {
+			players += t.seated
+		}
+		resp.Levels = append(resp.Levels, protocol.ClassicLevelInfo{
+			Level:   level,
+			Base:    lv.base,
+			Min:     lv.min,
+			Players: players,
+		})
+	}
+	return s.Response(resp)
+}
+
+// Join 进入金币场
+func (m *ClassicManager) Join(s *session.Session, req *protocol.ClassicJoinRequest) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	if p.currentDesk() != nil {
+		return s.Response(reentryDesk)
+	}
+	if isDraining() {
+		return s.Response(createMaintenance)
+	}
+
+	lv, ok := classicLevels[req.Level]
+	if !ok {
+		return errutil.ErrIllegalParameter
+	}
+	if p.goldBalance() < lv.min {
+		return s.Response(&protocol.ClassicJoinResponse{
+			Code:  errutil.Code(errutil.ErrGoldNotEnough),
+			Error: fmt.Sprintf(classicGoldNotEnoughMessage, lv.min),
+			Level: req.Level,
+			Base:  lv.base,
+			Min:   lv.min,
+		})
+	}
+
+	// 入座之前退出观战
+	leaveObserving(p, s)
+
+	m.seat(p, s, s.LastMid(), req.Level, nil)
+	return nil
+}
+
+// ChangeDesk 换桌, 只能在两局之间换到同一等级的其他牌桌
+func (m *ClassicManager) ChangeDesk(s *session.Session, _ []byte) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	d := p.currentDesk()
+	if d == nil || d.classic == nil {
+		return s.Response(&protocol.ClassicJoinResponse{Code: errutil.YXDeskNotFound, Error: classicDeskNotFoundMessage})
+	}
+	if isDraining() {
+		return s.Response(&protocol.ClassicJoinResponse{Code: errorCode, Error: maintenanceDeskMessage})
+	}
+
+	mid := s.LastMid()
+	level := d.classic.level
+	ok := d.post(func() {
+		if d.inRound() {
+			s.ResponseMID(mid, &protocol.ClassicJoinResponse{Code: errorCode, Error: classicInRoundMessage})
+			return
+		}
+		if _, err := d.playerWithId(p.Uid()); err != nil {
+			s.ResponseMID(mid, &protocol.ClassicJoinResponse{Code: errutil.YXDeskNotFound, Error: classicDeskNotFoundMessage})
+			return
+		}
+
+		d.classicExit(p, protocol.ExitTypeChangeDesk)
+		logicTask(func() { m.seat(p, s, mid, level, d) })
+	})
+	if !ok {
+		return s.Response(&protocol.ClassicJoinResponse{Code: errutil.YXDeskNotFound, Error: classicDeskNotFoundMessage})
+	}
+	return nil
+}
+
+// 在有空位的牌桌入座, 优先选择人数最多的牌桌, 没有空位时创建新的牌桌
+func (m *ClassicManager) seat(p *Player, s *session.Session, mid uint64, level int, exclude *Desk) {
+	var t *classicTable
+	for _, c := range m.tables[level] {
+		if c.desk == exclude || c.seated >= c.desk.totalPlayerCount() || c.desk.isDestroy() {
+			continue
+		}
+		if t == nil || c.seated > t.seated {
+			t = c
+		}
+	}
+	if t == nil {
+		t = m.createTable(level)
+	}
+
+	t.seated++
+	d := t.desk
+	ok := d.post(func() {
+		// 没有入座时释放分配的座位
+		if err := d.playerJoin(s, false); err != nil {
+			d.logger.Errorf("玩家进入金币场失败, UID=%d, Error=%v", s.UID(), err)
+			logicTask(func() { m.release(d) })
+			s.ResponseMID(mid, &protocol.ClassicJoinResponse{Code: errorCode, Error: classicJoinFailedMessage})
+			return
+		}
+
+		s.ResponseMID(mid, &protocol.ClassicJoinResponse{
+			Level:     level,
+			Base:      d.classic.base,
+			Min:       d.classic.min,
+			TableInfo: d.tableInfo(),
+		})
+	})
+
+	// 牌桌已经被销毁, 换一张牌桌
+	if !ok {
+		m.remove(d)
+		m.seat(p, s, mid, level, exclude)
+	}
+}
+
+func (m *ClassicManager) createTable(level int) *classicTable {
+	lv := classicLevels[level]
+	no := nextRoomNumber()
+	d := NewDesk(no, classicOptions(), -1)
+	d.createdAt = time.Now().Unix()
+	d.classic = &deskClassic{level: level, base: lv.base, min: lv.min}
+	defaultDeskManager.setDesk(no, d)
+
+	t := &classicTable{desk: d}
+	m.tables[level] = append(m.tables[level], t)
+	d.logger.Infof("创建金币场牌桌: 等级=%d 底注=%d", level, lv.base)
+	return t
+}
+
+// 玩家离开牌桌后释放座位, 牌桌上没有玩家时销毁牌桌
+func (m *ClassicManager) release(d *Desk) {
+	for _, t := range m.tables[d.classic.level] {
+		if t.desk != d {
+			continue
+		}
+		t.seated--
+		if t.seated <= 0 {
+			m.remove(d)
+			d.post(d.destroy)
+		}
+		return
+	}
+}
+
+func (m *ClassicManager) remove(d *Desk) {
+	tables := m.tables[d.classic.level]
+	for i, t := range tables {
+		if t.desk == d {
+			m.tables[d.classic.level] = append(tables[:i], tables[i+1:]...)
+			return
+		}
+	}
+}
+
+// 金币结算: 分数乘以底注, 输家最多输掉身上的金币, 输家付出的金币不足时赢家按比例分配,
+// 赢家的收入按比例抽水, 舍去的零头归系统. balances中没有的玩家(机器人)不限制输赢
+func settleGold(scores map[int64]int, balances map[int64]int64, base int64, rake int) (changes, rakes map[int64]int64) {
+	changes, rakes = map[int64]int64{}, map[int64]int64{}
+
+	var paid, owed int64
+	for uid, score := range scores {
+		if score >= 0 {
+			owed += int64(score) * base
+			continue
+		}
+		loss := int64(-score) * base
+		if balance, ok := balances[uid]; ok && loss > balance {
+			loss = balance
+		}
+		changes[uid] = -loss
+		paid += loss
+	}
+
+	for uid, score := range scores {
+		if score <= 0 {
+			continue
+		}
+		win := int64(score) * base
+		if paid < owed {
+			win = win * paid / owed
+		}
+		r := win * int64(rake) / 100
+		changes[uid] = win - r
+		rakes[uid] = r
+	}
+	return changes, rakes
+}
+
+// 每局结束后结算金币, 在牌桌协程中调用
+func (d *Desk) settleClassic(stats *protocol.RoundOverStats) {
+	scores := map[int64]int{}
+	for _, sc := range stats.ScoreChange {
+		scores[sc.Uid] = sc.Score
+	}
+	balances := map[int64]int64{}
+	for _, p := range d.players {
+		if !p.isRobot() {
+			balances[p.Uid()] = p.goldBalance()
+		}
+	}
+	changes, rakes := settleGold(scores, balances, d.classic.base, classicRake)
+
+	settle := &protocol.ClassicSettle{Base: d.classic.base, Items: []protocol.ClassicSettleItem{}}
+	ledgers := []*model.GoldLedger{}
+	players := []*Player{}
+	now := time.Now().Unix()
+	for _, p := range d.players {
+		uid := p.Uid()
+		change, r := changes[uid], rakes[uid]
+		gold := p.goldBalance()
+		if !p.isRobot() && (change != 0 || r != 0) {
+			gold = p.addGold(change)
+			ledgers = append(ledgers, &model.GoldLedger{
+				Uid:       uid,
+				Type:      model.GoldLedgerTypeSettle,
+				Change:    change,
+				Rake:      r,
+				DeskId:    d.deskID,
+				DeskNo:    d.roomNo.String(),
+				Round:     int(d.round),
+				CreatedAt: now,
+			})
+			players = append(players, p)
+		}
+		settle.Items = append(settle.Items, protocol.ClassicSettleItem{Uid: uid, Change: change, Rake: r, Gold: gold})
+	}
+	d.broadcast(protocol.RouteClassicSettle, settle)
+
+	if len(ledgers) == 0 {
+		return
+	}
+
+	// 即使数据库不成功, 玩家金币依然变化, 失败时重新从数据库同步
+	st := d.store
+	logger := d.logger
+	async.Run(func() {
+		if err := st.settleGold(ledgers); err != nil {
+			logger.Errorf("金币结算错误, Error=%v", err)
+			for _, p := range players {
+				p.syncCoinFromDB()
+			}
+			return
+		}
+
+		for i, p := range players {
+			if s := p.currentSession(); s != nil {
+				s.Push(protocol.RouteGoldChange, &protocol.GoldChangeInformation{Gold: ledgers[i].Balance})
+			}
+		}
+	})
+}
+
+// 每局结束后, 金币不足入场条件或者离线的玩家离开牌桌
+func (d *Desk) ejectClassicPlayers() {
+	for _, p := range append([]*Player{}, d.players...) {
+		switch {
+		case p.isRobot():
+		case p.goldBalance() < d.classic.min:
+			d.classicExit(p, protocol.ExitTypeClassicCoinNotEnough)
+		case !d.dissolve.isOnline(p.Uid()):
+			d.classicExit(p, protocol.ExitTypeNotReadyForStart)
+		}
+	}
+}
+
+// 玩家离开金币场牌桌, 在牌桌协程中调用
+func (d *Desk) classicExit(p *Player, exitType int) {
+	uid := p.Uid()
+	deskPos := -1
+	for i, v := range d.players {
+		if v == p {
+			deskPos = i
+			break
+		}
+	}
+	d.broadcast("onPlayerExit", &protocol.ExitResponse{
+		AccountId: uid,
+		IsExit:    true,
+		ExitType:  exitType,
+		DeskPos:   deskPos,
+	})
+
+	if s := p.currentSession(); s != nil {
+		d.group.Leave(s)
+	}
+	delete(d.dissolve.pause, uid)
+	d.removePlayer(uid)
+	d.releaseClassicSeat()
+}
+
+// 通知金币场释放座位
+func (d *Desk) releaseClassicSeat() {
+	logicTask(func() { defaultClassicManager.release(d) })
+}
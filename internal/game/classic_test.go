@@ -0,0 +1,318 @@
+package game
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/scheduler"
+	"github.com/lonng/nano/session"
+)
+
+func TestSettleGold(t *testing.T) {
+	cases := []struct {
+		scores   map[int64]int
+		balances map[int64]int64
+		rake     int
+		changes  map[int64]int64
+		rakes    map[int64]int64
+	}{
+		// 输家金币足够, 赢家按比例抽水
+		{
+			scores:   map[int64]int{1: -2, 2: -1, 3: 3},
+			balances: map[int64]int64{1: 1000, 2: 1000, 3: 1000},
+			rake:     10,
+			changes:  map[int64]int64{1: -200, 2: -100, 3: 270},
+			rakes:    map[int64]int64{3: 30},
+		},
+		// 输家最多输掉身上的金币
+		{
+			scores:   map[int64]int{1: -4, 2: 4},
+			balances: map[int64]int64{1: 150, 2: 1000},
+			changes:  map[int64]int64{1: -150, 2: 150},
+			rakes:    map[int64]int64{2: 0},
+		},
+		// 输家付出的金币不足时赢家按比例分配
+		{
+			scores:   map[int64]int{1: -4, 2: 1, 3: 3},
+			balances: map[int64]int64{1: 200, 2: 0, 3: 0},
+			changes:  map[int64]int64{1: -200, 2: 50, 3: 150},
+			rakes:    map[int64]int64{2: 0, 3: 0},
+		},
+		// 机器人不限制输赢
+		{
+			scores:   map[int64]int{-1: -10, 1: 10},
+			balances: map[int64]int64{1: 0},
+			rake:     5,
+			changes:  map[int64]int64{-1: -1000, 1: 950},
+			rakes:    map[int64]int64{1: 50},
+		},
+	}
+
+	for i, c := range cases {
+		changes, rakes := settleGold(c.scores, c.balances, 100, c.rake)
+		if fmt.Sprint(changes) != fmt.Sprint(c.changes) || fmt.Sprint(rakes) != fmt.Sprint(c.rakes) {
+			t.Fatalf("case %d: changes=%v rakes=%v, expected %v %v", i, changes, rakes, c.changes, c.rakes)
+		}
+	}
+}
+
+var testRoomSeq int64
+
+// 当前测试替换的逻辑协程任务队列, 牌桌协程随时可能投递任务, logicTask只在init中替换一次
+var testLogicTasks atomic.Value
+
+func init() {
+	logicTask = func(task scheduler.Task) {
+		if tasks := testLogicTasks.Load().(chan scheduler.Task); tasks != nil {
+			tasks <- task
+			return
+		}
+		scheduler.PushTask(task)
+	}
+	testLogicTasks.Store((chan scheduler.Task)(nil))
+}
+
+// 投递到逻辑协程的任务由测试协程执行
+func replaceLogicTask(t *testing.T) chan scheduler.Task {
+	tasks := make(chan scheduler.Task, 16)
+	testLogicTasks.Store(tasks)
+	nextRoomNumber = func() room.Number {
+		return room.Number(fmt.Sprintf("3%05d", atomic.AddInt64(&testRoomSeq, 1)))
+	}
+	t.Cleanup(func() {
+		testLogicTasks.Store((chan scheduler.Task)(nil))
+		nextRoomNumber = room.Next
+	})
+	return tasks
+}
+
+func runLogicTasks(t *testing.T, tasks chan scheduler.Task, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case task := <-tasks:
+			task()
+		case <-time.After(10 * time.Second):
+			t.Fatal("等待逻辑协程任务超时")
+		}
+	}
+}
+
+type sessionEntity struct {
+	s *session.Session
+	e *testEntity
+}
+
+func classicJoinResponse(t *testing.T, e *testEntity) *protocol.ClassicJoinResponse {
+	t.Helper()
+	waitFor(t, "金币场响应", func() bool {
+		_, ok := e.lastResponse().(*protocol.ClassicJoinResponse)
+		return ok
+	})
+	return e.lastResponse().(*protocol.ClassicJoinResponse)
+}
+
+func TestClassicTables(t *testing.T) {
+	setupLoopTest(t)
+	tasks := replaceLogicTask(t)
+
+	m := defaultClassicManager
+	m.tables = map[int][]*classicTable{}
+	level := protocol.ClassicLevelJunior
+	lv := classicLevels[level]
+
+	// 金币不足不能进入
+	s0, e0, p0 := newLoopTestSession(t, 41)
+	if err := m.Join(s0, &protocol.ClassicJoinRequest{Level: level}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := classicJoinResponse(t, e0); resp.Code != errutil.Code(errutil.ErrGoldNotEnough) || p0.currentDesk() != nil {
+		t.Fatalf("join response: %+v", resp)
+	}
+
+	// 两个玩家进入同一张牌桌
+	s1, e1, p1 := newLoopTestSession(t, 42)
+	s2, e2, p2 := newLoopTestSession(t, 43)
+	for _, p := range []*Player{p1, p2} {
+		p.setGold(lv.min)
+	}
+	for _, s := range []*sessionEntity{{s1, e1}, {s2, e2}} {
+		if err := m.Join(s.s, &protocol.ClassicJoinRequest{Level: level}); err != nil {
+			t.Fatal(err)
+		}
+		if resp := classicJoinResponse(t, s.e); resp.Code != 0 || resp.Base != lv.base {
+			t.Fatalf("join response: %+v", resp)
+		}
+		if err := defaultDeskManager.ClientInitCompleted(s.s, &protocol.ClientInitCompletedRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d1 := p1.currentDesk()
+	if d1 == nil || d1.classic == nil || p2.currentDesk() != d1 {
+		t.Fatal("players should be seated at the same classic desk")
+	}
+	defer defaultDeskManager.setDesk(d1.roomNo, nil)
+	if tables := m.tables[level]; len(tables) != 1 || tables[0].seated != 2 {
+		t.Fatalf("tables=%d", len(tables))
+	}
+
+	// 不能通过房间号加入
+	s3, e3, p3 := newLoopTestSession(t, 44)
+	p3.setGold(lv.min)
+	if err := defaultDeskManager.Join(s3, &protocol.JoinDeskRequest{DeskNo: d1.roomNo.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := e3.lastResponse().(*protocol.JoinDeskResponse); !ok || resp.Code != errorCode {
+		t.Fatalf("join by number response: %+v", e3.lastResponse())
+	}
+
+	// 换桌: 离开原来的牌桌, 在同一等级的其他牌桌入座
+	if err := m.ChangeDesk(s2, nil); err != nil {
+		t.Fatal(err)
+	}
+	runLogicTasks(t, tasks, 2)
+	waitFor(t, "换桌", func() bool { return p2.currentDesk() != nil && p2.currentDesk() != d1 })
+	d2 := p2.currentDesk()
+	defer func() {
+		destroyDesk(d2)
+		defaultDeskManager.setDesk(d2.roomNo, nil)
+	}()
+	waitFor(t, "换桌通知", func() bool { return e1.pushCount("onPlayerExit") == 1 })
+	if tables := m.tables[level]; len(tables) != 2 || tables[0].seated != 1 || tables[1].seated != 1 {
+		t.Fatalf("tables=%d", len(tables))
+	}
+
+	// 最后一个玩家退出后牌桌销毁
+	if err := defaultDeskManager.Exit(s1, &protocol.ExitRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	runLogicTasks(t, tasks, 2)
+	waitFor(t, "牌桌销毁", func() bool { return d1.isDestroy() })
+	if tables := m.tables[level]; len(tables) != 1 || tables[0].desk != d2 {
+		t.Fatalf("tables=%d", len(tables))
+	}
+	if p1.currentDesk() != nil {
+		t.Fatal("player should leave the desk after exit")
+	}
+}
+
+func TestClassicRound(t *testing.T) {
+	ms := setupLoopTest(t)
+	tasks := replaceLogicTask(t)
+
+	no := room.Number("100031")
+	d := NewDesk(no, classicOptions(), -1)
+	d.createdAt = time.Now().Unix()
+	d.classic = &deskClassic{level: protocol.ClassicLevelJunior, base: 100, min: 2000}
+	defaultDeskManager.setDesk(no, d)
+	defer func() {
+		destroyDesk(d)
+		defaultDeskManager.setDesk(no, nil)
+	}()
+
+	const gold = 100000
+	s, e, p := newLoopTestSession(t, 51)
+	p.setGold(gold)
+	d.do(func() {
+		if err := d.playerJoin(s, false); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := defaultDeskManager.ClientInitCompleted(s, &protocol.ClientInitCompletedRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	d.do(func() {
+		if err := d.robotJoin(0); err != nil {
+			t.Error(err)
+		}
+	})
+	startRound(t, d, s)
+
+	// 金币场不限局数, 每局结束后结算金币
+	waitFor(t, "第一局结束", func() bool { return d.status() == constant.DeskStatusCleaned || d.isDestroy() })
+	if d.isDestroy() {
+		t.Fatal("classic desk should not be destroyed after a round")
+	}
+	if c := e.pushCount(protocol.RouteClassicSettle); c != 1 {
+		t.Fatalf("settle count=%d", c)
+	}
+	waitFor(t, "金币流水", func() bool { return len(ms.goldLedgers(p.Uid())) == 1 || p.goldBalance() == gold })
+	if ledgers := ms.goldLedgers(p.Uid()); len(ledgers) == 1 {
+		l := ledgers[0]
+		if p.goldBalance() != gold+l.Change || l.Rake < 0 || l.Round != 1 || l.DeskNo != no.String() {
+			t.Fatalf("gold=%d ledger=%+v", p.goldBalance(), l)
+		}
+	}
+
+	// 金币不足入场条件的玩家离开牌桌
+	d.do(func() {
+		p.setGold(d.classic.min - 1)
+		d.ejectClassicPlayers()
+	})
+	if p.currentDesk() != nil {
+		t.Fatal("player without enough gold should leave the desk")
+	}
+	if c := e.pushCount("onPlayerExit"); c != 1 {
+		t.Fatalf("onPlayerExit count=%d", c)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("release tasks=%d", len(tasks))
+	}
+}
+
+func TestRechargeGold(t *testing.T) {
+	st := setupLoopTest(t)
+	tasks := replaceLogicTask(t)
+
+	_, e, p := newLoopTestSession(t, 45)
+	defaultManager.setPlayer(45, p)
+	t.Cleanup(func() { defaultManager.offline(45) })
+	p.setGold(100)
+
+	if err := RechargeGold(45, 0); err != errutil.ErrIllegalParameter {
+		t.Fatalf("recharge 0: %v", err)
+	}
+
+	// 共享的测试存储中只看这两个玩家的流水
+	ledgers := func() []*model.GoldLedger {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		list := []*model.GoldLedger{}
+		for _, l := range st.ledgers {
+			if l.Uid == 45 || l.Uid == 46 {
+				list = append(list, l)
+			}
+		}
+		return list
+	}
+
+	// 写入充值流水, 在线玩家增加金币
+	lv := classicLevels[protocol.ClassicLevelJunior]
+	if err := RechargeGold(45, lv.min); err != nil {
+		t.Fatal(err)
+	}
+	runLogicTasks(t, tasks, 1)
+	if l := ledgers(); len(l) != 1 || l[0].Type != model.GoldLedgerTypeRecharge || l[0].Change != lv.min {
+		t.Fatalf("ledgers: %+v", l)
+	}
+	if p.goldBalance() != lv.min+100 || e.pushCount(protocol.RouteGoldChange) != 1 {
+		t.Fatalf("gold=%d, pushes=%d", p.goldBalance(), e.pushCount(protocol.RouteGoldChange))
+	}
+
+	// 不在线的玩家只写入流水
+	if err := RechargeGold(46, 10); err != nil {
+		t.Fatal(err)
+	}
+	runLogicTasks(t, tasks, 1)
+	if l := ledgers(); len(l) != 2 || l[1].Uid != 46 {
+		t.Fatalf("ledgers: %d", len(l))
+	}
+}
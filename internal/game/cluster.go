@@ -0,0 +1,111 @@
+package game
+
+import (
+	"encoding/json"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/cluster"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+)
+
+// 节点之间的内部接口
+const (
+	routeKick      = "kick"
+	routeReset     = "reset"
+	routeRecharge  = "recharge"
+	routeGold      = "gold"
+	routeBroadcast = "broadcast"
+	routeMail      = "mail"
+)
+
+const deskRedirectMessage = "房间在其他服务器, 正在切换服务器"
+
+type clusterUid struct {
+	Uid int64 `json:"uid"`
+}
+
+type clusterGold struct {
+	Uid  int64 `json:"uid"`
+	Gold int64 `json:"gold"` // 增加的金币
+}
+
+// 注册其他节点调用的内部接口, 只在当前节点执行
+func registerClusterHandlers() {
+	cluster.Handle(routeKick, func(data []byte) error {
+		req := &clusterUid{}
+		if err := json.Unmarshal(data, req); err != nil {
+			return err
+		}
+		kick(req.Uid)
+		return nil
+	})
+
+	cluster.Handle(routeReset, func(data []byte) error {
+		req := &clusterUid{}
+		if err := json.Unmarshal(data, req); err != nil {
+			return err
+		}
+		reset(req.Uid)
+		return nil
+	})
+
+	cluster.Handle(routeRecharge, func(data []byte) error {
+		req := &RechargeInfo{}
+		if err := json.Unmarshal(data, req); err != nil {
+			return err
+		}
+		recharge(req.Uid, req.Coin)
+		return nil
+	})
+
+	cluster.Handle(routeGold, func(data []byte) error {
+		req := &clusterGold{}
+		if err := json.Unmarshal(data, req); err != nil {
+			return err
+		}
+		logicTask(func() { defaultManager.rechargeGold(req.Uid, req.Gold) })
+		return nil
+	})
+
+	cluster.Handle(routeBroadcast, func(data []byte) error {
+		req := &protocol.StringMessage{}
+		if err := json.Unmarshal(data, req); err != nil {
+			return err
+		}
+		broadcastSystemMessage(req.Message)
+		return nil
+	})
+
+	cluster.Handle(routeMail, func(data []byte) error {
+		mail := &model.Mail{}
+		if err := json.Unmarshal(data, mail); err != nil {
+			return err
+		}
+		logicTask(func() { defaultMailManager.notify(mail) })
+		return nil
+	})
+}
+
+// 房间所在的其他节点, 单机模式或者房间在当前节点时返回false.
+// 请求不在节点之间转发, 客户端收到房间所在节点的地址后重新连接
+func ownerNode(no room.Number) (*protocol.NodeInfo, bool) {
+	if !cluster.Enabled() || no.Node() == cluster.Self().ID {
+		return nil, false
+	}
+
+	n, ok := cluster.Lookup(no.Node())
+	if !ok {
+		return nil, false
+	}
+	return &protocol.NodeInfo{IP: n.Host(), Port: n.Port()}, true
+}
+
+func joinRedirect(node *protocol.NodeInfo) *protocol.JoinDeskResponse {
+	return &protocol.JoinDeskResponse{Code: errutil.YXDeskRedirect, Error: deskRedirectMessage, Node: node}
+}
+
+func reJoinRedirect(node *protocol.NodeInfo) *protocol.ReJoinDeskResponse {
+	return &protocol.ReJoinDeskResponse{Code: errutil.YXDeskRedirect, Error: deskRedirectMessage, Node: node}
+}
@@ -0,0 +1,44 @@
+package game
+
+import (
+	"testing"
+
+	"go-mahjong-server/pkg/cluster"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+)
+
+// 房间在其他节点时, 加入和重新加入返回房间所在节点的地址
+func TestClusterRedirect(t *testing.T) {
+	setupLoopTest(t)
+	nodes := []string{"1/127.0.0.1:33251/127.0.0.1:12307", "2/127.0.0.1:33252/127.0.0.1:12308"}
+	if err := cluster.Setup(1, nodes, "secret", "token"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Setup(0, nil, "", "") })
+
+	s, e, _ := newLoopTestSession(t, 3)
+	if err := defaultDeskManager.Join(s, &protocol.JoinDeskRequest{DeskNo: "200001"}); err != nil {
+		t.Fatal(err)
+	}
+	join, ok := e.lastResponse().(*protocol.JoinDeskResponse)
+	if !ok || join.Code != errutil.YXDeskRedirect || join.Node == nil || join.Node.Port != 33252 {
+		t.Fatalf("join response=%+v", e.lastResponse())
+	}
+
+	if err := defaultDeskManager.ReJoin(s, &protocol.ReJoinDeskRequest{DeskNo: "200001"}); err != nil {
+		t.Fatal(err)
+	}
+	rejoin, ok := e.lastResponse().(*protocol.ReJoinDeskResponse)
+	if !ok || rejoin.Code != errutil.YXDeskRedirect || rejoin.Node == nil || rejoin.Node.IP != "127.0.0.1" {
+		t.Fatalf("rejoin response=%+v", e.lastResponse())
+	}
+
+	// 当前节点的房间不需要跳转
+	if err := defaultDeskManager.Join(s, &protocol.JoinDeskRequest{DeskNo: "100009"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := e.lastResponse(); resp != deskNotFoundResponse {
+		t.Fatalf("join response=%+v, expected desk not found", resp)
+	}
+}
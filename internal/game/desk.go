@@ -3,29 +3,30 @@ package game
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
-	"go-mahjong-server/db"
 	"go-mahjong-server/db/model"
 	"go-mahjong-server/internal/game/history"
 	"go-mahjong-server/internal/game/mahjong"
 	"go-mahjong-server/pkg/async"
 	"go-mahjong-server/pkg/constant"
 	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/rng"
 	"go-mahjong-server/pkg/room"
 	"go-mahjong-server/protocol"
 
 	"github.com/lonng/nano"
-	"github.com/lonng/nano/scheduler"
 	"github.com/lonng/nano/session"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// 每局的随机数生成器, 测试时可以替换为固定种子
+var newRand = rng.New
+
 const (
 	ResultIllegal = 0
 	ResultZiMo    = 1
@@ -45,6 +46,7 @@ type Desk struct {
 	roomNo    room.Number           // 房间号
 	deskID    int64                 // desk表的pk
 	opts      *protocol.DeskOptions // 房间选项
+	rules     Ruleset               // 玩法规则
 	state     constant.DeskStatus   // 状态
 	round     uint32                // 第n局
 	creator   int64                 // 创建玩家UID
@@ -52,6 +54,8 @@ type Desk struct {
 	players   []*Player
 	group     *nano.Group // 组播通道
 	die       chan struct{}
+	chTask    chan func() // 牌桌事件队列, 所有修改牌桌状态的操作都在牌桌协程中执行
+	playing   bool        // 牌局是否正在进行(play正在执行)
 
 	allTiles      mahjong.Mahjong //所有麻将
 	bankerTurn    int             //庄家方位
@@ -74,6 +78,13 @@ type Desk struct {
 	dissolve *dissolveContext // 解散相关状态(改状态只可能只逻辑线程中更新, 不会并发)
 	prepare  *prepareContext  // 准备相关状态
 	dice     *dice            // 骰子
+	rand     *rng.Rand        // 本局的随机数, 每局开始时使用新的种子
+
+	huanSanZhang *huanSanZhangContext // 换三张
+	observers    *observerContext     // 观战者
+	match        *deskMatch           // 匹配创建的牌桌, 为nil时是玩家创建的房间
+	classic      *deskClassic         // 金币场牌桌, 局数不限, 每局结算金币
+	tournament   *deskTournament      // 比赛牌桌, 打完本轮的局数后销毁
 
 	lastTileId    int   //最后一张出牌
 	lastChuPaiUid int64 //最后一个出牌的玩家
@@ -81,6 +92,10 @@ type Desk struct {
 
 	latestEnter *protocol.PlayerEnterDesk //最新的进入状态
 
+	store       deskStore       // 牌桌数据持久化
+	checkpoints checkpointStore // 牌桌检查点, 为nil时不保存
+	sim         *simHooks       // 模拟牌局的钩子, 真实牌局为nil
+
 	logger *log.Entry
 }
 
@@ -92,6 +107,7 @@ func NewDesk(roomNo room.Number, opts *protocol.DeskOptions, clubId int64) *Desk
 		players: []*Player{},
 		group:   nano.NewGroup(uuid.New()),
 		die:     make(chan struct{}),
+		chTask:  make(chan func(), deskOpBacklog),
 
 		wonPlayers:   map[int64]bool{},
 		isNewRound:   true,
@@ -105,11 +121,26 @@ func NewDesk(roomNo room.Number, opts *protocol.DeskOptions, clubId int64) *Desk
 
 		prepare: newPrepareContext(),
 		dice:    newDice(),
+		rand:    newRand(),
+		store:   store,
+
+		checkpoints: checkpoints,
 
 		logger: log.WithField(fieldDesk, roomNo),
 	}
 
 	d.dissolve = newDissolveContext(d)
+	d.huanSanZhang = newHuanSanZhangContext(d)
+	d.observers = newObserverContext(d)
+
+	if r, ok := rulesetFor(opts); ok {
+		d.rules = r
+	} else {
+		d.logger.Warnf("未知的玩法: %s, 使用默认玩法", opts.Rule)
+		d.rules = rulesets[RuleXueZhan]
+	}
+
+	go d.loop()
 
 	return d
 }
@@ -121,19 +152,16 @@ func (d *Desk) totalPlayerCount() int {
 
 // 麻将数量
 func (d *Desk) totalTileCount() int {
-	if d.opts.Mode == 4 {
-		return 108
-	} else {
-		return 72
-	}
+	return d.rules.TileCount(d.opts)
 }
 
 func (d *Desk) save() error {
-	var name3 string
-	var player3 int64
-	if d.opts.Mode == ModeFours {
-		name3 = d.players[3].name
-		player3 = d.players[3].Uid()
+	// 二人和三人模式, 没有玩家的座位为空
+	var names [4]string
+	var uids [4]int64
+	for i, p := range d.players {
+		names[i] = p.name
+		uids[i] = p.Uid()
 	}
 	// save to database
 	desk := &model.Desk{
@@ -142,14 +170,14 @@ func (d *Desk) save() error {
 		CreatedAt:   time.Now().Unix(),
 		Mode:        d.opts.Mode,
 		DeskNo:      string(d.roomNo),
-		Player0:     d.players[0].Uid(),
-		Player1:     d.players[1].Uid(),
-		Player2:     d.players[2].Uid(),
-		Player3:     player3,
-		PlayerName0: d.players[0].name,
-		PlayerName1: d.players[1].name,
-		PlayerName2: d.players[2].name,
-		PlayerName3: name3,
+		Player0:     uids[0],
+		Player1:     uids[1],
+		Player2:     uids[2],
+		Player3:     uids[3],
+		PlayerName0: names[0],
+		PlayerName1: names[1],
+		PlayerName2: names[2],
+		PlayerName3: names[3],
 		Round:       d.opts.MaxRound, //最多局数
 	}
 
@@ -160,7 +188,7 @@ func (d *Desk) save() error {
 	d.logger.Infof("保存房间数据, 创建时间: %d", desk.CreatedAt)
 
 	// TODO: 改成异步
-	if err := db.InsertDesk(desk); err != nil {
+	if err := d.store.insertDesk(desk); err != nil {
 		return err
 	}
 
@@ -225,7 +253,7 @@ func (d *Desk) syncDeskStatus() {
 			Offline:  !d.dissolve.isOnline(uid),
 		})
 	}
-	d.group.Broadcast("onPlayerEnter", d.latestEnter)
+	d.broadcast("onPlayerEnter", d.latestEnter)
 }
 
 func (d *Desk) checkStart() {
@@ -235,6 +263,11 @@ func (d *Desk) checkStart() {
 		return
 	}
 
+	if isDraining() {
+		d.logger.Info("服务器正在停服，不能开始新的一局")
+		return
+	}
+
 	if count, num := len(d.players), d.totalPlayerCount(); count < num {
 		d.logger.Infof("当前房间玩家数量不足，不能开始游戏，当前玩家=%d, 最低数量=%d", count, num)
 		return
@@ -246,6 +279,12 @@ func (d *Desk) checkStart() {
 		}
 	}
 
+	// 匹配的牌桌开局时扣费, 有玩家余额不足时解散, 其他玩家重新排队
+	if d.match != nil && d.isFirstRound && !d.matchAffordable() {
+		d.matchDissolve(true)
+		return
+	}
+
 	d.start()
 }
 
@@ -292,14 +331,52 @@ func (d *Desk) noMoreTile() bool {
 }
 
 func (d *Desk) title() string {
+	if d.classic != nil {
+		return fmt.Sprintf("房号: %s %s 底注: %d", d.roomNo, classicLevels[d.classic.level].title, d.classic.base)
+	}
+	if t := d.tournament; t != nil {
+		stage := fmt.Sprintf("第%d轮", t.stage)
+		if t.final {
+			stage = "决赛"
+		}
+		return fmt.Sprintf("房号: %s 比赛%s 局数: %d/%d", d.roomNo, stage, d.round, d.opts.MaxRound)
+	}
 	return strings.TrimSpace(fmt.Sprintf("房号: %s 局数: %d/%d", d.roomNo, d.round, d.opts.MaxRound))
 }
 
+// 局数进度, 金币场不限局数
+func (d *Desk) roundProgress() string {
+	if d.classic != nil {
+		return fmt.Sprintf("局数: %d", d.round)
+	}
+	return fmt.Sprintf("局数: %d/%d", d.round, d.opts.MaxRound)
+}
+
+// 牌桌概要信息, 必须在牌桌协程中调用
+func (d *Desk) tableInfo() protocol.TableInfo {
+	return protocol.TableInfo{
+		DeskNo:    d.roomNo.String(),
+		CreatedAt: d.createdAt,
+		Creator:   d.creator,
+		Title:     d.title(),
+		Desc:      d.desc(true),
+		Status:    d.status(),
+		Round:     d.round,
+		Mode:      d.opts.Mode,
+	}
+}
+
 // 描述, 参数表示是否显示额外选项
 func (d *Desk) desc(detail bool) string {
 	desc := []string{}
 	zimo := "自摸加番"
 	opts := d.opts
+	switch opts.Rule {
+	case RuleXueLiu:
+		desc = append(desc, "血流成河")
+	case RuleTuiDaoHu:
+		desc = append(desc, "推倒胡")
+	}
 	if opts.Zimo == "di" {
 		zimo = "自摸加底"
 	}
@@ -325,6 +402,12 @@ func (d *Desk) desc(detail bool) string {
 		if opts.Yaojiu {
 			desc = append(desc, "全幺九")
 		}
+		if opts.HuanSanZhang {
+			desc = append(desc, "换三张")
+		}
+		if opts.Mode == ModeDuo && opts.DuoHonor {
+			desc = append(desc, "带字牌")
+		}
 	}
 
 	return strings.Join(desc, " ")
@@ -332,7 +415,7 @@ func (d *Desk) desc(detail bool) string {
 
 // 牌桌开始, 此方法只在开桌时执行, 非并行
 func (d *Desk) start() {
-	d.round++
+	atomic.AddUint32(&d.round, 1)
 	d.setStatus(constant.DeskStatusDuanPai)
 
 	var (
@@ -340,11 +423,14 @@ func (d *Desk) start() {
 		totalTileCount   = d.totalTileCount()   // 麻将数量
 	)
 
+	// 本局所有随机数(庄家, 牌墙, 骰子, 换三张)都来自同一个种子, 保存在回放中
+	d.rand = d.roundRand()
+
 	//第一局,随机庄,以后每局的庄家是上一局第一个和牌者或者点双响炮者
 	if d.isFirstRound {
 		d.isFirstRound = false
 		d.loseCoin()
-		d.bankerTurn = rand.Intn(totalPlayerCount)
+		d.bankerTurn = d.rand.Intn(totalPlayerCount)
 
 		//只有第一局才创建桌子
 		if err := d.save(); err != nil {
@@ -360,23 +446,19 @@ func (d *Desk) start() {
 		Mode:   d.opts.Mode,
 	}
 
-	d.group.Broadcast("onDeskBasicInfo", basic)
-	allTiles := mahjong.New(totalTileCount)
+	d.broadcast("onDeskBasicInfo", basic)
+	allTiles := d.roundWall()
 	d.logger.Debugf("麻将数量=%d, 玩家数量=%d, 所有麻将=%v", totalTileCount, totalPlayerCount, allTiles)
 
+	hands, nextIndex := d.rules.Deal(allTiles, totalPlayerCount, d.bankerTurn)
 	info := make([]protocol.DuanPaiInfo, totalPlayerCount)
 	for i, p := range d.players {
 		info[i] = protocol.DuanPaiInfo{
 			Uid:    p.Uid(),
-			OnHand: make([]int, 13),
+			OnHand: hands[i],
 		}
-		nextIndex := (i + 1) * 13
-		copy(info[i].OnHand, allTiles[i*13:nextIndex])
-		d.nextTileIndex = nextIndex
 	}
-	//庄家多一张牌
-	info[d.bankerTurn].OnHand = append(info[d.bankerTurn].OnHand, allTiles[d.nextTileIndex])
-	d.nextTileIndex++
+	d.nextTileIndex = nextIndex
 
 	d.allTiles = make(mahjong.Mahjong, len(allTiles))
 	for i, id := range allTiles {
@@ -394,31 +476,42 @@ func (d *Desk) start() {
 	}
 
 	// 骰子
-	d.dice.random()
+	d.dice.random(d.rand)
 	duan := &protocol.DuanPai{
 		MarkerID:    info[d.bankerTurn].Uid, //庄的账号ID
 		Dice1:       d.dice.dice1,
 		Dice2:       d.dice.dice2,
 		AccountInfo: info,
 	}
-	d.group.Broadcast("onDuanPai", duan)
+	d.broadcastView("onDuanPai", func(uid int64) interface{} {
+		return duanPaiView(duan, uid)
+	})
+
+	// 机器人不需要理牌动画
+	d.robotsPrepare()
+	if d.tournament != nil {
+		d.scheduleAutoPrepare()
+	}
 
 	//d.bankerTurn = turnUnknown //使用完毕,清空以便下一局使用
-	name4 := "/"
-	if len(d.players) > 3 {
-		name4 = d.players[3].name
+	names := [4]string{"/", "/", "/", "/"}
+	for i, p := range d.players {
+		names[i] = p.name
 	}
 	d.snapshot = history.New(
 		d.deskID,
 		d.opts.Mode,
-		d.players[0].name,
-		d.players[1].name,
-		d.players[2].name,
-		name4,
+		names[0],
+		names[1],
+		names[2],
+		names[3],
 		basic,
 		d.latestEnter,
 		duan,
 	)
+	d.snapshot.SetSeed(d.rand.Seed())
+	d.emitRoundStart(duan)
+	d.checkpoint()
 }
 
 func (d *Desk) qiPaiFinished(uid int64) error {
@@ -436,24 +529,53 @@ func (d *Desk) qiPaiFinished(uid int64) error {
 		}
 	}
 
+	// 换三张完成后再定缺
+	if d.opts.HuanSanZhang {
+		d.huanSanZhang.start()
+		return nil
+	}
+
+	d.dingQueHint()
+	return nil
+}
+
+// 进入定缺阶段, 通知玩家选择定缺, 不需要定缺的玩法直接开始
+func (d *Desk) dingQueHint() {
 	d.setStatus(constant.DeskStatusQiPai)
 
-	// 三人不需要定缺
-	if d.opts.Mode == ModeTrios {
-		go d.play()
+	// 不需要定缺的玩法直接开始
+	if !d.rules.RequireQue(d.opts) {
+		d.play()
 	} else {
+		robots := []*Player{}
 		for _, p := range d.players {
+			if p.isRobot() {
+				robots = append(robots, p)
+				continue
+			}
+			s := p.currentSession()
+			if s == nil {
+				continue
+			}
 			que := p.selectDefaultQue()
-			p.session.Push("onDingQueHint", protocol.DingQue{que})
+			s.Push("onDingQueHint", protocol.DingQue{Que: que})
+		}
+		for _, r := range robots {
+			d.dingQue(r, r.robotQue())
 		}
 	}
-	return nil
 }
 
 // 定缺
 func (d *Desk) dingQue(p *Player, que int) {
+	if d.status() != constant.DeskStatusQiPai {
+		p.logger.Debugf("当前牌桌状态不能定缺: %s", d.status().String())
+		return
+	}
+
 	p.ctx.Que = que
 	p.logger.Infof("玩家定缺，缺=%d", que)
+	d.emit(p.Uid(), history.EventDingQue, protocol.DingQue{Que: que})
 
 	// 等待所有人齐牌
 	for _, p := range d.players {
@@ -468,9 +590,9 @@ func (d *Desk) dingQue(p *Player, que int) {
 		ques[i] = protocol.QueItem{Uid: p.Uid(), Que: p.ctx.Que}
 	}
 
-	d.group.Broadcast("onDingQue", ques)
+	d.broadcast("onDingQue", ques)
 
-	go d.play()
+	d.play()
 }
 
 func (d *Desk) nextTurn() {
@@ -497,27 +619,24 @@ func (d *Desk) isRoundOver() bool {
 		return true
 	}
 
-	if d.noMoreTile() {
-		return true
-	}
-
-	//只剩下一个人没有和牌结算
-	return len(d.wonPlayers) == d.totalPlayerCount()-1
+	return d.rules.IsRoundOver(d)
 }
 
-// 循环中的核心逻辑
+// 循环中的核心逻辑, 在牌桌协程中执行
 // 1. 摸牌
 // 2. 检查自扣/暗杠/巴杠
 // 3. 打牌
 // 4. 检查是否有玩家要碰杠胡
 func (d *Desk) play() {
 	defer func() {
+		d.playing = false
 		if err := recover(); err != nil {
 			d.logger.Errorf("Error=%v", err)
 			println(stack())
 		}
 	}()
 
+	d.playing = true
 	d.setStatus(constant.DeskStatusPlaying)
 	d.logger.Debug("开始游戏")
 
@@ -525,6 +644,9 @@ func (d *Desk) play() {
 
 MAIN_LOOP:
 	for !d.isRoundOver() {
+		// 每一轮摸牌之前牌桌状态完整, 服务器重启后从这里继续
+		d.checkpoint()
+
 		// 切换到下一个玩家
 		if !d.isNewRound {
 			d.nextTurn()
@@ -532,7 +654,7 @@ MAIN_LOOP:
 		}
 
 		// 跳过胡牌玩家
-		if d.wonPlayers[curPlayer.Uid()] {
+		if d.isOut(curPlayer.Uid()) {
 			continue
 		}
 
@@ -628,7 +750,7 @@ MAIN_LOOP:
 		}
 
 		// 记录出牌
-		if typ == protocol.OptypeGang || typ == protocol.OptypePeng || typ == protocol.OptypeHu {
+		if typ == protocol.OptypeGang || typ == protocol.OptypePeng || typ == protocol.OptypeChi || typ == protocol.OptypeHu {
 			curPlayer.chupai = curPlayer.chupai[:len(curPlayer.chupai)-1]
 		}
 
@@ -656,8 +778,8 @@ MAIN_LOOP:
 			goto GANG
 		}
 
-		// 碰牌
-		if typ == protocol.OptypePeng {
+		// 碰牌或吃牌后直接出牌
+		if typ == protocol.OptypePeng || typ == protocol.OptypeChi {
 			goto PENG
 		}
 	}
@@ -683,7 +805,7 @@ func (d *Desk) allLosers(win *Player) []int64 {
 	for _, u := range d.players {
 		uid := u.Uid()
 		//跳过自己与已和玩家
-		if uid == win.Uid() || d.wonPlayers[uid] {
+		if uid == win.Uid() || d.isOut(uid) {
 			continue
 		}
 		loser = append(loser, uid)
@@ -691,81 +813,6 @@ func (d *Desk) allLosers(win *Player) []int64 {
 	return loser
 }
 
-// 转雨，需要考虑一下集中清空
-// 1. 普通转雨
-// 2. 点杠后，对方杠上炮，转雨给自己
-// 3. 暗杠或者巴杠后，一炮双向，另外两家相互转雨
-func (d *Desk) zhuanYu(huUid, chuUid int64) {
-	// 转雨: 杠牌后, 如果点炮, 则杠牌的钱转给胡牌的人
-	if changes, ok := d.scoreChanges[chuUid]; ok {
-		// 找到最后一个下雨或者刮风的分值改变记录
-		cl := len(changes)
-		lastChange := changes[len(changes)-1]
-		for i := cl; i > 0; i-- {
-			if c := changes[i-1]; c.typ == ScoreChangeTypeAnGang || c.typ == ScoreChangeTypeBaGang {
-				lastChange = c
-				break
-			}
-		}
-		lastTileId := lastChange.tileID
-
-		// 清除赢牌人的积分, 刮风下雨有可能是赢了两家人
-		for i := range changes {
-			c := changes[i]
-			if c.score > 0 && c.tileID == lastTileId && (c.typ == ScoreChangeTypeAnGang || c.typ == ScoreChangeTypeBaGang) {
-				c.score = 0
-			}
-			d.logger.Debugf("玩家ID=%d 流水=%s", chuUid, c.String())
-		}
-
-		// 修改输牌人把分输给谁了
-		for _uid, _changes := range d.scoreChanges {
-			// 前面已经处理了出牌人的情况
-			if _uid == chuUid {
-				continue
-			}
-
-			// FIXED: 自己杠，然后对方在点炮，转雨转回自己
-			cl := len(_changes)
-			for j := 0; j < cl; j++ {
-				c := _changes[j]
-				d.logger.Debugf("玩家ID=%d 流水=%s", _uid, c.String())
-				if c.uid == chuUid && c.tileID == lastTileId && (c.typ == ScoreChangeTypeAnGang || c.typ == ScoreChangeTypeBaGang) {
-					// 清除输掉的积分
-					c.score = 0
-
-					// 不需要转雨给自己
-					if _uid == huUid {
-						continue
-					}
-
-					score := 1
-					if c.typ == ScoreChangeTypeAnGang {
-						score = 2
-					}
-
-					// 转雨给胡牌的人
-					d.scoreChangeForUid(_uid, &scoreChangeInfo{
-						score:  -score, //之前是输分, 为负, 现在改为正
-						uid:    huUid,  //谁输的
-						typ:    c.typ,
-						tileID: lastTileId,
-					})
-
-					d.scoreChangeForUid(huUid, &scoreChangeInfo{
-						score:  score, //之前是输分, 为负, 现在改为正
-						uid:    _uid,  //谁输的
-						typ:    c.typ,
-						tileID: lastTileId,
-					})
-				}
-			}
-		}
-	} else {
-		panic("玩家杠牌, 但是没有杠牌记录")
-	}
-}
-
 func (d *Desk) chiPai(tileId int) int {
 	//出牌的玩家
 	chuPlayer := d.currentPlayer()
@@ -780,8 +827,9 @@ func (d *Desk) chiPai(tileId int) int {
 
 	// 检查有没有玩家要碰、杠、胡
 	checkTurn := d.curTurn
-	winOps := map[int]bool{}                                // 某个方位是否可以胡这张牌
-	pgOps := turnOp{turn: illegalTurn, op: []protocol.Op{}} // 牌桌同时只可能有一个人能碰杠
+	winOps := map[int]bool{}                                 // 某个方位是否可以胡这张牌
+	pgOps := turnOp{turn: illegalTurn, op: []protocol.Op{}}  // 牌桌同时只可能有一个人能碰杠
+	chiOps := turnOp{turn: illegalTurn, op: []protocol.Op{}} // 只有下家可以吃
 	for {
 		// 从下家开始检查, 一直检查到自己
 		checkTurn++
@@ -794,11 +842,11 @@ func (d *Desk) chiPai(tileId int) int {
 		checkPlayer := d.players[checkTurn]
 
 		//已经和牌 跳过
-		if d.wonPlayers[checkPlayer.Uid()] {
+		if d.isOut(checkPlayer.Uid()) {
 			continue
 		}
 
-		ops := checkPlayer.checkChi(tileId, chuPlayer)
+		ops := d.rules.DiscardOps(checkPlayer, tileId, chuPlayer)
 		if len(ops) == 0 {
 			continue
 		}
@@ -817,6 +865,10 @@ func (d *Desk) chiPai(tileId int) int {
 				pgOps.turn = checkTurn
 				pgOps.op = []protocol.Op{{Type: protocol.OptypePeng, TileIDs: []int{tileId}}}
 
+			case protocol.OptypeChi:
+				chiOps.turn = checkTurn
+				chiOps.op = append(chiOps.op, op)
+
 			case protocol.OptypeHu:
 				// 当前打牌玩家的上家
 				preTurn := d.curTurn - 1
@@ -849,7 +901,7 @@ func (d *Desk) chiPai(tileId int) int {
 					for i := nextTurn; i <= preTurn; i++ {
 						p := d.players[i%playerCount]
 						// 已经和牌的玩家不检查
-						if d.wonPlayers[p.uid] {
+						if d.isOut(p.uid) {
 							continue
 						}
 						// 上一张打掉掉牌
@@ -876,6 +928,7 @@ func (d *Desk) chiPai(tileId int) int {
 
 	// 是否有人胡牌，一炮多响
 	paoCount := 0
+	firstHu := !d.isMakerSet
 
 	// 先将提示发过去
 	// 如果胡牌的人同时可以碰杠, 将提示一起发送过去, 胡牌优先
@@ -927,7 +980,9 @@ func (d *Desk) chiPai(tileId int) int {
 			player.ctx.IsGangShangPao = true
 
 			// 转雨
-			d.zhuanYu(uid, chuUid)
+			d.adjustGangScore(history.AdjustZhuanYu, func() {
+				d.rules.GangShangPao(d, uid, chuUid)
+			})
 		}
 		score := player.scoring()
 
@@ -940,18 +995,20 @@ func (d *Desk) chiPai(tileId int) int {
 		losers := []Loser{{uid: chuPlayer.Uid(), score: score}}
 
 		d.scoreChangeForHu(player, losers, tileId, protocol.HuTypeDianPao)
+		d.continueAfterHu(player, tileId)
 	}
 
 	//点炮
 	if paoCount > 0 {
-		if paoCount == 2 {
+		// 本局第一次胡牌就是一炮多响, 放炮的玩家做庄
+		if paoCount > 1 && firstHu {
 			d.setNextRoundBanker(chuPlayer.Uid(), true)
 		}
 		return protocol.OptypeHu
 	}
 
 	if pgOps.turn == illegalTurn {
-		return protocol.OptypePass
+		return d.chiByNext(tileId, chiOps.turn, chiOps.op)
 	}
 
 	// 无人胡牌, 则通知可以碰杠的玩家, 如果玩家可以碰杠胡, 前面已经发送了碰杠提示, 但是未选择胡
@@ -963,7 +1020,7 @@ func (d *Desk) chiPai(tileId int) int {
 
 	d.logger.Debugf("玩家碰杠结果: 碰=%t 杠=%t", isPeng, isGang)
 	if !isPeng && !isGang {
-		return protocol.OptypePass
+		return d.chiByNext(tileId, chiOps.turn, chiOps.op)
 	}
 
 	d.curTurn = pgOps.turn
@@ -978,6 +1035,24 @@ func (d *Desk) chiPai(tileId int) int {
 	return protocol.OptypePeng
 }
 
+// 无人胡牌碰杠时, 通知下家吃牌
+func (d *Desk) chiByNext(tileId, turn int, ops []protocol.Op) int {
+	if turn == illegalTurn {
+		return protocol.OptypePass
+	}
+
+	isChi, isDissolve := d.players[turn].chiOrPass(tileId, ops)
+	if isDissolve {
+		return deskDissolved
+	}
+	if !isChi {
+		return protocol.OptypePass
+	}
+
+	d.curTurn = turn
+	return protocol.OptypeChi
+}
+
 // 检查有没有玩家抢杠, 第二个参数表示房间是否解散
 func (d *Desk) qiangGang(tid int) (bool, bool) {
 	//出牌的玩家
@@ -986,6 +1061,7 @@ func (d *Desk) qiangGang(tid int) (bool, bool) {
 	// 检查有没有玩家要胡
 	nextTurn := d.curTurn
 	paoCount := 0
+	firstHu := !d.isMakerSet
 
 	for {
 		// 从下家开始检查, 一直检查到自己
@@ -999,12 +1075,12 @@ func (d *Desk) qiangGang(tid int) (bool, bool) {
 		nextPlayer := d.players[nextTurn]
 
 		//已经和牌 跳过
-		if d.wonPlayers[nextPlayer.Uid()] {
+		if d.isOut(nextPlayer.Uid()) {
 			continue
 		}
 
 		//不能抢杠和
-		if !nextPlayer.checkHu(tid, true) {
+		if !d.rules.CanDianPao(nextPlayer, tid, true) {
 			continue
 		}
 
@@ -1032,6 +1108,7 @@ func (d *Desk) qiangGang(tid int) (bool, bool) {
 		score := nextPlayer.scoring()
 		losers := []Loser{{uid: chuPlayer.Uid(), score: score}}
 		d.scoreChangeForHu(nextPlayer, losers, tid, protocol.HuTypeDianPao)
+		d.continueAfterHu(nextPlayer, tid)
 
 		//切换当前玩家
 		d.curTurn = nextPlayer.turn
@@ -1039,7 +1116,7 @@ func (d *Desk) qiangGang(tid int) (bool, bool) {
 
 	//抢杠双响炮
 	if paoCount > 0 {
-		if paoCount == 2 {
+		if paoCount > 1 && firstHu {
 			d.setNextRoundBanker(chuPlayer.Uid(), true)
 		}
 
@@ -1051,6 +1128,32 @@ func (d *Desk) qiangGang(tid int) (bool, bool) {
 	return false, false
 }
 
+// 玩家是否已经退出本局, 血战到底中胡牌的玩家不再摸牌打牌, 血流成河中胡牌后继续
+func (d *Desk) isOut(uid int64) bool {
+	return d.wonPlayers[uid] && !d.rules.ContinueAfterHu()
+}
+
+// 血流成河: 胡牌结算完成后, 胡的牌从手牌中移出, 玩家继续摸牌打牌
+func (d *Desk) continueAfterHu(p *Player, tileID int) {
+	if !d.rules.ContinueAfterHu() {
+		return
+	}
+
+	mahjong.RemoveId(&p.onHand, tileID)
+	p.huTiles = append(p.huTiles, tileID)
+
+	// 杠上花/杠上炮/抢杠只对本次胡牌有效
+	p.ctx.IsGangShangHua = false
+	p.ctx.IsGangShangPao = false
+	p.ctx.IsQiangGangHu = false
+
+	d.broadcast(protocol.RouteHuContinue, &protocol.HuContinue{
+		Uid:     p.Uid(),
+		HuTiles: p.huTiles,
+		HuCount: len(p.huTiles),
+	})
+}
+
 func (d *Desk) nobodyWin() bool {
 	for _, ok := range d.wonPlayers {
 		if ok {
@@ -1114,7 +1217,7 @@ func (d *Desk) roundOverStatsForPlayer(p *Player) *protocol.RoundStats {
 func (d *Desk) roundOverHelper() *protocol.RoundOverStats {
 	// 游戏结束
 	overStats := &protocol.RoundOverStats{
-		Round:       fmt.Sprintf("局数: %d/%d", d.round, d.opts.MaxRound),
+		Round:       d.roundProgress(),
 		Title:       d.desc(false),
 		HandTiles:   []*protocol.HandTilesInfo{},
 		ScoreChange: []protocol.GameEndScoreChange{},
@@ -1125,72 +1228,14 @@ func (d *Desk) roundOverHelper() *protocol.RoundOverStats {
 		return overStats
 	}
 
-	playerCount := d.totalPlayerCount()
-
-	// 无叫玩家需要赔付给有叫玩家, 并且无叫的玩家之前所有刮风下雨积分全部清零
-	pei := map[int64]struct{}{}
-	ting := map[int64]struct{}{}
 	for _, p := range d.players {
-		uid := p.Uid()
-		tiles := d.roundOverTilesForPlayer(p)
-
-		overStats.HandTiles = append(overStats.HandTiles, tiles)
-
-		// 只有一个人没有和牌，不赔叫
-		if len(d.wonPlayers) == playerCount-1 {
-			continue
-		}
-
-		if !d.wonPlayers[uid] {
-			// 没有胡牌, 并且没叫
-			if !tiles.IsTing {
-				pei[uid] = struct{}{}
-			} else {
-				ting[uid] = struct{}{}
-			}
-		}
+		overStats.HandTiles = append(overStats.HandTiles, d.roundOverTilesForPlayer(p))
 	}
 
-	// 是否需要查叫: 牌桌的牌全部摸完, 并且还有人没胡牌
-	// 有人有叫有人没叫
-	if len(pei) > 0 {
-		// 要赔叫的人, 之前的所有刮风下雨清零
-		for uid := range pei {
-			if changes, ok := d.scoreChanges[uid]; ok {
-				for i := range changes {
-					c := changes[i]
-					// 清空正的刮风下雨积分(负分是输给别人的, 不能清空)
-					if c.score > 0 && (c.typ == ScoreChangeTypeBaGang || c.typ == ScoreChangeTypeAnGang) {
-						c.score = 0
-					}
-				}
-			}
-		}
-		for _, changes := range d.scoreChanges {
-			// 清除其他玩家的输分
-			for i := range changes {
-				change := changes[i]
-				winner := change.uid
-				// 如果赢家要赔付, 则清0不赔付
-				if _, ok := pei[winner]; ok && change.score < 0 && (change.typ == ScoreChangeTypeBaGang || change.typ == ScoreChangeTypeAnGang) {
-					change.score = 0
-				}
-			}
-		}
-
-		// 给有叫的人赔叫, 按最大的番数赔
-		// 有可能剩下两个人都没叫，不需要赔其他人，只需要清空刮风下雨都积分即可
-		for uid := range ting {
-			if p, err := d.playerWithId(uid); err == nil {
-				score, index := p.maxTingScore()
-				losers := []Loser{}
-				for loser := range pei {
-					losers = append(losers, Loser{loser, score})
-				}
-				d.scoreChangeForHu(p, losers, index, protocol.HuTypePei)
-			}
-		}
-	}
+	// 玩法相关的结算, 例如查叫
+	d.adjustGangScore(history.AdjustChaJiao, func() {
+		d.rules.Settle(d)
+	})
 
 	// 总结算分数
 	for i, p := range d.players {
@@ -1231,23 +1276,40 @@ func (d *Desk) status() constant.DeskStatus {
 func (d *Desk) roundOver() {
 	stats := d.roundOverHelper()
 	status := d.status()
+	d.emit(0, history.EventRoundEnd, &history.RoundEnd{Status: int(status), Stats: stats})
 
 	//只有正常结束的牌局才需要回放
 	//只有在已经开始本局或者正常结束时才需要缓存单局统计
 	if status == constant.DeskStatusRoundOver {
 		d.snapshot.SetEndStats(stats)
-		d.snapshot.Save()
+		if err := d.store.insertHistory(d.snapshot); err != nil {
+			d.logger.Errorf("保存牌局回放失败, Error=%v", err)
+		}
 		d.matchStats.Push(d.roundStats)
+
+		if d.classic != nil {
+			d.settleClassic(stats)
+		}
 	}
 
-	//满场
-	isMaxRound := d.round >= uint32(d.opts.MaxRound) && status == constant.DeskStatusRoundOver
+	if d.sim != nil && d.sim.onRoundOver != nil {
+		d.sim.onRoundOver(d)
+	}
+
+	//满场, 金币场不限局数
+	isMaxRound := d.classic == nil && d.round >= uint32(d.opts.MaxRound) && status == constant.DeskStatusRoundOver
 
 	d.logger.Debugf("本轮游戏结束, 状态=%s 结算数据=%#v", status.String(), stats)
 	//round over
 	if status == constant.DeskStatusRoundOver && !isMaxRound {
-		d.group.Broadcast("onRoundEnd", stats)
+		d.broadcast("onRoundEnd", stats)
 		d.clean()
+		if d.classic != nil {
+			d.ejectClassicPlayers()
+		}
+		if d.tournament != nil {
+			d.scheduleTournamentRound()
+		}
 	} else {
 		//最后一局以及中断统计的GameEnd与场结算一起发送
 		d.finalSettlement(isMaxRound, stats)
@@ -1261,10 +1323,13 @@ func (d *Desk) roundOver() {
 		4. A切回前台,开始游戏,此时A引发的定时器尚未撤销的bug
 	*/
 	d.dissolve.stop()
+
+	// 最后一局结束后牌桌已经销毁, 不再保存
+	d.checkpoint()
 }
 
 func (d *Desk) clean() {
-	d.state = constant.DeskStatusCleaned
+	d.setStatus(constant.DeskStatusCleaned)
 	d.isNewRound = true
 	d.snapshot = nil
 	d.isFirstRound = false
@@ -1284,6 +1349,8 @@ func (d *Desk) clean() {
 
 	d.dissolve.reset()
 	d.prepare.reset()
+	d.huanSanZhang.reset()
+	d.robotsPrepare()
 
 	//重置玩家状态
 	for _, p := range d.players {
@@ -1403,7 +1470,7 @@ func (d *Desk) finalSettlement(isNormalFinished bool, ge *protocol.RoundOverStat
 	}
 
 	//发送单场统计
-	err := d.group.Broadcast("onGameEnd", ddr)
+	err := d.broadcast("onGameEnd", ddr)
 	if err != nil {
 		log.Error(err)
 	}
@@ -1436,11 +1503,20 @@ func (d *Desk) finalSettlement(isNormalFinished bool, ge *protocol.RoundOverStat
 		}
 	}
 
+	if d.match != nil && isNormalFinished {
+		scores := map[int64]int{}
+		for uid, r := range stats {
+			scores[uid] = r.TotalScore
+		}
+		d.updateRatings(scores)
+	}
+	d.updateRanks(stats)
+
 	d.destroy()
 
 	// 数据库异步更新
 	async.Run(func() {
-		if err = db.UpdateDesk(desk); err != nil {
+		if err := d.store.updateDesk(desk); err != nil {
 			log.Error(err)
 		}
 	})
@@ -1467,17 +1543,25 @@ func (d *Desk) destroy() {
 		p := d.players[i]
 		d.logger.Debugf("销毁房间，清除玩家%d数据", p.Uid())
 		p.reset()
-		p.desk = nil
+		p.leaveDesk()
 		p.score = 1000
 		p.turn = 0
 		p.logger = log.WithField(fieldPlayer, p.uid)
 		d.players[i] = nil
 	}
 
+	// 比赛累计本轮分数, 玩家已经离开牌桌, 可以进入下一轮
+	if d.tournament != nil {
+		d.reportTournament()
+	}
+
 	// 释放desk资源
 	d.group.Close()
+	d.observers.close()
 	d.prepare.reset()
+	d.dissolve.stop()
 	d.dissolve.reset()
+	d.huanSanZhang.stop()
 	d.wonPlayers = nil
 	d.snapshot = nil
 	d.knownTiles = nil
@@ -1485,10 +1569,19 @@ func (d *Desk) destroy() {
 	d.scoreChanges = nil
 	d.roundStats = nil
 
-	//删除桌子
-	scheduler.PushTask(func() {
-		defaultDeskManager.setDesk(d.roomNo, nil)
-	})
+	if d.checkpoints != nil {
+		d.checkpoints.remove(d.roomNo)
+	}
+
+	//删除桌子, 模拟牌局没有注册到牌桌管理器
+	if d.sim == nil {
+		logicTask(func() {
+			defaultDeskManager.setDesk(d.roomNo, nil)
+			if d.classic != nil {
+				defaultClassicManager.remove(d)
+			}
+		})
+	}
 }
 
 func (d *Desk) scoreChangeHelper(winner int64, losers []Loser, typ ScoreChangeType, tileID int) {
@@ -1542,9 +1635,10 @@ func (d *Desk) scoreChangeForGang(winner *Player, loserPlayers []int64, tileID i
 
 	}
 
-	d.group.Broadcast("onGangScoreChange", gsc)
+	d.broadcast("onGangScoreChange", gsc)
 	d.scoreChangeHelper(winner.Uid(), losers, typ, tileID)
 	d.snapshot.PushGangScoreChange(gsc)
+	d.emit(0, history.EventScore, &history.Score{Type: int(typ), TileID: tileID, Changes: gsc.Changes})
 }
 
 func (d *Desk) maxScore() int {
@@ -1563,7 +1657,7 @@ func (d *Desk) maxScoreCutter(point int) int {
 func (d *Desk) scoreChangeForHu(winner *Player, losers []Loser, tileID int, huType protocol.HuPaiType) {
 	for _, l := range losers {
 		d.logger.Debugf("scoreChangeForHu 赢家=%d 输家=%d 分值=%d 类型=%d 牌=%s",
-			winner.Uid(), l.uid, l.score, huType, mahjong.IndexFromID(tileID))
+			winner.Uid(), l.uid, l.score, huType, mahjong.TileFromID(tileID))
 	}
 
 	var winUid = winner.Uid()
@@ -1581,11 +1675,17 @@ func (d *Desk) scoreChangeForHu(winner *Player, losers []Loser, tileID int, huTy
 		for i := range losers {
 			loser := losers[i].uid
 			d.roundStats[loser].PaoNum++
+			if huType != protocol.HuTypePei {
+				winner.ctx.ResultType = ResultHu
+			}
+			// 血流成河中已经胡过牌的玩家保留胡牌的结果
+			if d.wonPlayers[loser] {
+				continue
+			}
 			if p, err := d.playerWithId(loser); err == nil {
 				if huType == protocol.HuTypePei {
 					p.ctx.ResultType = ResultPei
 				} else {
-					winner.ctx.ResultType = ResultHu
 					p.ctx.ResultType = ResultPao
 				}
 			}
@@ -1628,7 +1728,13 @@ func (d *Desk) scoreChangeForHu(winner *Player, losers []Loser, tileID int, huTy
 	d.scoreChangeHelper(winUid, losers, ScoreChangeTypeHu, tileID)
 
 	d.snapshot.PushHuScoreChange(hsc)
-	d.group.Broadcast("onHuScoreChange", hsc)
+	d.emit(0, history.EventScore, &history.Score{
+		Type:    int(ScoreChangeTypeHu),
+		HuType:  huType,
+		TileID:  tileID,
+		Changes: append([]protocol.ScoreInfo{{Uid: winUid, Score: hsc.TotalWinScore}}, hsc.ScoreChange...),
+	})
+	d.broadcast("onHuScoreChange", hsc)
 }
 
 //桌上的最后一张牌
@@ -1641,19 +1747,21 @@ func (d *Desk) onPlayerExit(s *session.Session, isDisconnect bool) {
 	d.group.Leave(s)
 	if isDisconnect {
 		d.dissolve.updateOnlineStatus(uid, false)
+
+		// 金币场不等待离线的玩家, 一局之中由托管继续, 本局结束后离开牌桌
+		if p, err := d.playerWithId(uid); err == nil && d.classic != nil && !d.inRound() {
+			d.classicExit(p, protocol.ExitTypeNotReadyForStart)
+		}
 	} else {
-		restPlayers := []*Player{}
-		for _, p := range d.players {
-			if p.Uid() != uid {
-				restPlayers = append(restPlayers, p)
-			} else {
-				p.reset()
-				p.desk = nil
-				p.score = 1000
-				p.turn = 0
-			}
+		d.removePlayer(uid)
+		if d.classic != nil {
+			d.releaseClassicSeat()
+		}
+		// 匹配的牌桌没有房主, 有玩家退出时解散
+		if d.match != nil {
+			d.matchDissolve(true)
+			return
 		}
-		d.players = restPlayers
 	}
 
 	//如果桌上已无玩家, destroy it
@@ -1671,13 +1779,29 @@ func (d *Desk) onPlayerExit(s *session.Session, isDisconnect bool) {
 				Id:    d.deskID,
 				Round: 0,
 			}
-			if err := db.UpdateDesk(desk); err != nil {
+			if err := d.store.updateDesk(desk); err != nil {
 				log.Error(err)
 			}
 		})
 	}
 }
 
+// 玩家离开牌桌, 重置玩家的牌局数据
+func (d *Desk) removePlayer(uid int64) {
+	restPlayers := []*Player{}
+	for _, p := range d.players {
+		if p.Uid() != uid {
+			restPlayers = append(restPlayers, p)
+		} else {
+			p.reset()
+			p.leaveDesk()
+			p.score = 1000
+			p.turn = 0
+		}
+	}
+	d.players = restPlayers
+}
+
 func (d *Desk) playerWithId(uid int64) (*Player, error) {
 	for _, p := range d.players {
 		if p.Uid() == uid {
@@ -1715,11 +1839,24 @@ func (d *Desk) applyDissolve(uid int64) {
 	d.dissolve.reset()
 	d.dissolve.setUidStatus(uid, true, ApplyDissolve)
 
-	d.group.Broadcast("onDissolveAgreement", &protocol.DissolveResponse{
+	// 机器人默认同意解散
+	for _, p := range d.players {
+		if p.isRobot() {
+			d.dissolve.setUidStatus(p.Uid(), true, AgreeRequest)
+		}
+	}
+
+	d.broadcast("onDissolveAgreement", &protocol.DissolveResponse{
 		DissolveUid:    uid,
 		DissolveStatus: d.collectDissolveStatus(),
 		RestTime:       applyDissolveRestTime,
 	})
+
+	// 除申请人外都是机器人, 直接解散
+	if d.dissolve.agreeCount() >= d.totalPlayerCount() {
+		d.dissolve.stop()
+		d.doDissolve()
+	}
 }
 
 // 收集本桌玩家的解散状态
@@ -1844,11 +1981,14 @@ func (d *Desk) doDissolve() {
 	log.Debugf("房间: %s解散倒计时结束, 房间解散开始", d.roomNo)
 	//如果不是在桌子刚创建时解散,需要进行退出处理
 	if status := d.status(); status == constant.DeskStatusCreate {
-		d.group.Broadcast("onDissolve", &protocol.ExitResponse{
+		d.broadcast("onDissolve", &protocol.ExitResponse{
 			IsExit:   true,
 			ExitType: protocol.ExitTypeDissolve,
 		})
 		d.destroy()
+	} else if d.playing {
+		// 牌局进行中, 由play在退出循环后完成结算
+		d.setStatus(constant.DeskStatusInterruption)
 	} else {
 		d.setStatus(constant.DeskStatusInterruption)
 		d.roundOver()
@@ -1857,6 +1997,15 @@ func (d *Desk) doDissolve() {
 }
 
 func (d *Desk) loseCoin() {
+	// 金币场不消耗房卡, 每局从赢家的收入中抽水; 比赛报名时已经扣除报名费
+	if d.classic != nil || d.tournament != nil {
+		return
+	}
+	if d.match != nil {
+		d.matchLoseCoin()
+		return
+	}
+
 	cardCount := requireCardCount(d.opts.MaxRound)
 	consume := &model.CardConsume{
 		UserId:    d.creator,
@@ -1870,8 +2019,14 @@ func (d *Desk) loseCoin() {
 	// 俱乐部房间
 	if d.clubId > 0 {
 		async.Run(func() {
-			db.ClubLoseBalance(d.clubId, int64(cardCount), consume)
+			if err := d.store.clubLoseBalance(d.clubId, int64(cardCount), consume); err != nil {
+				log.Error(err)
+			}
 		})
+		// 房卡消耗计入房主, 房主不在牌桌上时不计入排行榜
+		if p, err := d.playerWithId(d.creator); err == nil {
+			d.rankCardConsume(p, consume)
+		}
 	} else {
 		p, err := d.playerWithId(d.creator)
 		if err != nil {
@@ -1879,5 +2034,6 @@ func (d *Desk) loseCoin() {
 			return
 		}
 		p.loseCoin(int64(cardCount), consume)
+		d.rankCardConsume(p, consume)
 	}
 }
@@ -0,0 +1,89 @@
+package game
+
+import (
+	"go-mahjong-server/pkg/constant"
+
+	"github.com/lonng/nano/scheduler"
+)
+
+// 牌桌事件循环: 玩家操作, 定时器和管理命令都以任务的形式投递到牌桌协程中执行,
+// 牌桌以及桌上玩家的状态只在牌桌协程中修改, 不需要加锁
+//
+// 牌局进行中时, play阻塞在等待玩家操作上, 等待期间由waitOperation继续处理队列中的任务,
+// 因此play执行过程中的任何时刻都可以处理加入, 断线, 解散等事件
+
+// 从牌桌协程投递任务到nano逻辑协程, 测试时可以替换
+var logicTask = scheduler.PushTask
+
+// 启动牌桌协程, 牌桌销毁后退出
+func (d *Desk) loop() {
+	for {
+		select {
+		case task := <-d.chTask:
+			d.run(task)
+
+		case <-d.die:
+			return
+		}
+	}
+}
+
+// 执行单个任务, 任务中的panic不能影响牌桌协程
+func (d *Desk) run(task func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			d.logger.Errorf("牌桌任务执行错误: Error=%v", err)
+			println(stack())
+		}
+	}()
+
+	task()
+}
+
+// 投递任务到牌桌协程, 牌桌已经销毁时返回false
+// 注意: 不能在牌桌协程中调用, 队列已满时会阻塞
+func (d *Desk) post(task func()) bool {
+	select {
+	case <-d.die:
+		return false
+	default:
+	}
+
+	select {
+	case d.chTask <- task:
+		return true
+	case <-d.die:
+		return false
+	}
+}
+
+// 投递任务并等待执行完成, 牌桌已经销毁时返回false
+func (d *Desk) do(task func()) bool {
+	done := make(chan struct{})
+	ok := d.post(func() {
+		defer close(done)
+		task()
+	})
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-d.die:
+		// 任务本身可能销毁了牌桌
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// 当前牌局是否被中断(解散或销毁), 牌局需要立即停止
+func (d *Desk) isInterrupted() bool {
+	s := d.status()
+	return s == constant.DeskStatusInterruption || s == constant.DeskStatusDestory
+}
@@ -0,0 +1,405 @@
+package game
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// 以下测试模拟nano逻辑协程(测试协程)和牌桌协程并发执行, 需要使用 go test -race 运行
+
+type memStore struct {
+	mu        sync.Mutex
+	histories int
+	byDesk    map[string][]*history.History
+	ledgers   []*model.GoldLedger
+	rankRows  []*model.RankStat
+}
+
+func (m *memStore) insertDesk(desk *model.Desk) error { return nil }
+func (m *memStore) updateDesk(desk *model.Desk) error { return nil }
+func (m *memStore) clubLoseBalance(clubId, count int64, consume *model.CardConsume) error {
+	return nil
+}
+func (m *memStore) loseCoin(uid, count int64, consume *model.CardConsume) error { return nil }
+
+func (m *memStore) settleGold(ledgers []*model.GoldLedger) error {
+	m.mu.Lock()
+	m.ledgers = append(m.ledgers, ledgers...)
+	m.mu.Unlock()
+	return nil
+}
+
+// 与数据库相同, 按用户, 俱乐部, 周期和类型累加
+func (m *memStore) incrRanks(stats []*model.RankStat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, st := range stats {
+		found := false
+		for _, r := range m.rankRows {
+			if r.Uid == st.Uid && r.ClubId == st.ClubId && r.Period == st.Period && r.Metric == st.Metric {
+				r.Value += st.Value
+				r.Name, r.UpdatedAt = st.Name, st.UpdatedAt
+				found = true
+				break
+			}
+		}
+		if !found {
+			r := *st
+			r.Id = int64(len(m.rankRows) + 1)
+			m.rankRows = append(m.rankRows, &r)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) goldLedgers(uid int64) []*model.GoldLedger {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []*model.GoldLedger{}
+	for _, l := range m.ledgers {
+		if l.Uid == uid {
+			list = append(list, l)
+		}
+	}
+	return list
+}
+
+func (m *memStore) insertHistory(h *history.History) error {
+	m.mu.Lock()
+	m.histories++
+	if m.byDesk == nil {
+		m.byDesk = map[string][]*history.History{}
+	}
+	no := h.BasicInfo.DeskID
+	m.byDesk[no] = append(m.byDesk[no], h)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memStore) deskHistories(no room.Number) []*history.History {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.byDesk[no.String()]
+}
+
+func (m *memStore) historyCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.histories
+}
+
+type testPush struct {
+	route string
+	v     interface{}
+	at    time.Time
+}
+
+// 记录收到的所有消息
+type testEntity struct {
+	mu        sync.Mutex
+	pushes    map[string]int
+	log       []testPush
+	responses []interface{}
+}
+
+func newTestEntity() *testEntity {
+	return &testEntity{pushes: map[string]int{}}
+}
+
+func (e *testEntity) Push(route string, v interface{}) error {
+	e.mu.Lock()
+	e.pushes[route]++
+	e.log = append(e.log, testPush{route: route, v: v, at: time.Now()})
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *testEntity) RPC(route string, v interface{}) error { return nil }
+func (e *testEntity) LastMid() uint64                       { return 1 }
+func (e *testEntity) Response(v interface{}) error          { return e.ResponseMid(1, v) }
+func (e *testEntity) Close() error                          { return nil }
+func (e *testEntity) RemoteAddr() net.Addr                  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (e *testEntity) ResponseMid(mid uint64, v interface{}) error {
+	e.mu.Lock()
+	e.responses = append(e.responses, v)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *testEntity) pushCount(route string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pushes[route]
+}
+
+func (e *testEntity) received(route string) []testPush {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := []testPush{}
+	for _, p := range e.log {
+		if p.route == route {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+func (e *testEntity) lastResponse() interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.responses) == 0 {
+		return nil
+	}
+	return e.responses[len(e.responses)-1]
+}
+
+var (
+	loopStore     = &memStore{}
+	loopSetupOnce sync.Once
+)
+
+// 替换数据库并缩短等待时间, 上一个测试的牌桌可能还有异步任务在执行, 因此只替换一次且不恢复
+func setupLoopTest(t *testing.T) *memStore {
+	loopSetupOnce.Do(func() {
+		store = loopStore
+		robotThinkTime = time.Millisecond
+		trusteeshipDelay = time.Millisecond
+		operationTimeout = time.Millisecond
+		log.SetLevel(log.FatalLevel)
+	})
+	return loopStore
+}
+
+func newLoopTestSession(t *testing.T, uid int64) (*session.Session, *testEntity, *Player) {
+	e := newTestEntity()
+	s := session.New(e)
+	if err := s.Bind(uid); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Player{
+		uid:         uid,
+		name:        "tester",
+		ctx:         &mahjong.Context{Uid: uid},
+		score:       1000,
+		coin:        100,
+		logger:      log.WithField(fieldPlayer, uid),
+		chOperation: make(chan *protocol.OpChoosed, 1),
+	}
+	p.ctx.Reset()
+	p.bindSession(s)
+	return s, e, p
+}
+
+// 销毁牌桌并等待destroy执行完成, 避免和下一个测试替换logicTask同时进行
+func destroyDesk(d *Desk) {
+	done := make(chan struct{})
+	if d.post(func() {
+		defer close(done)
+		d.destroy()
+	}) {
+		<-done
+	}
+}
+
+// 创建一张1个真实玩家和3个机器人的牌桌, 并推进到打牌阶段
+func newPlayingDesk(t *testing.T, no room.Number, maxRound int) (*Desk, *session.Session, *testEntity, *Player) {
+	return newPlayingDeskWithOptions(t, no, &protocol.DeskOptions{Mode: ModeFours, MaxRound: maxRound, MaxFan: 3, Pinghu: true})
+}
+
+func newPlayingDeskWithOptions(t *testing.T, no room.Number, opts *protocol.DeskOptions) (*Desk, *session.Session, *testEntity, *Player) {
+	d := NewDesk(no, opts, -1)
+	d.createdAt = time.Now().Unix()
+	d.creator = 1
+	defaultDeskManager.setDesk(no, d)
+	t.Cleanup(func() {
+		destroyDesk(d)
+		defaultDeskManager.setDesk(no, nil)
+	})
+
+	s, e, p := newLoopTestSession(t, 1)
+	if err := defaultDeskManager.Join(s, &protocol.JoinDeskRequest{DeskNo: string(no)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "加入房间", func() bool { return p.currentDesk() == d })
+
+	if err := defaultDeskManager.ClientInitCompleted(s, &protocol.ClientInitCompletedRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	d.do(func() {
+		if err := d.robotJoin(0); err != nil {
+			t.Error(err)
+		}
+	})
+	startRound(t, d, s)
+	return d, s, e, p
+}
+
+// 真实玩家准备, 理牌, 定缺, 直到牌局开始
+func startRound(t *testing.T, d *Desk, s *session.Session) {
+	if err := defaultDeskManager.Ready(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "开局", func() bool { return d.status() == constant.DeskStatusDuanPai })
+
+	if err := defaultDeskManager.QiPaiFinished(s, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 换三张使用推荐的牌
+	if d.opts.HuanSanZhang {
+		waitFor(t, "换三张", func() bool { return d.status() == constant.DeskStatusHuanSanZhang })
+		p, err := playerWithSession(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tiles []int
+		d.do(func() { tiles = p.huanSanZhangTiles() })
+		if err := defaultDeskManager.HuanSanZhang(s, &protocol.HuanSanZhangRequest{Tiles: tiles}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 不需要定缺的玩法理牌后直接开始
+	if !d.rules.RequireQue(d.opts) {
+		waitFor(t, "理牌", func() bool {
+			status := d.status()
+			return status != constant.DeskStatusDuanPai && status != constant.DeskStatusHuanSanZhang
+		})
+		return
+	}
+	waitFor(t, "理牌", func() bool { return d.status() == constant.DeskStatusQiPai })
+
+	if err := defaultDeskManager.DingQue(s, &protocol.DingQue{Que: 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "定缺", func() bool { return d.status() != constant.DeskStatusQiPai })
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeskLoopRoundOver(t *testing.T) {
+	ms := setupLoopTest(t)
+	histories := ms.historyCount()
+	d, s, _, p := newPlayingDesk(t, "100001", 2)
+
+	// 牌局进行中, 逻辑协程持续发送消息
+	for d.status() == constant.DeskStatusPlaying {
+		defaultDeskManager.Pause(s, nil)
+		defaultDeskManager.Resume(s, nil)
+		defaultDeskManager.OpChoose(s, &protocol.OpChooseRequest{OpType: protocol.OptypePass, Index: -1})
+		time.Sleep(time.Millisecond)
+	}
+
+	waitFor(t, "第一局结束", func() bool { return d.status() == constant.DeskStatusCleaned })
+	if c := ms.historyCount() - histories; c != 1 {
+		t.Fatalf("history count=%d, expected 1", c)
+	}
+
+	// 第二局是最后一局, 结束后销毁牌桌
+	startRound(t, d, s)
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+	if c := ms.historyCount() - histories; c != 2 {
+		t.Fatalf("history count=%d, expected 2", c)
+	}
+	if p.currentDesk() != nil {
+		t.Fatal("player should leave the desk after destroy")
+	}
+}
+
+func TestDeskLoopJoinDuringPlay(t *testing.T) {
+	setupLoopTest(t)
+	d, _, _, _ := newPlayingDesk(t, "100002", 1)
+
+	s2, e2, p2 := newLoopTestSession(t, 2)
+	if err := defaultDeskManager.Join(s2, &protocol.JoinDeskRequest{DeskNo: string(d.roomNo)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "加入房间响应", func() bool { return e2.lastResponse() != nil })
+
+	if resp := e2.lastResponse(); resp != deskPlayerNumEnough {
+		t.Fatalf("response=%+v, expected %+v", resp, deskPlayerNumEnough)
+	}
+	if p2.currentDesk() != nil {
+		t.Fatal("player should not join a full desk")
+	}
+}
+
+func TestDeskLoopDisconnectDuringPlay(t *testing.T) {
+	setupLoopTest(t)
+	d, s, _, p := newPlayingDesk(t, "100003", 1)
+
+	if err := defaultDeskManager.onPlayerDisconnect(s); err != nil {
+		t.Fatal(err)
+	}
+	var online bool
+	waitFor(t, "断线", func() bool {
+		d.do(func() { online = d.dissolve.isOnline(p.Uid()) })
+		return !online
+	})
+
+	// 使用新的连接重新加入
+	s2 := session.New(newTestEntity())
+	s2.Bind(p.Uid())
+	p.bindSession(s2)
+	if err := defaultDeskManager.ReJoin(s2, &protocol.ReJoinDeskRequest{DeskNo: string(d.roomNo)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "重新加入", func() bool {
+		d.do(func() { online = d.dissolve.isOnline(p.Uid()) })
+		return online || d.isDestroy()
+	})
+
+	// 断线期间牌局由托管继续进行
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+}
+
+func TestDeskLoopDissolveDuringPlay(t *testing.T) {
+	ms := setupLoopTest(t)
+	histories := ms.historyCount()
+	d, s, e, p := newPlayingDesk(t, "100004", 4)
+
+	if err := defaultDeskManager.Dissolve(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+
+	// 中断的牌局不保存回放
+	if c := ms.historyCount() - histories; c != 0 {
+		t.Fatalf("history count=%d, expected 0", c)
+	}
+	if p.currentDesk() != nil {
+		t.Fatal("player should leave the desk after dissolve")
+	}
+
+	// 牌桌销毁后的消息不再进入牌桌
+	prev := e.pushCount("onDissolveSuccess")
+	if err := defaultDeskManager.Dissolve(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := e.pushCount("onDissolveSuccess"); c != prev+1 {
+		t.Fatalf("onDissolveSuccess count=%d, expected %d", c, prev+1)
+	}
+}
@@ -2,7 +2,7 @@ package game
 
 import (
 	"fmt"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	"go-mahjong-server/db"
@@ -43,9 +43,10 @@ const (
 	versionExpireMessage       = "你当前的游戏版本过老，请更新客户端，地址: http://fir.im/tand"
 	deskCardNotEnoughMessage   = "房卡不足"
 	clubCardNotEnoughMessage   = "俱乐部房卡不足"
+	maintenanceDeskMessage     = "服务器即将停机维护, 暂时不能创建或加入房间"
 )
 
-var ErrModeCannotQue = errors.New("当前不为4人模式，不能定缺")
+var ErrModeCannotQue = errors.New("当前玩法不需要定缺")
 
 var (
 	deskNotFoundResponse = &protocol.JoinDeskResponse{Code: errutil.YXDeskNotFound, Error: deskNotFoundMessage}
@@ -55,6 +56,8 @@ var (
 	createVersionExpire  = &protocol.CreateDeskResponse{Code: 30001, Error: versionExpireMessage}
 	deskCardNotEnough    = &protocol.CreateDeskResponse{Code: 30002, Error: deskCardNotEnoughMessage}
 	clubCardNotEnough    = &protocol.CreateDeskResponse{Code: 30002, Error: clubCardNotEnoughMessage}
+	createMaintenance    = &protocol.CreateDeskResponse{Code: 30004, Error: maintenanceDeskMessage}
+	joinMaintenance      = &protocol.JoinDeskResponse{Code: errorCode, Error: maintenanceDeskMessage}
 )
 
 type (
@@ -78,23 +81,36 @@ func (manager *DeskManager) AfterInit() {
 		// Fixed: 玩家WIFI切换到4G网络不断开, 重连时，将UID设置为illegalSessionUid
 		if s.UID() > 0 {
 			if err := manager.onPlayerDisconnect(s); err != nil {
-				logger.Errorf("玩家退出: UID=%d, Error=%s", s.UID, err.Error())
+				logger.Errorf("玩家退出: UID=%d, Error=%s", s.UID(), err.Error())
 			}
 		}
 	})
 
+	// 恢复服务器重启之前未完成的牌桌, 并定时保存检查点
+	if checkpoints != nil {
+		manager.restoreDesks(checkpoints)
+		scheduler.NewTimer(checkpointInterval, func() {
+			for _, d := range manager.desks {
+				d.post(d.periodicCheckpoint)
+			}
+		})
+	}
+
 	// 每5分钟清空一次已摧毁的房间信息
 	scheduler.NewTimer(300*time.Second, func() {
 		destroyDesk := map[room.Number]*Desk{}
 		deadline := time.Now().Add(-24 * time.Hour).Unix()
 		for no, d := range manager.desks {
-			// 清除创建超过24小时的房间
-			if d.status() == constant.DeskStatusDestory || d.createdAt < deadline {
+			// 清除创建超过24小时的房间, 金币场牌桌常驻, 所有玩家离开后销毁
+			if d.status() == constant.DeskStatusDestory || (d.classic == nil && d.createdAt < deadline) {
 				destroyDesk[no] = d
 			}
 		}
-		for _, d := range destroyDesk {
-			d.destroy()
+		for no, d := range destroyDesk {
+			// 牌桌协程已经退出时直接清除
+			if !d.post(d.destroy) {
+				manager.setDesk(no, nil)
+			}
 		}
 
 		manager.dumpDeskInfo()
@@ -117,7 +133,7 @@ func (manager *DeskManager) dumpDeskInfo() {
 	logger.Infof("剩余房间数量: %d 在线人数: %d  当前时间: %s", c, defaultManager.sessionCount(), time.Now().Format("2006-01-02 15:04:05"))
 	for no, d := range manager.desks {
 		logger.Debugf("房号: %s, 创建时间: %s, 创建玩家: %d, 状态: %s, 总局数: %d, 当前局数: %d",
-			no, time.Unix(d.createdAt, 0).String(), d.creator, d.status().String(), d.opts.MaxRound, d.round)
+			no, time.Unix(d.createdAt, 0).String(), d.creator, d.status().String(), d.opts.MaxRound, atomic.LoadUint32(&d.round))
 	}
 }
 
@@ -129,16 +145,19 @@ func (manager *DeskManager) onPlayerDisconnect(s *session.Session) error {
 	}
 	p.logger.Debug("DeskManager.onPlayerDisconnect: 玩家网络断开")
 
+	// 退出观战
+	leaveObserving(p, s)
+
 	// 移除session
 	p.removeSession()
 
-	if p.desk == nil || p.desk.isDestroy() {
+	d := p.currentDesk()
+	if d == nil || d.isDestroy() {
 		defaultManager.offline(uid)
 		return nil
 	}
 
-	d := p.desk
-	d.onPlayerExit(s, true)
+	d.post(func() { d.onPlayerExit(s, true) })
 	return nil
 }
 
@@ -167,37 +186,40 @@ func (manager *DeskManager) UnCompleteDesk(s *session.Session, _ []byte) error {
 		return nil
 	}
 
-	if p.desk == nil {
-		p.logger.Debug("DeskManager.UnCompleteDesk: 玩家不在房间内")
+	d := p.currentDesk()
+	if d == nil {
+		logger.Debugf("DeskManager.UnCompleteDesk: 玩家不在房间内, UID=%d", s.UID())
 		return s.Response(resp)
 	}
 
-	d := p.desk
-	if d.isDestroy() {
+	mid := s.LastMid()
+	ok := d.post(func() {
+		s.ResponseMID(mid, &protocol.UnCompleteDeskResponse{
+			Exist:     true,
+			TableInfo: d.tableInfo(),
+		})
+	})
+	if !ok {
 		delete(manager.desks, d.roomNo)
-		p.desk = nil
-		p.logger.Debug("DeskManager.UnCompleteDesk: 房间已销毁")
+		p.leaveDesk()
+		logger.Debugf("DeskManager.UnCompleteDesk: 房间已销毁, UID=%d", s.UID())
 		return s.Response(resp)
 	}
 
-	return s.Response(&protocol.UnCompleteDeskResponse{
-		Exist: true,
-		TableInfo: protocol.TableInfo{
-			DeskNo:    string(d.roomNo),
-			CreatedAt: d.createdAt,
-			Creator:   d.creator,
-			Title:     d.title(),
-			Desc:      d.desc(true),
-			Status:    d.status(),
-			Round:     d.round,
-			Mode:      d.opts.Mode,
-		},
-	})
+	return nil
 }
 
 // 网络断开后, 重新连接网络
 func (manager *DeskManager) ReConnect(s *session.Session, req *protocol.ReConnect) error {
 	uid := req.Uid
+	pf, err := authenticate(uid, req.Token)
+	if err != nil {
+		logger.Warnf("玩家重新连接校验失败: UID=%d, Error=%v", uid, err)
+		return s.Response(&protocol.ErrorResponse{
+			Code:  errutil.Code(err),
+			Error: err.Error(),
+		})
+	}
 
 	// 绑定UID
 	if err := s.Bind(uid); err != nil {
@@ -210,17 +232,14 @@ func (manager *DeskManager) ReConnect(s *session.Session, req *protocol.ReConnec
 	p, ok := defaultManager.player(uid)
 	if !ok {
 		logger.Infof("玩家之前用户信息已被清除，重新初始化用户信息: UID=%d", uid)
-		ip := ""
-		if parts := strings.Split(s.RemoteAddr().String(), ":"); len(parts) > 0 {
-			ip = parts[0]
-		}
-		p = newPlayer(s, uid, req.Name, req.HeadUrl, ip, req.Sex)
+		p = newPlayer(s, uid, pf.name, pf.head, remoteIP(s), pf.sex)
 		defaultManager.setPlayer(uid, p)
 	} else {
 		logger.Infof("玩家之前用户信息存在服务器上，替换session: UID=%d", uid)
+		p.syncProfile(pf)
 
 		// 重置之前的session
-		prevSession := p.session
+		prevSession := p.currentSession()
 		if prevSession != nil {
 			prevSession.Clear()
 			prevSession.Close()
@@ -230,7 +249,7 @@ func (manager *DeskManager) ReConnect(s *session.Session, req *protocol.ReConnec
 		p.bindSession(s)
 
 		// 移除广播频道
-		if d := p.desk; d != nil && prevSession != nil {
+		if d := p.currentDesk(); d != nil && prevSession != nil {
 			d.group.Leave(prevSession)
 		}
 	}
@@ -240,6 +259,10 @@ func (manager *DeskManager) ReConnect(s *session.Session, req *protocol.ReConnec
 
 // 网络断开后, 如果ReConnect后发现当前正在房间中, 则重新进入, 桌号是之前的桌号
 func (manager *DeskManager) ReJoin(s *session.Session, data *protocol.ReJoinDeskRequest) error {
+	if node, ok := ownerNode(room.Number(data.DeskNo)); ok {
+		return s.Response(reJoinRedirect(node))
+	}
+
 	d, ok := manager.desk(room.Number(data.DeskNo))
 	if !ok || d.isDestroy() {
 		return s.Response(&protocol.ReJoinDeskResponse{
@@ -247,9 +270,21 @@ func (manager *DeskManager) ReJoin(s *session.Session, data *protocol.ReJoinDesk
 			Error: "房间已解散",
 		})
 	}
-	d.logger.Debugf("玩家重新加入房间: UID=%d, Data=%+v", s.UID(), data)
+	mid := s.LastMid()
+	ok = d.post(func() {
+		d.logger.Debugf("玩家重新加入房间: UID=%d, Data=%+v", s.UID(), data)
+		if err := d.onPlayerReJoin(s); err != nil {
+			d.logger.Errorf("玩家重新加入房间失败: UID=%d, Error=%v", s.UID(), err)
+		}
+	})
+	if !ok {
+		return s.ResponseMID(mid, &protocol.ReJoinDeskResponse{
+			Code:  -1,
+			Error: "房间已解散",
+		})
+	}
 
-	return d.onPlayerReJoin(s)
+	return nil
 }
 
 // 应用退出后重新进入房间
@@ -260,19 +295,27 @@ func (manager *DeskManager) ReEnter(s *session.Session, msg *protocol.ReEnterDes
 		return nil
 	}
 
-	if p.desk == nil {
-		p.logger.Debugf("玩家没有未完成房间，但是发送了重进请求: 请求房号: %s", msg.DeskNo)
+	d := p.currentDesk()
+	if d == nil {
+		// 未完成的房间在其他节点
+		if node, ok := ownerNode(room.Number(msg.DeskNo)); ok {
+			return s.Push("onDeskRedirect", &protocol.DeskRedirect{DeskNo: msg.DeskNo, Node: node})
+		}
+		logger.Debugf("玩家没有未完成房间，但是发送了重进请求: UID=%d, 请求房号: %s", s.UID(), msg.DeskNo)
 		return nil
 	}
 
-	d := p.desk
-
 	if string(d.roomNo) != msg.DeskNo {
-		p.logger.Debugf("玩家正在试图进入非上次未完成房间: 房号: %s", d.roomNo)
+		logger.Debugf("玩家正在试图进入非上次未完成房间: UID=%d, 房号: %s", s.UID(), d.roomNo)
 		return nil
 	}
 
-	return d.onPlayerReJoin(s)
+	d.post(func() {
+		if err := d.onPlayerReJoin(s); err != nil {
+			d.logger.Errorf("玩家重新进入房间失败: UID=%d, Error=%v", s.UID(), err)
+		}
+	})
+	return nil
 }
 
 func (manager *DeskManager) Pause(s *session.Session, _ []byte) error {
@@ -282,14 +325,16 @@ func (manager *DeskManager) Pause(s *session.Session, _ []byte) error {
 		return err
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	if d == nil {
-		p.logger.Debug("玩家不在房间内")
+		logger.Debugf("玩家不在房间内, UID=%d", uid)
 		return nil
 	}
 
-	p.logger.Debug("玩家切换到后台")
-	d.dissolve.updateOnlineStatus(uid, false)
+	d.post(func() {
+		p.logger.Debug("玩家切换到后台")
+		d.dissolve.updateOnlineStatus(uid, false)
+	})
 
 	return nil
 }
@@ -301,33 +346,37 @@ func (manager *DeskManager) Resume(s *session.Session, _ []byte) error {
 		return err
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	if d == nil {
-		p.logger.Debug("玩家不在房间内")
+		logger.Debugf("玩家不在房间内, UID=%d", uid)
 		return nil
 	}
 
-	// 玩家并未暂停
-	if d.dissolve.isOnline(uid) {
-		return nil
-	}
+	d.post(func() {
+		// 玩家并未暂停
+		if d.dissolve.isOnline(uid) {
+			return
+		}
 
-	p.logger.Debug("玩家切换到前台")
-	d.dissolve.updateOnlineStatus(uid, true)
+		p.logger.Debug("玩家切换到前台")
+		d.dissolve.updateOnlineStatus(uid, true)
 
-	// 人数不够, 未开局, 或没有人申请解散
-	if len(d.players) < d.totalPlayerCount() || !d.dissolve.isDissolving() {
-		return nil
-	}
+		// 人数不够, 未开局, 或没有人申请解散
+		if len(d.players) < d.totalPlayerCount() || !d.dissolve.isDissolving() {
+			return
+		}
 
-	// 有玩家切出游戏, 切回来时发现已经有人申请解散, 则刷新最新的解散状态
-	p.logger.Debug("已经有人申请退出了")
-	dissolveStatus := &protocol.DissolveStatusResponse{
-		DissolveStatus: d.collectDissolveStatus(),
-		RestTime:       d.dissolve.restTime,
-	}
+		// 有玩家切出游戏, 切回来时发现已经有人申请解散, 则刷新最新的解散状态
+		p.logger.Debug("已经有人申请退出了")
+		dissolveStatus := &protocol.DissolveStatusResponse{
+			DissolveStatus: d.collectDissolveStatus(),
+			RestTime:       d.dissolve.restTime,
+		}
 
-	return d.group.Broadcast("onDissolveStatus", dissolveStatus)
+		d.broadcast("onDissolveStatus", dissolveStatus)
+	})
+
+	return nil
 }
 
 // 理牌结束
@@ -337,13 +386,18 @@ func (manager *DeskManager) QiPaiFinished(s *session.Session, msg []byte) error
 		return err
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	if d == nil {
-		p.logger.Debug("玩家不在房间内")
+		logger.Debugf("玩家不在房间内, UID=%d", s.UID())
 		return nil
 	}
 
-	return d.qiPaiFinished(s.UID())
+	d.post(func() {
+		if err := d.qiPaiFinished(s.UID()); err != nil {
+			p.logger.Debugf("玩家理牌结束失败, Error=%v", err)
+		}
+	})
+	return nil
 }
 
 // 定缺
@@ -358,17 +412,43 @@ func (manager *DeskManager) DingQue(s *session.Session, msg *protocol.DingQue) e
 		return fmt.Errorf("玩家定缺麻将不能为0，实际=%d", que)
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	if d == nil {
-		p.logger.Debug("玩家不在房间内")
+		logger.Debugf("玩家不在房间内, UID=%d", s.UID())
 		return nil
 	}
 
-	if d.opts.Mode != ModeFours {
+	if !d.rules.RequireQue(d.opts) {
 		return ErrModeCannotQue
 	}
 
-	d.dingQue(p, que)
+	d.post(func() { d.dingQue(p, que) })
+	return nil
+}
+
+// HuanSanZhang 换三张, 选择三张同花色的手牌
+func (manager *DeskManager) HuanSanZhang(s *session.Session, msg *protocol.HuanSanZhangRequest) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	if len(msg.Tiles) != 3 {
+		return ErrIllegalHuanSanZhang
+	}
+
+	d := p.currentDesk()
+	if d == nil {
+		logger.Debugf("玩家不在房间内, UID=%d", s.UID())
+		return nil
+	}
+
+	tiles := msg.Tiles
+	d.post(func() {
+		if err := d.huanSanZhang.choose(p, tiles); err != nil {
+			p.logger.Debugf("玩家换三张失败, Error=%v", err)
+		}
+	})
 	return nil
 }
 
@@ -380,52 +460,63 @@ func (manager *DeskManager) Exit(s *session.Session, msg *protocol.ExitRequest)
 	if err != nil {
 		return err
 	}
-	p.logger.Debugf("DeskManager.Exit: %+v", msg)
-	d := p.desk
+	logger.Debugf("DeskManager.Exit: UID=%d, %+v", uid, msg)
+	d := p.currentDesk()
 	if d == nil || d.isDestroy() {
-		p.logger.Debug("玩家不在房间内")
+		logger.Debugf("玩家不在房间内, UID=%d", uid)
 		return s.Push("onDissolveSuccess", protocol.EmptyMessage)
 	}
 
-	if d.status() != constant.DeskStatusCreate {
-		p.logger.Debug("房间已经开始，中途不能退出")
-		return nil
-	}
+	ok := d.post(func() {
+		// 金币场在两局之间可以退出
+		if st := d.status(); st != constant.DeskStatusCreate && !(d.classic != nil && st == constant.DeskStatusCleaned) {
+			p.logger.Debug("房间已经开始，中途不能退出")
+			return
+		}
+		if d.tournament != nil {
+			p.logger.Debug("比赛牌桌不能退出")
+			return
+		}
 
-	deskPos := -1
-	for i, p := range d.players {
-		if p.Uid() == uid {
-			deskPos = i
-			if !d.prepare.isReady(uid) {
-				// fixed: 玩家在未准备的状态退出游戏, 不应该直接返回
-				msg := &protocol.ExitResponse{
-					AccountId: uid,
-					IsExit:    true,
-					ExitType:  protocol.ExitTypeExitDeskUI,
-					DeskPos:   deskPos,
-				}
-				if err := s.Push("onDissolve", msg); err != nil {
-					return err
+		deskPos := -1
+		for i, p := range d.players {
+			if p.Uid() == uid {
+				deskPos = i
+				if !d.prepare.isReady(uid) {
+					// fixed: 玩家在未准备的状态退出游戏, 不应该直接返回
+					msg := &protocol.ExitResponse{
+						AccountId: uid,
+						IsExit:    true,
+						ExitType:  protocol.ExitTypeExitDeskUI,
+						DeskPos:   deskPos,
+					}
+					if err := s.Push("onDissolve", msg); err != nil {
+						p.logger.Error(err)
+						return
+					}
 				}
+				break
 			}
-			break
 		}
-	}
 
-	res := &protocol.ExitResponse{
-		AccountId: uid,
-		IsExit:    true,
-		ExitType:  protocol.ExitTypeExitDeskUI,
-		DeskPos:   deskPos,
-	}
-	route := "onPlayerExit"
-	if msg.IsDestroy {
-		route = "onDissolve"
-	}
-	d.group.Broadcast(route, res)
+		res := &protocol.ExitResponse{
+			AccountId: uid,
+			IsExit:    true,
+			ExitType:  protocol.ExitTypeExitDeskUI,
+			DeskPos:   deskPos,
+		}
+		route := "onPlayerExit"
+		if msg.IsDestroy {
+			route = "onDissolve"
+		}
+		d.broadcast(route, res)
 
-	p.logger.Info("DeskManager.Exit: 退出房间")
-	d.onPlayerExit(s, false)
+		p.logger.Info("DeskManager.Exit: 退出房间")
+		d.onPlayerExit(s, false)
+	})
+	if !ok {
+		return s.Push("onDissolveSuccess", protocol.EmptyMessage)
+	}
 
 	return nil
 }
@@ -436,11 +527,16 @@ func (manager *DeskManager) OpChoose(s *session.Session, msg *protocol.OpChooseR
 		return err
 	}
 
-	p.logger.Debugf("玩家选择: MSG=%+v", msg)
-	p.chOperation <- &protocol.OpChoosed{
-		Type:   msg.OpType,
-		TileID: msg.Index,
+	d := p.currentDesk()
+	if d == nil {
+		logger.Debugf("玩家不在房间内, UID=%d", s.UID())
+		return nil
 	}
+
+	d.post(func() {
+		p.logger.Debugf("玩家选择: MSG=%+v", msg)
+		p.choose(s, &protocol.OpChoosed{Type: msg.OpType, TileID: msg.Index})
+	})
 	return nil
 }
 
@@ -450,13 +546,20 @@ func (manager *DeskManager) Ready(s *session.Session, _ []byte) error {
 		return err
 	}
 
-	d := p.desk
-	d.prepare.ready(s.UID())
-	d.syncDeskStatus()
+	d := p.currentDesk()
+	if d == nil {
+		logger.Debugf("玩家不在房间内, UID=%d", s.UID())
+		return nil
+	}
+
+	d.post(func() {
+		d.prepare.ready(s.UID())
+		d.syncDeskStatus()
 
-	// 必须在广播消息以后调用checkStart
-	d.checkStart()
-	return err
+		// 必须在广播消息以后调用checkStart
+		d.checkStart()
+	})
+	return nil
 }
 
 func (manager *DeskManager) ClientInitCompleted(s *session.Session, msg *protocol.ClientInitCompletedRequest) error {
@@ -467,25 +570,35 @@ func (manager *DeskManager) ClientInitCompleted(s *session.Session, msg *protoco
 		return err
 	}
 
-	d := p.desk
-	// 客户端准备完成后加入消息广播队列
-	for _, p := range d.players {
-		if p.Uid() == uid {
-			if p.session != s {
-				p.logger.Error("DeskManager.ClientInitCompleted: Session不一致")
+	d := p.currentDesk()
+	if d == nil {
+		logger.Debugf("玩家不在房间内, UID=%d", uid)
+		return nil
+	}
+
+	d.post(func() {
+		// 客户端准备完成后加入消息广播队列
+		for _, p := range d.players {
+			if p.Uid() == uid {
+				ps := p.currentSession()
+				if ps != s {
+					p.logger.Error("DeskManager.ClientInitCompleted: Session不一致")
+				}
+				p.logger.Info("eskManager.ClientInitCompleted: 玩家加入房间广播列表")
+				if ps != nil {
+					d.group.Add(ps)
+				}
+				break
 			}
-			p.logger.Info("eskManager.ClientInitCompleted: 玩家加入房间广播列表")
-			d.group.Add(p.session)
-			break
 		}
-	}
 
-	// 如果不是重新进入游戏, 则同步状态到房间所有玩家
-	if !msg.IsReEnter {
-		d.syncDeskStatus()
-	}
+		// 如果不是重新进入游戏, 则同步状态到房间所有玩家
+		if !msg.IsReEnter {
+			d.syncDeskStatus()
+		}
+	})
 
-	return err
+	return nil
 }
 
 //创建一张桌子
@@ -495,12 +608,15 @@ func (manager *DeskManager) CreateDesk(s *session.Session, data *protocol.Create
 		return err
 	}
 
-	if p.desk != nil {
+	if p.currentDesk() != nil {
 		return s.Response(reentryDesk)
 	}
 	if forceUpdate && data.Version != version {
 		return s.Response(createVersionExpire)
 	}
+	if isDraining() {
+		return s.Response(createMaintenance)
+	}
 
 	logger.Infof("牌桌选项: %#v", data.DeskOpts)
 
@@ -519,7 +635,7 @@ func (manager *DeskManager) CreateDesk(s *session.Session, data *protocol.Create
 	// 非俱乐部模式房卡数判定
 	if data.ClubId < 0 {
 		count := requireCardCount(data.DeskOpts.MaxRound)
-		if p.coin < int64(count) {
+		if p.coinCount() < int64(count) {
 			return s.Response(deskCardNotEnough)
 		}
 
@@ -533,28 +649,25 @@ func (manager *DeskManager) CreateDesk(s *session.Session, data *protocol.Create
 	d := NewDesk(no, data.DeskOpts, data.ClubId)
 	d.createdAt = time.Now().Unix()
 	d.creator = s.UID()
-	//房间创建者自动join
-	if err := d.playerJoin(s, false); err != nil {
-		return nil
-	}
 
 	// save desk information
 	manager.desks[no] = d
+	logger.Infof("当前已有牌桌数: %d", len(manager.desks))
+
+	// 入座之前退出观战
+	leaveObserving(p, s)
+
+	//房间创建者自动join
+	mid := s.LastMid()
+	d.post(func() {
+		if err := d.playerJoin(s, false); err != nil {
+			d.logger.Errorf("房间创建者加入房间失败，UID=%d, Error=%s", s.UID(), err.Error())
+			return
+		}
 
-	resp := &protocol.CreateDeskResponse{
-		TableInfo: protocol.TableInfo{
-			DeskNo:    string(no),
-			CreatedAt: d.createdAt,
-			Creator:   s.UID(),
-			Title:     d.title(),
-			Desc:      d.desc(true),
-			Status:    d.status(),
-			Round:     d.round,
-			Mode:      d.opts.Mode,
-		},
-	}
-	d.logger.Infof("当前已有牌桌数: %d", len(manager.desks))
-	return s.Response(resp)
+		s.ResponseMID(mid, &protocol.CreateDeskResponse{TableInfo: d.tableInfo()})
+	})
+	return nil
 }
 
 //新join在session的context中尚未有desk的cache
@@ -562,15 +675,26 @@ func (manager *DeskManager) Join(s *session.Session, data *protocol.JoinDeskRequ
 	if forceUpdate && data.Version != version {
 		return s.Response(joinVersionExpire)
 	}
-
 	dn := room.Number(data.DeskNo)
+	if node, ok := ownerNode(dn); ok {
+		return s.Response(joinRedirect(node))
+	}
+	if isDraining() {
+		return s.Response(joinMaintenance)
+	}
+
 	d, ok := manager.desk(dn)
 	if !ok {
 		return s.Response(deskNotFoundResponse)
 	}
-
-	if len(d.players) >= d.totalPlayerCount() {
-		return s.Response(deskPlayerNumEnough)
+	if d.classic != nil {
+		return s.Response(&protocol.JoinDeskResponse{Code: errorCode, Error: classicJoinByNumberMessage})
+	}
+	if d.tournament != nil {
+		return s.Response(&protocol.JoinDeskResponse{Code: errorCode, Error: fmt.Sprintf(tournamentDeskMessage, "通过房间号加入")})
+	}
+	if d.match != nil {
+		return s.Response(&protocol.JoinDeskResponse{Code: errorCode, Error: fmt.Sprintf(matchDeskMessage, "通过房间号加入")})
 	}
 
 	// 如果是俱乐部房间，则判断玩家是否是俱乐部玩家
@@ -584,22 +708,158 @@ func (manager *DeskManager) Join(s *session.Session, data *protocol.JoinDeskRequ
 		}
 	}
 
-	if err := d.playerJoin(s, false); err != nil {
-		d.logger.Errorf("玩家加入房间失败，UID=%d, Error=%s", s.UID(), err.Error())
+	// 入座之前退出观战
+	if p, err := playerWithSession(s); err == nil {
+		leaveObserving(p, s)
+	}
+
+	mid := s.LastMid()
+	ok = d.post(func() {
+		if len(d.players) >= d.totalPlayerCount() {
+			s.ResponseMID(mid, deskPlayerNumEnough)
+			return
+		}
+
+		if err := d.playerJoin(s, false); err != nil {
+			d.logger.Errorf("玩家加入房间失败，UID=%d, Error=%s", s.UID(), err.Error())
+		}
+
+		s.ResponseMID(mid, &protocol.JoinDeskResponse{TableInfo: d.tableInfo()})
+	})
+	if !ok {
+		return s.Response(deskNotFoundResponse)
+	}
+
+	return nil
+}
+
+// 俱乐部部长或管理员向牌桌添加机器人
+func (manager *DeskManager) AddRobot(s *session.Session, req *protocol.AddRobotRequest) error {
+	uid := s.UID()
+	d, ok := manager.desk(room.Number(req.DeskNo))
+	if !ok || d.isDestroy() {
+		return s.Response(deskNotFoundResponse)
+	}
+
+	if !db.IsAdmin(uid) && !(d.clubId > 0 && db.IsClubOwner(d.clubId, uid)) {
+		return s.Response(&protocol.ErrorResponse{
+			Code:  errutil.Code(errutil.ErrPermissionDenied),
+			Error: "只有俱乐部部长或管理员才能添加机器人",
+		})
+	}
+
+	// 金币场的座位由金币场统一分配
+	if d.classic != nil {
+		return s.Response(&protocol.ErrorResponse{Code: errorCode, Error: "金币场不能添加机器人"})
+	}
+	if d.tournament != nil {
+		return s.Response(&protocol.ErrorResponse{Code: errorCode, Error: fmt.Sprintf(tournamentDeskMessage, "添加机器人")})
+	}
+	if d.match != nil {
+		return s.Response(&protocol.ErrorResponse{Code: errorCode, Error: fmt.Sprintf(matchDeskMessage, "添加机器人")})
+	}
+
+	mid := s.LastMid()
+	ok = d.post(func() {
+		if err := d.robotJoin(req.Count); err != nil {
+			d.logger.Errorf("添加机器人失败, UID=%d, Error=%v", uid, err)
+			s.ResponseMID(mid, &protocol.ErrorResponse{
+				Code:  errutil.Code(err),
+				Error: err.Error(),
+			})
+			return
+		}
+
+		d.syncDeskStatus()
+
+		// 必须在广播消息以后调用checkStart
+		d.checkStart()
+		s.ResponseMID(mid, &protocol.SuccessResponse)
+	})
+	if !ok {
+		return s.Response(deskNotFoundResponse)
+	}
+
+	return nil
+}
+
+// Observe 观战, 观战者不占用座位, 俱乐部房间只有俱乐部成员可以观战
+func (manager *DeskManager) Observe(s *session.Session, req *protocol.ObserveDeskRequest) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	if p.currentDesk() != nil {
+		return s.Response(&protocol.ObserveDeskResponse{Code: errorCode, Error: "你当前正在房间中"})
+	}
+
+	dn := room.Number(req.DeskNo)
+	if node, ok := ownerNode(dn); ok {
+		return s.Response(&protocol.ObserveDeskResponse{Code: errutil.YXDeskRedirect, Error: deskRedirectMessage, Node: node})
 	}
 
-	return s.Response(&protocol.JoinDeskResponse{
-		TableInfo: protocol.TableInfo{
-			DeskNo:    d.roomNo.String(),
-			CreatedAt: d.createdAt,
-			Creator:   d.creator,
-			Title:     d.title(),
-			Desc:      d.desc(true),
-			Status:    d.status(),
-			Round:     d.round,
-			Mode:      d.opts.Mode,
-		},
+	d, ok := manager.desk(dn)
+	if !ok || d.isDestroy() {
+		return s.Response(&protocol.ObserveDeskResponse{Code: errutil.YXDeskNotFound, Error: deskNotFoundMessage})
+	}
+
+	if d.clubId > 0 && !db.IsClubMember(d.clubId, s.UID()) {
+		return s.Response(&protocol.ObserveDeskResponse{
+			Code:  errorCode,
+			Error: fmt.Sprintf("当前房间是俱乐部[%d]专属房间，俱乐部成员才可观战", d.clubId),
+		})
+	}
+
+	// 同时只能观看一张牌桌
+	if w := p.watchingDesk(); w != nil && w != d {
+		leaveObserving(p, s)
+	}
+
+	mid := s.LastMid()
+	ok = d.post(func() {
+		if err := d.observers.join(p, s); err != nil {
+			d.logger.Infof("玩家观战失败, UID=%d, Error=%v", s.UID(), err)
+			s.ResponseMID(mid, &protocol.ObserveDeskResponse{Code: errutil.Code(err), Error: err.Error()})
+			return
+		}
+
+		d.logger.Infof("玩家开始观战, UID=%d, 观战人数=%d", s.UID(), d.observers.count())
+		s.ResponseMID(mid, &protocol.ObserveDeskResponse{
+			TableInfo: d.tableInfo(),
+			Delay:     int(d.observers.delay / time.Second),
+			Observers: d.observers.count(),
+		})
+
+		// 房间信息立即推送, 玩家列表和牌局数据与之后的事件一起延迟推送
+		s.Push("onDeskBasicInfo", &protocol.DeskBasicInfo{
+			DeskID: d.roomNo.String(),
+			Title:  d.title(),
+			Desc:   d.desc(true),
+		})
+		if d.latestEnter != nil {
+			d.observers.push(s, "onPlayerEnter", d.latestEnter)
+		}
+		if d.inRound() {
+			d.observers.push(s, "onSyncDesk", d.syncDeskView(0))
+		}
 	})
+	if !ok {
+		return s.Response(&protocol.ObserveDeskResponse{Code: errutil.YXDeskNotFound, Error: deskNotFoundMessage})
+	}
+
+	return nil
+}
+
+// LeaveObserve 退出观战
+func (manager *DeskManager) LeaveObserve(s *session.Session, _ []byte) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	leaveObserving(p, s)
+	return s.Response(&protocol.SuccessResponse)
 }
 
 // 有玩家请求解散房间
@@ -609,13 +869,25 @@ func (manager *DeskManager) Dissolve(s *session.Session, msg []byte) error {
 		return err
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	if d == nil || d.isDestroy() {
 		logger.Infof("玩家: %d申请解散，但是房间为空或者已解散", s.UID())
 		return s.Push("onDissolveSuccess", protocol.EmptyMessage)
 	}
 
-	d.applyDissolve(s.UID())
+	// 金币场每局单独结算, 不能解散, 两局之间可以直接退出
+	if d.classic != nil {
+		p.logger.Info("金币场不能申请解散")
+		return nil
+	}
+	if d.tournament != nil {
+		p.logger.Info("比赛牌桌不能申请解散")
+		return nil
+	}
+
+	if !d.post(func() { d.applyDissolve(s.UID()) }) {
+		return s.Push("onDissolveSuccess", protocol.EmptyMessage)
+	}
 
 	return nil
 }
@@ -628,26 +900,29 @@ func (manager *DeskManager) DissolveStatus(s *session.Session, data *protocol.Di
 		return err
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	if d == nil || d.isDestroy() {
-		p.logger.Infof("申请解散，但是房间为空或者已解散")
+		logger.Infof("玩家: %d申请解散，但是房间为空或者已解散", s.UID())
 		return s.Push("onDissolveSuccess", protocol.EmptyMessage)
 	}
 
-	// 有玩家拒绝，则清空解散统计数据
-	if !data.Result {
-		deskPos := -1
-		for i, p := range d.players {
-			if p.Uid() == s.UID() {
-				deskPos = i + 1
-				break
+	ok := d.post(func() {
+		// 有玩家拒绝，则清空解散统计数据
+		if !data.Result {
+			deskPos := -1
+			for i, p := range d.players {
+				if p.Uid() == s.UID() {
+					deskPos = i + 1
+					break
+				}
 			}
+
+			d.dissolve.reset()
+			d.dissolve.stop()
+			d.broadcast("onDissolveFailure", &protocol.DissolveResult{DeskPos: deskPos})
+			return
 		}
 
-		d.dissolve.reset()
-		d.dissolve.stop()
-		return d.group.Broadcast("onDissolveFailure", &protocol.DissolveResult{DeskPos: deskPos})
-	} else {
 		d.dissolve.setUidStatus(s.UID(), true, AgreeRequest)
 		if d.dissolve.restTime > agreeDissolveRestTime {
 			d.dissolve.restTime = agreeDissolveRestTime
@@ -656,19 +931,23 @@ func (manager *DeskManager) DissolveStatus(s *session.Session, data *protocol.Di
 			DissolveStatus: d.collectDissolveStatus(),
 			RestTime:       d.dissolve.restTime,
 		}
-		if err := d.group.Broadcast("onDissolveStatus", status); err != nil {
+		if err := d.broadcast("onDissolveStatus", status); err != nil {
 			logger.Error(err)
 		}
 
 		if d.dissolve.agreeCount() < d.totalPlayerCount() {
-			return nil
+			return
 		}
 
 		d.logger.Debug("所有玩家同意解散, 即将解散")
 
 		d.dissolve.stop()
 		d.doDissolve()
+	})
+	if !ok {
+		return s.Push("onDissolveSuccess", protocol.EmptyMessage)
 	}
+
 	return nil
 }
 
@@ -679,7 +958,7 @@ func (manager *DeskManager) VoiceMessage(s *session.Session, msg []byte) error {
 		return err
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	if d != nil && d.group != nil {
 		return d.group.Broadcast("onVoiceMessage", msg)
 	}
@@ -694,7 +973,7 @@ func (manager *DeskManager) RecordingVoice(s *session.Session, msg *protocol.Rec
 		return err
 	}
 
-	d := p.desk
+	d := p.currentDesk()
 	resp := &protocol.PlayRecordingVoice{
 		Uid:    s.UID(),
 		FileId: msg.FileId,
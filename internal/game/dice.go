@@ -1,6 +1,6 @@
 package game
 
-import "math/rand"
+import "go-mahjong-server/pkg/rng"
 
 type dice struct {
 	dice1 int
@@ -11,6 +11,6 @@ func newDice() *dice {
 	return &dice{}
 }
 
-func (d *dice) random() {
-	d.dice1, d.dice2 = rand.Intn(6)+1, rand.Intn(6)+1
+func (d *dice) random(r *rng.Rand) {
+	d.dice1, d.dice2 = r.Intn(6)+1, r.Intn(6)+1
 }
@@ -17,6 +17,7 @@ type dissolveContext struct {
 	restTime int32            //解散剩余时间
 	timer    *scheduler.Timer //取消解散房间
 	pause    map[int64]bool   //离线状态
+	seq      int              //倒计时序号, 用于丢弃已经取消的倒计时
 }
 
 func newDissolveContext(desk *Desk) *dissolveContext {
@@ -44,29 +45,40 @@ func (d *dissolveContext) stop() {
 func (d *dissolveContext) start(restTime int32) {
 	d.desk.logger.Debug("开始解散倒计时")
 
-	//解散房间倒计时
+	//解散房间倒计时, 定时器在nano逻辑协程中触发, 倒计时投递到牌桌协程中执行
 	d.restTime = restTime
+	d.seq++
+	seq := d.seq
 	d.timer = scheduler.NewTimer(time.Second, func() {
-		if d.desk.status() == constant.DeskStatusDestory {
-			d.desk.logger.Error("解散倒计时过程中已退出")
-			d.stop()
-			return
-		}
-
-		d.restTime--
-		rest := d.restTime
-		// 每30秒记录日志
-		if rest%30 == 0 {
-			d.desk.logger.Debugf("解散倒计时: %d", rest)
-		}
-		if rest < 0 {
-			d.stop()
-			d.desk.doDissolve()
-			return
-		}
+		d.desk.post(func() { d.tick(seq) })
 	})
 }
 
+// 解散倒计时, 在牌桌协程中执行
+func (d *dissolveContext) tick(seq int) {
+	// 倒计时已经被取消
+	if d.timer == nil || d.seq != seq {
+		return
+	}
+
+	if d.desk.status() == constant.DeskStatusDestory {
+		d.desk.logger.Error("解散倒计时过程中已退出")
+		d.stop()
+		return
+	}
+
+	d.restTime--
+	rest := d.restTime
+	// 每30秒记录日志
+	if rest%30 == 0 {
+		d.desk.logger.Debugf("解散倒计时: %d", rest)
+	}
+	if rest < 0 {
+		d.stop()
+		d.desk.doDissolve()
+	}
+}
+
 func (d *dissolveContext) isOnline(uid int64) bool {
 	return !d.pause[uid]
 }
@@ -79,7 +91,7 @@ func (d *dissolveContext) updateOnlineStatus(uid int64, online bool) {
 	}
 
 	d.desk.logger.Debugf("玩家在线状态: %+v", d.pause)
-	d.desk.group.Broadcast("onPlayerOfflineStatus", &protocol.PlayerOfflineStatus{Uid: uid, Offline: !online})
+	d.desk.broadcast("onPlayerOfflineStatus", &protocol.PlayerOfflineStatus{Uid: uid, Offline: !online})
 }
 
 func (d *dissolveContext) setUidStatus(uid int64, agree bool, desc string) {
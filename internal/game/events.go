@@ -0,0 +1,62 @@
+package game
+
+import (
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/protocol"
+)
+
+// 记录本局的事件, 必须在牌桌协程中调用, 没有开局时忽略
+func (d *Desk) emit(actor int64, typ string, payload interface{}) {
+	if d.snapshot == nil {
+		return
+	}
+	if err := d.snapshot.Emit(actor, typ, payload); err != nil {
+		d.logger.Errorf("记录牌局事件失败: Type=%s Error=%v", typ, err)
+	}
+}
+
+// 开局和发牌
+func (d *Desk) emitRoundStart(duan *protocol.DuanPai) {
+	start := &history.RoundStart{
+		Round:   d.round,
+		Seed:    d.rand.Seed(),
+		Banker:  duan.MarkerID,
+		Options: d.opts,
+	}
+	for i, p := range d.players {
+		start.Players = append(start.Players, history.EventPlayer{Uid: p.Uid(), Name: p.name, Turn: i})
+	}
+	d.emit(0, history.EventRoundStart, start)
+	d.emit(0, history.EventDeal, duan)
+}
+
+// 每个玩家刮风下雨的分数
+func (d *Desk) gangScores() map[int64]int {
+	scores := map[int64]int{}
+	for uid, changes := range d.scoreChanges {
+		for _, c := range changes {
+			if c.typ == ScoreChangeTypeBaGang || c.typ == ScoreChangeTypeAnGang {
+				scores[uid] += c.score
+			}
+		}
+	}
+	return scores
+}
+
+// 转雨和查叫会直接修改之前的刮风下雨流水, 记录执行前后每个玩家刮风下雨分数的变化,
+// 查叫中的赔叫通过scoreChangeForHu单独记录
+func (d *Desk) adjustGangScore(reason string, fn func()) {
+	before := d.gangScores()
+	fn()
+	after := d.gangScores()
+
+	adjust := &history.Adjust{Reason: reason}
+	for _, p := range d.players {
+		if delta := after[p.Uid()] - before[p.Uid()]; delta != 0 {
+			adjust.Changes = append(adjust.Changes, protocol.ScoreInfo{Uid: p.Uid(), Score: delta})
+		}
+	}
+	if len(adjust.Changes) > 0 {
+		d.emit(0, history.EventAdjust, adjust)
+	}
+}
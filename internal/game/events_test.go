@@ -0,0 +1,108 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+)
+
+// 随机选择提示中的操作, 出牌使用机器人策略
+func randomDecider(r *rng.Rand) Decider {
+	return func(seat Seat, ops []protocol.Op) *protocol.OpChoosed {
+		op := ops[r.Intn(len(ops))]
+		if op.Type == protocol.OptypeChu {
+			return nil
+		}
+		choosed := &protocol.OpChoosed{Type: op.Type, TileID: illegalTile}
+		if len(op.TileIDs) > 0 {
+			choosed.TileID = op.TileIDs[0]
+		}
+		return choosed
+	}
+}
+
+// 按座位记录的操作, 机器人的UID每次模拟都不同
+func eventsByTurn(t *testing.T, result *SimResult) (do []string, chooses map[int][]*protocol.OpChoosed) {
+	chooses = map[int][]*protocol.OpChoosed{}
+	for _, round := range result.Rounds {
+		turns := map[int64]int{}
+		for _, e := range round.History.Events().Events {
+			switch e.Type {
+			case history.EventRoundStart:
+				start := &history.RoundStart{}
+				if err := json.Unmarshal(e.Data, start); err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range start.Players {
+					turns[p.Uid] = p.Turn
+				}
+			case history.EventChoose:
+				c := &history.Choose{}
+				if err := json.Unmarshal(e.Data, c); err != nil {
+					t.Fatal(err)
+				}
+				chooses[turns[e.Actor]] = append(chooses[turns[e.Actor]], c.Op)
+			case history.EventDo:
+				op := &protocol.OpTypeDo{}
+				if err := json.Unmarshal(e.Data, op); err != nil {
+					t.Fatal(err)
+				}
+				do = append(do, fmt.Sprintf("%d:%d:%v", turns[e.Actor], op.OpType, op.TileIDs))
+			}
+		}
+	}
+	return do, chooses
+}
+
+// 使用相同的种子和事件日志中记录的选择可以完全重现牌局
+func TestEventsReproducible(t *testing.T) {
+	opts := &protocol.DeskOptions{Mode: ModeFours, MaxRound: 4, MaxFan: 3, Pinghu: true, HuanSanZhang: true}
+	cfg := &SimConfig{Options: opts, Seed: "events"}
+	for i := 0; i < 4; i++ {
+		cfg.Deciders = append(cfg.Deciders, randomDecider(rng.NewWithSeed(fmt.Sprintf("events-%d", i))))
+	}
+
+	origin, err := Simulate(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do, chooses := eventsByTurn(t, origin)
+	if len(origin.Rounds) != 4 || len(do) == 0 {
+		t.Fatalf("rounds=%d do=%d", len(origin.Rounds), len(do))
+	}
+
+	cfg.Deciders = nil
+	for i := 0; i < 4; i++ {
+		queue := chooses[i]
+		cfg.Deciders = append(cfg.Deciders, func(seat Seat, ops []protocol.Op) *protocol.OpChoosed {
+			if len(queue) == 0 {
+				t.Errorf("turn=%d no more choices", seat.Turn)
+				return nil
+			}
+			op := queue[0]
+			queue = queue[1:]
+			return op
+		})
+	}
+
+	replayed, err := Simulate(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redo, _ := eventsByTurn(t, replayed)
+	if fmt.Sprint(do) != fmt.Sprint(redo) {
+		t.Fatalf("replayed actions differ:\n%v\n%v", do, redo)
+	}
+	for i := range origin.Rounds {
+		a, b := origin.Rounds[i].History.End.ScoreChange, replayed.Rounds[i].History.End.ScoreChange
+		for j := range a {
+			if a[j].Score != b[j].Score {
+				t.Fatalf("round %d turn %d: score %d, replayed %d", i+1, j, a[j].Score, b[j].Score)
+			}
+		}
+	}
+}
@@ -2,11 +2,13 @@ package game
 
 import (
 	"fmt"
-	"math/rand"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"go-mahjong-server/pkg/cluster"
+
 	"github.com/lonng/nano"
 	"github.com/lonng/nano/component"
 	"github.com/lonng/nano/pipeline"
@@ -20,6 +22,8 @@ var (
 	consume     = map[int]int{} // 房卡消耗配置
 	forceUpdate = false
 	logger      = log.WithField("component", "game")
+
+	operationTimeout time.Duration // 玩家操作超时时间, 超时后进入托管, 0表示不限制
 )
 
 // SetCardConsume 设置房卡消耗数量
@@ -45,9 +49,8 @@ func SetCardConsume(cfg string) {
 	logger.Infof("当前游戏房卡消耗配置: %+v", consume)
 }
 
-// Startup 初始化游戏服务器
+// Startup 初始化游戏服务器, 阻塞直到服务器停服
 func Startup() {
-	rand.Seed(time.Now().Unix())
 	version = viper.GetString("update.version")
 
 	heartbeat := viper.GetInt("core.heartbeat")
@@ -55,19 +58,80 @@ func Startup() {
 		heartbeat = 5
 	}
 
+	// 操作超时配置
+	if timeout := viper.GetInt("core.operation_timeout"); timeout > 0 {
+		operationTimeout = time.Duration(timeout) * time.Second
+	}
+
+	// 停服时等待牌局结束的最长时间
+	if timeout := viper.GetInt("core.shutdown_timeout"); timeout > 0 {
+		drainTimeout = time.Duration(timeout) * time.Second
+	}
+
 	// 房卡消耗配置
 	csm := viper.GetString("core.consume")
 	SetCardConsume(csm)
 	forceUpdate = viper.GetBool("update.force")
 
-	logger.Infof("当前游戏服务器版本: %s, 是否强制更新: %t, 当前心跳时间间隔: %d秒", version, forceUpdate, heartbeat)
+	// 牌桌检查点, 服务器重启后恢复未完成的牌桌
+	if dir := viper.GetString("checkpoint.dir"); dir != "" {
+		// 同一台机器上的多个节点使用不同的目录
+		if n := cluster.Self(); n != nil {
+			dir = filepath.Join(dir, strconv.Itoa(n.ID))
+		}
+		st, err := newFileCheckpointStore(dir)
+		if err != nil {
+			logger.Errorf("牌桌检查点目录不可用: %s, Error=%v", dir, err)
+		} else {
+			checkpoints = st
+		}
+	}
+	if interval := viper.GetInt("checkpoint.interval"); interval > 0 {
+		checkpointInterval = time.Duration(interval) * time.Second
+	}
+
+	// 观战延迟和每张牌桌的观战人数上限
+	if viper.Get("observer.delay") != nil {
+		observerDelay = time.Duration(viper.GetInt("observer.delay")) * time.Second
+	}
+	if limit := viper.GetInt("observer.limit"); limit > 0 {
+		observerLimit = limit
+	}
+
+	// 邮件默认有效期
+	if days := viper.GetInt("mail.expire_days"); days > 0 {
+		mailExpire = time.Duration(days) * 24 * time.Hour
+	}
+
+	// 快速匹配
+	loadMatchConfig()
+
+	// 金币场
+	loadClassicConfig()
+
+	// 每日比赛
+	loadTournamentConfig()
+
+	// 集群内部接口
+	if cluster.Enabled() {
+		registerClusterHandlers()
+	}
+
+	logger.Infof("当前游戏服务器版本: %s, 是否强制更新: %t, 当前心跳时间间隔: %d秒, 操作超时时间: %s",
+		version, forceUpdate, heartbeat, operationTimeout)
 	logger.Info("game service starup")
 
 	// register game handler
 	comps := &component.Components{}
 	comps.Register(defaultManager)
 	comps.Register(defaultDeskManager)
+	comps.Register(defaultMatchManager)
+	comps.Register(defaultClassicManager)
+	comps.Register(defaultTournamentManager)
+	comps.Register(defaultRankManager)
+	comps.Register(defaultMailManager)
 	comps.Register(new(ClubManager))
+	comps.Register(new(HistoryManager))
 
 	// 加密管道
 	c := newCrypto()
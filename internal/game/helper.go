@@ -11,6 +11,7 @@ import (
 )
 
 const (
+	ModeDuo   = 2 // 二人模式
 	ModeTrios = 3 // 三人模式
 	ModeFours = 4 // 四人模式
 )
@@ -20,7 +21,8 @@ func verifyOptions(opts *protocol.DeskOptions) bool {
 		return false
 	}
 
-	if opts.Mode != ModeTrios && opts.Mode != 4 {
+	r, ok := rulesetFor(opts)
+	if !ok || !r.Verify(opts) {
 		return false
 	}
 
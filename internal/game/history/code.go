@@ -0,0 +1,63 @@
+package history
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"go-mahjong-server/pkg/errutil"
+)
+
+// 回放码: 11位随机数字加1位校验位, 保存历史记录时生成并保存在数据库中,
+// 不能从历史记录ID推算出来. 校验位可以发现输错一位和大部分相邻两位颠倒, 输错时不需要查询数据库
+const (
+	codeDigits = 11
+	codeLength = codeDigits + 1
+)
+
+var codeModulus = new(big.Int).Exp(big.NewInt(10), big.NewInt(codeDigits), nil)
+
+// NewCode 生成随机的回放码
+func NewCode() (string, error) {
+	v, err := rand.Int(rand.Reader, codeModulus)
+	if err != nil {
+		return "", err
+	}
+	digits := strconv.FormatInt(v.Int64()+codeModulus.Int64(), 10)[1:]
+	return digits + strconv.Itoa(luhn(digits)), nil
+}
+
+// CheckCode 检查回放码的格式和校验位
+func CheckCode(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != codeLength {
+		return "", errutil.ErrIllegalReplayCode
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < '0' || code[i] > '9' {
+			return "", errutil.ErrIllegalReplayCode
+		}
+	}
+	if strconv.Itoa(luhn(code[:codeDigits])) != code[codeDigits:] {
+		return "", errutil.ErrIllegalReplayCode
+	}
+	return code, nil
+}
+
+// Luhn校验位
+func luhn(digits string) int {
+	sum := 0
+	double := true
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
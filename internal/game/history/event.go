@@ -0,0 +1,165 @@
+package history
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"go-mahjong-server/db"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+)
+
+// 事件格式的版本, 事件类型或者数据发生不兼容的修改时递增
+const EventVersion = 1
+
+// 事件类型
+const (
+	EventRoundStart        = "roundStart"        // 开局, RoundStart
+	EventDeal              = "deal"              // 发牌, protocol.DuanPai
+	EventHuanSanZhangChose = "huanSanZhangChose" // 玩家选择换出的牌, protocol.HuanSanZhangRequest
+	EventHuanSanZhang      = "huanSanZhang"      // 换三张结果, protocol.HuanSanZhangResult
+	EventDingQue           = "dingQue"           // 玩家定缺, protocol.DingQue
+	EventHint              = "hint"              // 提示玩家可选的操作, protocol.Hint
+	EventChoose            = "choose"            // 玩家对提示的选择, 包括过, Choose
+	EventIllegal           = "illegal"           // 不合法的选择, Illegal
+	EventDo                = "do"                // 摸牌, 出牌, 碰杠吃胡, protocol.OpTypeDo
+	EventScore             = "score"             // 杠牌或者胡牌的分数, Score
+	EventAdjust            = "adjust"            // 转雨, 查叫对刮风下雨分数的修改, Adjust
+	EventTrusteeship       = "trusteeship"       // 进入或者取消托管, Trusteeship
+	EventRoundEnd          = "roundEnd"          // 本局结束, RoundEnd
+)
+
+// 选择的来源
+const (
+	SourcePlayer      = "player"      // 玩家提交
+	SourceRobot       = "robot"       // 机器人
+	SourceTrusteeship = "trusteeship" // 超时后托管自动操作
+)
+
+// 分数修改的原因
+const (
+	AdjustZhuanYu = "zhuanYu" // 杠上炮, 杠牌的分数转给胡牌的玩家
+	AdjustChaJiao = "chaJiao" // 查叫, 无叫玩家的刮风下雨分数清零
+)
+
+type EventPlayer struct {
+	Uid  int64  `json:"acId"`
+	Name string `json:"name"`
+	Turn int    `json:"turn"`
+}
+
+type RoundStart struct {
+	Round   uint32                `json:"round"`
+	Seed    string                `json:"seed"`
+	Banker  int64                 `json:"banker"`
+	Options *protocol.DeskOptions `json:"options"`
+	Players []EventPlayer         `json:"players"`
+}
+
+type Choose struct {
+	Op     *protocol.OpChoosed `json:"op"`
+	Source string              `json:"source"`
+}
+
+type Illegal struct {
+	Op    *protocol.OpChoosed `json:"op"`
+	Error string              `json:"error"`
+}
+
+// Score 第一项为赢家, 其余为输家
+type Score struct {
+	Type    int                  `json:"type"` //刮风, 下雨, 胡牌
+	HuType  protocol.HuPaiType   `json:"huType,omitempty"`
+	TileID  int                  `json:"tileId"`
+	Changes []protocol.ScoreInfo `json:"changes"`
+}
+
+// Adjust 每个玩家刮风下雨分数的变化
+type Adjust struct {
+	Reason  string               `json:"reason"`
+	Changes []protocol.ScoreInfo `json:"changes"`
+}
+
+type Trusteeship struct {
+	On bool `json:"on"`
+}
+
+type RoundEnd struct {
+	Status int                      `json:"status"`
+	Stats  *protocol.RoundOverStats `json:"stats"`
+}
+
+// Emit 追加一个事件, actor为0表示牌桌
+func (h *History) Emit(actor int64, typ string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	h.events = append(h.events, &protocol.HistoryEvent{
+		Seq:   len(h.events) + 1,
+		At:    time.Now().UnixNano() / int64(time.Millisecond),
+		Actor: actor,
+		Type:  typ,
+		Data:  data,
+	})
+	return nil
+}
+
+// Events 本局到目前为止的事件日志
+func (h *History) Events() *protocol.HistoryEvents {
+	return &protocol.HistoryEvents{Version: EventVersion, Events: h.events}
+}
+
+// EncodeEvents 事件日志压缩后保存, 血流成河的一局可能有上千个事件
+func EncodeEvents(events *protocol.HistoryEvents) ([]byte, error) {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeEvents 解压事件日志, 不支持比当前版本新的事件格式
+func DecodeEvents(data []byte) (*protocol.HistoryEvents, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+	defer r.Close()
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+
+	events := &protocol.HistoryEvents{}
+	if err := json.Unmarshal(raw, events); err != nil || events.Version > EventVersion {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+	return events, nil
+}
+
+// LoadEvents 根据历史记录ID加载事件日志, 旧的历史记录没有事件日志
+func LoadEvents(id int64) (*protocol.HistoryEvents, error) {
+	h, err := db.QueryHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.Events) == 0 {
+		return &protocol.HistoryEvents{Events: []*protocol.HistoryEvent{}}, nil
+	}
+	return DecodeEvents(h.Events)
+}
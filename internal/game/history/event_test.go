@@ -0,0 +1,65 @@
+package history
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+
+	"go-mahjong-server/protocol"
+)
+
+func TestEvents(t *testing.T) {
+	h := New(1, 3, "a", "b", "c", "d", nil, nil, nil)
+	h.Emit(0, EventRoundStart, &RoundStart{Round: 1, Seed: "seed"})
+	h.PushAction(do(2, protocol.OptypeChu, 5))
+	h.Emit(3, EventChoose, &Choose{Op: &protocol.OpChoosed{Type: protocol.OptypePass}, Source: SourceTrusteeship})
+
+	events := h.Events()
+	if events.Version != EventVersion || len(events.Events) != 3 {
+		t.Fatalf("events: %+v", events)
+	}
+	for i, e := range events.Events {
+		if e.Seq != i+1 || e.At == 0 {
+			t.Fatalf("event %d: %+v", i, e)
+		}
+	}
+	if e := events.Events[1]; e.Type != EventDo || e.Actor != 2 {
+		t.Fatalf("do: %+v", e)
+	}
+
+	data, err := EncodeEvents(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeEvents(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Choose{}
+	if err := json.Unmarshal(decoded.Events[2].Data, c); err != nil || c.Source != SourceTrusteeship || c.Op.Type != protocol.OptypePass {
+		t.Fatalf("choose: %+v %v", c, err)
+	}
+
+	// 检查点恢复后继续追加
+	r := Restore(h.Meta(), h.SnapShot, decoded)
+	r.Emit(0, EventRoundEnd, &RoundEnd{})
+	if events := r.Events().Events; len(events) != 4 || events[3].Seq != 4 {
+		t.Fatalf("restored: %d", len(events))
+	}
+}
+
+func TestDecodeEventsIllegal(t *testing.T) {
+	if _, err := DecodeEvents([]byte("{}")); err == nil {
+		t.Fatal("uncompressed data should fail")
+	}
+
+	// 不支持更新的版本
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(`{"version":2,"events":[]}`))
+	w.Close()
+	if _, err := DecodeEvents(buf.Bytes()); err == nil {
+		t.Fatal("newer version should fail")
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"go-mahjong-server/db"
 	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/errutil"
 	"go-mahjong-server/protocol"
 )
 
@@ -16,6 +17,12 @@ type SnapShot struct {
 	DuanPai   *protocol.DuanPai         `json:"duanPai"`
 	End       *protocol.RoundOverStats  `json:"end"`
 
+	// 本局随机数种子, 使用相同的种子可以重新生成庄家, 牌墙, 骰子
+	Seed string `json:"seed"`
+
+	// 换三张, 在DuanPai之后, Do之前
+	HuanSanZhang *protocol.HuanSanZhangResult `json:"huanSanZhang,omitempty"`
+
 	// 如果在此遇到了gang操作就去GangScoreChanges中按序拿数据,
 	// 如果遇到了hu就去HuScoreChanges中拿数据,
 	// 即杠与和数据分开放
@@ -40,6 +47,9 @@ type History struct {
 	scoreChange3 int
 
 	SnapShot
+
+	// 完整的事件日志, 快照只保留回放需要的操作
+	events []*protocol.HistoryEvent
 }
 
 func New(deskID int64, mode int, name0, name1, name2, name3 string, basic *protocol.DeskBasicInfo, enter *protocol.PlayerEnterDesk, duan *protocol.DuanPai) *History {
@@ -59,8 +69,52 @@ func New(deskID int64, mode int, name0, name1, name2, name3 string, basic *proto
 	}
 }
 
+// Meta 回放中保存到数据库的牌桌信息, 牌桌检查点中与SnapShot一起保存
+type Meta struct {
+	Mode        int       `json:"mode"`
+	BeginAt     int64     `json:"beginAt"`
+	DeskID      int64     `json:"deskId"`
+	Names       [4]string `json:"names"`
+	ScoreChange [4]int    `json:"scoreChange"`
+}
+
+func (h *History) Meta() Meta {
+	return Meta{
+		Mode:        h.mode,
+		BeginAt:     h.beginAt,
+		DeskID:      h.deskID,
+		Names:       [4]string{h.playerName0, h.playerName1, h.playerName2, h.playerName3},
+		ScoreChange: [4]int{h.scoreChange0, h.scoreChange1, h.scoreChange2, h.scoreChange3},
+	}
+}
+
+// Restore 使用检查点中的数据恢复未完成的回放
+func Restore(meta Meta, snapshot SnapShot, events *protocol.HistoryEvents) *History {
+	h := &History{
+		mode:         meta.Mode,
+		beginAt:      meta.BeginAt,
+		deskID:       meta.DeskID,
+		playerName0:  meta.Names[0],
+		playerName1:  meta.Names[1],
+		playerName2:  meta.Names[2],
+		playerName3:  meta.Names[3],
+		scoreChange0: meta.ScoreChange[0],
+		scoreChange1: meta.ScoreChange[1],
+		scoreChange2: meta.ScoreChange[2],
+		scoreChange3: meta.ScoreChange[3],
+		SnapShot:     snapshot,
+	}
+	if events != nil {
+		h.events = events.Events
+	}
+	return h
+}
+
 func (h *History) PushAction(op *protocol.OpTypeDo) {
 	h.Do = append(h.Do, op)
+	if len(op.Uid) > 0 {
+		h.Emit(op.Uid[0], EventDo, op)
+	}
 }
 
 func (h *History) PushGangScoreChange(g *protocol.GangPaiScoreChange) error {
@@ -73,6 +127,16 @@ func (h *History) PushHuScoreChange(hsc *protocol.HuInfo) error {
 	return nil
 }
 
+func (h *History) SetSeed(seed string) error {
+	h.Seed = seed
+	return nil
+}
+
+func (h *History) SetHuanSanZhang(r *protocol.HuanSanZhangResult) error {
+	h.HuanSanZhang = r
+	return nil
+}
+
 func (h *History) SetEndStats(ge *protocol.RoundOverStats) error {
 	h.End = ge
 
@@ -97,11 +161,38 @@ func (h *History) SetScoreChangeForTurn(turn uint8, sc int) error {
 }
 
 func (h *History) Save() error {
-	data, err := json.Marshal(&h.SnapShot)
+	t, err := h.Model()
 	if err != nil {
 		return err
 	}
 
+	// 回放码重复时重新生成
+	for i := 0; i < 3; i++ {
+		if _, err := db.QueryHistoryByCode(t.ReplayCode); err == errutil.ErrHistoryNotFound {
+			break
+		}
+		if t.ReplayCode, err = NewCode(); err != nil {
+			return err
+		}
+	}
+	return db.InsertHistory(t)
+}
+
+// Model 保存到数据库的历史记录, 结束时间为当前时间
+func (h *History) Model() (*model.History, error) {
+	data, err := json.Marshal(&h.SnapShot)
+	if err != nil {
+		return nil, err
+	}
+	events, err := EncodeEvents(h.Events())
+	if err != nil {
+		return nil, err
+	}
+	code, err := NewCode()
+	if err != nil {
+		return nil, err
+	}
+
 	t := &model.History{
 		DeskId:       h.deskID,
 		BeginAt:      h.beginAt,
@@ -116,9 +207,11 @@ func (h *History) Save() error {
 		ScoreChange2: h.scoreChange2,
 		ScoreChange3: h.scoreChange3,
 		Snapshot:     string(data),
+		EventVersion: EventVersion,
+		Events:       events,
+		ReplayCode:   code,
 	}
-
-	return db.InsertHistory(t)
+	return t, nil
 }
 
 type Record struct {
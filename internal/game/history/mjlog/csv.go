@@ -0,0 +1,50 @@
+package mjlog
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"go-mahjong-server/db/model"
+)
+
+var csvHeader = []string{
+	"id", "desk_id", "mode", "begin_at", "end_at", "replay_code",
+	"name0", "score0", "name1", "score1", "name2", "score2", "name3", "score3",
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+}
+
+// WriteCSV 每局分数的汇总, 每条历史记录一行
+func WriteCSV(w io.Writer, list []model.History) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for i := range list {
+		h := &list[i]
+		names := []string{h.PlayerName0, h.PlayerName1, h.PlayerName2, h.PlayerName3}
+		scores := []int{h.ScoreChange0, h.ScoreChange1, h.ScoreChange2, h.ScoreChange3}
+		row := []string{
+			strconv.FormatInt(h.Id, 10),
+			strconv.FormatInt(h.DeskId, 10),
+			strconv.Itoa(h.Mode),
+			formatTime(h.BeginAt),
+			formatTime(h.EndAt),
+			h.ReplayCode,
+		}
+		for j := range names {
+			row = append(row, names[j], strconv.Itoa(scores[j]))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
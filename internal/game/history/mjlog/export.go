@@ -0,0 +1,258 @@
+package mjlog
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"go-mahjong-server/db"
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+)
+
+// 导出格式
+const (
+	OutputJSON = "json"
+	OutputCSV  = "csv"
+)
+
+// 最后一张打出的牌和最后一个巴杠, 用于确定碰杠吃胡的目标
+type lastTile struct {
+	seat int
+	id   int
+}
+
+type exporter struct {
+	log   *Log
+	seats map[int64]int
+
+	draws   []int // 每个座位最后摸到的牌, 出牌后清空
+	discard *lastTile
+	kakan   *lastTile
+}
+
+// Query 按历史记录ID或者牌桌ID查询历史记录, 优先使用历史记录ID
+func Query(id, deskID int64) ([]model.History, error) {
+	if id > 0 {
+		h, err := db.QueryHistory(id)
+		if err != nil {
+			return nil, err
+		}
+		return []model.History{*h}, nil
+	}
+	list, _, err := db.QueryHistoriesByDeskID(deskID)
+	return list, err
+}
+
+// Write 导出历史记录, json为每一局牌谱组成的数组, csv为每局分数的汇总
+func Write(w io.Writer, output string, list []model.History) error {
+	switch output {
+	case OutputCSV:
+		return WriteCSV(w, list)
+	case OutputJSON, "":
+		logs := []*Log{}
+		for i := range list {
+			l, err := Export(&list[i])
+			if err != nil {
+				return err
+			}
+			logs = append(logs, l)
+		}
+		return json.NewEncoder(w).Encode(logs)
+	}
+	return errutil.ErrIllegalParameter
+}
+
+// Export 把历史记录转换为牌谱, 通过回放确定每一步的碰杠类型和分数变化
+func Export(h *model.History) (*Log, error) {
+	s := &history.SnapShot{}
+	if err := json.Unmarshal([]byte(h.Snapshot), s); err != nil {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+	steps, err := s.Replay(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{h.PlayerName0, h.PlayerName1, h.PlayerName2, h.PlayerName3}
+	e := &exporter{
+		log: &Log{
+			Format:  Format,
+			Version: Version,
+			ID:      h.Id,
+			DeskID:  h.DeskId,
+			Mode:    h.Mode,
+			BeginAt: h.BeginAt,
+			EndAt:   h.EndAt,
+			Seed:    s.Seed,
+		},
+		seats: map[int64]int{},
+	}
+
+	start := &Event{Type: TypeStartKyoku, Dice: []int{s.DuanPai.Dice1, s.DuanPai.Dice2}}
+	for i, info := range s.DuanPai.AccountInfo {
+		e.seats[info.Uid] = i
+		e.draws = append(e.draws, -1)
+		e.log.Uids = append(e.log.Uids, info.Uid)
+		if i < len(names) {
+			e.log.Names = append(e.log.Names, names[i])
+		}
+		start.Tehais = append(start.Tehais, tileNames(info.OnHand))
+	}
+	start.Oya = seat(e.seats[s.DuanPai.MarkerID])
+	e.push(start)
+
+	if r := s.HuanSanZhang; r != nil {
+		swap := &Event{
+			Type:      TypeHuanSanZhang,
+			Dice:      []int{r.Dice1, r.Dice2},
+			Direction: r.Direction,
+			Outs:      make([][]string, len(e.seats)),
+			Ins:       make([][]string, len(e.seats)),
+		}
+		for _, info := range r.Players {
+			i := e.seats[info.Uid]
+			swap.Outs[i] = tileNames(info.Out)
+			swap.Ins[i] = tileNames(info.In)
+		}
+		e.push(swap)
+	}
+
+	for i := 1; i < len(steps); i++ {
+		if steps[i].Type == history.StepDo {
+			e.do(steps[i-1], steps[i])
+		}
+	}
+
+	if s.End != nil {
+		end := &Event{Type: TypeEndKyoku, Deltas: make([]int, len(e.seats))}
+		for _, sc := range s.End.ScoreChange {
+			if i, ok := e.seats[sc.Uid]; ok {
+				end.Deltas[i] = sc.Score
+			}
+		}
+		e.push(end)
+	}
+
+	return e.log, nil
+}
+
+func (e *exporter) push(ev *Event) {
+	e.log.Events = append(e.log.Events, ev)
+}
+
+func (e *exporter) do(prev, cur *protocol.ReplayStep) {
+	do := cur.Action
+	actor := e.seats[do.Uid[0]]
+	id := do.TileIDs[0]
+	ev := &Event{Actor: seat(actor), Pai: TileName(id)}
+
+	switch do.OpType {
+	case protocol.OptyMoPai:
+		ev.Type = TypeTsumo
+		e.draws[actor] = id
+		e.discard = nil
+		e.kakan = nil
+
+	case protocol.OptypeChu:
+		ev.Type = TypeDahai
+		ev.Tsumogiri = e.draws[actor] == id
+		e.draws[actor] = -1
+		e.discard = &lastTile{seat: actor, id: id}
+		e.kakan = nil
+
+	case protocol.OptypePeng, protocol.OptypeChi:
+		ev.Type = TypePon
+		if do.OpType == protocol.OptypeChi {
+			ev.Type = TypeChi
+		}
+		melds := cur.Players[actor].Melds
+		e.claim(ev, melds[len(melds)-1])
+
+	case protocol.OptypeGang:
+		if e.gang(ev, prev.Players[actor], cur.Players[actor], id) {
+			ev.Deltas = deltas(prev, cur)
+		}
+
+	case protocol.OptypeHu:
+		ev.Type = TypeHora
+		switch {
+		case e.discard != nil && e.discard.id == id:
+			ev.Target = seat(e.discard.seat)
+		case e.kakan != nil && e.kakan.id == id:
+			ev.Target = seat(e.kakan.seat)
+		default:
+			ev.Target = seat(actor)
+		}
+		ev.Deltas = deltas(prev, cur)
+	}
+
+	e.push(ev)
+}
+
+// 碰, 吃, 明杠别人打出的牌, 回放中碰杠的牌包含打出的牌
+func (e *exporter) claim(ev *Event, meld []int) {
+	ev.Target = seat(e.discard.seat)
+	ev.Pai = TileName(e.discard.id)
+	ev.Consumed = consumed(meld, e.discard.id)
+}
+
+// 新增的碰杠为明杠或者暗杠, 已有的碰牌变成4张为巴杠, 没有变化为被抢杠的巴杠,
+// 返回杠牌是否成立(有杠牌分数)
+func (e *exporter) gang(ev *Event, prev, cur *protocol.ReplayPlayer, id int) bool {
+	if len(cur.Melds) > len(prev.Melds) {
+		meld := cur.Melds[len(cur.Melds)-1]
+		if e.discard != nil && contains(meld, e.discard.id) {
+			ev.Type = TypeDaiminkan
+			e.claim(ev, meld)
+			return true
+		}
+		ev.Type = TypeAnkan
+		ev.Pai = ""
+		ev.Consumed = consumed(meld, -1)
+		return true
+	}
+
+	ev.Type = TypeKakan
+	e.kakan = &lastTile{seat: *ev.Actor, id: id}
+	index := mahjong.IndexFromID(id)
+	for i, m := range prev.Melds {
+		if len(m) == 3 && mahjong.IndexFromID(m[0]) == index && mahjong.IndexFromID(m[1]) == index {
+			ev.Consumed = consumed(m, -1)
+			return len(cur.Melds[i]) == 4
+		}
+	}
+	return false
+}
+
+func deltas(prev, cur *protocol.ReplayStep) []int {
+	d := make([]int, len(cur.Players))
+	for i := range cur.Players {
+		d[i] = cur.Players[i].Score - prev.Players[i].Score
+	}
+	return d
+}
+
+// 除去except之外的牌, 按ID排序
+func consumed(meld []int, except int) []string {
+	ids := []int{}
+	for _, id := range meld {
+		if id != except {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return tileNames(ids)
+}
+
+func contains(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,371 @@
+package mjlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+)
+
+type importer struct {
+	log      *Log
+	snapshot *history.SnapShot
+
+	used    map[string]int // 每种麻将已经分配的ID数量
+	hands   [][]int
+	draws   []int
+	discard *lastTile
+	kakan   *lastTile
+}
+
+// Import 把牌谱转换为历史记录, 牌谱中没有麻将ID, 同一种麻将按出现的顺序依次分配ID
+func Import(l *Log) (*model.History, error) {
+	if l.Format != Format || l.Version > Version || len(l.Uids) == 0 || len(l.Uids) > 4 {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+
+	im := &importer{
+		log:      l,
+		snapshot: &history.SnapShot{Seed: l.Seed},
+		used:     map[string]int{},
+		hands:    make([][]int, len(l.Uids)),
+		draws:    make([]int, len(l.Uids)),
+	}
+	for i, ev := range l.Events {
+		if err := im.event(i, ev); err != nil {
+			return nil, fmt.Errorf("%w: 第%d个事件 %s: %v", errutil.ErrIllegalSnapshot, i, ev.Type, err)
+		}
+	}
+	if im.snapshot.DuanPai == nil {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+
+	data, err := json.Marshal(im.snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 4)
+	scores := make([]int, 4)
+	copy(names, l.Names)
+	if end := im.snapshot.End; end != nil {
+		for i, sc := range end.ScoreChange {
+			scores[i] = sc.Score
+		}
+	}
+	return &model.History{
+		Id:           l.ID,
+		DeskId:       l.DeskID,
+		Mode:         l.Mode,
+		BeginAt:      l.BeginAt,
+		EndAt:        l.EndAt,
+		PlayerName0:  names[0],
+		PlayerName1:  names[1],
+		PlayerName2:  names[2],
+		PlayerName3:  names[3],
+		ScoreChange0: scores[0],
+		ScoreChange1: scores[1],
+		ScoreChange2: scores[2],
+		ScoreChange3: scores[3],
+		Snapshot:     string(data),
+	}, nil
+}
+
+func (im *importer) event(index int, ev *Event) error {
+	s := im.snapshot
+	if ev.Type == TypeStartKyoku {
+		if index != 0 {
+			return errutil.ErrIllegalOperation
+		}
+		return im.start(ev)
+	}
+	if s.DuanPai == nil {
+		return errutil.ErrIllegalOperation
+	}
+	if ev.Type == TypeHuanSanZhang {
+		return im.huanSanZhang(ev)
+	}
+	if ev.Type == TypeEndKyoku {
+		if len(ev.Deltas) != len(im.hands) {
+			return errutil.ErrIllegalParameter
+		}
+		s.End = &protocol.RoundOverStats{}
+		for i, uid := range im.log.Uids {
+			s.End.ScoreChange = append(s.End.ScoreChange, protocol.GameEndScoreChange{Uid: uid, Score: ev.Deltas[i]})
+		}
+		return nil
+	}
+
+	if ev.Actor == nil || *ev.Actor < 0 || *ev.Actor >= len(im.hands) {
+		return errutil.ErrPlayerNotFound
+	}
+	actor := *ev.Actor
+	uid := im.log.Uids[actor]
+
+	var (
+		opType int
+		ids    []int
+		err    error
+	)
+	switch ev.Type {
+	case TypeTsumo:
+		opType = protocol.OptyMoPai
+		id, err := im.alloc(ev.Pai)
+		if err != nil {
+			return err
+		}
+		ids = []int{id}
+		im.hands[actor] = append(im.hands[actor], id)
+		im.draws[actor] = id
+		im.discard = nil
+		im.kakan = nil
+
+	case TypeDahai:
+		opType = protocol.OptypeChu
+		id, err := im.take(actor, ev.Pai, ev.Tsumogiri)
+		if err != nil {
+			return err
+		}
+		ids = []int{id}
+		im.draws[actor] = -1
+		im.discard = &lastTile{seat: actor, id: id}
+		im.kakan = nil
+
+	case TypePon:
+		opType = protocol.OptypePeng
+		ids, err = im.claim(actor, ev, 2)
+
+	case TypeChi:
+		opType = protocol.OptypeChi
+		ids, err = im.claim(actor, ev, 2)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	case TypeDaiminkan:
+		opType = protocol.OptypeGang
+		ids, err = im.claim(actor, ev, 3)
+		im.gangScore(ev, false)
+
+	case TypeAnkan:
+		opType = protocol.OptypeGang
+		ids, err = im.takeAll(actor, ev.Consumed, 4)
+		im.gangScore(ev, true)
+
+	case TypeKakan:
+		opType = protocol.OptypeGang
+		id, err := im.take(actor, ev.Pai, true)
+		if err != nil {
+			return err
+		}
+		ids = []int{id}
+		im.kakan = &lastTile{seat: actor, id: id}
+		im.gangScore(ev, false)
+
+	case TypeHora:
+		opType = protocol.OptypeHu
+		id, err := im.hora(actor, ev)
+		if err != nil {
+			return err
+		}
+		ids = []int{id}
+
+	default:
+		return errutil.ErrIllegalOperation
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Do = append(s.Do, &protocol.OpTypeDo{Uid: []int64{uid}, OpType: opType, TileIDs: ids})
+	return nil
+}
+
+func (im *importer) start(ev *Event) error {
+	if len(ev.Tehais) != len(im.hands) || ev.Oya == nil || *ev.Oya < 0 || *ev.Oya >= len(im.hands) || len(ev.Dice) != 2 {
+		return errutil.ErrIllegalParameter
+	}
+
+	duan := &protocol.DuanPai{MarkerID: im.log.Uids[*ev.Oya], Dice1: ev.Dice[0], Dice2: ev.Dice[1]}
+	for i, tehai := range ev.Tehais {
+		for _, name := range tehai {
+			id, err := im.alloc(name)
+			if err != nil {
+				return err
+			}
+			im.hands[i] = append(im.hands[i], id)
+		}
+		duan.AccountInfo = append(duan.AccountInfo, protocol.DuanPaiInfo{
+			Uid:    im.log.Uids[i],
+			OnHand: append([]int{}, im.hands[i]...),
+			Count:  len(im.hands[i]),
+		})
+		im.draws[i] = -1
+	}
+	im.snapshot.DuanPai = duan
+	return nil
+}
+
+// 换入的牌是其他座位换出的牌, 按名字从换出的牌中取出
+func (im *importer) huanSanZhang(ev *Event) error {
+	if len(ev.Outs) != len(im.hands) || len(ev.Ins) != len(im.hands) || len(ev.Dice) != 2 {
+		return errutil.ErrIllegalParameter
+	}
+
+	result := &protocol.HuanSanZhangResult{Dice1: ev.Dice[0], Dice2: ev.Dice[1], Direction: ev.Direction}
+	pool := []int{}
+	for i, out := range ev.Outs {
+		ids, err := im.takeAll(i, out, len(out))
+		if err != nil {
+			return err
+		}
+		pool = append(pool, ids...)
+		result.Players = append(result.Players, protocol.HuanSanZhangInfo{Uid: im.log.Uids[i], Out: ids})
+	}
+	for i, in := range ev.Ins {
+		for _, name := range in {
+			id, ok := takeName(&pool, name, -1)
+			if !ok {
+				return errutil.ErrTileNotInHand
+			}
+			result.Players[i].In = append(result.Players[i].In, id)
+			im.hands[i] = append(im.hands[i], id)
+		}
+	}
+	im.snapshot.HuanSanZhang = result
+	return nil
+}
+
+// 碰, 吃, 明杠: 打出的牌在前, 之后是手牌中的count张
+func (im *importer) claim(actor int, ev *Event, count int) ([]int, error) {
+	d := im.discard
+	if d == nil || ev.Target == nil || *ev.Target != d.seat || TileName(d.id) != ev.Pai {
+		return nil, errutil.ErrIllegalOperation
+	}
+	ids, err := im.takeAll(actor, ev.Consumed, count)
+	if err != nil {
+		return nil, err
+	}
+	return append([]int{d.id}, ids...), nil
+}
+
+// 胡的牌: 点炮为打出的牌, 抢杠为巴杠的牌, 自摸从手牌中取出
+func (im *importer) hora(actor int, ev *Event) (int, error) {
+	if ev.Target == nil {
+		return 0, errutil.ErrIllegalParameter
+	}
+
+	var id int
+	switch target := *ev.Target; {
+	case target == actor:
+		tid, err := im.take(actor, ev.Pai, true)
+		if err != nil {
+			return 0, err
+		}
+		id = tid
+	case im.discard != nil && im.discard.seat == target && TileName(im.discard.id) == ev.Pai:
+		id = im.discard.id
+	case im.kakan != nil && im.kakan.seat == target && TileName(im.kakan.id) == ev.Pai:
+		id = im.kakan.id
+	default:
+		return 0, errutil.ErrIllegalOperation
+	}
+
+	if len(ev.Deltas) != len(im.hands) {
+		return 0, errutil.ErrIllegalParameter
+	}
+	hu := &protocol.HuInfo{Uid: im.log.Uids[actor], TotalWinScore: ev.Deltas[actor], ScoreChange: scoreInfos(im.log.Uids, ev.Deltas)}
+	if *ev.Target == actor {
+		hu.HuPaiType = protocol.HuTypeZiMo
+	}
+	im.snapshot.HuScoreChanges = append(im.snapshot.HuScoreChanges, hu)
+	return id, nil
+}
+
+// 被抢杠的巴杠没有分数变化
+func (im *importer) gangScore(ev *Event, isXiaYu bool) {
+	if ev.Deltas == nil {
+		return
+	}
+	im.snapshot.GangScoreChanges = append(im.snapshot.GangScoreChanges, &protocol.GangPaiScoreChange{
+		IsXiaYu: isXiaYu,
+		Changes: scoreInfos(im.log.Uids, ev.Deltas),
+	})
+}
+
+// 分配一张还没有使用的麻将ID
+func (im *importer) alloc(name string) (int, error) {
+	ids, ok := nameIDs[name]
+	if !ok || im.used[name] >= len(ids) {
+		return 0, errutil.ErrIllegalParameter
+	}
+	id := ids[im.used[name]]
+	im.used[name]++
+	return id, nil
+}
+
+// 从手牌中取出一张, drawn表示优先取最后摸到的牌, 否则优先取其他的牌
+func (im *importer) take(actor int, name string, drawn bool) (int, error) {
+	hand := &im.hands[actor]
+	draw := im.draws[actor]
+	if draw >= 0 && TileName(draw) == name {
+		if drawn {
+			removeID(hand, draw)
+			return draw, nil
+		}
+		if id, ok := takeName(hand, name, draw); ok {
+			return id, nil
+		}
+	}
+	if id, ok := takeName(hand, name, -1); ok {
+		return id, nil
+	}
+	return 0, errutil.ErrTileNotInHand
+}
+
+func (im *importer) takeAll(actor int, names []string, count int) ([]int, error) {
+	if len(names) != count {
+		return nil, errutil.ErrIllegalParameter
+	}
+	ids := []int{}
+	for _, name := range names {
+		id, err := im.take(actor, name, false)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// 取出第一张名字相同并且不是except的牌
+func takeName(ids *[]int, name string, except int) (int, bool) {
+	for _, id := range *ids {
+		if id != except && TileName(id) == name {
+			removeID(ids, id)
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func removeID(ids *[]int, id int) {
+	for i, v := range *ids {
+		if v == id {
+			*ids = append((*ids)[:i], (*ids)[i+1:]...)
+			return
+		}
+	}
+}
+
+func scoreInfos(uids []int64, deltas []int) []protocol.ScoreInfo {
+	infos := []protocol.ScoreInfo{}
+	for i, d := range deltas {
+		if i < len(uids) && d != 0 {
+			infos = append(infos, protocol.ScoreInfo{Uid: uids[i], Score: d})
+		}
+	}
+	return infos
+}
@@ -0,0 +1,119 @@
+// Package mjlog 牌谱导出: 把历史记录转换为参考天凤/MJAI事件流的JSON牌谱, 以及每局分数的CSV汇总
+//
+// 牌谱格式(Version=1), 每一局(一条历史记录)为一个Log:
+//
+//	{"format":"go-mahjong-mjlog","version":1,"id":1,"desk_id":1,"mode":4,"begin_at":0,"end_at":0,
+//	 "seed":"...","names":["a","b","c","d"],"uids":[1,2,3,4],"events":[...]}
+//
+// 座位(actor, target)为发牌时的顺序, 从0开始. 麻将使用MJAI的写法:
+// 1m~9m为万, 1p~9p为筒, 1s~9s为条, E/S/W/N为东南西北, P/F/C为白发中, 花牌为f1~f8(春夏秋冬梅兰竹菊).
+// deltas为每个座位的分数变化. 事件类型:
+//
+//	start_kyoku    {oya, dice, tehais}                         发牌, tehais为每个座位的手牌
+//	huansanzhang   {dice, direction, outs, ins}                换三张, 每个座位换出和换入的牌
+//	tsumo          {actor, pai}                                摸牌
+//	dahai          {actor, pai, tsumogiri}                     出牌, tsumogiri表示打出刚摸到的牌
+//	pon/chi        {actor, target, pai, consumed}              碰/吃target打出的pai, consumed为自己的牌
+//	daiminkan      {actor, target, pai, consumed, deltas}      明杠
+//	ankan          {actor, consumed, deltas}                   暗杠
+//	kakan          {actor, pai, consumed, deltas}              巴杠, consumed为碰牌, 被抢杠时没有deltas
+//	hora           {actor, target, pai, deltas}                胡牌, 自摸时target与actor相同
+//	end_kyoku      {deltas}                                    本局结算, 包含查叫等没有单独记录的分数
+//
+// 血战到底中一局可以有多个hora, 杠牌在杠牌时立即结算, 与日麻不同.
+package mjlog
+
+import (
+	"fmt"
+
+	"go-mahjong-server/internal/game/mahjong"
+)
+
+const (
+	Format  = "go-mahjong-mjlog"
+	Version = 1
+)
+
+// 事件类型
+const (
+	TypeStartKyoku   = "start_kyoku"
+	TypeHuanSanZhang = "huansanzhang"
+	TypeTsumo        = "tsumo"
+	TypeDahai        = "dahai"
+	TypePon          = "pon"
+	TypeChi          = "chi"
+	TypeDaiminkan    = "daiminkan"
+	TypeAnkan        = "ankan"
+	TypeKakan        = "kakan"
+	TypeHora         = "hora"
+	TypeEndKyoku     = "end_kyoku"
+)
+
+// Log 一局的牌谱
+type Log struct {
+	Format  string   `json:"format"`
+	Version int      `json:"version"`
+	ID      int64    `json:"id"`
+	DeskID  int64    `json:"desk_id"`
+	Mode    int      `json:"mode"`
+	BeginAt int64    `json:"begin_at"`
+	EndAt   int64    `json:"end_at"`
+	Seed    string   `json:"seed,omitempty"`
+	Names   []string `json:"names"`
+	Uids    []int64  `json:"uids"`
+	Events  []*Event `json:"events"`
+}
+
+// Event 牌谱事件, 不同类型使用的字段见包说明
+type Event struct {
+	Type      string     `json:"type"`
+	Actor     *int       `json:"actor,omitempty"`
+	Target    *int       `json:"target,omitempty"`
+	Pai       string     `json:"pai,omitempty"`
+	Tsumogiri bool       `json:"tsumogiri,omitempty"`
+	Consumed  []string   `json:"consumed,omitempty"`
+	Deltas    []int      `json:"deltas,omitempty"`
+	Oya       *int       `json:"oya,omitempty"`
+	Dice      []int      `json:"dice,omitempty"`
+	Direction int        `json:"direction,omitempty"`
+	Tehais    [][]string `json:"tehais,omitempty"`
+	Outs      [][]string `json:"outs,omitempty"`
+	Ins       [][]string `json:"ins,omitempty"`
+}
+
+func seat(i int) *int { return &i }
+
+var (
+	suitNames  = []string{"s", "p", "m"} // 条筒万
+	honorNames = []string{"E", "S", "W", "N", "C", "F", "P"}
+
+	// 麻将名字对应的所有ID, 按ID从小到大排列
+	nameIDs = map[string][]int{}
+)
+
+func init() {
+	for id := 0; id <= mahjong.MaxFlowerID; id++ {
+		name := TileName(id)
+		nameIDs[name] = append(nameIDs[name], id)
+	}
+}
+
+// TileName 麻将ID对应的牌谱写法
+func TileName(id int) string {
+	t := mahjong.TileFromID(id)
+	switch t.Suit {
+	case mahjong.SuitHonor:
+		return honorNames[t.Rank-1]
+	case mahjong.SuitFlower:
+		return fmt.Sprintf("f%d", t.Rank)
+	}
+	return fmt.Sprintf("%d%s", t.Rank, suitNames[t.Suit])
+}
+
+func tileNames(ids []int) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = TileName(id)
+	}
+	return names
+}
@@ -0,0 +1,185 @@
+package mjlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/protocol"
+)
+
+func do(uid int64, op int, ids ...int) *protocol.OpTypeDo {
+	return &protocol.OpTypeDo{Uid: []int64{uid}, OpType: op, TileIDs: ids}
+}
+
+// 庄家打出1条, 闲家碰, 之后闲家摸到第4张1条巴杠, 最后自摸
+func testHistory(t *testing.T, robbed bool) *model.History {
+	s := &history.SnapShot{
+		Seed: "seed",
+		DuanPai: &protocol.DuanPai{
+			MarkerID: 1,
+			Dice1:    3,
+			Dice2:    4,
+			AccountInfo: []protocol.DuanPaiInfo{
+				{Uid: 1, OnHand: []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52}},
+				{Uid: 2, OnHand: []int{2, 3, 5, 9, 13, 17, 21, 25, 29, 37, 41, 45, 49}},
+			},
+		},
+		Do: []*protocol.OpTypeDo{
+			do(1, protocol.OptypeChu, 0),
+			do(2, protocol.OptypePeng, 0, 2, 3),
+			do(2, protocol.OptypeChu, 5),
+			do(1, protocol.OptyMoPai, 56),
+			do(1, protocol.OptypeChu, 56),
+			do(2, protocol.OptyMoPai, 1),
+			do(2, protocol.OptypeGang, 1),
+			do(2, protocol.OptyMoPai, 60),
+			do(2, protocol.OptypeHu, 60),
+		},
+		GangScoreChanges: []*protocol.GangPaiScoreChange{
+			{Changes: []protocol.ScoreInfo{{Uid: 2, Score: 1}, {Uid: 1, Score: -1}}},
+		},
+		HuScoreChanges: []*protocol.HuInfo{
+			{Uid: 2, HuPaiType: protocol.HuTypeZiMo, TotalWinScore: 4, ScoreChange: []protocol.ScoreInfo{{Uid: 1, Score: -4}}},
+		},
+		End: &protocol.RoundOverStats{
+			ScoreChange: []protocol.GameEndScoreChange{{Uid: 1, Score: -6}, {Uid: 2, Score: 6}},
+		},
+	}
+	if robbed {
+		s.Do = append(s.Do[:7], do(1, protocol.OptypeHu, 1))
+		s.GangScoreChanges = nil
+		s.HuScoreChanges[0] = &protocol.HuInfo{Uid: 1, TotalWinScore: 2, ScoreChange: []protocol.ScoreInfo{{Uid: 2, Score: -2}}}
+		s.End = nil
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &model.History{Id: 7, DeskId: 3, Mode: 2, PlayerName0: "a", PlayerName1: "b", ScoreChange0: -6, ScoreChange1: 6, Snapshot: string(data), ReplayCode: "123456789015"}
+}
+
+func summary(l *Log) []string {
+	lines := []string{}
+	for _, ev := range l.Events {
+		line := ev.Type
+		if ev.Actor != nil {
+			line += fmt.Sprintf(" %d", *ev.Actor)
+		}
+		if ev.Target != nil {
+			line += fmt.Sprintf("<-%d", *ev.Target)
+		}
+		if ev.Pai != "" {
+			line += " " + ev.Pai
+		}
+		if ev.Tsumogiri {
+			line += "*"
+		}
+		if len(ev.Consumed) > 0 {
+			line += fmt.Sprint(ev.Consumed)
+		}
+		if ev.Deltas != nil {
+			line += fmt.Sprint(ev.Deltas)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestTileName(t *testing.T) {
+	for id, name := range map[int]string{0: "1s", 35: "9s", 36: "1p", 72: "1m", 107: "9m", 108: "E", 124: "C", 132: "P", 136: "f1"} {
+		if n := TileName(id); n != name {
+			t.Fatalf("id=%d name=%s, expected %s", id, n, name)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	l, err := Export(testHistory(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"start_kyoku",
+		"dahai 0 1s",
+		"pon 1<-0 1s[1s 1s]",
+		"dahai 1 2s",
+		"tsumo 0 6p",
+		"dahai 0 6p*",
+		"tsumo 1 1s",
+		"kakan 1 1s[1s 1s 1s][-1 1]",
+		"tsumo 1 7p",
+		"hora 1<-1 7p[-4 4]",
+		"end_kyoku[-6 6]",
+	}
+	if s := summary(l); strings.Join(s, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("events:\n%s", strings.Join(s, "\n"))
+	}
+	if fmt.Sprint(l.Uids, l.Names, *l.Events[0].Oya, l.Events[0].Tehais[1][:3]) != "[1 2] [a b] 0 [1s 1s 2s]" {
+		t.Fatalf("log: %v %v %v", l.Uids, l.Names, l.Events[0].Tehais)
+	}
+
+	// 被抢杠的巴杠没有分数
+	l, err = Export(testHistory(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := summary(l)
+	if s[len(s)-2] != "kakan 1 1s[1s 1s 1s]" || s[len(s)-1] != "hora 0<-1 1s[2 -2]" {
+		t.Fatalf("robbed:\n%s", strings.Join(s, "\n"))
+	}
+}
+
+// 导出后导入再导出, 牌谱相同, 导入的历史记录可以回放
+func TestImport(t *testing.T) {
+	for _, robbed := range []bool{false, true} {
+		l, err := Export(testHistory(t, robbed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := Import(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := Export(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, _ := json.Marshal(l)
+		b, _ := json.Marshal(again)
+		if string(a) != string(b) {
+			t.Fatalf("robbed=%v round trip:\n%s\n%s", robbed, a, b)
+		}
+	}
+
+	l, _ := Export(testHistory(t, false))
+	l.Events[1].Pai = "9m"
+	if _, err := Import(l); err == nil {
+		t.Fatal("discarding a tile not in hand should fail")
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := Write(buf, OutputCSV, []model.History{*testHistory(t, false)}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "id,desk_id") {
+		t.Fatalf("csv: %q", buf.String())
+	}
+	row := strings.Split(lines[1], ",")
+	if row[0] != "7" || row[1] != "3" || row[5] != "123456789015" || strings.Join(row[6:10], ",") != "a,-6,b,6" {
+		t.Fatalf("row: %v", row)
+	}
+
+	if err := Write(buf, "xml", nil); err == nil {
+		t.Fatal("unknown output should fail")
+	}
+}
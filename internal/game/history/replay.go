@@ -0,0 +1,458 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-mahjong-server/db"
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+)
+
+// 回放步骤类型
+const (
+	StepDuanPai      = "duanPai"
+	StepHuanSanZhang = "huanSanZhang"
+	StepDo           = "do"
+	StepEnd          = "end"
+)
+
+// 最后一张打出的牌, 碰杠吃和点炮时从出牌玩家的出牌中移除
+type discard struct {
+	seat  int
+	id    int
+	taken bool
+}
+
+type replayer struct {
+	snapshot *SnapShot
+	players  []*protocol.ReplayPlayer
+	seats    map[int64]int
+	steps    []*protocol.ReplayStep
+
+	last  *discard // 摸牌后清空
+	gangs int      // 已经使用的GangScoreChanges
+	hus   int      // 已经使用的HuScoreChanges
+}
+
+// Replay 根据快照重建每一步之后所有玩家的手牌, 出牌, 碰杠吃, 胡牌和分数
+// names为按座位顺序的玩家昵称, 可以为nil
+func (s *SnapShot) Replay(names []string) ([]*protocol.ReplayStep, error) {
+	if s.DuanPai == nil || len(s.DuanPai.AccountInfo) == 0 {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+
+	r := &replayer{snapshot: s, seats: map[int64]int{}}
+	for i, info := range s.DuanPai.AccountInfo {
+		if err := validTiles(info.OnHand); err != nil {
+			return nil, err
+		}
+		p := &protocol.ReplayPlayer{Uid: info.Uid, Hand: append([]int{}, info.OnHand...)}
+		if i < len(names) {
+			p.Name = names[i]
+		}
+		r.players = append(r.players, p)
+		r.seats[info.Uid] = i
+	}
+	r.push(StepDuanPai, nil)
+
+	if s.HuanSanZhang != nil {
+		if err := r.huanSanZhang(s.HuanSanZhang); err != nil {
+			return nil, err
+		}
+		r.push(StepHuanSanZhang, nil)
+	}
+
+	for i, do := range s.Do {
+		if err := r.do(i, do); err != nil {
+			return nil, fmt.Errorf("%w: 第%d步 %+v: %v", errutil.ErrIllegalSnapshot, i, do, err)
+		}
+		r.push(StepDo, do)
+	}
+
+	// 结算包含查叫等没有单独记录的分数变化, 以结算为准
+	if s.End != nil {
+		for _, sc := range s.End.ScoreChange {
+			if seat, ok := r.seats[sc.Uid]; ok {
+				r.players[seat].Score = sc.Score
+			}
+		}
+		r.push(StepEnd, nil)
+	}
+
+	return r.steps, nil
+}
+
+func (r *replayer) push(typ string, action *protocol.OpTypeDo) {
+	players := make([]*protocol.ReplayPlayer, len(r.players))
+	for i, p := range r.players {
+		c := *p
+		c.Hand = append([]int{}, p.Hand...)
+		c.Discards = append([]int{}, p.Discards...)
+		c.HuTiles = append([]int{}, p.HuTiles...)
+		c.Melds = make([][]int, len(p.Melds))
+		for j, m := range p.Melds {
+			c.Melds[j] = append([]int{}, m...)
+		}
+		players[i] = &c
+	}
+	r.steps = append(r.steps, &protocol.ReplayStep{Type: typ, Action: action, Players: players})
+}
+
+func (r *replayer) huanSanZhang(result *protocol.HuanSanZhangResult) error {
+	for _, info := range result.Players {
+		seat, ok := r.seats[info.Uid]
+		if !ok {
+			return errutil.ErrIllegalSnapshot
+		}
+		if err := validTiles(info.In); err != nil {
+			return err
+		}
+		p := r.players[seat]
+		for _, id := range info.Out {
+			if !removeID(&p.Hand, id) {
+				return errutil.ErrIllegalSnapshot
+			}
+		}
+		p.Hand = append(p.Hand, info.In...)
+	}
+	return nil
+}
+
+func (r *replayer) do(index int, do *protocol.OpTypeDo) error {
+	if len(do.Uid) != 1 || len(do.TileIDs) == 0 {
+		return errutil.ErrIllegalOperation
+	}
+	seat, ok := r.seats[do.Uid[0]]
+	if !ok {
+		return errutil.ErrPlayerNotFound
+	}
+	if err := validTiles(do.TileIDs); err != nil {
+		return err
+	}
+
+	p := r.players[seat]
+	id := do.TileIDs[0]
+	switch do.OpType {
+	case protocol.OptyMoPai:
+		p.Hand = append(p.Hand, id)
+		r.last = nil
+
+	case protocol.OptypeChu:
+		if !removeID(&p.Hand, id) {
+			return errutil.ErrTileNotInHand
+		}
+		p.Discards = append(p.Discards, id)
+		r.last = &discard{seat: seat, id: id}
+
+	case protocol.OptypePeng:
+		meld, err := r.claim(p, 2, do.TileIDs)
+		if err != nil {
+			return err
+		}
+		p.Melds = append(p.Melds, meld)
+
+	case protocol.OptypeChi:
+		meld, err := r.claimChi(p, do.TileIDs)
+		if err != nil {
+			return err
+		}
+		p.Melds = append(p.Melds, meld)
+
+	case protocol.OptypeGang:
+		if err := r.gang(index, p, do.TileIDs); err != nil {
+			return err
+		}
+
+	case protocol.OptypeHu:
+		if err := r.hu(p, id); err != nil {
+			return err
+		}
+
+	default:
+		return errutil.ErrIllegalOperation
+	}
+	return nil
+}
+
+// 碰或者明杠别人打出的牌, 从手牌中取出count张相同的牌, 优先使用记录中的牌
+func (r *replayer) claim(p *protocol.ReplayPlayer, count int, ids []int) ([]int, error) {
+	if r.last == nil || r.last.taken {
+		return nil, errutil.ErrIllegalOperation
+	}
+	meld, ok := takeIndex(&p.Hand, mahjong.IndexFromID(r.last.id), count, ids)
+	if !ok {
+		return nil, errutil.ErrTileNotInHand
+	}
+	return append([]int{r.takeDiscard()}, meld...), nil
+}
+
+// 吃上家打出的牌, 顺子中的另外两张从手牌中取出
+func (r *replayer) claimChi(p *protocol.ReplayPlayer, ids []int) ([]int, error) {
+	if r.last == nil || r.last.taken || len(ids) != 3 || !contains(ids, r.last.id) {
+		return nil, errutil.ErrIllegalOperation
+	}
+	for _, id := range ids {
+		if id != r.last.id && !removeID(&p.Hand, id) {
+			return nil, errutil.ErrTileNotInHand
+		}
+	}
+	r.takeDiscard()
+	return append([]int{}, ids...), nil
+}
+
+// 杠牌有三种情况: 巴杠(记录一张牌), 明杠(别人刚打出的牌), 暗杠
+func (r *replayer) gang(index int, p *protocol.ReplayPlayer, ids []int) error {
+	id := ids[0]
+	tile := mahjong.IndexFromID(id)
+
+	switch {
+	case len(ids) == 1:
+		if !removeID(&p.Hand, id) {
+			return errutil.ErrTileNotInHand
+		}
+		// 被抢杠时杠牌不成立, 也没有杠牌分数
+		if r.robbed(index, id) {
+			return nil
+		}
+		meld := findMeld(p.Melds, tile)
+		if meld < 0 {
+			return errutil.ErrIllegalOperation
+		}
+		p.Melds[meld] = append(p.Melds[meld], id)
+
+	case r.last != nil && !r.last.taken && mahjong.IndexFromID(r.last.id) == tile:
+		meld, err := r.claim(p, 3, ids)
+		if err != nil {
+			return err
+		}
+		p.Melds = append(p.Melds, meld)
+
+	default:
+		meld, ok := takeIndex(&p.Hand, tile, 4, ids)
+		if !ok {
+			return errutil.ErrTileNotInHand
+		}
+		p.Melds = append(p.Melds, meld)
+	}
+
+	if r.gangs < len(r.snapshot.GangScoreChanges) {
+		r.applyScore(r.snapshot.GangScoreChanges[r.gangs].Changes)
+		r.gangs++
+	}
+	return nil
+}
+
+// 巴杠之后其他玩家胡这张牌为抢杠
+func (r *replayer) robbed(index, id int) bool {
+	next := index + 1
+	if next >= len(r.snapshot.Do) {
+		return false
+	}
+	do := r.snapshot.Do[next]
+	return do.OpType == protocol.OptypeHu && len(do.TileIDs) > 0 && do.TileIDs[0] == id
+}
+
+// 点炮的牌从出牌中移除(一炮多响只移除一次), 抢杠的牌已经从杠牌玩家手中移除, 其他为自摸
+func (r *replayer) hu(p *protocol.ReplayPlayer, id int) error {
+	switch {
+	case r.last != nil && r.last.id == id:
+		if !r.last.taken {
+			r.takeDiscard()
+		}
+	case removeID(&p.Hand, id):
+	default:
+		if !r.robbedBy(id) {
+			return errutil.ErrTileNotInHand
+		}
+	}
+	p.HuTiles = append(p.HuTiles, id)
+
+	if r.hus < len(r.snapshot.HuScoreChanges) {
+		r.applyHuScore(r.snapshot.HuScoreChanges[r.hus])
+		r.hus++
+	}
+	return nil
+}
+
+// 抢杠胡的牌是否是上一个巴杠的牌
+func (r *replayer) robbedBy(id int) bool {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		action := r.steps[i].Action
+		if action == nil || action.OpType != protocol.OptypeHu {
+			return action != nil && action.OpType == protocol.OptypeGang &&
+				len(action.TileIDs) == 1 && action.TileIDs[0] == id
+		}
+	}
+	return false
+}
+
+func (r *replayer) takeDiscard() int {
+	r.last.taken = true
+	p := r.players[r.last.seat]
+	if n := len(p.Discards); n > 0 && p.Discards[n-1] == r.last.id {
+		p.Discards = p.Discards[:n-1]
+	}
+	return r.last.id
+}
+
+func (r *replayer) applyScore(changes []protocol.ScoreInfo) {
+	for _, c := range changes {
+		if seat, ok := r.seats[c.Uid]; ok {
+			r.players[seat].Score += c.Score
+		}
+	}
+}
+
+// 牌桌记录的胡牌分数只包含输家, 赢家的分数为TotalWinScore
+func (r *replayer) applyHuScore(hu *protocol.HuInfo) {
+	r.applyScore(hu.ScoreChange)
+	for _, c := range hu.ScoreChange {
+		if c.Uid == hu.Uid {
+			return
+		}
+	}
+	if seat, ok := r.seats[hu.Uid]; ok {
+		r.players[seat].Score += hu.TotalWinScore
+	}
+}
+
+func validTiles(ids []int) error {
+	for _, id := range ids {
+		if id < 0 || id > mahjong.MaxFlowerID {
+			return errutil.ErrIllegalSnapshot
+		}
+	}
+	return nil
+}
+
+func contains(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func removeID(ids *[]int, id int) bool {
+	for i, v := range *ids {
+		if v == id {
+			*ids = append((*ids)[:i], (*ids)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 从手牌中取出count张index相同的牌, 优先取prefer中的牌
+func takeIndex(hand *[]int, index, count int, prefer []int) ([]int, bool) {
+	taken := []int{}
+	for _, id := range prefer {
+		if len(taken) < count && mahjong.IndexFromID(id) == index && removeID(hand, id) {
+			taken = append(taken, id)
+		}
+	}
+	for i := 0; i < len(*hand) && len(taken) < count; {
+		if id := (*hand)[i]; mahjong.IndexFromID(id) == index {
+			removeID(hand, id)
+			taken = append(taken, id)
+			continue
+		}
+		i++
+	}
+	if len(taken) < count {
+		*hand = append(*hand, taken...)
+		return nil, false
+	}
+	return taken, true
+}
+
+// 巴杠对应的碰牌
+func findMeld(melds [][]int, index int) int {
+	for i, m := range melds {
+		if len(m) == 3 && mahjong.IndexFromID(m[0]) == index && mahjong.IndexFromID(m[1]) == index {
+			return i
+		}
+	}
+	return -1
+}
+
+// Lite 历史记录摘要, 包含回放码
+func Lite(h *model.History) protocol.HistoryLite {
+	return protocol.HistoryLite{
+		Id:           h.Id,
+		DeskId:       h.DeskId,
+		Mode:         h.Mode,
+		BeginAt:      h.BeginAt,
+		BeginAtStr:   time.Unix(h.BeginAt, 0).Format("2006-01-02 15:04:05"),
+		EndAt:        h.EndAt,
+		PlayerName0:  h.PlayerName0,
+		PlayerName1:  h.PlayerName1,
+		PlayerName2:  h.PlayerName2,
+		PlayerName3:  h.PlayerName3,
+		ScoreChange0: h.ScoreChange0,
+		ScoreChange1: h.ScoreChange1,
+		ScoreChange2: h.ScoreChange2,
+		ScoreChange3: h.ScoreChange3,
+		ReplayCode:   h.ReplayCode,
+	}
+}
+
+// ReplayOf 解析数据库中的快照并生成回放
+func ReplayOf(h *model.History) (*protocol.Replay, error) {
+	s := &SnapShot{}
+	if err := json.Unmarshal([]byte(h.Snapshot), s); err != nil {
+		return nil, errutil.ErrIllegalSnapshot
+	}
+
+	names := []string{h.PlayerName0, h.PlayerName1, h.PlayerName2, h.PlayerName3}
+	steps, err := s.Replay(names)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Replay{HistoryLite: Lite(h), Seed: s.Seed, End: s.End, Steps: steps}, nil
+}
+
+// Load 根据历史记录ID加载回放
+func Load(id int64) (*model.History, *protocol.Replay, error) {
+	h, err := db.QueryHistory(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := ReplayOf(h)
+	return h, r, err
+}
+
+// LoadByCode 按回放码回放
+func LoadByCode(code string) (*model.History, *protocol.Replay, error) {
+	code, err := CheckCode(code)
+	if err != nil {
+		return nil, nil, err
+	}
+	h, err := db.QueryHistoryByCode(code)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := ReplayOf(h)
+	return h, r, err
+}
+
+// List 牌桌的历史记录摘要, 按开始时间排序
+func List(deskID int64, offset, count int) ([]protocol.HistoryLite, int, error) {
+	list, total, err := db.QueryHistoriesByDeskID(deskID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := []protocol.HistoryLite{}
+	for i := offset; i < total && (count <= 0 || len(result) < count); i++ {
+		if i >= 0 {
+			result = append(result, Lite(&list[i]))
+		}
+	}
+	return result, total, nil
+}
@@ -0,0 +1,146 @@
+package history
+
+import (
+	"fmt"
+	"testing"
+
+	"go-mahjong-server/protocol"
+)
+
+func do(uid int64, op int, ids ...int) *protocol.OpTypeDo {
+	return &protocol.OpTypeDo{Uid: []int64{uid}, OpType: op, TileIDs: ids}
+}
+
+// 庄家打出1条, 闲家碰, 之后闲家摸到第4张1条巴杠, 最后自摸
+func replaySnapshot() *SnapShot {
+	return &SnapShot{
+		DuanPai: &protocol.DuanPai{
+			MarkerID: 1,
+			AccountInfo: []protocol.DuanPaiInfo{
+				{Uid: 1, OnHand: []int{0, 4, 8, 12, 16, 20, 24, 28, 32, 36, 40, 44, 48, 52}},
+				{Uid: 2, OnHand: []int{2, 3, 5, 9, 13, 17, 21, 25, 29, 37, 41, 45, 49}},
+			},
+		},
+		Do: []*protocol.OpTypeDo{
+			do(1, protocol.OptypeChu, 0),
+			do(2, protocol.OptypePeng, 0, 2, 3),
+			do(2, protocol.OptypeChu, 5),
+			do(1, protocol.OptyMoPai, 56),
+			do(1, protocol.OptypeChu, 56),
+			do(2, protocol.OptyMoPai, 1),
+			do(2, protocol.OptypeGang, 1),
+			do(2, protocol.OptyMoPai, 60),
+			do(2, protocol.OptypeHu, 60),
+		},
+		GangScoreChanges: []*protocol.GangPaiScoreChange{
+			{Changes: []protocol.ScoreInfo{{Uid: 2, Score: 1}, {Uid: 1, Score: -1}}},
+		},
+		HuScoreChanges: []*protocol.HuInfo{
+			{Uid: 2, ScoreChange: []protocol.ScoreInfo{{Uid: 2, Score: 4}, {Uid: 1, Score: -4}}},
+		},
+		End: &protocol.RoundOverStats{
+			ScoreChange: []protocol.GameEndScoreChange{{Uid: 1, Score: -6}, {Uid: 2, Score: 6}},
+		},
+	}
+}
+
+func TestReplay(t *testing.T) {
+	steps, err := replaySnapshot().Replay([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 11 || steps[0].Type != StepDuanPai || steps[10].Type != StepEnd {
+		t.Fatalf("steps=%d", len(steps))
+	}
+
+	// 碰牌后1条从庄家的出牌中移除
+	peng := steps[2].Players
+	if len(peng[0].Discards) != 0 || fmt.Sprint(peng[1].Melds) != "[[0 2 3]]" || len(peng[1].Hand) != 11 {
+		t.Fatalf("after peng: %+v %+v", peng[0], peng[1])
+	}
+
+	// 巴杠和自摸的分数
+	gang := steps[7].Players
+	if fmt.Sprint(gang[1].Melds) != "[[0 2 3 1]]" || gang[1].Score != 1 || gang[0].Score != -1 {
+		t.Fatalf("after gang: %+v", gang[1])
+	}
+	hu := steps[9].Players
+	if fmt.Sprint(hu[1].HuTiles) != "[60]" || hu[1].Score != 5 || fmt.Sprint(hu[1].Hand) != "[9 13 17 21 25 29 37 41 45 49]" {
+		t.Fatalf("after hu: %+v", hu[1])
+	}
+	if fmt.Sprint(hu[0].Discards) != "[56]" || hu[0].Name != "a" {
+		t.Fatalf("after hu: %+v", hu[0])
+	}
+
+	// 结算以RoundOverStats为准
+	if end := steps[10].Players; end[0].Score != -6 || end[1].Score != 6 {
+		t.Fatalf("end: %+v %+v", end[0], end[1])
+	}
+
+	// 每一步都是独立的副本
+	if len(steps[0].Players[1].Melds) != 0 || len(steps[0].Players[0].Hand) != 14 {
+		t.Fatal("steps should not share state")
+	}
+}
+
+// 巴杠被抢杠时杠牌不成立, 也没有杠牌分数
+func TestReplayQiangGang(t *testing.T) {
+	s := replaySnapshot()
+	s.Do = append(s.Do[:7], do(1, protocol.OptypeHu, 1))
+	s.HuScoreChanges[0] = &protocol.HuInfo{Uid: 1, ScoreChange: []protocol.ScoreInfo{{Uid: 1, Score: 2}, {Uid: 2, Score: -2}}}
+	s.End = nil
+
+	steps, err := s.Replay(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := steps[len(steps)-1].Players
+	if fmt.Sprint(last[1].Melds) != "[[0 2 3]]" || last[1].Score != -2 || len(last[1].Hand) != 10 {
+		t.Fatalf("robbed: %+v", last[1])
+	}
+	if fmt.Sprint(last[0].HuTiles) != "[1]" || last[0].Score != 2 {
+		t.Fatalf("winner: %+v", last[0])
+	}
+}
+
+func TestReplayIllegal(t *testing.T) {
+	s := replaySnapshot()
+	s.Do[2] = do(2, protocol.OptypeChu, 100)
+	if _, err := s.Replay(nil); err == nil {
+		t.Fatal("discarding a tile not in hand should fail")
+	}
+
+	if _, err := (&SnapShot{}).Replay(nil); err == nil {
+		t.Fatal("snapshot without deal should fail")
+	}
+}
+
+func TestCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		code, err := NewCode()
+		if err != nil || len(code) != codeLength || seen[code] {
+			t.Fatalf("code=%s err=%v", code, err)
+		}
+		seen[code] = true
+
+		if checked, err := CheckCode(" " + code + " "); err != nil || checked != code {
+			t.Fatalf("code=%s checked=%s err=%v", code, checked, err)
+		}
+
+		// 输错任意一位都能发现
+		for i := 0; i < codeLength; i++ {
+			b := []byte(code)
+			b[i] = '0' + (b[i]-'0'+1)%10
+			if _, err := CheckCode(string(b)); err == nil {
+				t.Fatalf("code=%s typo=%s should be rejected", code, b)
+			}
+		}
+	}
+
+	for _, code := range []string{"", "12345678", "1234567890123", "abcdefghijkl"} {
+		if _, err := CheckCode(code); err == nil {
+			t.Fatalf("code=%q should be rejected", code)
+		}
+	}
+}
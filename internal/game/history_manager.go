@@ -0,0 +1,73 @@
+package game
+
+import (
+	"go-mahjong-server/db"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/component"
+	"github.com/lonng/nano/session"
+)
+
+// HistoryManager 战绩和回放
+type HistoryManager struct {
+	component.Base
+}
+
+// 只有参与牌桌的玩家和管理员可以查看战绩
+func canViewDesk(uid, deskID int64) bool {
+	if db.IsAdmin(uid) {
+		return true
+	}
+	d, err := db.QueryDesk(deskID)
+	if err != nil {
+		return false
+	}
+	for _, p := range []int64{d.Player0, d.Player1, d.Player2, d.Player3} {
+		if p == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func replayError(err error) *protocol.ReplayResponse {
+	return &protocol.ReplayResponse{Code: errutil.Code(err), Error: err.Error()}
+}
+
+// List 牌桌每一局的战绩
+func (m *HistoryManager) List(s *session.Session, req *protocol.HistoryLiteListRequest) error {
+	if !canViewDesk(s.UID(), req.DeskID) {
+		return s.Response(&protocol.HistoryLiteListResponse{Code: errutil.Code(errutil.ErrPermissionDenied)})
+	}
+
+	list, total, err := history.List(req.DeskID, req.Offset, req.Count)
+	if err != nil {
+		return s.Response(&protocol.HistoryLiteListResponse{Code: errutil.Code(err)})
+	}
+	return s.Response(&protocol.HistoryLiteListResponse{Total: int64(total), Data: list})
+}
+
+// Replay 按历史记录ID回放一局
+func (m *HistoryManager) Replay(s *session.Session, req *protocol.HistoryByIDRequest) error {
+	h, r, err := history.Load(req.ID)
+	if h != nil && !canViewDesk(s.UID(), h.DeskId) {
+		err = errutil.ErrPermissionDenied
+	}
+	if err != nil {
+		logger.Infof("回放失败: UID=%d, ID=%d, Error=%v", s.UID(), req.ID, err)
+		return s.Response(replayError(err))
+	}
+	return s.Response(&protocol.ReplayResponse{Data: r})
+}
+
+// ReplayByCode 回放码可以分享给其他玩家, 不检查是否参与牌桌. 回放码是随机生成的, 只有看到战绩的玩家才能得到
+func (m *HistoryManager) ReplayByCode(s *session.Session, req *protocol.ReplayCodeRequest) error {
+	_, r, err := history.LoadByCode(req.Code)
+	if err != nil {
+		logger.Infof("回放失败: UID=%d, 回放码=%s, Error=%v", s.UID(), req.Code, err)
+		return s.Response(replayError(err))
+	}
+	return s.Response(&protocol.ReplayResponse{Data: r})
+}
@@ -0,0 +1,265 @@
+package game
+
+import (
+	"errors"
+	"time"
+
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/scheduler"
+)
+
+// 换三张: 所有玩家理牌完成后, 定缺之前, 每个玩家选择三张同花色的手牌,
+// 全部选择完成后根据骰子点数决定的方向交换
+
+// 等待玩家选择的时间, 超时后使用推荐的牌
+var huanSanZhangTimeout = 30 * time.Second
+
+var ErrIllegalHuanSanZhang = errors.New("换三张必须选择三张同花色的手牌")
+
+type huanSanZhangContext struct {
+	desk   *Desk
+	chosen map[int64][]int  //玩家选择换出的牌
+	timer  *scheduler.Timer //选择超时
+	seq    int              //超时序号, 用于丢弃已经取消的超时
+}
+
+func newHuanSanZhangContext(desk *Desk) *huanSanZhangContext {
+	return &huanSanZhangContext{
+		desk:   desk,
+		chosen: map[int64][]int{},
+	}
+}
+
+func (h *huanSanZhangContext) reset() {
+	h.stop()
+	h.chosen = map[int64][]int{}
+}
+
+func (h *huanSanZhangContext) stop() {
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+}
+
+// 开始换三张, 通知真实玩家选择, 机器人直接选择推荐的牌.
+// 有玩家没有三张同花色的数牌时跳过换三张
+func (h *huanSanZhangContext) start() {
+	d := h.desk
+	for _, p := range d.players {
+		if p.huanSanZhangTiles() == nil {
+			d.logger.Warnf("玩家没有三张同花色的数牌, 跳过换三张: UID=%d", p.Uid())
+			d.dingQueHint()
+			return
+		}
+	}
+	d.setStatus(constant.DeskStatusHuanSanZhang)
+	h.startTimer()
+
+	robots := []*Player{}
+	for _, p := range d.players {
+		if p.isRobot() {
+			robots = append(robots, p)
+			continue
+		}
+		s := p.currentSession()
+		if s == nil {
+			continue
+		}
+		s.Push(protocol.RouteHuanSanZhangHint, &protocol.HuanSanZhangHint{Tiles: p.huanSanZhangTiles()})
+	}
+	for _, r := range robots {
+		if err := h.choose(r, r.huanSanZhangTiles()); err != nil {
+			r.logger.Error(err)
+		}
+	}
+}
+
+// 超时定时器在nano逻辑协程中触发, 投递到牌桌协程中执行
+func (h *huanSanZhangContext) startTimer() {
+	d := h.desk
+	h.seq++
+	seq := h.seq
+	h.timer = scheduler.NewAfterTimer(huanSanZhangTimeout, func() {
+		d.post(func() { h.timeout(seq) })
+	})
+}
+
+func (h *huanSanZhangContext) isChosen(uid int64) bool {
+	_, ok := h.chosen[uid]
+	return ok
+}
+
+// 玩家选择换出的牌, 所有人选择完成后交换
+func (h *huanSanZhangContext) choose(p *Player, tiles []int) error {
+	d := h.desk
+	if d.status() != constant.DeskStatusHuanSanZhang {
+		return errutil.ErrIllegalDeskStatus
+	}
+
+	uid := p.Uid()
+	if h.isChosen(uid) {
+		return nil
+	}
+	if !p.canHuanSanZhang(tiles) {
+		return ErrIllegalHuanSanZhang
+	}
+
+	h.chosen[uid] = tiles
+	p.logger.Infof("玩家选择换三张: %v", tiles)
+	d.emit(uid, history.EventHuanSanZhangChose, &protocol.HuanSanZhangRequest{Tiles: tiles})
+	d.broadcast(protocol.RouteHuanSanZhangChosen, &protocol.HuanSanZhangChosen{Uid: uid})
+
+	for _, p := range d.players {
+		if !h.isChosen(p.Uid()) {
+			return nil
+		}
+	}
+
+	h.exchange()
+	return nil
+}
+
+// 选择超时, 未选择的玩家使用推荐的牌
+func (h *huanSanZhangContext) timeout(seq int) {
+	if h.timer == nil || h.seq != seq {
+		return
+	}
+	h.stop()
+
+	for _, p := range h.desk.players {
+		if h.isChosen(p.Uid()) {
+			continue
+		}
+		if err := h.choose(p, p.huanSanZhangTiles()); err != nil {
+			p.logger.Error(err)
+		}
+	}
+}
+
+// 掷骰子决定方向: 四人牌桌为顺时针/逆时针/对家, 其他为顺时针/逆时针
+func huanSanZhangDirection(dice1, dice2, playerCount int) int {
+	sum := dice1 + dice2
+	if playerCount == 4 {
+		return []int{
+			protocol.HuanSanZhangAcross,
+			protocol.HuanSanZhangClockwise,
+			protocol.HuanSanZhangCounterClockwise,
+		}[sum%3]
+	}
+	if sum%2 == 0 {
+		return protocol.HuanSanZhangClockwise
+	}
+	return protocol.HuanSanZhangCounterClockwise
+}
+
+// 换给哪个方位的玩家, 打牌顺序为逆时针, 下家为turn+1
+func huanSanZhangTarget(turn, direction, playerCount int) int {
+	switch direction {
+	case protocol.HuanSanZhangClockwise:
+		return (turn + playerCount - 1) % playerCount
+	case protocol.HuanSanZhangAcross:
+		return (turn + 2) % playerCount
+	default:
+		return (turn + 1) % playerCount
+	}
+}
+
+// 交换手牌, 通知玩家并进入定缺
+func (h *huanSanZhangContext) exchange() {
+	h.stop()
+
+	d := h.desk
+	count := d.totalPlayerCount()
+
+	dc := newDice()
+	dc.random(d.rand)
+	result := &protocol.HuanSanZhangResult{
+		Dice1:     dc.dice1,
+		Dice2:     dc.dice2,
+		Direction: huanSanZhangDirection(dc.dice1, dc.dice2, count),
+		Players:   make([]protocol.HuanSanZhangInfo, count),
+	}
+
+	for i, p := range d.players {
+		out := h.chosen[p.Uid()]
+		result.Players[i].Uid = p.Uid()
+		result.Players[i].Out = out
+		result.Players[huanSanZhangTarget(i, result.Direction, count)].In = out
+		for _, id := range out {
+			mahjong.RemoveId(&p.onHand, id)
+		}
+	}
+	for i, p := range d.players {
+		for _, id := range result.Players[i].In {
+			p.onHand = append(p.onHand, mahjong.TileFromID(id))
+		}
+	}
+
+	d.logger.Infof("换三张完成: 骰子=%d,%d 方向=%d", result.Dice1, result.Dice2, result.Direction)
+
+	if d.snapshot != nil {
+		d.snapshot.SetHuanSanZhang(result)
+	}
+	d.emit(0, history.EventHuanSanZhang, result)
+	d.broadcastView(protocol.RouteHuanSanZhang, func(uid int64) interface{} {
+		return huanSanZhangView(result, uid)
+	})
+
+	d.dingQueHint()
+}
+
+// 推荐换出的牌: 数量不少于三张的花色中, 数量最少的花色的三张牌, 没有时返回nil
+func (p *Player) huanSanZhangTiles() []int {
+	suits := make([]mahjong.Mahjong, 3)
+	for _, t := range p.onHand {
+		if t.Suit > mahjong.SuitWan {
+			continue
+		}
+		suits[t.Suit] = append(suits[t.Suit], t)
+	}
+
+	var tiles mahjong.Mahjong
+	for _, s := range suits {
+		if len(s) >= 3 && (tiles == nil || len(s) < len(tiles)) {
+			tiles = s
+		}
+	}
+	if tiles == nil {
+		return nil
+	}
+	return tiles[:3].Ids()
+}
+
+// 是否是三张不同的同花色数牌手牌
+func (p *Player) canHuanSanZhang(tiles []int) bool {
+	if len(tiles) != 3 {
+		return false
+	}
+
+	onHand := map[int]bool{}
+	for _, t := range p.onHand {
+		onHand[t.Id] = true
+	}
+
+	suit := -1
+	for _, id := range tiles {
+		if !onHand[id] {
+			return false
+		}
+		// 同一张牌不能选择两次
+		onHand[id] = false
+
+		t := mahjong.TileFromID(id)
+		if t.Suit > mahjong.SuitWan || suit >= 0 && t.Suit != suit {
+			return false
+		}
+		suit = t.Suit
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package game
+
+import (
+	"testing"
+
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/protocol"
+)
+
+func TestHuanSanZhangTarget(t *testing.T) {
+	cases := []struct {
+		count     int
+		direction int
+		targets   []int
+	}{
+		{4, protocol.HuanSanZhangClockwise, []int{3, 0, 1, 2}},
+		{4, protocol.HuanSanZhangCounterClockwise, []int{1, 2, 3, 0}},
+		{4, protocol.HuanSanZhangAcross, []int{2, 3, 0, 1}},
+		{3, protocol.HuanSanZhangClockwise, []int{2, 0, 1}},
+		{3, protocol.HuanSanZhangCounterClockwise, []int{1, 2, 0}},
+	}
+	for _, c := range cases {
+		for turn, expected := range c.targets {
+			if target := huanSanZhangTarget(turn, c.direction, c.count); target != expected {
+				t.Fatalf("count=%d direction=%d turn=%d, target=%d, expected %d", c.count, c.direction, turn, target, expected)
+			}
+		}
+	}
+
+	// 三人牌桌不能对家互换
+	for d1 := 1; d1 <= 6; d1++ {
+		for d2 := 1; d2 <= 6; d2++ {
+			if huanSanZhangDirection(d1, d2, 3) == protocol.HuanSanZhangAcross {
+				t.Fatalf("dice=%d,%d should not swap across with 3 players", d1, d2)
+			}
+		}
+	}
+}
+
+func TestCanHuanSanZhang(t *testing.T) {
+	p := &Player{}
+	// 1条 x2, 2条, 1筒
+	for _, id := range []int{0, 1, 4, 36} {
+		p.onHand = append(p.onHand, mahjong.TileFromID(id))
+	}
+
+	cases := []struct {
+		tiles []int
+		ok    bool
+	}{
+		{[]int{0, 1, 4}, true},
+		{[]int{0, 1}, false},
+		{[]int{0, 0, 4}, false},
+		{[]int{0, 1, 36}, false},
+		{[]int{0, 1, 8}, false},
+	}
+	for _, c := range cases {
+		if ok := p.canHuanSanZhang(c.tiles); ok != c.ok {
+			t.Fatalf("tiles=%v ok=%t, expected %t", c.tiles, ok, c.ok)
+		}
+	}
+}
+
+// 字牌很多的手牌: 没有三张同花色的数牌时没有推荐, 字牌不能换出
+func TestHuanSanZhangHonors(t *testing.T) {
+	p := &Player{}
+	// 1条, 2条, 1筒 和十张字牌
+	for _, id := range []int{0, 4, 36, 108, 109, 110, 112, 113, 116, 120, 124, 128, 132} {
+		p.onHand = append(p.onHand, mahjong.TileFromID(id))
+	}
+	if tiles := p.huanSanZhangTiles(); tiles != nil {
+		t.Fatalf("tiles=%v, expected nil", tiles)
+	}
+	for _, tiles := range [][]int{{108, 109, 110}, {108, 112, 116}, {0, 4, 108}} {
+		if p.canHuanSanZhang(tiles) {
+			t.Fatalf("tiles=%v should be rejected", tiles)
+		}
+	}
+
+	// 有三张条子时推荐条子
+	p.onHand = append(p.onHand, mahjong.TileFromID(8))
+	if tiles := p.huanSanZhangTiles(); len(tiles) != 3 || !p.canHuanSanZhang(tiles) {
+		t.Fatalf("tiles=%v", tiles)
+	}
+}
+
+func TestHuanSanZhangRound(t *testing.T) {
+	ms := setupLoopTest(t)
+	before := len(ms.deskHistories("100201"))
+	opts := &protocol.DeskOptions{Mode: ModeFours, MaxRound: 1, MaxFan: 3, Pinghu: true, HuanSanZhang: true}
+	d, _, e, _ := newPlayingDeskWithOptions(t, "100201", opts)
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+
+	if c := e.pushCount(protocol.RouteHuanSanZhang); c != 1 {
+		t.Fatalf("huan san zhang push count=%d, expected 1", c)
+	}
+
+	hs := ms.deskHistories(d.roomNo)
+	if c := len(hs) - before; c != 1 {
+		t.Fatalf("history count=%d, expected 1", c)
+	}
+	r := hs[len(hs)-1].HuanSanZhang
+	if r == nil {
+		t.Fatal("history should record huan san zhang")
+	}
+
+	// 每个玩家换入的牌就是对应方位玩家换出的牌
+	count := len(r.Players)
+	for turn, info := range r.Players {
+		if len(info.Out) != 3 || len(info.In) != 3 {
+			t.Fatalf("player=%d out=%v in=%v", info.Uid, info.Out, info.In)
+		}
+		target := r.Players[huanSanZhangTarget(turn, r.Direction, count)]
+		for i := range info.Out {
+			if info.Out[i] != target.In[i] {
+				t.Fatalf("player=%d out=%v, target=%d in=%v", info.Uid, info.Out, target.Uid, target.In)
+			}
+		}
+	}
+}
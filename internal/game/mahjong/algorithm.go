@@ -9,7 +9,7 @@ func isLegal(indexes Indexes) bool {
 
 	sequence, sequenceCount := indexes.UnmarkedSequence() // 顺子
 	if sequenceCount == 3 {
-		if sequence[0].Index > 30 {
+		if sequence[0].Index > MaxSuitIndex {
 			return false // 字牌不能组合成顺子
 		}
 		indexes.Mark(int(sequence[0].I), int(sequence[1].I), int(sequence[2].I))
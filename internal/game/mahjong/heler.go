@@ -10,8 +10,8 @@ func NewStats(indexes ...Indexes) *Stats {
 	return ts
 }
 
-//是否是清一色
-func isQingYiSe(ms *Stats) bool {
+// 牌型中出现的花色, 条/筒/万/字牌各占一位
+func suitFlags(ms *Stats) byte {
 	var flag byte
 
 	for i, v := range ms {
@@ -19,7 +19,9 @@ func isQingYiSe(ms *Stats) bool {
 			continue
 		}
 
-		if i > 20 {
+		if i > MaxSuitIndex {
+			flag |= 1 << 3
+		} else if i > 20 {
 			flag |= 1 << 2
 		} else if i > 10 {
 			flag |= 1 << 1
@@ -29,6 +31,12 @@ func isQingYiSe(ms *Stats) bool {
 
 	}
 
+	return flag
+}
+
+//是否是清一色
+func isQingYiSe(ms *Stats) bool {
+	flag := suitFlags(ms)
 	return flag == 4 || flag == 2 || flag == 1
 }
 
@@ -84,6 +92,11 @@ func is258(ms *Stats) bool {
 			continue
 		}
 
+		// 字牌不是258
+		if index > MaxSuitIndex {
+			return false
+		}
+
 		switch mod := index % 10; mod {
 		case 2, 5, 8:
 			continue
@@ -94,13 +107,17 @@ func is258(ms *Stats) bool {
 	return true
 }
 
-// 胡牌时, 所有牌没有1和9
+// 胡牌时, 所有牌没有1和9, 也没有字牌
 func isZhongzhang(ms *Stats) bool {
 	for index, v := range ms {
 		if v == 0 {
 			continue
 		}
 
+		if index > MaxSuitIndex {
+			return false
+		}
+
 		if mod := index % 10; mod == 1 || mod == 9 {
 			return false
 		}
@@ -116,7 +133,7 @@ func isJiaxin(ctx *Context, onHand Indexes) bool {
 	}
 
 	// 5,15,25
-	if index%10 != 5 {
+	if index > MaxSuitIndex || index%10 != 5 {
 		return false
 	}
 
@@ -272,7 +289,7 @@ func CanHu(onHand Indexes, discard int) bool {
 func IsTing(onHand Indexes) bool {
 	clone := make(Indexes, len(onHand)+1)
 	for i := 0; i <= MaxTileIndex; i++ {
-		if i%10 == 0 {
+		if !IsPlayableIndex(i) {
 			continue
 		}
 		copy(clone, onHand)
@@ -286,15 +303,20 @@ func IsTing(onHand Indexes) bool {
 
 // 传入一副牌，返回所有的听牌
 func TingTiles(onHand Indexes) Indexes {
+	return tingTiles(onHand, CheckWin)
+}
+
+// 逐一加入每种麻将, 使用checkWin判断是否可以胡牌
+func tingTiles(onHand Indexes, checkWin func(Indexes) bool) Indexes {
 	clone := make(Indexes, len(onHand)+1)
 	rts := make(Indexes, 0)
 	for i := 0; i <= MaxTileIndex; i++ {
-		if i%10 == 0 {
+		if !IsPlayableIndex(i) {
 			continue
 		}
 		copy(clone, onHand)
 		clone[len(onHand)] = i
-		if CheckWin(clone) {
+		if checkWin(clone) {
 			rts = append(rts, i)
 		}
 	}
@@ -1,17 +1,23 @@
 package mahjong
 
 import (
-	"math/rand"
 	"sort"
 	"strings"
-	"time"
+
+	"go-mahjong-server/pkg/rng"
 )
 
 //每种花色(条,筒)最多9种牌型,但牌是没有0点的共计 9+9
 // 1-9: 条
 // 11-19: 筒
 // 21-29: 万
-const MaxTileIndex = 29
+// 31-37: 东南西北中发白
+// 41-48: 春夏秋冬梅兰竹菊
+const (
+	MaxSuitIndex  = 29 // 最大的数牌
+	MaxHonorIndex = 37 // 最大的字牌
+	MaxTileIndex  = 48 // 最大的花牌
+)
 
 type Mahjong []*Tile
 
@@ -35,12 +41,10 @@ func (m Mahjong) String() string {
 	return strings.Join(res, " ")
 }
 
-func (m Mahjong) Shuffle() {
-	s := rand.New(rand.NewSource(time.Now().Unix()))
-	for i := range m {
-		j := s.Intn(len(m))
+func (m Mahjong) Shuffle(r *rng.Rand) {
+	r.Shuffle(len(m), func(i, j int) {
 		m[i], m[j] = m[j], m[i]
-	}
+	})
 }
 
 func (m Mahjong) Sort() {
@@ -88,7 +92,3 @@ func FromID(ids []int) Mahjong {
 	}
 	return mj
 }
-
-func init() {
-	rand.Seed(time.Now().Unix())
-}
@@ -3,9 +3,8 @@ package mahjong
 import (
 	"bytes"
 	"fmt"
-	"math/rand"
-	"time"
 
+	"go-mahjong-server/pkg/rng"
 	"go-mahjong-server/protocol"
 )
 
@@ -14,24 +13,44 @@ const (
 	MeiHu  = -2 // 没胡牌
 )
 
-type Tiles []int //麻将内部表示(即72张牌的id号列表)
+type Tiles []int //麻将内部表示(即牌墙中麻将的id号列表)
 
-func (m Tiles) Shuffle() {
-	s := rand.New(rand.NewSource(time.Now().Unix()))
-	for i := range m {
-		j := s.Intn(len(m))
+func (m Tiles) Shuffle(r *rng.Rand) {
+	r.Shuffle(len(m), func(i, j int) {
 		m[i], m[j] = m[j], m[i]
-	}
+	})
 }
 
-func New(count int) Tiles {
+func New(r *rng.Rand, count int) Tiles {
 	tiles := make(Tiles, count)
 
 	for i := range tiles {
 		tiles[i] = i
 	}
 
-	tiles.Shuffle()
+	tiles.Shuffle(r)
+	return tiles
+}
+
+// 只包含指定花色的牌墙, 例如二人麻将只使用万字牌
+func NewWithSuits(r *rng.Rand, suits ...int) Tiles {
+	tiles := Tiles{}
+	for _, suit := range suits {
+		var begin, end int
+		switch suit {
+		case SuitHonor:
+			begin, end = MaxSuitID+1, MaxHonorID
+		case SuitFlower:
+			begin, end = MaxHonorID+1, MaxFlowerID
+		default:
+			begin, end = suit*36, suit*36+35
+		}
+		for id := begin; id <= end; id++ {
+			tiles = append(tiles, id)
+		}
+	}
+
+	tiles.Shuffle(r)
 	return tiles
 }
 
@@ -70,7 +89,7 @@ func (ms *Stats) FromIndex(tiles ...Indexes) {
 }
 
 func (ms *Stats) CountWithIndex(idx int) int {
-	if idx < 0 || idx%10 == 0 || idx > MaxTileIndex {
+	if !IsValidIndex(idx) {
 		return IllegalIndex
 	}
 	fmt.Println("CountWithIndex", idx, ms)
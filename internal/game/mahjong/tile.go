@@ -4,25 +4,80 @@ import (
 	"fmt"
 )
 
+// 花色
+const (
+	SuitTiao   = 0
+	SuitTong   = 1
+	SuitWan    = 2
+	SuitHonor  = 3 // 字牌
+	SuitFlower = 4 // 花牌
+)
+
+// 麻将ID的范围, 数牌和字牌每种4张, 花牌每种1张
+const (
+	MaxSuitID   = 107 // 0~107: 条筒万
+	MaxHonorID  = 135 // 108~135: 东南西北中发白
+	MaxFlowerID = 143 // 136~143: 春夏秋冬梅兰竹菊
+)
+
 var tileNames = []string{"条", "筒", "万"}
 
+var honorNames = []string{"东", "南", "西", "北", "中", "发", "白"}
+
+var flowerNames = []string{"春", "夏", "秋", "冬", "梅", "兰", "竹", "菊"}
+
 type Tile struct {
 	Id    int
 	Suit  int //花色
 	Rank  int //点数
-	Index int //索引(1~9, 11~19)
+	Index int //索引(1~9, 11~19, 21~29, 31~37, 41~48)
 }
 
 func (t *Tile) String() string {
+	switch t.Suit {
+	case SuitHonor:
+		return honorNames[t.Rank-1]
+	case SuitFlower:
+		return flowerNames[t.Rank-1]
+	}
 	return fmt.Sprintf("%d%s", t.Rank, tileNames[t.Suit])
 }
 
+// 是否是字牌
+func (t *Tile) IsHonor() bool {
+	return t.Suit == SuitHonor
+}
+
+// 是否是花牌
+func (t *Tile) IsFlower() bool {
+	return t.Suit == SuitFlower
+}
+
 func (t *Tile) Equals(other *Tile) bool {
 	return t.Index == other.Index
 }
 
+// 是否是合法的麻将索引
+func IsValidIndex(idx int) bool {
+	switch {
+	case idx <= 0 || idx%10 == 0:
+		return false
+	case idx <= MaxSuitIndex:
+		return true
+	case idx < 40:
+		return idx <= MaxHonorIndex
+	default:
+		return idx <= MaxTileIndex
+	}
+}
+
+// 是否是可以组成胡牌牌型的麻将(数牌和字牌), 花牌不参与胡牌
+func IsPlayableIndex(idx int) bool {
+	return IsValidIndex(idx) && idx <= MaxHonorIndex
+}
+
 func TileFromIndex(idx int) *Tile {
-	if idx < 0 || idx > MaxTileIndex || idx%10 == 0 {
+	if !IsValidIndex(idx) {
 		return nil
 	}
 
@@ -34,32 +89,31 @@ func TileFromIndex(idx int) *Tile {
 }
 
 func IndexFromID(id int) int {
-	if id < 0 {
+	if id < 0 || id > MaxFlowerID {
 		panic(fmt.Errorf("ilegal tile id: %d", id))
 	}
-	var (
-		tmp = id / 4
-		h   = tmp / 9
-		v   = tmp%9 + 1
-		i   = h*10 + v
-	)
-
-	return i
+	return TileFromID(id).Index
 }
 
 //id: 0~3 -> 1条  4~7 -> 2条 ...
-//0~35 =>条 36~71 =>筒
+//0~35 =>条 36~71 =>筒 72~107 =>万
+//108~135 =>字牌, 每4张一种 136~143 =>花牌, 每种1张
 func TileFromID(id int) *Tile {
-	if id < 0 {
+	if id < 0 || id > MaxFlowerID {
 		panic("illegal tile id")
 	}
 
-	var (
-		tmp = id / 4
-		h   = tmp / 9
-		v   = tmp%9 + 1
-		i   = h*10 + v
-	)
+	var h, v int
+	switch {
+	case id <= MaxHonorID:
+		tmp := id / 4
+		h, v = tmp/9, tmp%9+1
+		if h == SuitHonor {
+			v = tmp - 27 + 1
+		}
+	default:
+		h, v = SuitFlower, id-MaxHonorID
+	}
 
-	return &Tile{Suit: h, Rank: v, Index: i, Id: id}
+	return &Tile{Suit: h, Rank: v, Index: h*10 + v, Id: id}
 }
@@ -0,0 +1,119 @@
+package mahjong
+
+// 推倒胡: 136张(条筒万和字牌), 可以吃碰杠, 除普通胡牌和七对外还可以胡十三幺
+
+// 十三幺需要的13种幺九牌和字牌
+var shiSanYao = []int{1, 9, 11, 19, 21, 29, 31, 32, 33, 34, 35, 36, 37}
+
+// 十三幺的番数, 超过封顶番数时按极品计算
+const shiSanYaoFan = 13
+
+// 十三幺: 13种幺九牌和字牌各一张, 其中一种再多一张
+func IsShiSanYao(onHand Indexes) bool {
+	if len(onHand) != 14 {
+		return false
+	}
+
+	ms := NewStats(onHand)
+	pair := false
+	for _, idx := range shiSanYao {
+		switch ms[idx] {
+		case 1:
+		case 2:
+			if pair {
+				return false
+			}
+			pair = true
+		default:
+			return false
+		}
+	}
+	return pair
+}
+
+// 推倒胡是否可以胡牌
+func CheckTuiDaoHu(onHand Indexes) bool {
+	return IsShiSanYao(onHand) || CheckWin(onHand)
+}
+
+// 推倒胡的所有听牌
+func TuiDaoHuTingTiles(onHand Indexes) Indexes {
+	return tingTiles(onHand, CheckTuiDaoHu)
+}
+
+// 推倒胡番数: 十三幺, 字一色, 清一色, 混一色, 七对, 碰碰胡, 海底, 杠上花, 杠上炮, 抢杠胡
+func TuiDaoHuMultiple(ctx *Context, onHand, pongKong Indexes) int {
+	if len(onHand)%3 != 2 {
+		panic("error tile count")
+	}
+
+	ctx.Desc = []string{}
+
+	if len(pongKong) == 0 && IsShiSanYao(onHand) {
+		ctx.Desc = append(ctx.Desc, "十三幺")
+		return shiSanYaoFan
+	}
+
+	ms := NewStats(onHand, pongKong)
+	multiple := 0
+
+	const honor = 1 << 3
+	switch flag := suitFlags(ms); flag {
+	case honor:
+		multiple += 3
+		ctx.Desc = append(ctx.Desc, "字一色")
+	case 1, 2, 4:
+		multiple += 2
+		ctx.Desc = append(ctx.Desc, "清一色")
+	case honor | 1, honor | 2, honor | 4:
+		multiple++
+		ctx.Desc = append(ctx.Desc, "混一色")
+	}
+
+	// 七对不能有碰杠吃
+	if len(pongKong) == 0 && isQiDui(ms) {
+		multiple += 2
+		ctx.Desc = append(ctx.Desc, "七对")
+	} else if isDaDui(ms) {
+		multiple++
+		ctx.Desc = append(ctx.Desc, "碰碰胡")
+	}
+
+	if ctx.IsLastTile {
+		multiple++
+		ctx.Desc = append(ctx.Desc, "海底")
+	}
+	if ctx.IsGangShangHua {
+		multiple++
+		ctx.Desc = append(ctx.Desc, "杠上花")
+	}
+	if ctx.IsGangShangPao {
+		multiple++
+		ctx.Desc = append(ctx.Desc, "杠上炮")
+	}
+	if ctx.IsQiangGangHu {
+		multiple++
+		ctx.Desc = append(ctx.Desc, "抢杠胡")
+	}
+
+	return multiple
+}
+
+// 推倒胡听牌的最大番数
+func TuiDaoHuMaxMultiple(onHand, pongKong Indexes) (multiple int, index int) {
+	index = IllegalIndex
+	multiple = -1
+	for _, idx := range TuiDaoHuTingTiles(onHand) {
+		handTiles := make(Indexes, len(onHand)+1)
+		copy(handTiles, onHand)
+		handTiles[len(onHand)] = idx
+
+		ctx := &Context{}
+		if m := TuiDaoHuMultiple(ctx, handTiles, pongKong); m > multiple {
+			index = idx
+			multiple = m
+		}
+	}
+
+	return
+}
@@ -0,0 +1,392 @@
+package game
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-mahjong-server/db"
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/async"
+	"go-mahjong-server/pkg/cluster"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/component"
+	"github.com/lonng/nano/session"
+)
+
+// 邮件: 系统或者管理员发送给单个玩家, 俱乐部成员或者所有玩家, 可以附带房卡.
+// 邮件只保存一份, 每个玩家的已读/领取/删除状态单独记录, 领取附件时在同一个事务中增加房卡, 重复领取不会重复增加
+
+const (
+	mailMaxCount     = 100 // 最多显示的邮件数量
+	mailTitleLimit   = 64
+	mailContentLimit = 1024
+)
+
+var mailExpire = 30 * 24 * time.Hour // 邮件默认有效期
+
+const (
+	mailNotFoundMessage = "邮件不存在或者已经过期"
+	mailAdminMessage    = "只有管理员才能发送邮件"
+)
+
+type MailManager struct {
+	component.Base
+	store   mailStore
+	now     func() time.Time
+	isAdmin func(uid int64) bool
+	isClub  func(clubId, uid int64) bool
+}
+
+// 玩家看到的一封邮件
+type mailEntry struct {
+	mail  *model.Mail
+	state *model.MailState // 没有操作过时为nil
+}
+
+var defaultMailManager = NewMailManager()
+
+func NewMailManager() *MailManager {
+	return &MailManager{
+		store:   dbStore{},
+		now:     time.Now,
+		isAdmin: db.IsAdmin,
+		isClub:  db.IsClubMember,
+	}
+}
+
+func (e *mailEntry) read() bool {
+	return e.state != nil && e.state.ReadAt > 0
+}
+
+func (e *mailEntry) claimed() bool {
+	return e.state != nil && e.state.ClaimedAt > 0
+}
+
+func (e *mailEntry) deleted() bool {
+	return e.state != nil && e.state.DeletedAt > 0
+}
+
+func (e *mailEntry) setState(fn func(st *model.MailState)) {
+	if e.state == nil {
+		e.state = &model.MailState{MailId: e.mail.Id}
+	}
+	fn(e.state)
+}
+
+func (e *mailEntry) view() protocol.Mail {
+	return protocol.Mail{
+		ID:        e.mail.Id,
+		Kind:      e.mail.Kind,
+		Title:     e.mail.Title,
+		Content:   e.mail.Content,
+		Coin:      e.mail.Coin,
+		Read:      e.read(),
+		Claimed:   e.claimed(),
+		CreatedAt: e.mail.CreatedAt,
+		ExpireAt:  e.mail.ExpireAt,
+	}
+}
+
+func mailUnread(entries []*mailEntry) int {
+	n := 0
+	for _, e := range entries {
+		if !e.read() && !e.deleted() {
+			n++
+		}
+	}
+	return n
+}
+
+// 请求中的邮件, 为空时返回所有邮件, 有不存在的邮件时返回false
+func selectMails(entries []*mailEntry, ids []int64) ([]*mailEntry, bool) {
+	if len(ids) == 0 {
+		return entries, true
+	}
+	byId := map[int64]*mailEntry{}
+	for _, e := range entries {
+		byId[e.mail.Id] = e
+	}
+	list := []*mailEntry{}
+	for _, id := range ids {
+		e, ok := byId[id]
+		if !ok {
+			return nil, false
+		}
+		list = append(list, e)
+	}
+	return list, true
+}
+
+// 玩家当前可以看到的邮件和状态
+func (m *MailManager) entries(uid int64) ([]*mailEntry, error) {
+	mails, err := m.store.mails(uid, m.now().Unix(), mailMaxCount)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(mails))
+	for _, mail := range mails {
+		ids = append(ids, mail.Id)
+	}
+	states, err := m.store.mailStates(uid, ids)
+	if err != nil {
+		return nil, err
+	}
+	byMail := map[int64]*model.MailState{}
+	for _, st := range states {
+		byMail[st.MailId] = st
+	}
+
+	entries := make([]*mailEntry, 0, len(mails))
+	for _, mail := range mails {
+		entries = append(entries, &mailEntry{mail: mail, state: byMail[mail.Id]})
+	}
+	return entries, nil
+}
+
+// List 邮件列表, 新邮件在前
+func (m *MailManager) List(s *session.Session, _ []byte) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	entries, err := m.entries(p.Uid())
+	if err != nil {
+		return s.Response(&protocol.ErrorResponse{Code: errutil.Code(err), Error: err.Error()})
+	}
+	resp := &protocol.MailListResponse{Mails: []protocol.Mail{}, Unread: mailUnread(entries)}
+	for _, e := range entries {
+		resp.Mails = append(resp.Mails, e.view())
+	}
+	return s.Response(resp)
+}
+
+// Read 标记为已读
+func (m *MailManager) Read(s *session.Session, req *protocol.MailOperateRequest) error {
+	return m.operate(s, req, func(uid int64, list []*mailEntry, resp *protocol.MailOperateResponse) error {
+		now := m.now().Unix()
+		ids := []int64{}
+		for _, e := range list {
+			if !e.read() {
+				ids = append(ids, e.mail.Id)
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := m.store.readMails(uid, ids, now); err != nil {
+			return err
+		}
+		for _, e := range list {
+			e.setState(func(st *model.MailState) {
+				if st.ReadAt == 0 {
+					st.ReadAt = now
+				}
+			})
+		}
+		return nil
+	})
+}
+
+// Claim 领取附件, 已经领取过的邮件忽略
+func (m *MailManager) Claim(s *session.Session, req *protocol.MailOperateRequest) error {
+	return m.operate(s, req, func(uid int64, list []*mailEntry, resp *protocol.MailOperateResponse) error {
+		balance, err := m.claim(uid, list, resp)
+		// 与充值相同, 同步玩家的房卡数量并推送
+		if len(resp.Claimed) > 0 {
+			defaultManager.rechargePlayer(RechargeInfo{Uid: uid, Coin: balance})
+		}
+		return err
+	})
+}
+
+// 逐个领取附件, 返回领取之后的房卡数量
+func (m *MailManager) claim(uid int64, list []*mailEntry, resp *protocol.MailOperateResponse) (int64, error) {
+	now := m.now().Unix()
+	balance := int64(0)
+	for _, e := range list {
+		if e.mail.Coin <= 0 || e.claimed() {
+			continue
+		}
+		ok, coin, err := m.store.claimMail(uid, e.mail, now)
+		if err != nil {
+			logger.Errorf("领取邮件附件失败, UID=%d, 邮件=%d, Error=%v", uid, e.mail.Id, err)
+			return balance, err
+		}
+		e.setState(func(st *model.MailState) {
+			if st.ReadAt == 0 {
+				st.ReadAt = now
+			}
+			st.ClaimedAt = now
+		})
+		// 在其他节点已经领取
+		if !ok {
+			continue
+		}
+		resp.Claimed = append(resp.Claimed, e.mail.Id)
+		balance = coin
+		logger.Infof("领取邮件附件: UID=%d, 邮件=%d, 房卡=%d, 剩余房卡=%d", uid, e.mail.Id, e.mail.Coin, coin)
+	}
+	return balance, nil
+}
+
+// Delete 删除邮件, 还没有领取附件的邮件不能删除
+func (m *MailManager) Delete(s *session.Session, req *protocol.MailOperateRequest) error {
+	return m.operate(s, req, func(uid int64, list []*mailEntry, resp *protocol.MailOperateResponse) error {
+		now := m.now().Unix()
+		deleted := []*mailEntry{}
+		ids := []int64{}
+		for _, e := range list {
+			if e.mail.Coin > 0 && !e.claimed() {
+				continue
+			}
+			deleted = append(deleted, e)
+			ids = append(ids, e.mail.Id)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := m.store.deleteMails(uid, ids, now); err != nil {
+			return err
+		}
+		for _, e := range deleted {
+			e.setState(func(st *model.MailState) { st.DeletedAt = now })
+		}
+		return nil
+	})
+}
+
+// 已读/领取/删除的公共流程: 检查邮件是否存在, 操作之后返回未读数量和房卡数量
+func (m *MailManager) operate(s *session.Session, req *protocol.MailOperateRequest,
+	fn func(uid int64, list []*mailEntry, resp *protocol.MailOperateResponse) error) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+	if len(req.MailIDs) > mailMaxCount {
+		return errutil.ErrIllegalParameter
+	}
+
+	uid := p.Uid()
+	entries, err := m.entries(uid)
+	if err != nil {
+		return s.Response(&protocol.MailOperateResponse{Code: errutil.Code(err), Error: err.Error()})
+	}
+	list, ok := selectMails(entries, req.MailIDs)
+	if !ok {
+		return s.Response(&protocol.MailOperateResponse{Code: errorCode, Error: mailNotFoundMessage})
+	}
+
+	resp := &protocol.MailOperateResponse{Claimed: []int64{}}
+	if err := fn(uid, list, resp); err != nil {
+		resp.Code, resp.Error = errutil.Code(err), err.Error()
+	}
+	resp.Unread = mailUnread(entries)
+	resp.Coin = p.coinCount()
+	return s.Response(resp)
+}
+
+// Send 管理员发送邮件
+func (m *MailManager) Send(s *session.Session, req *protocol.SendMailRequest) error {
+	uid := s.UID()
+	if !m.isAdmin(uid) {
+		return s.Response(&protocol.ErrorResponse{
+			Code:  errutil.Code(errutil.ErrPermissionDenied),
+			Error: mailAdminMessage,
+		})
+	}
+
+	mail, err := m.newMail(protocol.MailKindAdmin, uid, req)
+	if err != nil {
+		return err
+	}
+	if err := m.store.insertMail(mail); err != nil {
+		return s.Response(&protocol.ErrorResponse{Code: errutil.Code(err), Error: err.Error()})
+	}
+	logger.Infof("管理员发送邮件: UID=%d, 邮件=%d, 范围=%d, 对象=%d, 房卡=%d", uid, mail.Id, mail.Scope, mail.Target, mail.Coin)
+
+	m.notify(mail)
+	if cluster.Enabled() {
+		async.Run(func() { cluster.Broadcast(routeMail, mail) })
+	}
+	return s.Response(protocol.SuccessResponse)
+}
+
+func (m *MailManager) newMail(kind int, sender int64, req *protocol.SendMailRequest) (*model.Mail, error) {
+	title := strings.TrimSpace(req.Title)
+	switch {
+	case req.Scope < protocol.MailScopeUser || req.Scope > protocol.MailScopeAll,
+		req.Scope != protocol.MailScopeAll && req.Target <= 0,
+		title == "", utf8.RuneCountInString(title) > mailTitleLimit,
+		utf8.RuneCountInString(req.Content) > mailContentLimit,
+		req.Coin < 0, req.ExpireDays < 0:
+		return nil, errutil.ErrIllegalParameter
+	}
+
+	now := m.now()
+	expire := mailExpire
+	if req.ExpireDays > 0 {
+		expire = time.Duration(req.ExpireDays) * 24 * time.Hour
+	}
+	mail := &model.Mail{
+		Kind:      kind,
+		Sender:    sender,
+		Scope:     req.Scope,
+		Target:    req.Target,
+		Title:     title,
+		Content:   req.Content,
+		Coin:      req.Coin,
+		CreatedAt: now.Unix(),
+		ExpireAt:  now.Add(expire).Unix(),
+	}
+	if mail.Scope == protocol.MailScopeAll {
+		mail.Target = 0
+	}
+	return mail, nil
+}
+
+// 推送当前节点上在线收件人的未读数量, 在逻辑协程中调用
+func (m *MailManager) notify(mail *model.Mail) {
+	type recipient struct {
+		uid int64
+		s   *session.Session
+	}
+	list := []recipient{}
+	for uid, p := range defaultManager.players {
+		if mail.Scope == protocol.MailScopeUser && uid != mail.Target {
+			continue
+		}
+		if s := p.currentSession(); s != nil {
+			list = append(list, recipient{uid, s})
+		}
+	}
+	if len(list) == 0 {
+		return
+	}
+
+	async.Run(func() {
+		for _, r := range list {
+			if mail.Scope == protocol.MailScopeClub && !m.isClub(mail.Target, r.uid) {
+				continue
+			}
+			m.pushUnread(r.s, r.uid)
+		}
+	})
+}
+
+// 玩家登录后推送未读数量
+func (m *MailManager) login(s *session.Session, uid int64) {
+	async.Run(func() { m.pushUnread(s, uid) })
+}
+
+func (m *MailManager) pushUnread(s *session.Session, uid int64) {
+	entries, err := m.entries(uid)
+	if err != nil {
+		logger.Errorf("查询未读邮件失败, UID=%d, Error=%v", uid, err)
+		return
+	}
+	s.Push(protocol.RouteMailNotify, &protocol.MailNotify{Unread: mailUnread(entries)})
+}
@@ -0,0 +1,250 @@
+package game
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+)
+
+// 与数据库相同: 领取附件时只有第一次增加房卡
+type memMailStore struct {
+	mu     sync.Mutex
+	rows   []*model.Mail
+	states map[[2]int64]*model.MailState
+	coins  map[int64]int64
+	clubs  map[int64]int64 // 玩家所在的俱乐部
+}
+
+func newMemMailStore() *memMailStore {
+	return &memMailStore{
+		states: map[[2]int64]*model.MailState{},
+		coins:  map[int64]int64{},
+		clubs:  map[int64]int64{},
+	}
+}
+
+func (m *memMailStore) insertMail(mail *model.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mail.Id = int64(len(m.rows) + 1)
+	m.rows = append(m.rows, mail)
+	return nil
+}
+
+func (m *memMailStore) mails(uid, now int64, limit int) ([]*model.Mail, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []*model.Mail{}
+	for _, mail := range m.rows {
+		visible := mail.Scope == protocol.MailScopeAll ||
+			mail.Scope == protocol.MailScopeUser && mail.Target == uid ||
+			mail.Scope == protocol.MailScopeClub && mail.Target == m.clubs[uid]
+		if st := m.states[[2]int64{mail.Id, uid}]; !visible || mail.ExpireAt <= now || st != nil && st.DeletedAt > 0 {
+			continue
+		}
+		list = append(list, mail)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id > list[j].Id })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (m *memMailStore) mailStates(uid int64, ids []int64) ([]*model.MailState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := []*model.MailState{}
+	for _, id := range ids {
+		if st, ok := m.states[[2]int64{id, uid}]; ok {
+			st := *st
+			list = append(list, &st)
+		}
+	}
+	return list, nil
+}
+
+func (m *memMailStore) state(uid, id int64) *model.MailState {
+	key := [2]int64{id, uid}
+	if _, ok := m.states[key]; !ok {
+		m.states[key] = &model.MailState{MailId: id, Uid: uid}
+	}
+	return m.states[key]
+}
+
+func (m *memMailStore) readMails(uid int64, ids []int64, now int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		if st := m.state(uid, id); st.ReadAt == 0 {
+			st.ReadAt = now
+		}
+	}
+	return nil
+}
+
+func (m *memMailStore) deleteMails(uid int64, ids []int64, now int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		if st := m.state(uid, id); st.DeletedAt == 0 {
+			st.DeletedAt = now
+		}
+	}
+	return nil
+}
+
+func (m *memMailStore) claimMail(uid int64, mail *model.Mail, now int64) (bool, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.state(uid, mail.Id)
+	if st.ClaimedAt > 0 {
+		return false, 0, nil
+	}
+	st.ClaimedAt = now
+	if st.ReadAt == 0 {
+		st.ReadAt = now
+	}
+	m.coins[uid] += mail.Coin
+	return true, m.coins[uid], nil
+}
+
+func TestMail(t *testing.T) {
+	setupLoopTest(t)
+
+	ms := newMemMailStore()
+	now := time.Now()
+	m := NewMailManager()
+	m.store = ms
+	m.now = func() time.Time { return now }
+	m.isAdmin = func(uid int64) bool { return uid == 300 }
+	m.isClub = func(clubId, uid int64) bool { return ms.clubs[uid] == clubId }
+
+	// 在线玩家, 俱乐部7的成员
+	s, e, p := newLoopTestSession(t, 301)
+	p.setCoin(10)
+	ms.coins[301] = 10
+	ms.clubs[301] = 7
+	defaultManager.setPlayer(301, p)
+	t.Cleanup(func() { defaultManager.offline(301) })
+	admin, ae, _ := newLoopTestSession(t, 300)
+
+	send := func(req *protocol.SendMailRequest) int64 {
+		t.Helper()
+		if err := m.Send(admin, req); err != nil {
+			t.Fatal(err)
+		}
+		if resp := ae.lastResponse(); resp != protocol.SuccessResponse {
+			t.Fatalf("send: %+v", resp)
+		}
+		return ms.rows[len(ms.rows)-1].Id
+	}
+	operate := func(fn func(*protocol.MailOperateRequest) error, ids ...int64) *protocol.MailOperateResponse {
+		t.Helper()
+		if err := fn(&protocol.MailOperateRequest{MailIDs: ids}); err != nil {
+			t.Fatal(err)
+		}
+		return e.lastResponse().(*protocol.MailOperateResponse)
+	}
+	read := func(ids ...int64) *protocol.MailOperateResponse {
+		return operate(func(req *protocol.MailOperateRequest) error { return m.Read(s, req) }, ids...)
+	}
+	claim := func(ids ...int64) *protocol.MailOperateResponse {
+		return operate(func(req *protocol.MailOperateRequest) error { return m.Claim(s, req) }, ids...)
+	}
+	remove := func(ids ...int64) *protocol.MailOperateResponse {
+		return operate(func(req *protocol.MailOperateRequest) error { return m.Delete(s, req) }, ids...)
+	}
+	list := func() *protocol.MailListResponse {
+		t.Helper()
+		if err := m.List(s, nil); err != nil {
+			t.Fatal(err)
+		}
+		return e.lastResponse().(*protocol.MailListResponse)
+	}
+
+	// 只有管理员可以发送, 参数不合法时不发送
+	if err := m.Send(s, &protocol.SendMailRequest{Scope: protocol.MailScopeAll, Title: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := e.lastResponse().(*protocol.ErrorResponse); resp.Code != errutil.Code(errutil.ErrPermissionDenied) {
+		t.Fatalf("not admin: %+v", resp)
+	}
+	for _, req := range []*protocol.SendMailRequest{
+		{Scope: 0, Title: "t"},
+		{Scope: protocol.MailScopeUser, Title: "t"},
+		{Scope: protocol.MailScopeAll, Title: " "},
+		{Scope: protocol.MailScopeAll, Title: "t", Coin: -1},
+	} {
+		if err := m.Send(admin, req); err != errutil.ErrIllegalParameter {
+			t.Fatalf("send %+v: %v", req, err)
+		}
+	}
+
+	// 发送给自己, 俱乐部, 所有玩家和其他玩家, 在线收件人收到未读数量
+	mine := send(&protocol.SendMailRequest{Scope: protocol.MailScopeUser, Target: 301, Title: "补偿", Coin: 5})
+	waitFor(t, "新邮件通知", func() bool { return e.pushCount(protocol.RouteMailNotify) == 1 })
+	club := send(&protocol.SendMailRequest{Scope: protocol.MailScopeClub, Target: 7, Title: "俱乐部公告"})
+	all := send(&protocol.SendMailRequest{Scope: protocol.MailScopeAll, Title: "活动", Coin: 2, ExpireDays: 1})
+	other := send(&protocol.SendMailRequest{Scope: protocol.MailScopeUser, Target: 302, Title: "补偿", Coin: 5})
+	send(&protocol.SendMailRequest{Scope: protocol.MailScopeClub, Target: 8, Title: "其他俱乐部"})
+	waitFor(t, "新邮件通知", func() bool { return e.pushCount(protocol.RouteMailNotify) == 3 })
+
+	resp := list()
+	if len(resp.Mails) != 3 || resp.Unread != 3 || resp.Mails[0].ID != all || resp.Mails[2].ID != mine {
+		t.Fatalf("list: %+v", resp)
+	}
+
+	// 已读
+	if r := read(club); r.Code != 0 || r.Unread != 2 {
+		t.Fatalf("read: %+v", r)
+	}
+	if r := read(club, other); r.Code != errorCode {
+		t.Fatalf("read other: %+v", r)
+	}
+
+	// 领取所有附件, 房卡通过充值的流程同步
+	r := claim()
+	if r.Code != 0 || len(r.Claimed) != 2 || r.Coin != 17 || r.Unread != 0 {
+		t.Fatalf("claim: %+v", r)
+	}
+	if p.coinCount() != 17 || e.pushCount("onCoinChange") != 1 {
+		t.Fatalf("coin=%d, pushes=%d", p.coinCount(), e.pushCount("onCoinChange"))
+	}
+
+	// 重复领取不会再增加房卡
+	if r := claim(mine); len(r.Claimed) != 0 || r.Coin != 17 || ms.coins[301] != 17 {
+		t.Fatalf("claim again: %+v", r)
+	}
+	if ok, _, _ := ms.claimMail(301, ms.rows[all-1], now.Unix()); ok {
+		t.Fatal("claimed twice")
+	}
+
+	// 没有领取附件的邮件不能删除
+	gift := send(&protocol.SendMailRequest{Scope: protocol.MailScopeUser, Target: 301, Title: "礼物", Coin: 3})
+	waitFor(t, "新邮件通知", func() bool { return e.pushCount(protocol.RouteMailNotify) == 4 })
+	if r := remove(); r.Code != 0 || r.Unread != 1 {
+		t.Fatalf("delete: %+v", r)
+	}
+	if resp := list(); len(resp.Mails) != 1 || resp.Mails[0].ID != gift {
+		t.Fatalf("after delete: %+v", resp)
+	}
+
+	// 登录时推送未读数量
+	m.login(s, 301)
+	waitFor(t, "登录通知", func() bool { return e.pushCount(protocol.RouteMailNotify) == 5 })
+
+	// 过期之后不显示, 也不能领取
+	now = now.Add(mailExpire)
+	if resp := list(); len(resp.Mails) != 0 {
+		t.Fatalf("expired: %+v", resp)
+	}
+	if r := claim(gift); r.Code != errorCode || ms.coins[301] != 17 {
+		t.Fatalf("claim expired: %+v", r)
+	}
+}
@@ -1,6 +1,8 @@
 package game
 
 import (
+	"go-mahjong-server/db"
+	"go-mahjong-server/pkg/errutil"
 	"go-mahjong-server/protocol"
 
 	"github.com/lonng/nano/scheduler"
@@ -55,10 +57,11 @@ func (m *Manager) AfterInit() {
 			select {
 			case uid := <-m.chKick:
 				p, ok := defaultManager.player(uid)
-				if !ok || p.session == nil {
+				if !ok || p.currentSession() == nil {
 					logger.Errorf("玩家%d不在线", uid)
+					continue
 				}
-				p.session.Close()
+				p.currentSession().Close()
 				logger.Infof("踢出玩家, UID=%d", uid)
 
 			case uid := <-m.chReset:
@@ -66,19 +69,17 @@ func (m *Manager) AfterInit() {
 				if !ok {
 					return
 				}
-				if p.session != nil {
+				if p.currentSession() != nil {
 					logger.Errorf("玩家正在游戏中，不能重置: %d", uid)
 					return
 				}
-				p.desk = nil
+				if d := p.currentDesk(); d == nil || !d.post(p.leaveDesk) {
+					p.leaveDesk()
+				}
 				logger.Infof("重置玩家, UID=%d", uid)
 
 			case ri := <-m.chRecharge:
-				player, ok := m.player(ri.Uid)
-				// 如果玩家在线
-				if s := player.session; ok && s != nil {
-					s.Push("onCoinChange", &protocol.CoinChangeInformation{Coin: ri.Coin})
-				}
+				m.rechargePlayer(ri)
 
 			default:
 				break ctrl
@@ -89,23 +90,35 @@ func (m *Manager) AfterInit() {
 
 func (m *Manager) Login(s *session.Session, req *protocol.LoginToGameServerRequest) error {
 	uid := req.Uid
-	s.Bind(uid)
+	pf, err := authenticate(uid, req.Token)
+	if err != nil {
+		log.Warnf("玩家: %d登录校验失败, Error=%v", uid, err)
+		return s.Response(&protocol.ErrorResponse{
+			Code:  errutil.Code(err),
+			Error: err.Error(),
+		})
+	}
+
+	if err := s.Bind(uid); err != nil {
+		return err
+	}
 
-	log.Infof("玩家: %d登录: %+v", uid, req)
+	log.Infof("玩家: %d登录: %+v", uid, pf)
 	if p, ok := m.player(uid); !ok {
 		log.Infof("玩家: %d不在线，创建新的玩家", uid)
-		p = newPlayer(s, uid, req.Name, req.HeadUrl, req.IP, req.Sex)
+		p = newPlayer(s, uid, pf.name, pf.head, remoteIP(s), pf.sex)
 		m.setPlayer(uid, p)
 	} else {
 		log.Infof("玩家: %d已经在线", uid)
+		p.syncProfile(pf)
 		// 移除广播频道
 		m.group.Leave(s)
 
 		// 重置之前的session
-		if prevSession := p.session; prevSession != nil && prevSession != s {
+		if prevSession := p.currentSession(); prevSession != nil && prevSession != s {
 			// 如果之前房间存在，则退出来
-			if p, err := playerWithSession(prevSession); err == nil && p != nil && p.desk != nil && p.desk.group != nil {
-				p.desk.group.Leave(prevSession)
+			if d := p.currentDesk(); d != nil && d.group != nil {
+				d.group.Leave(prevSession)
 			}
 
 			prevSession.Clear()
@@ -121,13 +134,44 @@ func (m *Manager) Login(s *session.Session, req *protocol.LoginToGameServerReque
 
 	res := &protocol.LoginToGameServerResponse{
 		Uid:      s.UID(),
-		Nickname: req.Name,
-		Sex:      req.Sex,
-		HeadUrl:  req.HeadUrl,
-		FangKa:   req.FangKa,
+		Nickname: pf.name,
+		Sex:      pf.sex,
+		HeadUrl:  pf.head,
+		FangKa:   int(pf.coin),
+	}
+
+	if err := s.Response(res); err != nil {
+		return err
+	}
+
+	// 推送未读邮件数量
+	defaultMailManager.login(s, uid)
+	return nil
+}
+
+// 充值之后同步在线玩家的房卡数量, 在逻辑协程中调用
+func (m *Manager) rechargePlayer(ri RechargeInfo) {
+	player, ok := m.player(ri.Uid)
+	// 如果玩家在线
+	if !ok {
+		return
+	}
+	player.setCoin(ri.Coin)
+	if s := player.currentSession(); s != nil {
+		s.Push("onCoinChange", &protocol.CoinChangeInformation{Coin: ri.Coin})
 	}
+}
 
-	return s.Response(res)
+// 充值金币之后增加在线玩家的金币, 只修改增量, 不覆盖牌桌上正在结算的金币. 在逻辑协程中调用
+func (m *Manager) rechargeGold(uid, gold int64) {
+	p, ok := m.player(uid)
+	if !ok {
+		return
+	}
+	balance := p.addGold(gold)
+	if s := p.currentSession(); s != nil {
+		s.Push(protocol.RouteGoldChange, &protocol.GoldChangeInformation{Gold: balance})
+	}
 }
 
 func (m *Manager) player(uid int64) (*Player, bool) {
@@ -151,6 +195,22 @@ func (m *Manager) CheckOrder(s *session.Session, msg *protocol.CheckOrderReqeust
 	})
 }
 
+// Maintenance 管理员触发停服, 排空牌桌后关闭服务器
+func (m *Manager) Maintenance(s *session.Session, _ []byte) error {
+	if !db.IsAdmin(s.UID()) {
+		return s.Response(&protocol.ErrorResponse{
+			Code:  errutil.Code(errutil.ErrPermissionDenied),
+			Error: "只有管理员才能停服",
+		})
+	}
+
+	if !Shutdown() {
+		return s.Response(&protocol.ErrorResponse{Code: errorCode, Error: "服务器已经在停服"})
+	}
+	logger.Warnf("管理员触发停服: UID=%d", s.UID())
+	return s.Response(protocol.SuccessResponse)
+}
+
 func (m *Manager) sessionCount() int {
 	return len(m.players)
 }
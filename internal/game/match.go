@@ -0,0 +1,575 @@
+package game
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go-mahjong-server/db"
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/async"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/component"
+	"github.com/lonng/nano/scheduler"
+	"github.com/lonng/nano/session"
+	"github.com/spf13/viper"
+)
+
+// 快速匹配: 玩家按人数模式和玩法排队, 服务器每秒把匹配分接近的玩家分成一桌, 创建牌桌并自动入座.
+// 每个玩家可以接受的匹配分差距随着等待时间扩大, 超过最长等待时间后退出队列.
+// 队列只在nano逻辑协程中访问
+
+// 匹配扣费方式
+const (
+	MatchChargeNone = "none" // 不扣费
+	MatchChargeCard = "card" // 每个玩家扣除房卡
+	MatchChargeGold = "gold" // 每个玩家扣除金币
+)
+
+var (
+	matchRound         = 4                // 匹配牌桌的局数
+	matchTimeout       = 2 * time.Minute  // 最长等待时间
+	matchBaseRange     = 100              // 初始可以接受的匹配分差距
+	matchWidenInterval = 10 * time.Second // 每等待一段时间扩大一次差距
+	matchWidenStep     = 50               // 每次扩大的差距
+	matchMaxRange      = 500              // 最大差距
+	matchCharge        = MatchChargeCard  // 扣费方式
+	matchCost          = 1                // 每个玩家扣除的数量
+	matchTickInterval  = time.Second
+)
+
+// 匹配牌桌的房间号, 测试时可以替换
+var nextRoomNumber = room.Next
+
+const (
+	ratingDivisor = 2  // 匹配分变化 = 与同桌平均分的差距 / ratingDivisor
+	ratingMaxStep = 32 // 每场匹配分的最大变化
+)
+
+const (
+	matchCardNotEnoughMessage = "房卡不足, 不能参加匹配"
+	matchGoldNotEnoughMessage = "金币不足, 不能参加匹配"
+	matchDeskMessage          = "匹配的牌桌不能%s"
+)
+
+type matchEntry struct {
+	p        *Player
+	s        *session.Session
+	key      string
+	opts     *protocol.DeskOptions
+	rating   int
+	joinedAt time.Time
+	rng      int // 最近一次推送的差距
+}
+
+// 匹配的牌桌: 没有房主, 开局时每个玩家各自扣费, 结束后更新匹配分
+type deskMatch struct {
+	charge  string
+	cost    int
+	manager *MatchManager // 开局之前有玩家退出时其他玩家重新排队
+}
+
+type MatchManager struct {
+	component.Base
+	queues  map[string][]*matchEntry // 模式和玩法 -> 队列
+	entries map[int64]*matchEntry    // uid -> 队列中的玩家
+	now     func() time.Time
+}
+
+var defaultMatchManager = NewMatchManager()
+
+func NewMatchManager() *MatchManager {
+	return &MatchManager{
+		queues:  map[string][]*matchEntry{},
+		entries: map[int64]*matchEntry{},
+		now:     time.Now,
+	}
+}
+
+func (m *MatchManager) AfterInit() {
+	// 断线后退出队列
+	session.Lifetime.OnClosed(func(s *session.Session) {
+		logicTask(func() {
+			if e, ok := m.entries[s.UID()]; ok && e.s == s {
+				m.remove(e)
+			}
+		})
+	})
+
+	scheduler.NewTimer(matchTickInterval, func() {
+		m.tick()
+	})
+}
+
+// 读取匹配配置, 未配置的项使用默认值
+func loadMatchConfig() {
+	if round := viper.GetInt("match.round"); round > 0 {
+		matchRound = round
+	}
+	if timeout := viper.GetInt("match.timeout"); timeout > 0 {
+		matchTimeout = time.Duration(timeout) * time.Second
+	}
+	if r := viper.GetInt("match.range"); r > 0 {
+		matchBaseRange = r
+	}
+	if interval := viper.GetInt("match.widen_interval"); interval > 0 {
+		matchWidenInterval = time.Duration(interval) * time.Second
+	}
+	if step := viper.GetInt("match.widen_step"); step > 0 {
+		matchWidenStep = step
+	}
+	if r := viper.GetInt("match.max_range"); r > 0 {
+		matchMaxRange = r
+	}
+	switch charge := viper.GetString("match.charge"); charge {
+	case MatchChargeNone, MatchChargeCard, MatchChargeGold:
+		matchCharge = charge
+	case "":
+	default:
+		logger.Warnf("未知的匹配扣费方式: %s, 使用默认方式: %s", charge, matchCharge)
+	}
+	if cost := viper.GetInt("match.cost"); cost > 0 {
+		matchCost = cost
+	}
+}
+
+// 匹配牌桌的选项, 除了人数模式和玩法之外都使用服务器配置
+func matchOptions(req *protocol.MatchRequest) *protocol.DeskOptions {
+	opts := &protocol.DeskOptions{
+		Mode:     req.Mode,
+		Rule:     req.Rule,
+		MaxRound: matchRound,
+		MaxFan:   3,
+	}
+	if opts.Rule == "" {
+		opts.Rule = RuleXueZhan
+	}
+	// 四人模式，默认可以平胡
+	if opts.Mode == ModeFours {
+		opts.Pinghu = true
+	}
+	return opts
+}
+
+// 当前等待时间可以接受的匹配分差距
+func matchRange(waited time.Duration) int {
+	r := matchBaseRange
+	if matchWidenInterval > 0 {
+		r += int(waited/matchWidenInterval) * matchWidenStep
+	}
+	if r > matchMaxRange {
+		r = matchMaxRange
+	}
+	return r
+}
+
+// 从队列中选出匹配分接近的玩家组成一桌, 一组中最高分和最低分的差距不能超过任何一个玩家可以接受的差距
+func pickGroups(queue []*matchEntry, size int, now time.Time) (groups [][]*matchEntry, rest []*matchEntry) {
+	sorted := append([]*matchEntry{}, queue...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].rating < sorted[j].rating })
+
+	i := 0
+	for i+size <= len(sorted) {
+		group := sorted[i : i+size]
+		spread := group[size-1].rating - group[0].rating
+		ok := true
+		for _, e := range group {
+			if spread > matchRange(now.Sub(e.joinedAt)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			groups = append(groups, group)
+			i += size
+			continue
+		}
+		rest = append(rest, sorted[i])
+		i++
+	}
+	rest = append(rest, sorted[i:]...)
+	return groups, rest
+}
+
+// Enqueue 开始匹配, 已经在队列中时使用新的选项重新排队
+func (m *MatchManager) Enqueue(s *session.Session, req *protocol.MatchRequest) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	if p.currentDesk() != nil {
+		return s.Response(reentryDesk)
+	}
+	if isDraining() {
+		return s.Response(createMaintenance)
+	}
+
+	opts := matchOptions(req)
+	if !verifyOptions(opts) {
+		return errutil.ErrIllegalParameter
+	}
+	if !matchAffordable(p, matchCharge, matchCost) {
+		if matchCharge == MatchChargeGold {
+			return s.Response(&protocol.ErrorResponse{
+				Code:  errutil.Code(errutil.ErrGoldNotEnough),
+				Error: matchGoldNotEnoughMessage,
+			})
+		}
+		return s.Response(&protocol.ErrorResponse{
+			Code:  errutil.Code(errutil.ErrCoinNotEnough),
+			Error: matchCardNotEnoughMessage,
+		})
+	}
+
+	e := m.add(p, s, opts)
+	if err := s.Response(&protocol.SuccessResponse); err != nil {
+		return err
+	}
+	return m.pushStatus(e, protocol.MatchStatusWaiting)
+}
+
+// 加入队列, 已经在队列中时移除之前的记录
+func (m *MatchManager) add(p *Player, s *session.Session, opts *protocol.DeskOptions) *matchEntry {
+	if e, ok := m.entries[p.Uid()]; ok {
+		m.remove(e)
+	}
+
+	e := &matchEntry{
+		p:        p,
+		s:        s,
+		key:      fmt.Sprintf("%d/%s", opts.Mode, opts.Rule),
+		opts:     opts,
+		rating:   p.ratingValue(),
+		joinedAt: m.now(),
+		rng:      matchBaseRange,
+	}
+	m.entries[p.Uid()] = e
+	m.queues[e.key] = append(m.queues[e.key], e)
+	logger.Infof("玩家开始匹配: UID=%d 队列=%s 匹配分=%d", p.Uid(), e.key, e.rating)
+	return e
+}
+
+// 匹配的牌桌解散后重新排队, 等待时间重新计算. 玩家已经离线, 进入其他牌桌, 重新开始匹配或者余额不足时跳过
+func (m *MatchManager) requeue(p *Player, s *session.Session, opts *protocol.DeskOptions) {
+	if p.currentSession() != s || p.currentDesk() != nil || isDraining() || !matchAffordable(p, matchCharge, matchCost) {
+		return
+	}
+	if _, ok := m.entries[p.Uid()]; ok {
+		return
+	}
+	m.pushStatus(m.add(p, s, opts), protocol.MatchStatusWaiting)
+}
+
+// Cancel 取消匹配
+func (m *MatchManager) Cancel(s *session.Session, _ []byte) error {
+	if e, ok := m.entries[s.UID()]; ok {
+		m.remove(e)
+		m.pushStatus(e, protocol.MatchStatusCancelled)
+	}
+	return s.Response(&protocol.SuccessResponse)
+}
+
+func (m *MatchManager) remove(e *matchEntry) {
+	delete(m.entries, e.p.Uid())
+	queue := m.queues[e.key]
+	for i, v := range queue {
+		if v == e {
+			m.queues[e.key] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(m.queues[e.key]) == 0 {
+		delete(m.queues, e.key)
+	}
+}
+
+func (m *MatchManager) pushStatus(e *matchEntry, status int) error {
+	return e.s.Push(protocol.RouteMatchStatus, &protocol.MatchStatus{
+		Status: status,
+		Waited: int(m.now().Sub(e.joinedAt) / time.Second),
+		Queued: len(m.queues[e.key]),
+		Range:  e.rng,
+	})
+}
+
+// 每秒执行一次: 移除超时的玩家, 分组并创建牌桌, 向差距扩大的玩家推送匹配状态
+func (m *MatchManager) tick() {
+	now := m.now()
+	for _, e := range m.entries {
+		// 排队期间通过房间号加入了其他牌桌
+		if e.p.currentDesk() != nil {
+			m.remove(e)
+			continue
+		}
+		if now.Sub(e.joinedAt) >= matchTimeout {
+			m.remove(e)
+			m.pushStatus(e, protocol.MatchStatusTimeout)
+		}
+	}
+
+	// 停服期间不再创建牌桌
+	if isDraining() {
+		return
+	}
+
+	for key, queue := range m.queues {
+		size := queue[0].opts.Mode
+		groups, rest := pickGroups(queue, size, now)
+		for _, group := range groups {
+			for _, e := range group {
+				delete(m.entries, e.p.Uid())
+			}
+			m.createDesk(group)
+		}
+		if len(rest) == 0 {
+			delete(m.queues, key)
+			continue
+		}
+		m.queues[key] = rest
+
+		for _, e := range rest {
+			if r := matchRange(now.Sub(e.joinedAt)); r != e.rng {
+				e.rng = r
+				m.pushStatus(e, protocol.MatchStatusWaiting)
+			}
+		}
+	}
+}
+
+// 创建牌桌并让匹配的玩家入座, 之后与创建房间的流程相同, 客户端初始化完成后准备开局
+func (m *MatchManager) createDesk(group []*matchEntry) {
+	opts := group[0].opts
+	no := nextRoomNumber()
+	d := NewDesk(no, opts, -1)
+	d.createdAt = m.now().Unix()
+	d.match = &deskMatch{charge: matchCharge, cost: matchCost, manager: m}
+	defaultDeskManager.setDesk(no, d)
+
+	uids := make([]int64, 0, len(group))
+	for _, e := range group {
+		uids = append(uids, e.p.Uid())
+	}
+	d.logger.Infof("匹配成功, 创建牌桌: 玩家=%v", uids)
+
+	for _, e := range group {
+		leaveObserving(e.p, e.s)
+	}
+
+	d.post(func() {
+		seated := 0
+		for _, e := range group {
+			// 玩家已经使用新的连接重新登录
+			if e.p.currentSession() != e.s {
+				continue
+			}
+			if err := d.playerJoin(e.s, false); err != nil {
+				d.logger.Errorf("匹配的玩家入座失败, UID=%d, Error=%v", e.p.Uid(), err)
+				continue
+			}
+			seated++
+		}
+
+		// 匹配的牌桌不能通过房间号加入, 人数不够时永远不会开局, 入座的玩家重新排队
+		if seated < len(group) {
+			d.logger.Warnf("匹配的玩家没有全部入座, 解散牌桌: 入座=%d", seated)
+			d.matchDissolve(false)
+			return
+		}
+
+		info := d.tableInfo()
+		for _, e := range group {
+			e.s.Push(protocol.RouteMatchStatus, &protocol.MatchStatus{
+				Status:    protocol.MatchStatusMatched,
+				Waited:    int(m.now().Sub(e.joinedAt) / time.Second),
+				TableInfo: &info,
+			})
+		}
+	})
+}
+
+// 匹配的牌桌开局之前有玩家退出或者没有全部入座: 解散牌桌, 其他在线的玩家重新排队.
+// notify为true时通知客户端牌桌已经解散. 在牌桌协程中调用
+func (d *Desk) matchDissolve(notify bool) {
+	type seat struct {
+		p *Player
+		s *session.Session
+	}
+	rest := []seat{}
+	for _, p := range d.players {
+		if s := p.currentSession(); s != nil && d.dissolve.isOnline(p.Uid()) {
+			rest = append(rest, seat{p, s})
+		}
+	}
+
+	// 客户端初始化完成之前玩家还没有加入分组, 逐个推送
+	d.logger.Infof("匹配的牌桌开局之前解散, 重新排队的玩家=%d", len(rest))
+	if notify {
+		for _, v := range rest {
+			v.s.Push("onDissolve", &protocol.ExitResponse{IsExit: true, ExitType: protocol.ExitTypeDissolve, DeskPos: -1})
+		}
+	}
+	d.destroy()
+
+	m, opts := d.match.manager, d.opts
+	if m == nil {
+		m = defaultMatchManager
+	}
+	logicTask(func() {
+		for _, v := range rest {
+			m.requeue(v.p, v.s, opts)
+		}
+	})
+}
+
+// 玩家的房卡或者金币是否足够支付匹配的费用, 机器人不扣费
+func matchAffordable(p *Player, charge string, cost int) bool {
+	if p.isRobot() {
+		return true
+	}
+	switch charge {
+	case MatchChargeCard:
+		return p.coinCount() >= int64(cost)
+	case MatchChargeGold:
+		return p.goldBalance() >= int64(cost)
+	}
+	return true
+}
+
+// 开局之前重新检查所有玩家的余额, 排队期间余额可能已经变化
+func (d *Desk) matchAffordable() bool {
+	for _, p := range d.players {
+		if !matchAffordable(p, d.match.charge, d.match.cost) {
+			p.logger.Infof("匹配的牌桌开局时余额不足: 扣费方式=%s 数量=%d", d.match.charge, d.match.cost)
+			return false
+		}
+	}
+	return true
+}
+
+// 匹配的牌桌开局时每个玩家各自扣费
+func (d *Desk) matchLoseCoin() {
+	if d.match.cost <= 0 {
+		return
+	}
+	if d.match.charge == MatchChargeGold {
+		d.matchLoseGold()
+		return
+	}
+	if d.match.charge != MatchChargeCard {
+		return
+	}
+
+	for _, p := range d.players {
+		consume := &model.CardConsume{
+			UserId:    p.Uid(),
+			CardCount: d.match.cost,
+			DeskId:    d.deskID,
+			ClubId:    d.clubId,
+			DeskNo:    d.roomNo.String(),
+			ConsumeAt: time.Now().Unix(),
+		}
+		p.loseCoin(int64(d.match.cost), consume)
+		d.rankCardConsume(p, consume)
+	}
+}
+
+// 扣除金币并写入金币流水, 与金币场结算相同, 数据库失败时重新同步玩家的金币
+func (d *Desk) matchLoseGold() {
+	ledgers := []*model.GoldLedger{}
+	players := []*Player{}
+	now := time.Now().Unix()
+	for _, p := range d.players {
+		if p.isRobot() {
+			continue
+		}
+		p.addGold(-int64(d.match.cost))
+		ledgers = append(ledgers, &model.GoldLedger{
+			Uid:       p.Uid(),
+			Type:      model.GoldLedgerTypeMatchFee,
+			Change:    -int64(d.match.cost),
+			DeskId:    d.deskID,
+			DeskNo:    d.roomNo.String(),
+			Round:     int(d.round),
+			CreatedAt: now,
+		})
+		players = append(players, p)
+	}
+	if len(ledgers) == 0 {
+		return
+	}
+
+	st := d.store
+	logger := d.logger
+	async.Run(func() {
+		if err := st.settleGold(ledgers); err != nil {
+			logger.Errorf("匹配扣除金币错误, Error=%v", err)
+			for _, p := range players {
+				p.syncCoinFromDB()
+			}
+			return
+		}
+
+		for i, p := range players {
+			if s := p.currentSession(); s != nil {
+				s.Push(protocol.RouteGoldChange, &protocol.GoldChangeInformation{Gold: ledgers[i].Balance})
+			}
+		}
+	})
+}
+
+// 匹配分变化: 与同桌平均分比较, 赢得越多增加越多
+func ratingChanges(scores map[int64]int) map[int64]int {
+	if len(scores) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, score := range scores {
+		total += score
+	}
+	avg := total / len(scores)
+
+	changes := map[int64]int{}
+	for uid, score := range scores {
+		delta := (score - avg) / ratingDivisor
+		if delta > ratingMaxStep {
+			delta = ratingMaxStep
+		} else if delta < -ratingMaxStep {
+			delta = -ratingMaxStep
+		}
+		changes[uid] = delta
+	}
+	return changes
+}
+
+// 匹配的牌桌正常结束后更新匹配分, 机器人不参与
+func (d *Desk) updateRatings(stats map[int64]int) {
+	scores := map[int64]int{}
+	players := map[int64]*Player{}
+	for _, p := range d.players {
+		if p.isRobot() {
+			continue
+		}
+		scores[p.Uid()] = stats[p.Uid()]
+		players[p.Uid()] = p
+	}
+
+	for uid, delta := range ratingChanges(scores) {
+		if delta == 0 {
+			continue
+		}
+		p := players[uid]
+		p.setRating(p.ratingValue() + delta)
+
+		uid, delta := uid, delta
+		async.Run(func() {
+			if err := db.UserAddRating(uid, delta); err != nil {
+				d.logger.Errorf("更新匹配分失败, UID=%d Delta=%d Error=%v", uid, delta, err)
+			}
+		})
+	}
+}
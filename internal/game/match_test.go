@@ -0,0 +1,330 @@
+package game
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/session"
+)
+
+func matchEntries(now time.Time, waited time.Duration, ratings ...int) []*matchEntry {
+	entries := []*matchEntry{}
+	for i, r := range ratings {
+		entries = append(entries, &matchEntry{
+			p:        &Player{uid: int64(i + 1)},
+			rating:   r,
+			joinedAt: now.Add(-waited),
+		})
+	}
+	return entries
+}
+
+func groupRatings(groups [][]*matchEntry) string {
+	s := ""
+	for _, g := range groups {
+		rs := []int{}
+		for _, e := range g {
+			rs = append(rs, e.rating)
+		}
+		s += fmt.Sprint(rs)
+	}
+	return s
+}
+
+func TestPickGroups(t *testing.T) {
+	now := time.Now()
+
+	groups, rest := pickGroups(matchEntries(now, 0, 400, 20, 0, 410, 30, 10), 4, now)
+	if s := groupRatings(groups); s != "[0 10 20 30]" || len(rest) != 2 {
+		t.Fatalf("groups=%s rest=%d", s, len(rest))
+	}
+
+	// 差距随等待时间扩大
+	for _, c := range []struct {
+		waited  time.Duration
+		matched bool
+	}{
+		{0, false},
+		{60 * time.Second, false},
+		{80 * time.Second, true},
+	} {
+		groups, rest := pickGroups(matchEntries(now, c.waited, 0, 150, 300, 450), 4, now)
+		if (len(groups) == 1) != c.matched || len(rest)+len(groups)*4 != 4 {
+			t.Fatalf("waited=%v groups=%s rest=%d", c.waited, groupRatings(groups), len(rest))
+		}
+	}
+
+	// 差距不能超过任何一个玩家可以接受的范围
+	entries := matchEntries(now, 80*time.Second, 0, 150, 300, 450)
+	entries[0].joinedAt = now
+	if groups, _ := pickGroups(entries, 4, now); len(groups) != 0 {
+		t.Fatalf("groups=%s", groupRatings(groups))
+	}
+}
+
+func TestRatingChanges(t *testing.T) {
+	changes := ratingChanges(map[int64]int{1: 40, 2: -40, 3: 200, 4: -200})
+	if changes[1] != 20 || changes[2] != -20 || changes[3] != ratingMaxStep || changes[4] != -ratingMaxStep {
+		t.Fatalf("changes=%v", changes)
+	}
+}
+
+var matchRoomSeq int64
+
+func TestMatchQueue(t *testing.T) {
+	setupLoopTest(t)
+	nextRoomNumber = func() room.Number {
+		return room.Number(fmt.Sprintf("2%05d", atomic.AddInt64(&matchRoomSeq, 1)))
+	}
+	defer func() { nextRoomNumber = room.Next }()
+
+	now := time.Now()
+	m := NewMatchManager()
+	m.now = func() time.Time { return now }
+
+	players := []*Player{}
+	entities := []*testEntity{}
+	for uid := int64(31); uid <= 35; uid++ {
+		s, e, p := newLoopTestSession(t, uid)
+		p.setRating(int(uid))
+		req := &protocol.MatchRequest{Mode: ModeFours}
+		if uid == 35 {
+			req.Mode = ModeTrios
+		}
+		if err := m.Enqueue(s, req); err != nil {
+			t.Fatal(err)
+		}
+		players = append(players, p)
+		entities = append(entities, e)
+	}
+	if len(m.queues) != 2 || len(m.entries) != 5 {
+		t.Fatalf("queues=%d entries=%d", len(m.queues), len(m.entries))
+	}
+
+	// 四人模式的玩家匹配到同一张牌桌
+	m.tick()
+	for _, p := range players[:4] {
+		waitFor(t, "入座", func() bool { return p.currentDesk() != nil })
+	}
+	d := players[0].currentDesk()
+	defer func() {
+		destroyDesk(d)
+		defaultDeskManager.setDesk(d.roomNo, nil)
+	}()
+	if d.match == nil || d.opts.Rule != RuleXueZhan || d.opts.MaxRound != matchRound {
+		t.Fatalf("matched desk: match=%+v opts=%+v", d.match, d.opts)
+	}
+	for i, p := range players[:4] {
+		if p.currentDesk() != d {
+			t.Fatalf("player %d seated at another desk", p.Uid())
+		}
+		waitFor(t, "匹配成功", func() bool { return entities[i].pushCount(protocol.RouteMatchStatus) >= 2 })
+	}
+	var seated int
+	d.do(func() { seated = len(d.players) })
+	if seated != 4 {
+		t.Fatalf("seated=%d", seated)
+	}
+
+	// 三人模式只有一个玩家, 超时后退出队列
+	if len(m.entries) != 1 {
+		t.Fatalf("entries=%d", len(m.entries))
+	}
+	now = now.Add(matchTimeout)
+	m.tick()
+	if len(m.entries) != 0 || len(m.queues) != 0 {
+		t.Fatalf("entries=%d queues=%d after timeout", len(m.entries), len(m.queues))
+	}
+	if players[4].currentDesk() != nil {
+		t.Fatal("timed out player should not be seated")
+	}
+}
+
+// 开局之前有玩家退出时解散牌桌, 其他玩家重新排队; 匹配的牌桌不能通过房间号加入
+func TestMatchExit(t *testing.T) {
+	setupLoopTest(t)
+	tasks := replaceLogicTask(t)
+
+	now := time.Now()
+	m := NewMatchManager()
+	m.now = func() time.Time { return now }
+
+	sessions := []*sessionEntity{}
+	players := []*Player{}
+	for uid := int64(36); uid <= 39; uid++ {
+		s, e, p := newLoopTestSession(t, uid)
+		p.setRating(int(uid))
+		if err := m.Enqueue(s, &protocol.MatchRequest{Mode: ModeFours}); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, &sessionEntity{s, e})
+		players = append(players, p)
+	}
+	m.tick()
+	for _, p := range players {
+		waitFor(t, "入座", func() bool { return p.currentDesk() != nil })
+	}
+	d := players[0].currentDesk()
+	defer defaultDeskManager.setDesk(d.roomNo, nil)
+
+	s, e, _ := newLoopTestSession(t, 40)
+	if err := defaultDeskManager.Join(s, &protocol.JoinDeskRequest{DeskNo: d.roomNo.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := e.lastResponse().(*protocol.JoinDeskResponse); !ok || resp.Code != errorCode {
+		t.Fatalf("join by number response: %+v", e.lastResponse())
+	}
+
+	// 第一个玩家退出
+	if err := defaultDeskManager.Exit(sessions[0].s, &protocol.ExitRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	runLogicTasks(t, tasks, 2)
+	if !d.isDestroy() {
+		t.Fatal("match desk should be destroyed")
+	}
+	if _, ok := m.entries[36]; ok || len(m.entries) != 3 {
+		t.Fatalf("entries=%d", len(m.entries))
+	}
+	for i, p := range players {
+		if p.currentDesk() != nil {
+			t.Fatalf("player %d still seated", p.Uid())
+		}
+		if i == 0 {
+			continue
+		}
+		if e := sessions[i].e; e.pushCount("onDissolve") != 1 || e.pushCount(protocol.RouteMatchStatus) != 3 {
+			t.Fatalf("player %d pushes: dissolve=%d status=%d", p.Uid(), e.pushCount("onDissolve"), e.pushCount(protocol.RouteMatchStatus))
+		}
+	}
+}
+
+// 匹配的玩家没有全部入座时解散牌桌, 入座的玩家重新排队, 不推送匹配成功
+func TestMatchSeatFailed(t *testing.T) {
+	setupLoopTest(t)
+	tasks := replaceLogicTask(t)
+
+	now := time.Now()
+	m := NewMatchManager()
+	m.now = func() time.Time { return now }
+
+	entities := []*testEntity{}
+	players := []*Player{}
+	for uid := int64(51); uid <= 54; uid++ {
+		s, e, p := newLoopTestSession(t, uid)
+		p.setRating(int(uid))
+		if err := m.Enqueue(s, &protocol.MatchRequest{Mode: ModeFours}); err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, e)
+		players = append(players, p)
+	}
+
+	// 最后一个玩家使用新的连接重新登录, 队列中的session已经失效
+	players[3].bindSession(session.New(newTestEntity()))
+
+	m.tick()
+	runLogicTasks(t, tasks, 2)
+	if _, ok := m.entries[54]; ok || len(m.entries) != 3 {
+		t.Fatalf("entries=%d", len(m.entries))
+	}
+	for i, p := range players {
+		if p.currentDesk() != nil {
+			t.Fatalf("player %d should not be seated", p.Uid())
+		}
+		for _, status := range entities[i].received(protocol.RouteMatchStatus) {
+			if status.v.(*protocol.MatchStatus).Status == protocol.MatchStatusMatched {
+				t.Fatalf("player %d received matched status", p.Uid())
+			}
+		}
+	}
+}
+
+// 使用金币扣费: 排队和开局时检查余额, 开局时写入金币流水
+func TestMatchGold(t *testing.T) {
+	st := setupLoopTest(t)
+	tasks := replaceLogicTask(t)
+	prevCharge, prevCost := matchCharge, matchCost
+	matchCharge, matchCost = MatchChargeGold, 100
+	defer func() { matchCharge, matchCost = prevCharge, prevCost }()
+
+	now := time.Now()
+	m := NewMatchManager()
+	m.now = func() time.Time { return now }
+
+	s, e, _ := newLoopTestSession(t, 60)
+	if err := m.Enqueue(s, &protocol.MatchRequest{Mode: ModeFours}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := e.lastResponse().(*protocol.ErrorResponse); !ok || resp.Code != errutil.Code(errutil.ErrGoldNotEnough) {
+		t.Fatalf("enqueue response: %+v", e.lastResponse())
+	}
+
+	players := []*Player{}
+	for uid := int64(61); uid <= 64; uid++ {
+		s, _, p := newLoopTestSession(t, uid)
+		p.setRating(int(uid))
+		p.setGold(150)
+		if err := m.Enqueue(s, &protocol.MatchRequest{Mode: ModeFours}); err != nil {
+			t.Fatal(err)
+		}
+		players = append(players, p)
+	}
+	m.tick()
+	for _, p := range players {
+		waitFor(t, "入座", func() bool { return p.currentDesk() != nil })
+	}
+	d := players[0].currentDesk()
+	defer defaultDeskManager.setDesk(d.roomNo, nil)
+
+	// 开局扣除金币并写入流水
+	fees := func() int {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		n := 0
+		for _, l := range st.ledgers {
+			if l.Uid >= 61 && l.Uid <= 64 && l.Type == model.GoldLedgerTypeMatchFee && l.Change == -100 {
+				n++
+			}
+		}
+		return n
+	}
+	prev := fees()
+	d.do(d.matchLoseGold)
+	waitFor(t, "金币流水", func() bool { return fees() == prev+4 })
+	for _, p := range players {
+		if p.goldBalance() != 50 {
+			t.Fatalf("player %d gold=%d", p.Uid(), p.goldBalance())
+		}
+	}
+
+	// 开局时余额不足: 解散牌桌, 余额足够的玩家重新排队
+	players[0].setGold(100)
+	players[1].setGold(100)
+	d.do(func() {
+		for _, p := range d.players {
+			d.prepare.ready(p.Uid())
+		}
+		d.checkStart()
+	})
+	runLogicTasks(t, tasks, 2)
+	if !d.isDestroy() || d.status() == constant.DeskStatusDuanPai {
+		t.Fatal("match desk should be dissolved")
+	}
+	if len(m.entries) != 2 {
+		t.Fatalf("entries=%d", len(m.entries))
+	}
+	for _, uid := range []int64{61, 62} {
+		if _, ok := m.entries[uid]; !ok {
+			t.Fatalf("player %d should be requeued", uid)
+		}
+	}
+}
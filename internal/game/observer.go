@@ -0,0 +1,199 @@
+package game
+
+import (
+	"time"
+
+	"go-mahjong-server/pkg/errutil"
+
+	"github.com/lonng/nano"
+	"github.com/lonng/nano/session"
+	"github.com/pborman/uuid"
+)
+
+// 观战: 俱乐部管理员和主播可以在不占用座位的情况下观看牌局. 观战者使用单独的组播通道,
+// 只接收公开的事件(出牌, 碰杠, 分数, 解散状态等), 暗牌全部隐藏, 并且延迟推送, 防止向玩家透露信息.
+// 观战者不在d.players中, 不参与准备, 开局判断和解散投票
+
+var (
+	observerDelay = 30 * time.Second // 观战延迟, 0表示不延迟
+	observerLimit = 10               // 每张牌桌的观战人数上限
+)
+
+const observerBacklog = 1024
+
+type observer struct {
+	p *Player
+	s *session.Session
+}
+
+type observerMessage struct {
+	at    time.Time // 推送时间
+	route string
+	v     interface{}
+	s     *session.Session // 不为nil时只推送给该观战者
+}
+
+type observerContext struct {
+	desk      *Desk
+	group     *nano.Group
+	observers map[int64]*observer // uid -> 观战者, 只在牌桌协程中访问
+	queue     chan *observerMessage
+	delay     time.Duration
+	limit     int
+	started   bool   // 延迟推送协程是否已经启动
+	resync    bool   // 队列已满时丢弃过消息, 队列有空位时先推送完整的牌桌数据
+	closed    bool   // 牌桌已经销毁
+	release   func() // 延迟推送协程退出前释放观战者, 在关闭队列之前设置
+}
+
+func newObserverContext(d *Desk) *observerContext {
+	return &observerContext{
+		desk:      d,
+		group:     nano.NewGroup(uuid.New()),
+		observers: map[int64]*observer{},
+		queue:     make(chan *observerMessage, observerBacklog),
+		delay:     observerDelay,
+		limit:     observerLimit,
+	}
+}
+
+func (o *observerContext) count() int {
+	return len(o.observers)
+}
+
+// 加入观战, 在牌桌协程中调用, 同一个玩家重新加入时替换之前的session
+func (o *observerContext) join(p *Player, s *session.Session) error {
+	if o.closed {
+		return errutil.ErrDeskNotFound
+	}
+
+	uid := s.UID()
+	prev, exists := o.observers[uid]
+	if !exists && len(o.observers) >= o.limit {
+		return errutil.ErrObserverFull
+	}
+	if exists && prev.s != s {
+		o.group.Leave(prev.s)
+	}
+
+	o.observers[uid] = &observer{p: p, s: s}
+	o.group.Add(s)
+	p.setWatching(o.desk)
+	return nil
+}
+
+// 退出观战, 在牌桌协程中调用, 只移除对应的session, 重新连接后的session不受影响
+func (o *observerContext) leave(p *Player, s *session.Session) bool {
+	ob, ok := o.observers[p.Uid()]
+	if !ok || ob.s != s {
+		return false
+	}
+
+	delete(o.observers, p.Uid())
+	o.group.Leave(s)
+	p.stopWatching(o.desk)
+	return true
+}
+
+// 向所有观战者推送公开的事件, 在牌桌协程中调用, 推送之后不能再修改v
+func (o *observerContext) publish(route string, v interface{}) {
+	o.send(&observerMessage{route: route, v: v})
+}
+
+// 向一个观战者推送数据, 与公开事件使用相同的延迟, 保证顺序
+func (o *observerContext) push(s *session.Session, route string, v interface{}) {
+	o.send(&observerMessage{route: route, v: v, s: s})
+}
+
+func (o *observerContext) send(m *observerMessage) {
+	if o.closed || len(o.observers) == 0 {
+		return
+	}
+	if o.delay <= 0 {
+		o.deliver(m)
+		return
+	}
+
+	if !o.started {
+		o.started = true
+		go o.run()
+	}
+	m.at = time.Now().Add(o.delay)
+	if o.resync && o.desk.inRound() {
+		if !o.enqueue(&observerMessage{at: m.at, route: "onSyncDesk", v: o.desk.syncDeskView(0)}) {
+			o.desk.logger.Warnf("观战消息队列已满, 丢弃消息: Route=%s", m.route)
+			return
+		}
+	}
+	o.resync = false
+	if !o.enqueue(m) {
+		o.resync = true
+		o.desk.logger.Warnf("观战消息队列已满, 丢弃消息: Route=%s", m.route)
+	}
+}
+
+func (o *observerContext) enqueue(m *observerMessage) bool {
+	select {
+	case o.queue <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *observerContext) deliver(m *observerMessage) {
+	var err error
+	if m.s != nil {
+		err = m.s.Push(m.route, m.v)
+	} else {
+		err = o.group.Broadcast(m.route, m.v)
+	}
+	if err != nil {
+		o.desk.logger.Debugf("推送观战消息失败, Route=%s Error=%v", m.route, err)
+	}
+}
+
+// 延迟推送协程, 队列关闭后推送完剩余的消息再释放观战者
+func (o *observerContext) run() {
+	for m := range o.queue {
+		if wait := time.Until(m.at); wait > 0 {
+			time.Sleep(wait)
+		}
+		o.deliver(m)
+	}
+	o.release()
+}
+
+// 牌桌销毁时调用, 在牌桌协程中执行
+func (o *observerContext) close() {
+	if o.closed {
+		return
+	}
+	o.closed = true
+
+	observers := o.observers
+	o.observers = map[int64]*observer{}
+	o.release = func() {
+		for _, ob := range observers {
+			ob.p.stopWatching(o.desk)
+		}
+		o.group.Close()
+	}
+
+	if !o.started {
+		o.release()
+		return
+	}
+	close(o.queue)
+}
+
+// 观战者退出正在观看的牌桌, 可以在任意协程中调用
+func leaveObserving(p *Player, s *session.Session) {
+	d := p.watchingDesk()
+	if d == nil {
+		return
+	}
+	if !d.post(func() { d.observers.leave(p, s) }) {
+		p.stopWatching(d)
+	}
+}
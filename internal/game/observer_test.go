@@ -0,0 +1,175 @@
+package game
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/session"
+)
+
+func newObserverSession(t *testing.T, uid int64) (*session.Session, *testEntity, *Player) {
+	_, _, p := newLoopTestSession(t, uid)
+	e := newTestEntity()
+	s := session.New(e)
+	if err := s.Bind(uid); err != nil {
+		t.Fatal(err)
+	}
+	p.bindSession(s)
+	return s, e, p
+}
+
+func observe(t *testing.T, s *session.Session, e *testEntity, no room.Number) *protocol.ObserveDeskResponse {
+	t.Helper()
+	e.mu.Lock()
+	e.responses = nil
+	e.mu.Unlock()
+	if err := defaultDeskManager.Observe(s, &protocol.ObserveDeskRequest{DeskNo: string(no)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "观战响应", func() bool {
+		_, ok := e.lastResponse().(*protocol.ObserveDeskResponse)
+		return ok
+	})
+	return e.lastResponse().(*protocol.ObserveDeskResponse)
+}
+
+func TestObserver(t *testing.T) {
+	setupLoopTest(t)
+	delay := 50 * time.Millisecond
+	prevDelay, prevLimit := observerDelay, observerLimit
+	observerDelay, observerLimit = delay, 1
+	defer func() { observerDelay, observerLimit = prevDelay, prevLimit }()
+
+	no := room.Number("100011")
+	d := NewDesk(no, &protocol.DeskOptions{Mode: ModeFours, MaxRound: 1, MaxFan: 3, Pinghu: true}, -1)
+	d.createdAt = time.Now().Unix()
+	d.creator = 1
+	defaultDeskManager.setDesk(no, d)
+	defer defaultDeskManager.setDesk(no, nil)
+
+	s, e, p := newLoopTestSession(t, 1)
+	if err := defaultDeskManager.Join(s, &protocol.JoinDeskRequest{DeskNo: string(no)}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "加入房间", func() bool { return p.currentDesk() == d })
+	defaultDeskManager.ClientInitCompleted(s, &protocol.ClientInitCompletedRequest{})
+	d.do(func() {
+		if err := d.robotJoin(0); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// 牌桌上的玩家不能观战
+	if err := defaultDeskManager.Observe(s, &protocol.ObserveDeskRequest{DeskNo: string(no)}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := e.lastResponse().(*protocol.ObserveDeskResponse); !ok || resp.Code == 0 {
+		t.Fatalf("seated player observe response: %+v", e.lastResponse())
+	}
+
+	// 超过观战人数上限, 退出观战后可以加入
+	s1, e1, p1 := newObserverSession(t, 11)
+	if resp := observe(t, s1, e1, no); resp.Code != 0 || resp.Observers != 1 {
+		t.Fatalf("observe response: %+v", resp)
+	}
+	s2, e2, p2 := newObserverSession(t, 12)
+	if resp := observe(t, s2, e2, no); resp.Code != errutil.Code(errutil.ErrObserverFull) {
+		t.Fatalf("observe response: %+v", resp)
+	}
+	if err := defaultDeskManager.LeaveObserve(s1, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "退出观战", func() bool { return p1.watchingDesk() == nil })
+	if resp := observe(t, s2, e2, no); resp.Code != 0 || resp.Observers != 1 {
+		t.Fatalf("observe response: %+v", resp)
+	}
+	if p2.watchingDesk() != d || p2.currentDesk() != nil {
+		t.Fatal("observer should watch the desk without taking a seat")
+	}
+
+	// 观战者不占用座位, 不影响开局
+	var players, total int
+	d.do(func() { players, total = len(d.players), d.totalPlayerCount() })
+	if players != total {
+		t.Fatalf("players=%d total=%d", players, total)
+	}
+	start := time.Now()
+	startRound(t, d, s)
+
+	// 牌桌销毁后, 推送完剩余的消息再释放观战者
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+	waitFor(t, "释放观战者", func() bool { return p2.watchingDesk() == nil })
+	if len(e2.received("onGameEnd")) != 1 || len(e2.received(protocol.RouteTypeDo)) == 0 {
+		t.Fatalf("observer should receive public events, onGameEnd=%d", len(e2.received("onGameEnd")))
+	}
+	if len(e1.received(protocol.RouteTypeDo)) != 0 {
+		t.Fatal("observer should not receive events after leave")
+	}
+
+	duan := e2.received("onDuanPai")
+	if len(duan) != 1 {
+		t.Fatalf("onDuanPai count=%d", len(duan))
+	}
+	if wait := duan[0].at.Sub(start); wait < delay {
+		t.Fatalf("onDuanPai delivered without delay: %v", wait)
+	}
+	for _, info := range duan[0].v.(*protocol.DuanPai).AccountInfo {
+		if len(info.OnHand) != 0 || info.Count == 0 {
+			t.Fatalf("concealed tiles leaked to observer: %+v", info)
+		}
+	}
+	for _, mo := range e2.received("onMoPai") {
+		for _, id := range mo.v.(*protocol.MoPai).TileIDs {
+			if id != protocol.HiddenTileID {
+				t.Fatalf("drawn tile leaked to observer: %+v", mo.v)
+			}
+		}
+	}
+}
+
+// 队列已满时丢弃消息, 队列有空位之后先推送完整的牌桌数据
+func TestObserverResync(t *testing.T) {
+	setupLoopTest(t)
+	d := NewDesk(room.Number("100019"), &protocol.DeskOptions{Mode: ModeFours, MaxRound: 1, MaxFan: 3, Pinghu: true}, -1)
+	defer destroyDesk(d)
+	s, _, p := newObserverSession(t, 13)
+
+	d.do(func() {
+		d.setStatus(constant.DeskStatusPlaying)
+		prev := d.observers
+		defer func() { d.observers = prev }()
+
+		// 不启动推送协程, 直接检查队列
+		o := newObserverContext(d)
+		o.queue = make(chan *observerMessage, 2)
+		o.delay = time.Hour
+		o.started = true
+		o.observers[13] = &observer{p: p, s: s}
+		d.observers = o
+
+		for _, route := range []string{"a", "b", "c", "d"} {
+			o.publish(route, nil)
+		}
+		if !o.resync || len(o.queue) != 2 {
+			t.Fatalf("resync=%v queued=%d", o.resync, len(o.queue))
+		}
+
+		routes := []string{}
+		for i := 0; i < 2; i++ {
+			routes = append(routes, (<-o.queue).route)
+		}
+		o.publish("e", nil)
+		for len(o.queue) > 0 {
+			routes = append(routes, (<-o.queue).route)
+		}
+		if o.resync || fmt.Sprint(routes) != "[a b onSyncDesk e]" {
+			t.Fatalf("resync=%v routes=%v", o.resync, routes)
+		}
+	})
+}
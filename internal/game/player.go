@@ -2,11 +2,15 @@ package game
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"go-mahjong-server/db"
 	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
 	"go-mahjong-server/internal/game/mahjong"
 	"go-mahjong-server/pkg/async"
+	"go-mahjong-server/pkg/constant"
 	"go-mahjong-server/protocol"
 
 	"github.com/lonng/nano/session"
@@ -19,27 +23,38 @@ type Loser struct {
 }
 
 type Player struct {
-	uid  int64  // 用户ID
-	head string // 头像地址
-	name string // 玩家名字
-	ip   string // ip地址
-	sex  int    // 性别
-	coin int64  // 房卡数量
+	uid    int64  // 用户ID
+	head   string // 头像地址
+	name   string // 玩家名字
+	ip     string // ip地址
+	sex    int    // 性别
+	coin   int64  // 房卡数量, 原子操作
+	rating int64  // 匹配分, 原子操作
+	gold   int64  // 金币场的金币, 原子操作
 
 	// 玩家数据
+	mu      sync.RWMutex // 保护session, desk和watching, 这些字段会在nano逻辑协程和牌桌协程中同时访问
 	session *session.Session
 
 	// 游戏相关字段
 	onHand   mahjong.Mahjong
 	pongKong mahjong.Mahjong
+	chiTiles mahjong.Mahjong // 吃的顺子, 每三张一组
 	chupai   mahjong.Mahjong
+	huTiles  []int // 血流成河中已经胡的牌
 	ctx      *mahjong.Context
 
 	chOperation chan *protocol.OpChoosed
+	trusteeship int32   // 是否托管, 1: 托管中
+	robot       bool    // 是否是机器人
+	illegalOps  int     // 本局非法操作次数
+	autoOp      bool    // 等待超时后已经自动操作, 收到下一次提示之前迟到的选择不计入非法操作
+	decide      Decider // 模拟牌局中的决策, 为nil时使用机器人或者托管策略
 
-	desk  *Desk //当前桌
-	turn  int   //当前玩家在桌上的方位
-	score int   //经过n局后,当前玩家余下的分值数,默认为1000
+	desk     *Desk //当前桌
+	turn     int   //当前玩家在桌上的方位
+	score    int   //经过n局后,当前玩家余下的分值数,默认为1000
+	watching *Desk // 正在观战的牌桌
 
 	logger *log.Entry // 日志
 }
@@ -66,51 +81,92 @@ func newPlayer(s *session.Session, uid int64, name, head, ip string, sex int) *P
 	return p
 }
 
-// 异步从数据库同步房卡
+// 没有session的玩家, 例如比赛开始时不在线的参赛玩家, 登录后绑定session
+func newOfflinePlayer(uid int64, name string) *Player {
+	p := &Player{
+		uid:   uid,
+		name:  name,
+		head:  protocol.DefaultHeadUrl,
+		ctx:   &mahjong.Context{Uid: uid},
+		score: 1000,
+
+		logger: log.WithField(fieldPlayer, uid),
+
+		chOperation: make(chan *protocol.OpChoosed, 1),
+	}
+
+	p.ctx.Reset()
+	return p
+}
+
+// 异步从数据库同步房卡, 匹配分和金币
 func (p *Player) syncCoinFromDB() {
+	logger := p.logger
 	async.Run(func() {
 		u, err := db.QueryUser(p.uid)
 		if err != nil {
-			p.logger.Errorf("玩家同步房卡错误, Error=%v", err)
+			logger.Errorf("玩家同步房卡错误, Error=%v", err)
 			return
 		}
 
-		p.coin = u.Coin
-		if s := p.session; s != nil {
-			s.Push("onCoinChange", &protocol.CoinChangeInformation{p.coin})
+		p.setCoin(u.Coin)
+		p.setRating(u.Rating)
+		p.setGold(u.Gold)
+		if s := p.currentSession(); s != nil {
+			s.Push("onCoinChange", &protocol.CoinChangeInformation{Coin: u.Coin})
 		}
 	})
 }
 
 // 异步扣除玩家房卡
 func (p *Player) loseCoin(count int64, consume *model.CardConsume) {
+	// 机器人不消耗房卡
+	if p.isRobot() {
+		return
+	}
+
+	// 即使数据库不成功，玩家房卡数量依然扣除
+	coin := atomic.AddInt64(&p.coin, -count)
+	logger := p.logger
+	st := p.desk.store
 	async.Run(func() {
-		u, err := db.QueryUser(p.uid)
-		if err != nil {
-			p.logger.Errorf("扣除房卡，查询玩家错误, Error=%v", err)
-			return
+		if err := st.loseCoin(p.uid, count, consume); err != nil {
+			logger.Errorf("扣除房卡错误, Error=%v Payload=%+v", err, consume)
 		}
 
-		// 即使数据库不成功，玩家房卡数量依然扣除
-		p.coin -= count
-		u.Coin = p.coin
-		if err := db.UpdateUser(u); err != nil {
-			p.logger.Errorf("扣除房卡，更新房卡数量错误, Error=%v", err)
-			return
+		if s := p.currentSession(); s != nil {
+			s.Push("onCoinChange", &protocol.CoinChangeInformation{Coin: coin})
 		}
+	})
+}
 
-		if u.Coin != p.coin {
-			p.logger.Errorf("玩家扣除房卡，同步到数据库后，发现房卡数量不一致，玩家数量=%d，数据库数量=%d", p.coin, u.Coin)
-		}
+func (p *Player) coinCount() int64 {
+	return atomic.LoadInt64(&p.coin)
+}
 
-		if err := db.Insert(consume); err != nil {
-			p.logger.Errorf("新增消费数据错误，Error=%v Payload=%+v", err, consume)
-		}
+func (p *Player) setCoin(coin int64) {
+	atomic.StoreInt64(&p.coin, coin)
+}
 
-		if s := p.session; s != nil {
-			s.Push("onCoinChange", &protocol.CoinChangeInformation{p.coin})
-		}
-	})
+func (p *Player) ratingValue() int {
+	return int(atomic.LoadInt64(&p.rating))
+}
+
+func (p *Player) setRating(rating int) {
+	atomic.StoreInt64(&p.rating, int64(rating))
+}
+
+func (p *Player) goldBalance() int64 {
+	return atomic.LoadInt64(&p.gold)
+}
+
+func (p *Player) setGold(gold int64) {
+	atomic.StoreInt64(&p.gold, gold)
+}
+
+// 修改金币, 返回修改后的余额
+func (p *Player) addGold(delta int64) int64 {
+	return atomic.AddInt64(&p.gold, delta)
 }
 
 func (p *Player) setDesk(d *Desk, turn int) {
@@ -119,10 +175,12 @@ func (p *Player) setDesk(d *Desk, turn int) {
 		return
 	}
 
+	p.mu.Lock()
 	p.desk = d
+	p.mu.Unlock()
 	p.turn = turn
 
-	p.logger = log.WithFields(log.Fields{fieldDesk: p.desk.roomNo, fieldPlayer: p.uid})
+	p.logger = log.WithFields(log.Fields{fieldDesk: d.roomNo, fieldPlayer: p.uid})
 
 	//全、半频道
 	p.ctx.Opts = d.opts
@@ -130,18 +188,87 @@ func (p *Player) setDesk(d *Desk, turn int) {
 
 }
 
+// 玩家当前所在的牌桌, 可以在任意协程中调用
+func (p *Player) currentDesk() *Desk {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.desk
+}
+
+// 离开牌桌, 在牌桌协程中调用, 牌桌协程已经退出时可以在其他协程中调用
+func (p *Player) leaveDesk() {
+	p.mu.Lock()
+	p.desk = nil
+	p.mu.Unlock()
+}
+
+// 正在观战的牌桌, 可以在任意协程中调用
+func (p *Player) watchingDesk() *Desk {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.watching
+}
+
+func (p *Player) setWatching(d *Desk) {
+	p.mu.Lock()
+	p.watching = d
+	p.mu.Unlock()
+}
+
+// 退出观战, 已经开始观战其他牌桌时不受影响
+func (p *Player) stopWatching(d *Desk) {
+	p.mu.Lock()
+	if p.watching == d {
+		p.watching = nil
+	}
+	p.mu.Unlock()
+}
+
 func (p *Player) setIp(ip string) {
 	p.ip = ip
 }
 
+// 玩家当前的session, 可以在任意协程中调用, 玩家离线时返回nil
+func (p *Player) currentSession() *session.Session {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.session
+}
+
 func (p *Player) bindSession(s *session.Session) {
+	p.mu.Lock()
 	p.session = s
-	p.session.Set(kCurPlayer, p)
+	p.mu.Unlock()
+	s.Set(kCurPlayer, p)
+}
+
+// 使用数据库中的资料更新玩家的信息, 玩家在牌桌中时需要在牌桌协程中调用
+func (p *Player) updateProfile(pf *profile) {
+	p.name = pf.name
+	p.head = pf.head
+	p.sex = pf.sex
+	p.setCoin(pf.coin)
+	p.setRating(pf.rating)
+	p.setGold(pf.gold)
+}
+
+// 玩家在牌桌中时资料由牌桌协程更新
+func (p *Player) syncProfile(pf *profile) {
+	if d := p.currentDesk(); d != nil && d.post(func() { p.updateProfile(pf) }) {
+		return
+	}
+	p.updateProfile(pf)
 }
 
 func (p *Player) removeSession() {
-	p.session.Remove(kCurPlayer)
+	p.mu.Lock()
+	s := p.session
 	p.session = nil
+	p.mu.Unlock()
+
+	if s != nil {
+		s.Remove(kCurPlayer)
+	}
 }
 
 func (p *Player) Uid() int64 {
@@ -161,24 +288,19 @@ func (p *Player) chuPai() int {
 
 ctrl:
 	p.hint([]protocol.Op{{Type: protocol.OptypeChu}}, p.tingTiles())
-	select {
-	case op, ok := <-p.chOperation:
-		if !ok {
-			return deskDissolved
-		}
-
-		if op.Type != protocol.OptypeChu {
-			p.logger.Errorf("玩家操作异常，期待操作出牌，获取操作=%+v", op)
-			goto ctrl
-		}
+	op, ok := p.waitOperation(p.autoChuPai)
+	if !ok {
+		return deskDissolved
+	}
 
-		tid = op.TileID
-		if tid < 0 {
-			p.logger.Debugf("玩家读取到一个非法的麻将ID: ID=%+v", op)
-		}
+	if op.Type != protocol.OptypeChu {
+		p.logger.Errorf("玩家操作异常，期待操作出牌，获取操作=%+v", op)
+		goto ctrl
+	}
 
-	case <-p.desk.die:
-		return deskDissolved
+	tid = op.TileID
+	if tid < 0 {
+		p.logger.Debugf("玩家读取到一个非法的麻将ID: ID=%+v", op)
 	}
 
 	// 删掉已经出过的牌
@@ -212,21 +334,13 @@ func (p *Player) hu(tileID int, hasHint bool) int {
 			{Type: protocol.OptypePass},
 		})
 	}
-	select {
-	case op, ok := <-p.chOperation:
-		if !ok {
-			return deskDissolved
-		}
-
-		p.ctx.SetPrevOp(op.Type)
-		return op.Type
-
-	case <-p.desk.die:
+	op, ok := p.waitOperation(p.autoHu(tileID))
+	if !ok {
 		return deskDissolved
 	}
 
-	p.logger.Debugf("玩家胡牌: 麻将=%d", tileID)
-	return protocol.OptypeHu
+	p.ctx.SetPrevOp(op.Type)
+	return op.Type
 }
 
 // 让玩家选择碰杠
@@ -251,20 +365,14 @@ func (p *Player) pengOrGang(tileID int, ops []protocol.Op, hasHint bool) (isPeng
 		//碰、杠、过
 		p.hint(hints)
 
-		select {
-		case op, ok := <-p.chOperation:
-			if !ok {
-				isDissolve = true
-				return
-			}
-
-			tileID = op.TileID
-			opType = op.Type
-
-		case <-p.desk.die:
+		op, ok := p.waitOperation(p.autoPass)
+		if !ok {
 			isDissolve = true
 			return
 		}
+
+		// 碰杠的只能是打出的这张牌, 不使用客户端提交的ID
+		opType = op.Type
 	}
 
 	switch opType {
@@ -285,6 +393,47 @@ func (p *Player) pengOrGang(tileID int, ops []protocol.Op, hasHint bool) (isPeng
 	return isPeng, isGang, isDissolve
 }
 
+// 让下家选择吃牌, ops为所有可以组成的顺子
+func (p *Player) chiOrPass(tileID int, ops []protocol.Op) (isChi, isDissolve bool) {
+	hints := []protocol.Op{{Type: protocol.OptypePass}}
+	hints = append(hints, ops...)
+	p.hint(hints)
+
+	op, ok := p.waitOperation(p.autoPass)
+	if !ok {
+		return false, true
+	}
+	if op.Type != protocol.OptypeChi {
+		p.logger.Debugf("玩家选择不吃, 麻将: %d", tileID)
+		return false, false
+	}
+
+	// 以顺子的第一张牌区分玩家选择的顺子
+	index := mahjong.IndexFromID(op.TileID)
+	for _, o := range ops {
+		if mahjong.IndexFromID(o.TileIDs[0]) == index {
+			p.chi(tileID, o.TileIDs)
+			p.action(protocol.OptypeChi, o.TileIDs)
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// 吃牌, 顺子中的另外两张从手牌中移出
+func (p *Player) chi(tileID int, ids []int) {
+	for _, id := range ids {
+		if id != tileID {
+			mahjong.RemoveId(&p.onHand, id)
+		}
+		p.chiTiles = append(p.chiTiles, mahjong.TileFromID(id))
+	}
+
+	p.logger.Debugf("玩家吃牌, 麻将=%v 手牌=%+v 碰杠吃=%+v", mahjong.TileFromID(tileID), p.handTiles(), p.pgTiles())
+
+	p.ctx.SetPrevOp(protocol.OptypeChi)
+}
+
 func (p *Player) moPai() {
 	id := p.desk.nextTile().Id
 	mo := &protocol.MoPai{
@@ -304,10 +453,10 @@ func (p *Player) moPai() {
 	// 保存快照
 	p.desk.snapshot.PushAction(record)
 
-	// 这里如果返回错误, 可能是有玩家的socket关掉了, 玩家掉线, 可能需要把玩家标记为托管
-	if err := p.desk.group.Broadcast("onMoPai", mo); err != nil {
-		log.Error(err)
-	}
+	// 其他玩家只能看到摸牌动作, 看不到具体的牌
+	p.desk.broadcastView("onMoPai", func(uid int64) interface{} {
+		return moPaiView(mo, uid)
+	})
 
 	// TODO: 确认海底捞是否是最后一个摸牌的, 其他人摸最后一张牌, 点炮是否算海底捞
 	p.ctx.IsLastTile = p.desk.noMoreTile()
@@ -326,7 +475,7 @@ func (p *Player) chuTiles() mahjong.Mahjong {
 
 // 检查是否有叫
 func (p *Player) isTing() bool {
-	return mahjong.IsTing(p.handTiles().Indexes())
+	return len(p.desk.rules.TingTiles(p.handTiles().Indexes())) > 0
 }
 
 func (p *Player) tileIDWithIndex(index int) int {
@@ -351,31 +500,15 @@ func (p *Player) allTileIDWithIndex(index int) mahjong.Tiles {
 }
 
 // 碰杠牌
+// 碰杠吃的牌
 func (p *Player) pgTiles() mahjong.Mahjong {
-	return p.pongKong
-}
-
-func (p *Player) canWin() bool {
-	newTile := mahjong.TileFromID(p.ctx.NewDrawingID)
-	que := p.ctx.Que
-	// 打缺的牌不能胡
-	if que == newTile.Suit+1 {
-		return false
+	if len(p.chiTiles) == 0 {
+		return p.pongKong
 	}
 
-	// 还没有打缺不能胡
-	for _, t := range p.onHand {
-		if que == t.Suit+1 {
-			return false
-		}
-	}
-
-	canWin := mahjong.CheckWin(p.handTiles().Indexes())
-
-	p.logger.Infof("玩家计算是否可以胡牌: 手牌=%+v, 新上手=%v, 是否可以胡=%t",
-		p.handTiles(), newTile, canWin)
-
-	return canWin
+	tiles := make(mahjong.Mahjong, 0, len(p.pongKong)+len(p.chiTiles))
+	tiles = append(tiles, p.pongKong...)
+	return append(tiles, p.chiTiles...)
 }
 
 func (p *Player) allGang() []protocol.Op {
@@ -383,7 +516,7 @@ func (p *Player) allGang() []protocol.Op {
 	ops := []protocol.Op{}
 
 	handTiles := p.handTiles()
-	pgTiles := p.pgTiles()
+	pgTiles := p.pongKong // 吃的顺子不能杠
 
 	for _, t := range handTiles {
 		tileGroup[t.Index] = append(tileGroup[t.Index], t)
@@ -471,7 +604,7 @@ func (p *Player) tingTiles() protocol.Tings {
 	for index := range distinct {
 		rest := exclude(index)
 		//log.Debugf("去除：%v，剩余：%+v", index, rest)
-		if ting := mahjong.TingTiles(rest); len(ting) > 0 {
+		if ting := p.desk.rules.TingTiles(rest); len(ting) > 0 {
 			tings = append(tings, protocol.Ting{Index: index, Hu: ting})
 		}
 	}
@@ -526,6 +659,7 @@ func (p *Player) doCheckHandTiles(isNewRound bool) (int, int) {
 			pp.desk.scoreChangeForHu(pp, losers, pp.ctx.WinningID, protocol.HuTypeZiMo)
 
 			pp.ctx.ResultType = ResultZiMo
+			pp.desk.continueAfterHu(pp, pp.ctx.WinningID)
 		}
 		return op.Type, pp.ctx.NewDrawingID
 	}
@@ -535,7 +669,7 @@ func (p *Player) doCheckHandTiles(isNewRound bool) (int, int) {
 		p.onHand = append(p.onHand, mahjong.TileFromID(p.ctx.NewDrawingID))
 	}
 
-	canWin = p.canWin()
+	canWin = p.desk.rules.CanZiMo(p)
 
 	//机器人如果能和能杠,则直接和,而玩家则给他两个选择
 	ops := []protocol.Op{}
@@ -567,134 +701,47 @@ func (p *Player) doCheckHandTiles(isNewRound bool) (int, int) {
 
 	p.hint(ops)
 
-	select {
-	case op, ok := <-p.chOperation:
-		if !ok {
-			return protocol.OptypePass, deskDissolved
-		}
-
-		var mjs mahjong.Tiles
-		switch op.Type {
-		case protocol.OptypePass:
-			return op.Type, p.ctx.NewDrawingID
+	op, ok := p.waitOperation(p.autoCheckHandTiles(ops))
+	if !ok {
+		return protocol.OptypePass, deskDissolved
+	}
 
-		case protocol.OptypeGang:
+	var mjs mahjong.Tiles
+	switch op.Type {
+	case protocol.OptypePass:
+		return op.Type, p.ctx.NewDrawingID
 
-			//刮风的牌,是onHand里只可能有一张,而其他3张在"pongKong"里
-			mjs = p.allTileIDWithIndex(mahjong.TileFromID(op.TileID).Index)
-			//巴杠,抢杠
-			if len(mjs) == 1 {
-				// fixed: 巴杠也需要通知客户端
-				p.action(op.Type, mjs)
-				return protocol.OptypeBaGang, op.TileID //可能杠的并不是最后摸的那一张牌，即n把后才杠
-			}
+	case protocol.OptypeGang:
 
-		case protocol.OptypeHu:
-			mjs = []int{op.TileID}
+		//刮风的牌,是onHand里只可能有一张,而其他3张在"pongKong"里
+		mjs = p.allTileIDWithIndex(mahjong.TileFromID(op.TileID).Index)
+		//巴杠,抢杠
+		if len(mjs) == 1 {
+			// fixed: 巴杠也需要通知客户端
+			p.action(op.Type, mjs)
+			return protocol.OptypeBaGang, op.TileID //可能杠的并不是最后摸的那一张牌，即n把后才杠
 		}
 
-		return fn(p, op, mjs)
-
-	case <-p.desk.die:
-		return protocol.OptypePass, deskDissolved
+	case protocol.OptypeHu:
+		mjs = []int{p.ctx.NewDrawingID}
 	}
 
-	return protocol.OptypePass, p.ctx.NewDrawingID
+	return fn(p, op, mjs)
 }
 
 // 计算番数
 func (p *Player) scoring() int {
-	m := mahjong.Multiple(p.ctx, p.handTiles().Indexes(), p.pgTiles().Indexes())
+	m := p.desk.rules.Multiple(p.ctx, p.handTiles().Indexes(), p.pgTiles().Indexes())
 	p.ctx.Fan = m
 	return 1 << uint(m)
 }
 
 func (p *Player) maxTingScore() (int, int) {
-	m, idx := mahjong.MaxMultiple(p.desk.opts, p.handTiles().Indexes(), p.pgTiles().Indexes())
+	m, idx := p.desk.rules.MaxMultiple(p.desk.opts, p.handTiles().Indexes(), p.pgTiles().Indexes())
 	p.ctx.Fan = m
 	return 1 << uint(m), idx
 }
 
-// 检查吃牌
-// 是否碰(pong)/杠(kong)/胡(win)其他人的牌
-func (p *Player) checkChi(tid int, chuPlayer *Player) []protocol.Op {
-	tile := mahjong.TileFromID(tid)
-	ret := []protocol.Op{}
-
-	// 不能碰杠缺的牌
-	if tile.Suit+1 == p.ctx.Que {
-		return ret
-	}
-
-	// 检查胡牌
-	if p.checkHu(tid, chuPlayer.ctx.PrevOp == protocol.OptypeGang) {
-		ret = append(ret, protocol.Op{Type: protocol.OptypeHu, TileIDs: []int{tile.Id}})
-	}
-
-	sameTiles := mahjong.Mahjong{}
-	tiles := p.handTiles()
-	for _, sp := range tiles {
-		if sp.Index == tile.Index {
-			sameTiles = append(sameTiles, sp)
-		}
-	}
-
-	p.logger.Debugf("其他人打牌, 检查玩家是否可以杠, 手牌=%+v 检查是否能吃的牌=%s, 相同麻将=%+v",
-		tiles, tile.String(), sameTiles)
-	// 明牌玩家直接检查扣牌是否可以杠
-
-	//检查碰、杠
-	if len(sameTiles) == 3 && !p.desk.noMoreTile() {
-		ret = append(ret, protocol.Op{Type: protocol.OptypeGang, TileIDs: mahjong.Tiles{sameTiles[0].Id}})
-	}
-	if len(sameTiles) == 2 {
-		ret = append(ret, protocol.Op{Type: protocol.OptypePeng, TileIDs: mahjong.Tiles{sameTiles[0].Id}})
-	}
-
-	p.logger.Debugf("计算杠牌完毕, 所有可用操作: %+v", ret)
-	return ret
-}
-
-// 是否胡牌, plus表示是不是额外有番(比如抢杠，别人杠上炮)
-func (p *Player) checkHu(tid int, plus bool) bool {
-	index := mahjong.IndexFromID(tid)
-	tiles := p.handTiles()
-	que := p.ctx.Que
-
-	// 不能胡缺牌
-	tile := mahjong.TileFromID(tid)
-	if tile.Suit+1 == que {
-		return false
-	}
-	// 还没有打缺不能胡
-	for _, t := range tiles {
-		if que == t.Suit+1 {
-			return false
-		}
-	}
-
-	// 检查胡牌
-	canHu := mahjong.CanHu(tiles.Indexes(), index)
-	if !canHu {
-		return false
-	}
-
-	// 如果可以平胡
-	if p.desk.opts.Pinghu {
-		return true
-	}
-
-	// 如果不能点炮平胡
-	onHand := append(p.handTiles().Indexes(), index)
-	old := p.ctx.NewOtherDiscardID
-	p.ctx.NewOtherDiscardID = tid
-	m := mahjong.Multiple(p.ctx, onHand, p.pgTiles().Indexes())
-	p.ctx.NewOtherDiscardID = old
-
-	// 有番才能胡
-	return m > 0 || plus
-}
-
 func (p *Player) brotherTiles(id, count int) mahjong.Tiles {
 	tile := mahjong.TileFromID(id)
 
@@ -763,7 +810,7 @@ func (p *Player) action(opType int, tiles mahjong.Tiles) {
 		OpType:  opType,
 		TileIDs: tiles,
 	}
-	if err := p.desk.group.Broadcast(protocol.RouteTypeDo, do); err != nil {
+	if err := p.desk.broadcast(protocol.RouteTypeDo, do); err != nil {
 		log.Error(err)
 	}
 
@@ -795,16 +842,24 @@ func (p *Player) hint(ops []protocol.Op, args ...protocol.Tings) {
 
 	hint := &protocol.Hint{Uid: p.Uid(), Ops: ops, Tings: tings}
 
+	p.autoOp = false
 	p.ctx.LastHint = hint
 	p.desk.lastHintUid = p.Uid()
+	p.desk.emit(p.Uid(), history.EventHint, hint)
+
+	// 机器人在waitOperation中做出选择
+	if p.isRobot() {
+		return
+	}
 
-	if p.session == nil {
+	s := p.currentSession()
+	if s == nil {
 		p.logger.Warnf("玩家网络已经断开，不能通知出牌")
 		return
 	}
 
 	p.logger.Debugf("玩家最后提示: Hint=%+v", hint)
-	p.session.Push(protocol.RouteOpTypeHint, hint)
+	s.Push(protocol.RouteOpTypeHint, hint)
 }
 
 // 定缺
@@ -826,74 +881,52 @@ func (p *Player) selectDefaultQue() int {
 func (p *Player) reset() {
 	p.onHand = mahjong.Mahjong{}
 	p.pongKong = mahjong.Mahjong{}
+	p.chiTiles = mahjong.Mahjong{}
 	p.chupai = mahjong.Mahjong{}
+	p.huTiles = nil
 
 	// 重置channel
 	close(p.chOperation)
 	p.chOperation = make(chan *protocol.OpChoosed, 1)
 	p.ctx.Reset()
+	atomic.StoreInt32(&p.trusteeship, 0)
+	p.illegalOps = 0
+	p.autoOp = false
 }
 
 // 断线重连后，同步牌桌数据
 // TODO: 断线重连，已和牌玩家显示不正常
 func (p *Player) syncDeskData() error {
 	desk := p.desk
-	data := &protocol.SyncDesk{
-		Status:    desk.status(),
-		Players:   []protocol.DeskPlayerData{},
-		ScoreInfo: []protocol.ScoreInfo{},
-	}
-
-	markerUid := int64(0)
-	lastMoPaiUid := int64(0)
-	for i, player := range desk.players {
-		uid := player.Uid()
-		if i == desk.bankerTurn {
-			markerUid = uid
-		}
-		if i == desk.curTurn {
-			lastMoPaiUid = uid
-		}
-		// 有可能已经有玩家和牌
-		stats := desk.roundOverTilesForPlayer(player)
-		playerData := protocol.DeskPlayerData{
-			Uid:        uid,
-			HandTiles:  stats.Tiles,
-			PGTiles:    player.pgTiles().Ids(),
-			ChuTiles:   player.chuTiles().Ids(),
-			LatestTile: player.ctx.NewDrawingID,
-			HuPai:      player.ctx.WinningID,
-			HuType:     player.ctx.ResultType,
-			IsHu:       desk.wonPlayers[uid],
-			Que:        player.ctx.Que,
-			Score:      player.score,
-		}
+	syncUid := p.Uid()
+	data := desk.syncDeskView(syncUid)
 
-		// 如果自己断线重连，并且在定缺中，则发回提示，使用负数表示定缺建议选项
-		if p.Uid() == uid && p.ctx.Que < 1 {
-			playerData.Que = -player.selectDefaultQue()
+	// 如果自己断线重连，并且在定缺中，则发回提示，使用负数表示定缺建议选项
+	if p.ctx.Que < 1 && desk.rules.RequireQue(desk.opts) {
+		for i := range data.Players {
+			if data.Players[i].Uid == syncUid {
+				data.Players[i].Que = -p.selectDefaultQue()
+			}
 		}
+	}
 
-		data.Players = append(data.Players, playerData)
+	if data.LastMoPaiUid == syncUid || desk.lastHintUid == syncUid {
+		data.Hint = p.ctx.LastHint
+	}
 
-		score := protocol.ScoreInfo{
-			Uid:   uid,
-			Score: player.score,
+	// 换三张中, 发回已经选择的牌或者推荐的牌
+	if desk.status() == constant.DeskStatusHuanSanZhang {
+		tiles, chosen := desk.huanSanZhang.chosen[syncUid]
+		if !chosen {
+			tiles = p.huanSanZhangTiles()
 		}
-
-		data.ScoreInfo = append(data.ScoreInfo, score)
+		data.HuanSanZhang = &protocol.HuanSanZhangSync{Chosen: chosen, Tiles: tiles}
 	}
-	data.MarkerUid = markerUid
-	data.LastMoPaiUid = lastMoPaiUid
-	data.RestCount = desk.remainTileCount()
-	data.Dice1 = desk.dice.dice1
-	data.Dice2 = desk.dice.dice2
-	syncUid := p.Uid()
-	if lastMoPaiUid == syncUid || p.desk.lastHintUid == syncUid {
-		data.Hint = p.ctx.LastHint
-	}
-	data.LastTileId = p.desk.lastTileId
-	data.LastChuPaiUid = p.desk.lastChuPaiUid
 	p.logger.Debugf("同步房间数据: %+v", data)
-	return p.session.Push("onSyncDesk", data)
+
+	s := p.currentSession()
+	if s == nil {
+		return nil
+	}
+	return s.Push("onSyncDesk", data)
 }
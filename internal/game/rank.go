@@ -0,0 +1,219 @@
+package game
+
+import (
+	"fmt"
+	"time"
+
+	"go-mahjong-server/db"
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/pkg/async"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/component"
+	"github.com/lonng/nano/session"
+)
+
+// 排行榜: 按天/周/全部统计累计分数, 胡牌次数和房卡消耗, 分为全服和俱乐部排行榜.
+// 每场牌局结束(或者扣除房卡)时增量累加到数据库, 查询时直接按数值排序, 列表缓存一小段时间.
+// 金币场按金币结算, 不计入排行榜
+
+const (
+	rankPeriodAll = "all"
+	rankCacheTTL  = 10 * time.Second
+	rankMaxLen    = 100 // 单次查询的最大数量
+)
+
+const (
+	rankClubMessage = "你不是该俱乐部的成员"
+)
+
+type rankCache struct {
+	ranks    []protocol.Rank
+	expireAt time.Time
+}
+
+type RankManager struct {
+	component.Base
+	store  rankStore
+	caches map[string]*rankCache // 排行榜列表缓存, 只在nano逻辑协程中访问
+	now    func() time.Time
+	isClub func(clubId, uid int64) bool
+}
+
+var defaultRankManager = NewRankManager()
+
+func NewRankManager() *RankManager {
+	return &RankManager{
+		store:  dbStore{},
+		caches: map[string]*rankCache{},
+		now:    time.Now,
+		isClub: db.IsClubMember,
+	}
+}
+
+// 统计周期的名字, 周使用ISO周数
+func rankPeriodKey(period int, now time.Time) string {
+	switch period {
+	case protocol.RankPeriodDaily:
+		return "d" + now.Format("20060102")
+	case protocol.RankPeriodWeekly:
+		y, w := now.ISOWeek()
+		return fmt.Sprintf("w%d%02d", y, w)
+	default:
+		return rankPeriodAll
+	}
+}
+
+// 一次变化需要累加的所有统计: 每个周期的全服排行榜, 俱乐部房间同时累加到俱乐部排行榜
+func rankStats(uid int64, name string, clubId int64, now time.Time, values map[int]int64) []*model.RankStat {
+	stats := []*model.RankStat{}
+	clubs := []int64{0}
+	if clubId > 0 {
+		clubs = append(clubs, clubId)
+	}
+	for metric, value := range values {
+		if value == 0 {
+			continue
+		}
+		for _, period := range []int{protocol.RankPeriodDaily, protocol.RankPeriodWeekly, protocol.RankPeriodAll} {
+			for _, club := range clubs {
+				stats = append(stats, &model.RankStat{
+					Uid:       uid,
+					Name:      name,
+					ClubId:    club,
+					Period:    rankPeriodKey(period, now),
+					Metric:    metric,
+					Value:     value,
+					UpdatedAt: now.Unix(),
+				})
+			}
+		}
+	}
+	return stats
+}
+
+// Query 查询排行榜和自己的排名
+func (m *RankManager) Query(s *session.Session, req *protocol.GetRankInfoRequest) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	if req.Type < protocol.RankTypeScore || req.Type > protocol.RankTypeCard ||
+		req.Period < protocol.RankPeriodDaily || req.Period > protocol.RankPeriodAll || req.Start < 0 {
+		return errutil.ErrIllegalParameter
+	}
+	if req.ClubId > 0 && !m.isClub(req.ClubId, p.Uid()) {
+		return s.Response(&protocol.RankInfoResponse{Code: errorCode, Error: rankClubMessage})
+	}
+	if req.Len <= 0 {
+		req.Len = db.DefaultTopN
+	}
+	if req.Len > rankMaxLen {
+		req.Len = rankMaxLen
+	}
+
+	period := rankPeriodKey(req.Period, m.now())
+	resp := &protocol.RankInfoResponse{
+		Type:   req.Type,
+		Period: req.Period,
+		ClubId: req.ClubId,
+		Ranks:  []protocol.Rank{},
+		Self:   protocol.Rank{Uid: p.Uid(), Name: p.name},
+	}
+
+	if !req.IsSelf {
+		ranks, err := m.ranks(req.Type, period, req.ClubId, req.Start, req.Len)
+		if err != nil {
+			return s.Response(&protocol.RankInfoResponse{Code: errutil.Code(err), Error: err.Error()})
+		}
+		resp.Ranks = ranks
+	}
+
+	st, err := m.store.rankStat(p.Uid(), req.Type, period, req.ClubId)
+	if err != nil {
+		return s.Response(&protocol.RankInfoResponse{Code: errutil.Code(err), Error: err.Error()})
+	}
+	if st != nil {
+		rank, err := m.store.rankOf(st)
+		if err != nil {
+			return s.Response(&protocol.RankInfoResponse{Code: errutil.Code(err), Error: err.Error()})
+		}
+		resp.Self.Value, resp.Self.Rank = st.Value, rank
+	}
+
+	return s.Response(resp)
+}
+
+// 排行榜列表, 缓存过期后重新查询
+func (m *RankManager) ranks(metric int, period string, clubId int64, start, count int) ([]protocol.Rank, error) {
+	now := m.now()
+	key := fmt.Sprintf("%d:%s:%d:%d:%d", metric, period, clubId, start, count)
+	if c, ok := m.caches[key]; ok && now.Before(c.expireAt) {
+		return c.ranks, nil
+	}
+
+	list, err := m.store.ranks(metric, period, clubId, start, count)
+	if err != nil {
+		return nil, err
+	}
+	ranks := make([]protocol.Rank, 0, len(list))
+	for i, st := range list {
+		ranks = append(ranks, protocol.Rank{Uid: st.Uid, Name: st.Name, Value: st.Value, Rank: start + i + 1})
+	}
+
+	// 清除过期的缓存
+	for k, c := range m.caches {
+		if !now.Before(c.expireAt) {
+			delete(m.caches, k)
+		}
+	}
+	m.caches[key] = &rankCache{ranks: ranks, expireAt: now.Add(rankCacheTTL)}
+	return ranks, nil
+}
+
+// 牌局结束后累加分数和胡牌次数, 在牌桌协程中调用
+func (d *Desk) updateRanks(stats map[int64]*history.Record) {
+	if d.classic != nil {
+		return
+	}
+
+	now := time.Now()
+	list := []*model.RankStat{}
+	for _, p := range d.players {
+		r, ok := stats[p.Uid()]
+		if !ok || p.isRobot() {
+			continue
+		}
+		list = append(list, rankStats(p.Uid(), p.name, d.clubId, now, map[int]int64{
+			protocol.RankTypeScore: int64(r.TotalScore),
+			protocol.RankTypeWins:  int64(r.HuNum),
+		})...)
+	}
+	d.incrRanks(list)
+}
+
+// 扣除房卡后累加房卡消耗, 俱乐部房间计入房主
+func (d *Desk) rankCardConsume(p *Player, consume *model.CardConsume) {
+	if p.isRobot() {
+		return
+	}
+	d.incrRanks(rankStats(p.Uid(), p.name, consume.ClubId, time.Now(), map[int]int64{
+		protocol.RankTypeCard: int64(consume.CardCount),
+	}))
+}
+
+func (d *Desk) incrRanks(list []*model.RankStat) {
+	if len(list) == 0 {
+		return
+	}
+	st := d.store
+	logger := d.logger
+	async.Run(func() {
+		if err := st.incrRanks(list); err != nil {
+			logger.Errorf("更新排行榜失败, Error=%v", err)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package game
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+)
+
+// 与数据库相同: 数值大的在前, 数值相同时先上榜的在前
+func (m *memStore) rankList(metric int, period string, clubId int64) []*model.RankStat {
+	list := []*model.RankStat{}
+	for _, r := range m.rankRows {
+		if r.Metric == metric && r.Period == period && r.ClubId == clubId {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Value != list[j].Value {
+			return list[i].Value > list[j].Value
+		}
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+func (m *memStore) ranks(metric int, period string, clubId int64, offset, limit int) ([]*model.RankStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.rankList(metric, period, clubId)
+	if offset >= len(list) {
+		return nil, nil
+	}
+	list = list[offset:]
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	ret := []*model.RankStat{}
+	for _, r := range list {
+		r := *r
+		ret = append(ret, &r)
+	}
+	return ret, nil
+}
+
+func (m *memStore) rankStat(uid int64, metric int, period string, clubId int64) (*model.RankStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.rankRows {
+		if r.Uid == uid && r.Metric == metric && r.Period == period && r.ClubId == clubId {
+			r := *r
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memStore) rankOf(st *model.RankStat) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.rankList(st.Metric, st.Period, st.ClubId) {
+		if r.Id == st.Id {
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (m *memStore) rankValue(uid int64, metric int, period string, clubId int64) int64 {
+	st, _ := m.rankStat(uid, metric, period, clubId)
+	if st == nil {
+		return 0
+	}
+	return st.Value
+}
+
+func TestRankStats(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+	if d, w := rankPeriodKey(protocol.RankPeriodDaily, now), rankPeriodKey(protocol.RankPeriodWeekly, now); d != "d20261016" || w != "w202642" {
+		t.Fatalf("period keys: %s %s", d, w)
+	}
+
+	// 俱乐部房间同时计入全服和俱乐部排行榜, 没有变化的类型不累加
+	stats := rankStats(1, "a", 9, now, map[int]int64{protocol.RankTypeScore: -3, protocol.RankTypeWins: 0})
+	if len(stats) != 6 {
+		t.Fatalf("stats=%d", len(stats))
+	}
+	seen := map[string]bool{}
+	for _, st := range stats {
+		if st.Metric != protocol.RankTypeScore || st.Value != -3 {
+			t.Fatalf("stat: %+v", st)
+		}
+		seen[st.Period+":"+string(rune('0'+st.ClubId))] = true
+	}
+	if len(seen) != 6 {
+		t.Fatalf("periods and scopes should not repeat: %v", seen)
+	}
+	if stats := rankStats(1, "a", 0, now, map[int]int64{protocol.RankTypeCard: 4}); len(stats) != 3 {
+		t.Fatalf("stats=%d", len(stats))
+	}
+}
+
+func TestRankQuery(t *testing.T) {
+	ms := setupLoopTest(t)
+
+	now := time.Now()
+	m := NewRankManager()
+	m.store = ms
+	m.now = func() time.Time { return now }
+	m.isClub = func(clubId, uid int64) bool { return clubId == 901 }
+
+	// 俱乐部牌桌结束后累加分数和胡牌次数, 机器人不计入
+	no := room.Number("100091")
+	d := NewDesk(no, &protocol.DeskOptions{Mode: ModeFours, Rule: RuleXueZhan, MaxRound: 1, MaxFan: 3}, 901)
+	defer destroyDesk(d)
+	uids := []int64{91, 92, 93}
+	sessions := map[int64]*sessionEntity{}
+	for _, uid := range uids {
+		s, e, _ := newLoopTestSession(t, uid)
+		sessions[uid] = &sessionEntity{s, e}
+		d.do(func() {
+			if err := d.playerJoin(s, false); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	d.do(func() {
+		if err := d.robotJoin(1); err != nil {
+			t.Error(err)
+		}
+	})
+	d.do(func() {
+		d.updateRanks(map[int64]*history.Record{
+			91:                 {TotalScore: 5, HuNum: 1},
+			92:                 {TotalScore: 12, HuNum: 2},
+			93:                 {TotalScore: -17},
+			d.players[3].Uid(): {TotalScore: 100, HuNum: 3},
+		})
+	})
+	all := rankPeriodKey(protocol.RankPeriodAll, now)
+	waitFor(t, "排行榜更新", func() bool { return ms.rankValue(93, protocol.RankTypeScore, all, 901) == -17 })
+	if v := ms.rankValue(92, protocol.RankTypeWins, rankPeriodKey(protocol.RankPeriodDaily, now), 0); v != 2 {
+		t.Fatalf("daily wins=%d", v)
+	}
+
+	query := func(uid int64, req *protocol.GetRankInfoRequest) *protocol.RankInfoResponse {
+		t.Helper()
+		se := sessions[uid]
+		if err := m.Query(se.s, req); err != nil {
+			t.Fatal(err)
+		}
+		return se.e.lastResponse().(*protocol.RankInfoResponse)
+	}
+
+	// 俱乐部分数排行榜: 前两名和自己的排名
+	resp := query(93, &protocol.GetRankInfoRequest{Type: protocol.RankTypeScore, Period: protocol.RankPeriodWeekly, ClubId: 901, Len: 2})
+	if resp.Code != 0 || len(resp.Ranks) != 2 || resp.Ranks[0].Uid != 92 || resp.Ranks[1].Uid != 91 || resp.Ranks[1].Rank != 2 {
+		t.Fatalf("ranks: %+v", resp)
+	}
+	if resp.Self.Uid != 93 || resp.Self.Rank != 3 || resp.Self.Value != -17 {
+		t.Fatalf("self: %+v", resp.Self)
+	}
+
+	// 只查询自己的排名, 没有上榜时名次为0
+	resp = query(91, &protocol.GetRankInfoRequest{IsSelf: true, Type: protocol.RankTypeWins, Period: protocol.RankPeriodAll})
+	if len(resp.Ranks) != 0 || resp.Self.Rank != 2 || resp.Self.Value != 1 {
+		t.Fatalf("self only: %+v", resp)
+	}
+	resp = query(93, &protocol.GetRankInfoRequest{Type: protocol.RankTypeWins, Period: protocol.RankPeriodAll})
+	if len(resp.Ranks) != 2 || resp.Self.Rank != 0 {
+		t.Fatalf("not ranked: %+v", resp)
+	}
+
+	// 不是俱乐部成员不能查询
+	resp = query(91, &protocol.GetRankInfoRequest{Type: protocol.RankTypeScore, Period: protocol.RankPeriodAll, ClubId: 902})
+	if resp.Code != errorCode {
+		t.Fatalf("other club: %+v", resp)
+	}
+
+	// 房卡消耗计入房主
+	d.do(func() {
+		d.rankCardConsume(d.players[0], &model.CardConsume{UserId: 91, CardCount: 3, ClubId: 901})
+	})
+	waitFor(t, "房卡消耗", func() bool { return ms.rankValue(91, protocol.RankTypeCard, all, 0) == 3 })
+
+	// 列表缓存过期之前不重新查询, 自己的排名实时查询
+	d.do(func() {
+		d.updateRanks(map[int64]*history.Record{93: {TotalScore: 40}})
+	})
+	waitFor(t, "排行榜更新", func() bool { return ms.rankValue(93, protocol.RankTypeScore, all, 901) == 23 })
+	resp = query(93, &protocol.GetRankInfoRequest{Type: protocol.RankTypeScore, Period: protocol.RankPeriodWeekly, ClubId: 901, Len: 2})
+	if resp.Ranks[0].Uid != 92 || resp.Self.Rank != 1 {
+		t.Fatalf("cached ranks: %+v", resp)
+	}
+	now = now.Add(rankCacheTTL)
+	resp = query(93, &protocol.GetRankInfoRequest{Type: protocol.RankTypeScore, Period: protocol.RankPeriodWeekly, ClubId: 901, Len: 2})
+	if resp.Ranks[0].Uid != 93 || resp.Ranks[0].Value != 23 {
+		t.Fatalf("refreshed ranks: %+v", resp)
+	}
+}
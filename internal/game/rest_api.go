@@ -1,23 +1,99 @@
 package game
 
 import (
+	"sync"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/pkg/cluster"
+	"go-mahjong-server/pkg/errutil"
 	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano"
 )
 
+// 集群模式下同时发送到其他节点, 玩家可能连接在任意一个节点
+
 // TODO: conc
 func Kick(uid int64) error {
-	defaultManager.chKick <- uid
-	return nil
+	kick(uid)
+	return cluster.Broadcast(routeKick, &clusterUid{Uid: uid})
 }
 
 func BroadcastSystemMessage(message string) {
-	defaultManager.group.Broadcast("onBroadcast", &protocol.StringMessage{Message: message})
+	broadcastSystemMessage(message)
+	cluster.Broadcast(routeBroadcast, &protocol.StringMessage{Message: message})
 }
 
 func Reset(uid int64) {
-	defaultManager.chReset <- uid
+	reset(uid)
+	cluster.Broadcast(routeReset, &clusterUid{Uid: uid})
 }
 
 func Recharge(uid, coin int64) {
+	recharge(uid, coin)
+	cluster.Broadcast(routeRecharge, &RechargeInfo{Uid: uid, Coin: coin})
+}
+
+// RechargeGold 后台充值金币, 写入金币流水后同步所有节点上的在线玩家
+func RechargeGold(uid, gold int64) error {
+	if gold <= 0 {
+		return errutil.ErrIllegalParameter
+	}
+	l := &model.GoldLedger{
+		Uid:       uid,
+		Type:      model.GoldLedgerTypeRecharge,
+		Change:    gold,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := store.settleGold([]*model.GoldLedger{l}); err != nil {
+		return err
+	}
+	logicTask(func() { defaultManager.rechargeGold(uid, gold) })
+	return cluster.Broadcast(routeGold, &clusterGold{Uid: uid, Gold: gold})
+}
+
+// SendMail 发送系统邮件, 通知所有节点上在线的收件人
+func SendMail(req *protocol.SendMailRequest) error {
+	m := defaultMailManager
+	mail, err := m.newMail(protocol.MailKindSystem, 0, req)
+	if err != nil {
+		return err
+	}
+	if err := m.store.insertMail(mail); err != nil {
+		return err
+	}
+	logicTask(func() { m.notify(mail) })
+	return cluster.Broadcast(routeMail, mail)
+}
+
+var (
+	shutdownOnce sync.Once
+	nanoShutdown = nano.Shutdown // nano重复关闭时会panic, 测试时可以替换
+)
+
+// Shutdown 停服, 排空牌桌后nano退出, Startup返回. 只有第一次调用时开始停服并返回true
+func Shutdown() bool {
+	started := false
+	shutdownOnce.Do(func() {
+		started = true
+		nanoShutdown()
+	})
+	return started
+}
+
+func kick(uid int64) {
+	defaultManager.chKick <- uid
+}
+
+func broadcastSystemMessage(message string) {
+	defaultManager.group.Broadcast("onBroadcast", &protocol.StringMessage{Message: message})
+}
+
+func reset(uid int64) {
+	defaultManager.chReset <- uid
+}
+
+func recharge(uid, coin int64) {
 	defaultManager.chRecharge <- RechargeInfo{uid, coin}
 }
@@ -0,0 +1,270 @@
+package game
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 机器人思考时间, 避免客户端动画过快
+var robotThinkTime = 500 * time.Millisecond
+
+// 机器人UID从-1开始递减, 不会与数据库中的玩家冲突
+var robotUidSeq int64
+
+// 机器人没有session, 在waitOperation中等待思考时间后根据提示做出选择
+func newRobot() *Player {
+	uid := atomic.AddInt64(&robotUidSeq, -1)
+	p := &Player{
+		uid:   uid,
+		name:  fmt.Sprintf("机器人%d", -uid),
+		ctx:   &mahjong.Context{Uid: uid},
+		sex:   protocol.SexTypeMale,
+		score: 1000,
+		robot: true,
+
+		logger: log.WithField(fieldPlayer, uid),
+
+		chOperation: make(chan *protocol.OpChoosed, 1),
+	}
+
+	p.ctx.Reset()
+	return p
+}
+
+func (p *Player) isRobot() bool {
+	return p.robot
+}
+
+func (p *Player) robotDecide(ops []protocol.Op) *protocol.OpChoosed {
+	var (
+		canPeng bool
+		pengID  = illegalTile
+		chiID   = illegalTile
+	)
+
+	for _, op := range ops {
+		switch op.Type {
+		case protocol.OptypeHu:
+			// 能胡必胡
+			return &protocol.OpChoosed{Type: protocol.OptypeHu, TileID: op.TileIDs[0]}
+
+		case protocol.OptypeChu:
+			return &protocol.OpChoosed{Type: protocol.OptypeChu, TileID: p.robotChuPai()}
+		}
+	}
+
+	for _, op := range ops {
+		switch op.Type {
+		case protocol.OptypeGang:
+			// 已经听牌时, 杠牌不能破坏听牌
+			if !p.isTing() || p.robotKeepTingAfterGang(op.TileIDs[0]) {
+				return &protocol.OpChoosed{Type: protocol.OptypeGang, TileID: op.TileIDs[0]}
+			}
+
+		case protocol.OptypePeng:
+			canPeng = true
+			pengID = op.TileIDs[0]
+
+		case protocol.OptypeChi:
+			// 多个顺子时吃第一个
+			if chiID == illegalTile {
+				chiID = op.TileIDs[0]
+			}
+		}
+	}
+
+	// 已经听牌则不碰, 避免拆掉叫
+	if canPeng && !p.isTing() {
+		return &protocol.OpChoosed{Type: protocol.OptypePeng, TileID: pengID}
+	}
+	if chiID != illegalTile && !p.isTing() {
+		return &protocol.OpChoosed{Type: protocol.OptypeChi, TileID: chiID}
+	}
+
+	return &protocol.OpChoosed{Type: protocol.OptypePass, TileID: illegalTile}
+}
+
+// 杠牌后是否依然听牌
+func (p *Player) robotKeepTingAfterGang(tid int) bool {
+	index := mahjong.IndexFromID(tid)
+	rest := mahjong.Indexes{}
+	for _, idx := range p.handTiles().Indexes() {
+		if idx != index {
+			rest = append(rest, idx)
+		}
+	}
+	return len(p.desk.rules.TingTiles(rest)) > 0
+}
+
+// 机器人选择要打出的牌
+// 1. 有定缺花色的牌先打缺
+// 2. 打出后能听牌的, 选择胡牌张数最多, 番数最大的
+// 3. 否则打出最孤立的牌
+func (p *Player) robotChuPai() int {
+	if que := p.queTiles(); len(que) > 0 {
+		return que[len(que)-1].Id
+	}
+
+	hand := p.handTiles()
+	if len(hand) == 0 {
+		return illegalTile
+	}
+
+	indexes := hand.Indexes()
+	pongKong := p.pgTiles().Indexes()
+
+	bestID, bestScore := illegalTile, -1
+	for _, t := range hand {
+		rest := make(mahjong.Indexes, 0, len(indexes)-1)
+		removed := false
+		for _, idx := range indexes {
+			if idx == t.Index && !removed {
+				removed = true
+				continue
+			}
+			rest = append(rest, idx)
+		}
+
+		tings := p.desk.rules.TingTiles(rest)
+		if len(tings) == 0 {
+			continue
+		}
+
+		remain := 0
+		for _, idx := range tings {
+			remain += 4 - p.visibleCount(idx)
+		}
+		fan, _ := p.desk.rules.MaxMultiple(p.desk.opts, rest, pongKong)
+		score := remain*10 + fan
+		if score > bestScore {
+			bestID, bestScore = t.Id, score
+		}
+	}
+
+	if bestID != illegalTile {
+		return bestID
+	}
+
+	return p.robotIsolatedTile()
+}
+
+// 找出手牌中与其他牌关联最少的牌
+func (p *Player) robotIsolatedTile() int {
+	stats := mahjong.Stats{}
+	hand := p.handTiles()
+	stats.From(hand)
+
+	weight := func(index int) int {
+		w := int(stats[index]-1) * 3
+		for _, delta := range []int{-2, -1, 1, 2} {
+			n := index + delta
+			// 不同花色之间不相邻, 字牌不能组成顺子
+			if index > mahjong.MaxSuitIndex || n < 0 || n > mahjong.MaxTileIndex || n/10 != index/10 {
+				continue
+			}
+			if stats[n] > 0 {
+				if delta == -1 || delta == 1 {
+					w += 2
+				} else {
+					w++
+				}
+			}
+		}
+		// 边张价值更低
+		if r := index % 10; r == 1 || r == 9 {
+			w--
+		}
+		return w
+	}
+
+	id, min := hand[len(hand)-1].Id, 1<<10
+	for _, t := range hand {
+		if w := weight(t.Index); w < min {
+			id, min = t.Id, w
+		}
+	}
+	return id
+}
+
+// 玩家可见的某张牌的数量(自己手牌, 碰杠以及所有人的出牌)
+func (p *Player) visibleCount(index int) int {
+	count := 0
+	tiles := []mahjong.Mahjong{p.handTiles()}
+	for _, other := range p.desk.players {
+		tiles = append(tiles, other.pgTiles(), other.chuTiles())
+	}
+	for _, mj := range tiles {
+		for _, t := range mj {
+			if t.Index == index {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// 机器人定缺, 选择张数最少的花色
+func (p *Player) robotQue() int {
+	stats := map[int]int{}
+	for _, t := range p.onHand {
+		stats[t.Suit]++
+	}
+
+	que, min := 0, len(p.onHand)+1
+	for suit := 0; suit < 3; suit++ {
+		if c := stats[suit]; c < min {
+			que, min = suit, c
+		}
+	}
+	return que + 1
+}
+
+// 添加机器人到牌桌
+func (d *Desk) robotJoin(count int) error {
+	if d.status() != constant.DeskStatusCreate {
+		return errutil.ErrIllegalDeskStatus
+	}
+
+	rest := d.totalPlayerCount() - len(d.players)
+	if count < 1 || count > rest {
+		count = rest
+	}
+	if count < 1 {
+		return errutil.ErrDeskFull
+	}
+
+	for i := 0; i < count; i++ {
+		r := newRobot()
+		d.players = append(d.players, r)
+		r.setDesk(d, len(d.players)-1)
+		d.roundStats[r.Uid()] = &history.Record{}
+		d.prepare.ready(r.Uid())
+		d.logger.Infof("添加机器人: UID=%d", r.Uid())
+	}
+
+	return nil
+}
+
+// 机器人自动完成理牌和定缺等准备工作
+func (d *Desk) robotsPrepare() {
+	for _, p := range d.players {
+		if !p.isRobot() {
+			continue
+		}
+		switch d.status() {
+		case constant.DeskStatusCleaned, constant.DeskStatusCreate:
+			d.prepare.ready(p.Uid())
+		case constant.DeskStatusDuanPai:
+			d.prepare.sorted(p.Uid())
+		}
+	}
+}
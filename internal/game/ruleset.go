@@ -0,0 +1,87 @@
+package game
+
+import (
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+)
+
+const (
+	RuleXueZhan  = "xuezhan"  // 血战到底, 默认玩法
+	RuleXueLiu   = "xueliu"   // 血流成河
+	RuleTuiDaoHu = "tuidaohu" // 推倒胡
+)
+
+// Ruleset 玩法规则, 牌桌的牌墙, 发牌, 开局前的准备阶段, 可用操作, 胡牌判定, 番数计算
+// 和单局结算都通过玩法规则完成, 新增地方玩法只需要实现该接口并注册
+//
+// 所有方法都在牌桌协程中调用
+type Ruleset interface {
+	// 校验牌桌选项, 例如支持的人数
+	Verify(opts *protocol.DeskOptions) bool
+
+	// 牌墙中麻将的数量
+	TileCount(opts *protocol.DeskOptions) int
+
+	// 使用本局的随机数生成洗好的牌墙, 元素为麻将ID
+	Wall(opts *protocol.DeskOptions, r *rng.Rand) mahjong.Tiles
+
+	// 发牌, 返回每个玩家的起手牌和发牌后牌墙中下一张牌的位置
+	Deal(wall mahjong.Tiles, playerCount, bankerTurn int) ([][]int, int)
+
+	// 理牌完成后, 打牌之前是否需要定缺
+	RequireQue(opts *protocol.DeskOptions) bool
+
+	// 玩家是否可以自摸, 新摸的牌已经在手牌中
+	CanZiMo(p *Player) bool
+
+	// 玩家是否可以胡其他玩家打出的牌(点炮或者抢杠), plus表示是否有额外的番(杠上炮, 抢杠)
+	CanDianPao(p *Player, tileID int, plus bool) bool
+
+	// 其他玩家打出一张牌后, 玩家可以进行的操作(吃/碰/杠/胡)
+	DiscardOps(p *Player, tileID int, chuPlayer *Player) []protocol.Op
+
+	// 手牌听的牌, 返回麻将的Index
+	TingTiles(onHand mahjong.Indexes) mahjong.Indexes
+
+	// 计算番数, 番型描述写入ctx.Desc
+	Multiple(ctx *mahjong.Context, onHand, pongKong mahjong.Indexes) int
+
+	// 听牌的最大番数以及对应的麻将Index
+	MaxMultiple(opts *protocol.DeskOptions, onHand, pongKong mahjong.Indexes) (int, int)
+
+	// 杠上炮时杠牌积分的处理(转雨)
+	GangShangPao(d *Desk, huUid, chuUid int64)
+
+	// 胡牌后是否继续摸牌打牌, 直到牌墙摸完(血流成河)
+	ContinueAfterHu() bool
+
+	// 牌局是否正常结束(解散中断由牌桌处理)
+	IsRoundOver(d *Desk) bool
+
+	// 单局结束时的额外结算(查叫)
+	Settle(d *Desk)
+}
+
+var rulesets = map[string]Ruleset{
+	RuleXueZhan:  xueZhan{},
+	RuleXueLiu:   xueLiu{},
+	RuleTuiDaoHu: tuiDaoHu{},
+}
+
+// RegisterRuleset 注册玩法, 只能在服务器启动之前调用
+func RegisterRuleset(name string, r Ruleset) {
+	if _, ok := rulesets[name]; ok {
+		logger.Warnf("玩法已经存在, 正在覆盖玩法: %s", name)
+	}
+	rulesets[name] = r
+}
+
+// 牌桌选项对应的玩法, 未指定玩法时使用血战到底
+func rulesetFor(opts *protocol.DeskOptions) (Ruleset, bool) {
+	if opts.Rule == "" {
+		return rulesets[RuleXueZhan], true
+	}
+	r, ok := rulesets[opts.Rule]
+	return r, ok
+}
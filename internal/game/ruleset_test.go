@@ -0,0 +1,340 @@
+package game
+
+import (
+	"fmt"
+	"testing"
+
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+)
+
+// 只修改牌墙数量的测试玩法
+type shortWall struct{ xueZhan }
+
+func (shortWall) TileCount(opts *protocol.DeskOptions) int { return 72 }
+
+func TestVerifyRuleset(t *testing.T) {
+	RegisterRuleset("short", shortWall{})
+	defer delete(rulesets, "short")
+
+	cases := []struct {
+		opts *protocol.DeskOptions
+		ok   bool
+	}{
+		{&protocol.DeskOptions{Mode: ModeFours, MaxRound: 4}, true},
+		{&protocol.DeskOptions{Mode: ModeTrios, MaxRound: 4, Rule: RuleXueZhan}, true},
+		{&protocol.DeskOptions{Mode: ModeDuo, MaxRound: 4}, true},
+		{&protocol.DeskOptions{Mode: ModeDuo, MaxRound: 4, DuoSuits: 3}, false},
+		{&protocol.DeskOptions{Mode: ModeDuo, MaxRound: 4, Rule: RuleTuiDaoHu}, false},
+		{&protocol.DeskOptions{Mode: ModeFours, MaxRound: 4, Rule: RuleTuiDaoHu, HuanSanZhang: true}, false},
+		{&protocol.DeskOptions{Mode: ModeDuo, MaxRound: 4, DuoHonor: true, HuanSanZhang: true}, false},
+		{&protocol.DeskOptions{Mode: ModeDuo, MaxRound: 4, HuanSanZhang: true}, true},
+		{&protocol.DeskOptions{Mode: 5, MaxRound: 4}, false},
+		{&protocol.DeskOptions{Mode: ModeFours, MaxRound: 4, Rule: "unknown"}, false},
+		{&protocol.DeskOptions{Mode: ModeFours, MaxRound: 4, Rule: "short"}, true},
+	}
+	for _, c := range cases {
+		if ok := verifyOptions(c.opts); ok != c.ok {
+			t.Fatalf("opts=%+v expect=%t got=%t", c.opts, c.ok, ok)
+		}
+	}
+
+	d := NewDesk("000000", &protocol.DeskOptions{Mode: ModeFours, MaxRound: 4, Rule: "short"}, -1)
+	defer destroyDesk(d)
+	if c := d.totalTileCount(); c != 72 {
+		t.Fatalf("tile count=%d, expected 72", c)
+	}
+}
+
+func TestXueZhanDeal(t *testing.T) {
+	r := xueZhan{}
+	opts := &protocol.DeskOptions{Mode: ModeFours}
+
+	wall := r.Wall(opts, rng.New())
+	if len(wall) != 108 {
+		t.Fatalf("wall=%d, expected 108", len(wall))
+	}
+
+	hands, next := r.Deal(wall, ModeFours, 2)
+	if next != 53 {
+		t.Fatalf("next=%d, expected 53", next)
+	}
+
+	seen := map[int]bool{}
+	for i, hand := range hands {
+		expect := 13
+		if i == 2 {
+			expect = 14
+		}
+		if len(hand) != expect {
+			t.Fatalf("hand %d count=%d, expected %d", i, len(hand), expect)
+		}
+		for _, id := range hand {
+			if seen[id] {
+				t.Fatalf("tile %v dealt twice", mahjong.TileFromID(id))
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestXueLiuRoundOver(t *testing.T) {
+	ms := setupLoopTest(t)
+	opts := &protocol.DeskOptions{Mode: ModeFours, MaxRound: 1, MaxFan: 3, Pinghu: true, Rule: RuleXueLiu}
+	before := len(ms.deskHistories("100101"))
+	d, _, _, _ := newPlayingDeskWithOptions(t, "100101", opts)
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+
+	hs := ms.deskHistories(d.roomNo)
+	if c := len(hs) - before; c != 1 {
+		t.Fatalf("history count=%d, expected 1", c)
+	}
+	h := hs[len(hs)-1]
+
+	// 血流成河必须摸完牌墙中发牌后剩下的所有牌
+	moPai := 0
+	for _, do := range h.Do {
+		if do.OpType == protocol.OptyMoPai {
+			moPai++
+		}
+	}
+	if expected := 108 - 53; moPai != expected {
+		t.Fatalf("mo pai count=%d, expected %d", moPai, expected)
+	}
+
+	total := 0
+	for _, sc := range h.End.ScoreChange {
+		total += sc.Score
+	}
+	if total != 0 {
+		t.Fatalf("total score change=%d, expected 0", total)
+	}
+}
+
+func TestHonorTiles(t *testing.T) {
+	cases := []struct {
+		id    int
+		index int
+		name  string
+	}{
+		{107, 29, "9万"},
+		{108, 31, "东"},
+		{135, 37, "白"},
+		{136, 41, "春"},
+		{143, 48, "菊"},
+	}
+	for _, c := range cases {
+		tile := mahjong.TileFromID(c.id)
+		if tile.Index != c.index || tile.String() != c.name {
+			t.Fatalf("id=%d tile=%+v, expected index=%d name=%s", c.id, tile, c.index, c.name)
+		}
+		if idx := mahjong.IndexFromID(c.id); idx != c.index {
+			t.Fatalf("id=%d index=%d, expected %d", c.id, idx, c.index)
+		}
+	}
+}
+
+func TestTuiDaoHuMultiple(t *testing.T) {
+	cases := []struct {
+		onHand   mahjong.Indexes
+		pongKong mahjong.Indexes
+		win      bool
+		fan      int
+	}{
+		// 十三幺
+		{mahjong.Indexes{1, 9, 11, 19, 21, 29, 31, 32, 33, 34, 35, 36, 37, 37}, nil, true, 13},
+		// 字一色碰碰胡
+		{mahjong.Indexes{31, 31, 31, 32, 32, 32, 33, 33, 33, 35, 35}, mahjong.Indexes{36, 36, 36}, true, 4},
+		// 混一色
+		{mahjong.Indexes{1, 2, 3, 4, 5, 6, 7, 8, 9, 31, 31, 31, 37, 37}, nil, true, 1},
+		// 清一色七对
+		{mahjong.Indexes{1, 1, 2, 2, 3, 3, 5, 5, 6, 6, 8, 8, 9, 9}, nil, true, 4},
+		// 吃的顺子算在碰杠中, 不能算七对
+		{mahjong.Indexes{1, 1, 2, 2, 3, 3, 5, 5, 6, 6, 8, 8}, mahjong.Indexes{12, 13, 14}, false, 0},
+		// 平胡
+		{mahjong.Indexes{1, 2, 3, 14, 15, 16, 27, 28, 29, 31, 31, 31, 5, 5}, nil, true, 0},
+	}
+	for i, c := range cases {
+		if win := mahjong.CheckTuiDaoHu(c.onHand); win != c.win {
+			t.Fatalf("case %d win=%t, expected %t", i, win, c.win)
+		}
+		if !c.win {
+			continue
+		}
+		ctx := &mahjong.Context{}
+		if fan := mahjong.TuiDaoHuMultiple(ctx, c.onHand, c.pongKong); fan != c.fan {
+			t.Fatalf("case %d fan=%d desc=%v, expected %d", i, fan, ctx.Desc, c.fan)
+		}
+	}
+
+	// 十三幺听13面
+	ting := mahjong.TuiDaoHuTingTiles(mahjong.Indexes{1, 9, 11, 19, 21, 29, 31, 32, 33, 34, 35, 36, 37})
+	if len(ting) != 13 {
+		t.Fatalf("ting=%v, expected 13 tiles", ting)
+	}
+}
+
+func TestTuiDaoHuChiOps(t *testing.T) {
+	d := NewDesk("000001", &protocol.DeskOptions{Mode: ModeFours, MaxRound: 1, Rule: RuleTuiDaoHu}, -1)
+	defer destroyDesk(d)
+
+	players := make([]*Player, 4)
+	for i := range players {
+		p := &Player{uid: int64(i + 1), turn: i, desk: d, ctx: &mahjong.Context{}, logger: logger}
+		p.ctx.Reset()
+		// 手牌: 1条2条4条5条 东东
+		for _, id := range []int{0, 4, 12, 16, 108, 109} {
+			p.onHand = append(p.onHand, mahjong.TileFromID(id+i%4))
+		}
+		players[i] = p
+	}
+	d.players = players
+
+	ops := func(p *Player, tid int) []protocol.Op {
+		var ret []protocol.Op
+		for _, op := range d.rules.DiscardOps(p, tid, players[0]) {
+			if op.Type == protocol.OptypeChi {
+				ret = append(ret, op)
+			}
+		}
+		return ret
+	}
+
+	// 下家可以吃3条: 123, 234, 345
+	chi := ops(players[1], 8)
+	if len(chi) != 3 {
+		t.Fatalf("chi ops=%+v, expected 3", chi)
+	}
+	if first := mahjong.IndexFromID(chi[0].TileIDs[0]); first != 1 {
+		t.Fatalf("first chi=%v, expected 1条开头", chi[0].TileIDs)
+	}
+	// 对家不能吃
+	if chi := ops(players[2], 8); len(chi) != 0 {
+		t.Fatalf("chi ops=%+v, expected none", chi)
+	}
+	// 字牌不能吃, 但可以碰
+	all := d.rules.DiscardOps(players[1], 110, players[0])
+	if len(all) != 1 || all[0].Type != protocol.OptypePeng {
+		t.Fatalf("ops=%+v, expected peng", all)
+	}
+}
+
+func TestTuiDaoHuRound(t *testing.T) {
+	ms := setupLoopTest(t)
+	opts := &protocol.DeskOptions{Mode: ModeFours, MaxRound: 1, MaxFan: 3, Rule: RuleTuiDaoHu}
+	before := len(ms.deskHistories("100102"))
+	d, _, _, _ := newPlayingDeskWithOptions(t, "100102", opts)
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+
+	hs := ms.deskHistories(d.roomNo)
+	if c := len(hs) - before; c != 1 {
+		t.Fatalf("history count=%d, expected 1", c)
+	}
+	h := hs[len(hs)-1]
+
+	// 吃牌记录顺子中的三张牌
+	for _, do := range h.Do {
+		if do.OpType == protocol.OptypeChi && len(do.TileIDs) != 3 {
+			t.Fatalf("chi tiles=%v, expected 3 tiles", do.TileIDs)
+		}
+	}
+
+	total := 0
+	for _, sc := range h.End.ScoreChange {
+		total += sc.Score
+	}
+	if total != 0 {
+		t.Fatalf("total score change=%d, expected 0", total)
+	}
+}
+
+func TestDuoWall(t *testing.T) {
+	cases := []struct {
+		opts  *protocol.DeskOptions
+		count int
+		suits map[int]bool
+	}{
+		{&protocol.DeskOptions{Mode: ModeDuo}, 36, map[int]bool{mahjong.SuitWan: true}},
+		{&protocol.DeskOptions{Mode: ModeDuo, DuoSuits: 2}, 72, map[int]bool{mahjong.SuitTong: true, mahjong.SuitWan: true}},
+		{&protocol.DeskOptions{Mode: ModeDuo, DuoHonor: true}, 64, map[int]bool{mahjong.SuitWan: true, mahjong.SuitHonor: true}},
+	}
+	for _, c := range cases {
+		r := xueZhan{}
+		wall := r.Wall(c.opts, rng.New())
+		if len(wall) != c.count || r.TileCount(c.opts) != c.count {
+			t.Fatalf("opts=%+v wall=%d count=%d, expected %d", c.opts, len(wall), r.TileCount(c.opts), c.count)
+		}
+
+		seen := map[int]bool{}
+		for _, id := range wall {
+			tile := mahjong.TileFromID(id)
+			if !c.suits[tile.Suit] || seen[id] {
+				t.Fatalf("opts=%+v unexpected tile %v", c.opts, tile)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestDuoRound(t *testing.T) {
+	ms := setupLoopTest(t)
+	opts := &protocol.DeskOptions{Mode: ModeDuo, MaxRound: 1, MaxFan: 3, Pinghu: true, DuoHonor: true}
+	before := len(ms.deskHistories("100103"))
+	d, _, _, _ := newPlayingDeskWithOptions(t, "100103", opts)
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+
+	hs := ms.deskHistories(d.roomNo)
+	if c := len(hs) - before; c != 1 {
+		t.Fatalf("history count=%d, expected 1", c)
+	}
+	h := hs[len(hs)-1]
+	if c := len(h.DuanPai.AccountInfo); c != ModeDuo {
+		t.Fatalf("players=%d, expected %d", c, ModeDuo)
+	}
+
+	total := 0
+	for _, sc := range h.End.ScoreChange {
+		total += sc.Score
+	}
+	if total != 0 || len(h.End.ScoreChange) != ModeDuo {
+		t.Fatalf("score change=%+v, expected %d players with total 0", h.End.ScoreChange, ModeDuo)
+	}
+}
+
+// 使用回放中的种子可以重新生成庄家, 牌墙和骰子
+func TestDeskSeedReplay(t *testing.T) {
+	ms := setupLoopTest(t)
+	before := len(ms.deskHistories("100005"))
+	d, _, _, _ := newPlayingDesk(t, "100005", 1)
+	waitFor(t, "牌桌销毁", func() bool { return d.isDestroy() })
+
+	hs := ms.deskHistories(d.roomNo)
+	if c := len(hs) - before; c != 1 {
+		t.Fatalf("history count=%d, expected 1", c)
+	}
+	h := hs[len(hs)-1]
+	if h.Seed == "" {
+		t.Fatal("seed should be saved in history")
+	}
+
+	r := rng.NewWithSeed(h.Seed)
+	banker := r.Intn(d.totalPlayerCount())
+	wall := d.rules.Wall(d.opts, r)
+	hands, _ := d.rules.Deal(wall, d.totalPlayerCount(), banker)
+	dc := newDice()
+	dc.random(r)
+
+	duan := h.DuanPai
+	if duan.MarkerID != duan.AccountInfo[banker].Uid {
+		t.Fatalf("banker=%d, expected %d", duan.MarkerID, duan.AccountInfo[banker].Uid)
+	}
+	if duan.Dice1 != dc.dice1 || duan.Dice2 != dc.dice2 {
+		t.Fatalf("dice=%d,%d, expected %d,%d", duan.Dice1, duan.Dice2, dc.dice1, dc.dice2)
+	}
+	for i, info := range duan.AccountInfo {
+		if fmt.Sprint(info.OnHand) != fmt.Sprint(hands[i]) {
+			t.Fatalf("player %d hand=%v, expected %v", i, info.OnHand, hands[i])
+		}
+	}
+}
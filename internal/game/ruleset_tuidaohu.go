@@ -0,0 +1,123 @@
+package game
+
+import (
+	"sort"
+
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+)
+
+// 广东推倒胡: 条筒万和字牌136张, 不定缺, 可以吃碰杠, 可以胡十三幺, 一家胡牌后本局结束,
+// 同一张牌多人可以胡时一炮多响
+type tuiDaoHu struct{}
+
+// 只支持四人, 有字牌不能换三张
+func (tuiDaoHu) Verify(opts *protocol.DeskOptions) bool {
+	return opts.Mode == ModeFours && !opts.HuanSanZhang
+}
+
+func (tuiDaoHu) TileCount(opts *protocol.DeskOptions) int {
+	return 136
+}
+
+func (r tuiDaoHu) Wall(opts *protocol.DeskOptions, rand *rng.Rand) mahjong.Tiles {
+	return mahjong.New(rand, r.TileCount(opts))
+}
+
+func (tuiDaoHu) Deal(wall mahjong.Tiles, playerCount, bankerTurn int) ([][]int, int) {
+	return xueZhan{}.Deal(wall, playerCount, bankerTurn)
+}
+
+func (tuiDaoHu) RequireQue(opts *protocol.DeskOptions) bool {
+	return false
+}
+
+func (tuiDaoHu) CanZiMo(p *Player) bool {
+	canWin := mahjong.CheckTuiDaoHu(p.handTiles().Indexes())
+
+	p.logger.Infof("玩家计算是否可以胡牌: 手牌=%+v, 新上手=%v, 是否可以胡=%t",
+		p.handTiles(), mahjong.TileFromID(p.ctx.NewDrawingID), canWin)
+
+	return canWin
+}
+
+// 推倒胡没有番数限制, 能胡就可以点炮
+func (tuiDaoHu) CanDianPao(p *Player, tid int, plus bool) bool {
+	onHand := append(p.handTiles().Indexes(), mahjong.IndexFromID(tid))
+	return mahjong.CheckTuiDaoHu(onHand)
+}
+
+// 其他玩家打牌后, 检查胡、碰、杠, 下家还可以吃
+func (r tuiDaoHu) DiscardOps(p *Player, tid int, chuPlayer *Player) []protocol.Op {
+	tile := mahjong.TileFromID(tid)
+	ret := []protocol.Op{}
+
+	if r.CanDianPao(p, tid, chuPlayer.ctx.PrevOp == protocol.OptypeGang) {
+		ret = append(ret, protocol.Op{Type: protocol.OptypeHu, TileIDs: []int{tile.Id}})
+	}
+
+	ret = append(ret, pengGangOps(p, tile)...)
+
+	if p.turn == (chuPlayer.turn+1)%p.desk.totalPlayerCount() {
+		ret = append(ret, chiOps(p, tile)...)
+	}
+
+	p.logger.Debugf("计算吃碰杠完毕, 所有可用操作: %+v", ret)
+	return ret
+}
+
+// 可以和打出的牌组成的所有顺子, TileIDs为顺子中三张牌的ID, 从小到大排列
+func chiOps(p *Player, tile *mahjong.Tile) []protocol.Op {
+	ret := []protocol.Op{}
+	if tile.Index > mahjong.MaxSuitIndex {
+		return ret
+	}
+
+	for _, delta := range [][2]int{{-2, -1}, {-1, 1}, {1, 2}} {
+		i1, i2 := tile.Index+delta[0], tile.Index+delta[1]
+		// 顺子不能跨花色
+		if i1/10 != tile.Index/10 || i2/10 != tile.Index/10 || i1%10 == 0 || i2%10 == 0 {
+			continue
+		}
+
+		id1, id2 := p.tileIDWithIndex(i1), p.tileIDWithIndex(i2)
+		if id1 < 0 || id2 < 0 {
+			continue
+		}
+
+		ids := []int{tile.Id, id1, id2}
+		sort.Slice(ids, func(i, j int) bool {
+			return mahjong.IndexFromID(ids[i]) < mahjong.IndexFromID(ids[j])
+		})
+		ret = append(ret, protocol.Op{Type: protocol.OptypeChi, TileIDs: ids})
+	}
+	return ret
+}
+
+func (tuiDaoHu) TingTiles(onHand mahjong.Indexes) mahjong.Indexes {
+	return mahjong.TuiDaoHuTingTiles(onHand)
+}
+
+func (tuiDaoHu) Multiple(ctx *mahjong.Context, onHand, pongKong mahjong.Indexes) int {
+	return mahjong.TuiDaoHuMultiple(ctx, onHand, pongKong)
+}
+
+func (tuiDaoHu) MaxMultiple(opts *protocol.DeskOptions, onHand, pongKong mahjong.Indexes) (int, int) {
+	return mahjong.TuiDaoHuMaxMultiple(onHand, pongKong)
+}
+
+// 推倒胡没有转雨
+func (tuiDaoHu) GangShangPao(d *Desk, huUid, chuUid int64) {}
+
+func (tuiDaoHu) ContinueAfterHu() bool {
+	return false
+}
+
+// 有人胡牌或者牌摸完
+func (tuiDaoHu) IsRoundOver(d *Desk) bool {
+	return d.noMoreTile() || len(d.wonPlayers) > 0
+}
+
+// 推倒胡不查叫
+func (tuiDaoHu) Settle(d *Desk) {}
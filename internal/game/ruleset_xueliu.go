@@ -0,0 +1,21 @@
+package game
+
+// 四川血流成河: 牌墙和胡牌规则与血战到底相同, 胡牌后立即结算, 胡牌的玩家继续摸牌打牌,
+// 可以多次胡牌, 直到牌墙摸完
+type xueLiu struct {
+	xueZhan
+}
+
+func (xueLiu) ContinueAfterHu() bool {
+	return true
+}
+
+// 只有牌墙摸完才结束
+func (xueLiu) IsRoundOver(d *Desk) bool {
+	return d.noMoreTile()
+}
+
+// 牌墙摸完后, 从未胡牌的玩家之间查叫
+func (xueLiu) Settle(d *Desk) {
+	chaJiao(d)
+}
@@ -0,0 +1,360 @@
+package game
+
+import (
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+)
+
+// 四川血战到底: 条筒万108张(三人72张, 二人默认只用万36张), 四人需要定缺, 一家胡牌后其他玩家继续,
+// 直到只剩一家或者牌摸完
+type xueZhan struct{}
+
+func (xueZhan) Verify(opts *protocol.DeskOptions) bool {
+	switch opts.Mode {
+	case ModeDuo:
+		// 带字牌时可能没有三张同花色的数牌, 不能换三张
+		return opts.DuoSuits >= 0 && opts.DuoSuits <= 2 && !(opts.DuoHonor && opts.HuanSanZhang)
+	case ModeTrios, ModeFours:
+		return true
+	}
+	return false
+}
+
+func (xueZhan) TileCount(opts *protocol.DeskOptions) int {
+	switch opts.Mode {
+	case ModeFours:
+		return 108
+	case ModeDuo:
+		// 数牌每种花色36张, 字牌28张
+		count := 36
+		if opts.DuoSuits == 2 {
+			count = 72
+		}
+		if opts.DuoHonor {
+			count += 28
+		}
+		return count
+	}
+	return 72
+}
+
+func (r xueZhan) Wall(opts *protocol.DeskOptions, rand *rng.Rand) mahjong.Tiles {
+	if opts.Mode == ModeDuo {
+		return mahjong.NewWithSuits(rand, duoSuits(opts)...)
+	}
+	return mahjong.New(rand, r.TileCount(opts))
+}
+
+// 二人模式牌墙中的花色
+func duoSuits(opts *protocol.DeskOptions) []int {
+	suits := []int{mahjong.SuitWan}
+	if opts.DuoSuits == 2 {
+		suits = []int{mahjong.SuitTong, mahjong.SuitWan}
+	}
+	if opts.DuoHonor {
+		suits = append(suits, mahjong.SuitHonor)
+	}
+	return suits
+}
+
+// 每人13张, 庄家多一张
+func (xueZhan) Deal(wall mahjong.Tiles, playerCount, bankerTurn int) ([][]int, int) {
+	hands := make([][]int, playerCount)
+	next := 0
+	for i := range hands {
+		hands[i] = make([]int, 13)
+		copy(hands[i], wall[next:next+13])
+		next += 13
+	}
+	hands[bankerTurn] = append(hands[bankerTurn], wall[next])
+	next++
+	return hands, next
+}
+
+// 三人不需要定缺
+func (xueZhan) RequireQue(opts *protocol.DeskOptions) bool {
+	return opts.Mode == ModeFours
+}
+
+func (xueZhan) CanZiMo(p *Player) bool {
+	newTile := mahjong.TileFromID(p.ctx.NewDrawingID)
+	que := p.ctx.Que
+	// 打缺的牌不能胡
+	if que == newTile.Suit+1 {
+		return false
+	}
+
+	// 还没有打缺不能胡
+	for _, t := range p.onHand {
+		if que == t.Suit+1 {
+			return false
+		}
+	}
+
+	canWin := mahjong.CheckWin(p.handTiles().Indexes())
+
+	p.logger.Infof("玩家计算是否可以胡牌: 手牌=%+v, 新上手=%v, 是否可以胡=%t",
+		p.handTiles(), newTile, canWin)
+
+	return canWin
+}
+
+func (r xueZhan) CanDianPao(p *Player, tid int, plus bool) bool {
+	index := mahjong.IndexFromID(tid)
+	tiles := p.handTiles()
+	que := p.ctx.Que
+
+	// 不能胡缺牌
+	tile := mahjong.TileFromID(tid)
+	if tile.Suit+1 == que {
+		return false
+	}
+	// 还没有打缺不能胡
+	for _, t := range tiles {
+		if que == t.Suit+1 {
+			return false
+		}
+	}
+
+	// 检查胡牌
+	canHu := mahjong.CanHu(tiles.Indexes(), index)
+	if !canHu {
+		return false
+	}
+
+	// 如果可以平胡
+	if p.desk.opts.Pinghu {
+		return true
+	}
+
+	// 如果不能点炮平胡
+	onHand := append(p.handTiles().Indexes(), index)
+	old := p.ctx.NewOtherDiscardID
+	p.ctx.NewOtherDiscardID = tid
+	m := r.Multiple(p.ctx, onHand, p.pgTiles().Indexes())
+	p.ctx.NewOtherDiscardID = old
+
+	// 有番才能胡
+	return m > 0 || plus
+}
+
+// 检查吃牌
+// 是否碰(pong)/杠(kong)/胡(win)其他人的牌
+func (r xueZhan) DiscardOps(p *Player, tid int, chuPlayer *Player) []protocol.Op {
+	tile := mahjong.TileFromID(tid)
+	ret := []protocol.Op{}
+
+	// 不能碰杠缺的牌
+	if tile.Suit+1 == p.ctx.Que {
+		return ret
+	}
+
+	// 检查胡牌
+	if r.CanDianPao(p, tid, chuPlayer.ctx.PrevOp == protocol.OptypeGang) {
+		ret = append(ret, protocol.Op{Type: protocol.OptypeHu, TileIDs: []int{tile.Id}})
+	}
+
+	ret = append(ret, pengGangOps(p, tile)...)
+
+	p.logger.Debugf("计算杠牌完毕, 所有可用操作: %+v", ret)
+	return ret
+}
+
+// 检查是否可以碰杠其他人打出的牌
+func pengGangOps(p *Player, tile *mahjong.Tile) []protocol.Op {
+	ret := []protocol.Op{}
+	sameTiles := mahjong.Mahjong{}
+	tiles := p.handTiles()
+	for _, sp := range tiles {
+		if sp.Index == tile.Index {
+			sameTiles = append(sameTiles, sp)
+		}
+	}
+
+	p.logger.Debugf("其他人打牌, 检查玩家是否可以杠, 手牌=%+v 检查是否能吃的牌=%s, 相同麻将=%+v",
+		tiles, tile.String(), sameTiles)
+	// 明牌玩家直接检查扣牌是否可以杠
+
+	//检查碰、杠
+	if len(sameTiles) == 3 && !p.desk.noMoreTile() {
+		ret = append(ret, protocol.Op{Type: protocol.OptypeGang, TileIDs: mahjong.Tiles{sameTiles[0].Id}})
+	}
+	if len(sameTiles) == 2 {
+		ret = append(ret, protocol.Op{Type: protocol.OptypePeng, TileIDs: mahjong.Tiles{sameTiles[0].Id}})
+	}
+	return ret
+}
+
+func (xueZhan) TingTiles(onHand mahjong.Indexes) mahjong.Indexes {
+	return mahjong.TingTiles(onHand)
+}
+
+func (xueZhan) Multiple(ctx *mahjong.Context, onHand, pongKong mahjong.Indexes) int {
+	return mahjong.Multiple(ctx, onHand, pongKong)
+}
+
+func (xueZhan) MaxMultiple(opts *protocol.DeskOptions, onHand, pongKong mahjong.Indexes) (int, int) {
+	return mahjong.MaxMultiple(opts, onHand, pongKong)
+}
+
+// 转雨，需要考虑一下集中清空
+// 1. 普通转雨
+// 2. 点杠后，对方杠上炮，转雨给自己
+// 3. 暗杠或者巴杠后，一炮双向，另外两家相互转雨
+func (xueZhan) GangShangPao(d *Desk, huUid, chuUid int64) {
+	// 转雨: 杠牌后, 如果点炮, 则杠牌的钱转给胡牌的人
+	if changes, ok := d.scoreChanges[chuUid]; ok {
+		// 找到最后一个下雨或者刮风的分值改变记录
+		cl := len(changes)
+		lastChange := changes[len(changes)-1]
+		for i := cl; i > 0; i-- {
+			if c := changes[i-1]; c.typ == ScoreChangeTypeAnGang || c.typ == ScoreChangeTypeBaGang {
+				lastChange = c
+				break
+			}
+		}
+		lastTileId := lastChange.tileID
+
+		// 清除赢牌人的积分, 刮风下雨有可能是赢了两家人
+		for i := range changes {
+			c := changes[i]
+			if c.score > 0 && c.tileID == lastTileId && (c.typ == ScoreChangeTypeAnGang || c.typ == ScoreChangeTypeBaGang) {
+				c.score = 0
+			}
+			d.logger.Debugf("玩家ID=%d 流水=%s", chuUid, c.String())
+		}
+
+		// 修改输牌人把分输给谁了
+		for _uid, _changes := range d.scoreChanges {
+			// 前面已经处理了出牌人的情况
+			if _uid == chuUid {
+				continue
+			}
+
+			// FIXED: 自己杠，然后对方在点炮，转雨转回自己
+			cl := len(_changes)
+			for j := 0; j < cl; j++ {
+				c := _changes[j]
+				d.logger.Debugf("玩家ID=%d 流水=%s", _uid, c.String())
+				if c.uid == chuUid && c.tileID == lastTileId && (c.typ == ScoreChangeTypeAnGang || c.typ == ScoreChangeTypeBaGang) {
+					// 清除输掉的积分
+					c.score = 0
+
+					// 不需要转雨给自己
+					if _uid == huUid {
+						continue
+					}
+
+					score := 1
+					if c.typ == ScoreChangeTypeAnGang {
+						score = 2
+					}
+
+					// 转雨给胡牌的人
+					d.scoreChangeForUid(_uid, &scoreChangeInfo{
+						score:  -score, //之前是输分, 为负, 现在改为正
+						uid:    huUid,  //谁输的
+						typ:    c.typ,
+						tileID: lastTileId,
+					})
+
+					d.scoreChangeForUid(huUid, &scoreChangeInfo{
+						score:  score, //之前是输分, 为负, 现在改为正
+						uid:    _uid,  //谁输的
+						typ:    c.typ,
+						tileID: lastTileId,
+					})
+				}
+			}
+		}
+	} else {
+		panic("玩家杠牌, 但是没有杠牌记录")
+	}
+}
+
+// 胡牌的玩家退出本局
+func (xueZhan) ContinueAfterHu() bool {
+	return false
+}
+
+// 牌摸完, 或者只剩下一个人没有和牌
+func (xueZhan) IsRoundOver(d *Desk) bool {
+	if d.noMoreTile() {
+		return true
+	}
+
+	return len(d.wonPlayers) == d.totalPlayerCount()-1
+}
+
+// 查叫: 无叫玩家需要赔付给有叫玩家, 并且无叫的玩家之前所有刮风下雨积分全部清零
+func (xueZhan) Settle(d *Desk) {
+	// 只有一个人没有和牌，不赔叫
+	if len(d.wonPlayers) == d.totalPlayerCount()-1 {
+		return
+	}
+
+	chaJiao(d)
+}
+
+// 查叫的具体实现, 只检查没有胡过牌的玩家
+func chaJiao(d *Desk) {
+	pei := map[int64]struct{}{}
+	ting := map[int64]struct{}{}
+	for _, p := range d.players {
+		uid := p.Uid()
+		if d.wonPlayers[uid] {
+			continue
+		}
+
+		// 没有胡牌, 并且没叫
+		if !p.isTing() {
+			pei[uid] = struct{}{}
+		} else {
+			ting[uid] = struct{}{}
+		}
+	}
+
+	// 是否需要查叫: 牌桌的牌全部摸完, 并且还有人没胡牌
+	// 有人有叫有人没叫
+	if len(pei) == 0 {
+		return
+	}
+
+	// 要赔叫的人, 之前的所有刮风下雨清零
+	for uid := range pei {
+		if changes, ok := d.scoreChanges[uid]; ok {
+			for i := range changes {
+				c := changes[i]
+				// 清空正的刮风下雨积分(负分是输给别人的, 不能清空)
+				if c.score > 0 && (c.typ == ScoreChangeTypeBaGang || c.typ == ScoreChangeTypeAnGang) {
+					c.score = 0
+				}
+			}
+		}
+	}
+	for _, changes := range d.scoreChanges {
+		// 清除其他玩家的输分
+		for i := range changes {
+			change := changes[i]
+			winner := change.uid
+			// 如果赢家要赔付, 则清0不赔付
+			if _, ok := pei[winner]; ok && change.score < 0 && (change.typ == ScoreChangeTypeBaGang || change.typ == ScoreChangeTypeAnGang) {
+				change.score = 0
+			}
+		}
+	}
+
+	// 给有叫的人赔叫, 按最大的番数赔
+	// 有可能剩下两个人都没叫，不需要赔其他人，只需要清空刮风下雨都积分即可
+	for uid := range ting {
+		if p, err := d.playerWithId(uid); err == nil {
+			score, index := p.maxTingScore()
+			losers := []Loser{}
+			for loser := range pei {
+				losers = append(losers, Loser{loser, score})
+			}
+			d.scoreChangeForHu(p, losers, index, protocol.HuTypePei)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package game
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go-mahjong-server/pkg/constant"
+)
+
+// 停服排空: 收到退出信号或者管理员触发停服后, 不再创建和加入牌桌, 也不再开始新的一局,
+// 通知所有玩家服务器维护, 等待进行中的牌局结束, 超过期限后保存检查点, 最后关闭所有连接.
+// 服务器重启后从检查点恢复未完成的牌桌
+
+const maintenanceMessage = "服务器即将停机维护, 当前牌局结束后暂停开始新的牌局, 维护完成后可以继续未完成的房间"
+
+var (
+	draining int32 // 是否正在停服, 原子操作
+
+	drainTimeout      = 5 * time.Minute // 等待进行中的牌局结束的最长时间
+	drainPollInterval = time.Second     // 检查牌局是否结束的间隔
+)
+
+// 是否正在停服, 可以在任意协程中调用
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// 牌桌是否在一局之中, 可以在任意协程中调用
+func (d *Desk) inRound() bool {
+	switch d.status() {
+	case constant.DeskStatusCreate, constant.DeskStatusCleaned, constant.DeskStatusDestory:
+		return false
+	}
+	return true
+}
+
+// 在nano逻辑协程中执行并等待完成, 超时返回false
+func invoke(task func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	logicTask(func() {
+		defer close(done)
+		task()
+	})
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// BeforeShutdown nano关闭之前排空所有牌桌, 在nano关闭流程的协程中调用
+func (manager *DeskManager) BeforeShutdown() {
+	var desks []*Desk
+	if !invoke(func() { desks = manager.drain() }, drainPollInterval*10) {
+		logger.Error("停服: 逻辑协程没有响应")
+		return
+	}
+
+	busy := waitRounds(desks, drainTimeout)
+	if busy > 0 && checkpoints == nil {
+		logger.Warnf("停服: %d张牌桌的牌局没有结束, 并且没有配置检查点, 这些牌局将会丢失", busy)
+	}
+
+	// 打牌阶段的检查点在每一轮摸牌之前已经保存, 其他牌桌保存最新的状态
+	for _, d := range desks {
+		d.do(d.periodicCheckpoint)
+	}
+	if checkpoints != nil {
+		checkpoints.flush()
+	}
+
+	logger.Infof("停服: 牌桌排空完成, 牌桌数量=%d 未结束的牌局=%d", len(desks), busy)
+}
+
+// 开始停服, 在nano逻辑协程中调用, 返回需要排空的牌桌
+func (manager *DeskManager) drain() []*Desk {
+	atomic.StoreInt32(&draining, 1)
+	broadcastSystemMessage(maintenanceMessage)
+
+	desks := make([]*Desk, 0, len(manager.desks))
+	for _, d := range manager.desks {
+		desks = append(desks, d)
+	}
+	logger.Infof("停服: 开始排空牌桌, 牌桌数量=%d", len(desks))
+	return desks
+}
+
+// 等待进行中的牌局结束, 返回超时后还没有结束的牌局数量
+func waitRounds(desks []*Desk, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		busy := 0
+		for _, d := range desks {
+			if d.inRound() {
+				busy++
+			}
+		}
+		if busy == 0 || time.Now().After(deadline) {
+			return busy
+		}
+
+		logger.Infof("停服: 等待%d张牌桌的牌局结束", busy)
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// BeforeShutdown 牌桌排空后关闭所有玩家的连接
+func (m *Manager) BeforeShutdown() {
+	if !invoke(m.closeSessions, drainPollInterval*10) {
+		logger.Error("停服: 关闭连接超时")
+	}
+}
+
+func (m *Manager) closeSessions() {
+	for _, p := range m.players {
+		if s := p.currentSession(); s != nil {
+			s.Close()
+		}
+	}
+	logger.Infof("停服: 关闭玩家连接, 玩家数量=%d", len(m.players))
+}
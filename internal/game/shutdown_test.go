@@ -0,0 +1,68 @@
+package game
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano"
+)
+
+// 停服时拒绝加入房间, 进行中的牌局结束后不再开始新的一局
+func TestDrainDesks(t *testing.T) {
+	setupLoopTest(t)
+	d, s, _, _ := newPlayingDesk(t, "100007", 4)
+
+	atomic.StoreInt32(&draining, 1)
+	t.Cleanup(func() { atomic.StoreInt32(&draining, 0) })
+
+	other, e, _ := newLoopTestSession(t, 2)
+	if err := defaultDeskManager.Join(other, &protocol.JoinDeskRequest{DeskNo: string(d.roomNo)}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := e.lastResponse(); resp != joinMaintenance {
+		t.Fatalf("join response=%+v, expected maintenance", resp)
+	}
+	if err := defaultDeskManager.CreateDesk(other, &protocol.CreateDeskRequest{DeskOpts: d.opts, ClubId: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := e.lastResponse(); resp != createMaintenance {
+		t.Fatalf("create response=%+v, expected maintenance", resp)
+	}
+
+	if busy := waitRounds([]*Desk{d}, 10*time.Second); busy != 0 {
+		t.Fatalf("busy=%d, expected 0", busy)
+	}
+	if s := d.status(); s != constant.DeskStatusCleaned {
+		t.Fatalf("status=%s, expected cleaned", s)
+	}
+
+	// 所有玩家准备后也不会开始下一局
+	if err := defaultDeskManager.Ready(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	d.do(func() {})
+	if d.inRound() {
+		t.Fatal("next round should not start while draining")
+	}
+}
+
+// 重复停服只关闭一次nano
+func TestShutdownOnce(t *testing.T) {
+	var calls int32
+	nanoShutdown = func() { atomic.AddInt32(&calls, 1) }
+	t.Cleanup(func() { nanoShutdown = nano.Shutdown })
+
+	if !Shutdown() {
+		t.Fatal("first shutdown should start")
+	}
+	if Shutdown() || Shutdown() {
+		t.Fatal("shutdown started twice")
+	}
+	if calls != 1 {
+		t.Fatalf("nano shutdown called %d times", calls)
+	}
+}
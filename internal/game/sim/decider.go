@@ -0,0 +1,60 @@
+package sim
+
+import (
+	"go-mahjong-server/internal/game"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+)
+
+// Robot 使用服务器机器人的策略
+func Robot() game.Decider {
+	return func(game.Seat, []protocol.Op) *protocol.OpChoosed { return nil }
+}
+
+// Random 在提示的操作中随机选择, 出牌时随机打出一张手牌(有定缺的牌时先打缺)
+func Random(r *rng.Rand) game.Decider {
+	return func(seat game.Seat, ops []protocol.Op) *protocol.OpChoosed {
+		if len(ops) == 0 {
+			return nil
+		}
+
+		op := ops[r.Intn(len(ops))]
+		switch op.Type {
+		case protocol.OptypeChu:
+			return &protocol.OpChoosed{Type: protocol.OptypeChu, TileID: randomTile(r, seat)}
+		case protocol.OptypePass:
+			return &protocol.OpChoosed{Type: protocol.OptypePass, TileID: -1}
+		}
+
+		if len(op.TileIDs) == 0 {
+			return nil
+		}
+		return &protocol.OpChoosed{Type: op.Type, TileID: op.TileIDs[0]}
+	}
+}
+
+func randomTile(r *rng.Rand, seat game.Seat) int {
+	que := []int{}
+	for _, id := range seat.Hand {
+		if mahjong.TileFromID(id).Suit+1 == seat.Que {
+			que = append(que, id)
+		}
+	}
+	if len(que) > 0 {
+		return que[r.Intn(len(que))]
+	}
+	return seat.Hand[r.Intn(len(seat.Hand))]
+}
+
+// Script 按顺序使用预设的选择, 用完后使用服务器机器人的策略
+func Script(choices ...*protocol.OpChoosed) game.Decider {
+	return func(game.Seat, []protocol.Op) *protocol.OpChoosed {
+		if len(choices) == 0 {
+			return nil
+		}
+		op := choices[0]
+		choices = choices[1:]
+		return op
+	}
+}
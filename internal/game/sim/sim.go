@@ -0,0 +1,316 @@
+// Package sim 规则回归测试: 不依赖网络和数据库, 批量执行完整的模拟牌局并检查不变量
+//
+// 检查的不变量: 每局正常结束, 场统计总分为0, 单局结算总分为0, 麻将没有丢失或者重复,
+// 每种麻将摸出的数量不超过4张, 决策没有被判为非法操作, 回放的最后一步与结算的手牌相同,
+// 事件日志中的分数变化与结算相同, 导出的牌谱导入后再导出不变. 失败的牌局输出种子和回放用于复现
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"go-mahjong-server/internal/game"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/history/mjlog"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+)
+
+// Config 批量模拟的配置
+type Config struct {
+	Options *protocol.DeskOptions
+	Games   int    // 模拟的场数
+	Seed    string // 第i场的种子为"Seed-i"
+	Workers int    // 并发执行的场数, 为0时使用CPU数量
+	DumpDir string // 失败牌局的输出目录, 为空时不输出
+
+	// 每个座位的决策, rand由该场的种子和座位确定, 为nil时使用机器人策略
+	Decider func(rand *rng.Rand, seat int) game.Decider
+}
+
+// Failure 不满足不变量的牌局
+type Failure struct {
+	Seed   string `json:"seed"`
+	Round  int    `json:"round"`
+	Reason string `json:"reason"`
+	Dump   string `json:"-"` // 输出的文件
+}
+
+// Report 批量模拟的结果统计
+type Report struct {
+	Games    int
+	Rounds   int
+	Fans     map[string]int // 番型出现的次数
+	Results  map[int]int    // 单局结果(自摸, 胡, 点炮, 赔付)出现的次数
+	Failures []*Failure
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("场数=%d 局数=%d 失败=%d 结果=%v 番型=%v", r.Games, r.Rounds, len(r.Failures), r.Results, r.Fans)
+}
+
+// 输出到文件的失败牌局, 使用Seed调用Replay可以复现
+type dump struct {
+	Failure
+	Options   *protocol.DeskOptions     `json:"options"`
+	Histories []*history.History        `json:"histories"`
+	Events    []*protocol.HistoryEvents `json:"events"`
+}
+
+// Run 执行所有模拟牌局并检查不变量
+func Run(cfg *Config) *Report {
+	report := &Report{Fans: map[string]int{}, Results: map[int]int{}}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		seeds = make(chan string)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seed := range seeds {
+				result, err := Replay(cfg, seed)
+				mu.Lock()
+				report.collect(cfg, seed, result, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < cfg.Games; i++ {
+		seeds <- fmt.Sprintf("%s-%d", cfg.Seed, i)
+	}
+	close(seeds)
+	wg.Wait()
+
+	return report
+}
+
+// Replay 使用指定的种子执行一场模拟牌局, 用于复现失败的牌局
+func Replay(cfg *Config, seed string) (*game.SimResult, error) {
+	sc := &game.SimConfig{Options: cfg.Options, Seed: seed}
+	if cfg.Decider != nil {
+		for seat := 0; seat < cfg.Options.Mode; seat++ {
+			r := rng.NewWithSeed(fmt.Sprintf("%s/decider/%d", seed, seat))
+			sc.Deciders = append(sc.Deciders, cfg.Decider(r, seat))
+		}
+	}
+	return game.Simulate(sc)
+}
+
+func (r *Report) collect(cfg *Config, seed string, result *game.SimResult, err error) {
+	r.Games++
+	if err != nil {
+		r.fail(cfg, &Failure{Seed: seed, Reason: err.Error()}, nil)
+		return
+	}
+
+	histories := []*history.History{}
+	for _, round := range result.Rounds {
+		histories = append(histories, round.History)
+	}
+
+	if len(result.Rounds) != cfg.Options.MaxRound {
+		reason := fmt.Sprintf("只完成了%d局, 总局数%d", len(result.Rounds), cfg.Options.MaxRound)
+		r.fail(cfg, &Failure{Seed: seed, Round: len(result.Rounds) + 1, Reason: reason}, histories)
+		return
+	}
+
+	for _, round := range result.Rounds {
+		r.Rounds++
+		if reason := check(round); reason != "" {
+			r.fail(cfg, &Failure{Seed: seed, Round: round.Round, Reason: reason}, histories)
+			return
+		}
+
+		for _, stats := range round.History.End.Stats {
+			r.Results[stats.BannerType]++
+			if stats.Desc == "" {
+				continue
+			}
+			for _, desc := range strings.Fields(stats.Desc) {
+				r.Fans[desc]++
+			}
+		}
+	}
+}
+
+// 检查单局的不变量, 返回不满足的原因
+func check(round *game.SimRound) string {
+	if !round.Normal || round.History == nil || round.History.End == nil {
+		return "牌局没有正常结束"
+	}
+	if round.TileCount != round.TotalTiles {
+		return fmt.Sprintf("麻将数量不守恒: %d, 总数%d", round.TileCount, round.TotalTiles)
+	}
+	for index, count := range round.KnownTiles {
+		if count > 4 {
+			return fmt.Sprintf("麻将%d摸出了%d张", index, count)
+		}
+	}
+	if round.IllegalOps > 0 {
+		return fmt.Sprintf("非法操作%d次", round.IllegalOps)
+	}
+
+	if reason := checkReplay(round.History); reason != "" {
+		return reason
+	}
+	if reason := checkEvents(round.History); reason != "" {
+		return reason
+	}
+	if reason := checkExport(round.History); reason != "" {
+		return reason
+	}
+
+	total := 0
+	for _, sc := range round.History.End.ScoreChange {
+		total += sc.Score
+	}
+	if total != 0 {
+		return fmt.Sprintf("单局总分为%d", total)
+	}
+
+	total = 0
+	for _, score := range round.Scores {
+		total += score
+	}
+	if total != 0 {
+		return fmt.Sprintf("场统计总分为%d", total)
+	}
+	return ""
+}
+
+// 回放的最后一步与结算的手牌相同
+func checkReplay(h *history.History) string {
+	steps, err := h.SnapShot.Replay(nil)
+	if err != nil {
+		return fmt.Sprintf("回放失败: %v", err)
+	}
+
+	last := steps[len(steps)-1]
+	for _, tiles := range h.End.HandTiles {
+		for _, p := range last.Players {
+			if p.Uid != tiles.Uid {
+				continue
+			}
+			hand := append([]int{}, p.Hand...)
+			end := append([]int{}, tiles.Tiles...)
+			sort.Ints(hand)
+			sort.Ints(end)
+			if fmt.Sprint(hand) != fmt.Sprint(end) {
+				return fmt.Sprintf("回放手牌%v与结算手牌%v不同: UID=%d", hand, end, p.Uid)
+			}
+		}
+	}
+	return ""
+}
+
+// 事件日志完整: 序号连续, 以开局开始, 以结束结束, 包含快照中的所有操作, 分数变化之和与结算相同
+func checkEvents(h *history.History) string {
+	events := h.Events().Events
+	if len(events) < 2 || events[0].Type != history.EventRoundStart || events[len(events)-1].Type != history.EventRoundEnd {
+		return "事件日志不完整"
+	}
+
+	do := 0
+	scores := map[int64]int{}
+	for i, e := range events {
+		if e.Seq != i+1 {
+			return fmt.Sprintf("事件序号不连续: %d", e.Seq)
+		}
+
+		var changes []protocol.ScoreInfo
+		switch e.Type {
+		case history.EventDo:
+			do++
+		case history.EventScore:
+			s := &history.Score{}
+			if err := json.Unmarshal(e.Data, s); err != nil {
+				return fmt.Sprintf("事件%d解析失败: %v", e.Seq, err)
+			}
+			changes = s.Changes
+		case history.EventAdjust:
+			a := &history.Adjust{}
+			if err := json.Unmarshal(e.Data, a); err != nil {
+				return fmt.Sprintf("事件%d解析失败: %v", e.Seq, err)
+			}
+			changes = a.Changes
+		}
+		for _, c := range changes {
+			scores[c.Uid] += c.Score
+		}
+	}
+
+	if do != len(h.Do) {
+		return fmt.Sprintf("事件日志中的操作%d个, 快照中%d个", do, len(h.Do))
+	}
+	for _, sc := range h.End.ScoreChange {
+		if scores[sc.Uid] != sc.Score {
+			return fmt.Sprintf("事件日志中的分数%d与结算%d不同: UID=%d", scores[sc.Uid], sc.Score, sc.Uid)
+		}
+	}
+	return ""
+}
+
+// 牌谱导出后导入再导出, 两次导出的牌谱相同
+func checkExport(h *history.History) string {
+	m, err := h.Model()
+	if err != nil {
+		return fmt.Sprintf("历史记录序列化失败: %v", err)
+	}
+	l, err := mjlog.Export(m)
+	if err != nil {
+		return fmt.Sprintf("导出牌谱失败: %v", err)
+	}
+	imported, err := mjlog.Import(l)
+	if err != nil {
+		return fmt.Sprintf("导入牌谱失败: %v", err)
+	}
+	again, err := mjlog.Export(imported)
+	if err != nil {
+		return fmt.Sprintf("导入后导出牌谱失败: %v", err)
+	}
+
+	a, _ := json.Marshal(l)
+	b, _ := json.Marshal(again)
+	if string(a) != string(b) {
+		return "导入后导出的牌谱不同"
+	}
+	return ""
+}
+
+func (r *Report) fail(cfg *Config, f *Failure, histories []*history.History) {
+	r.Failures = append(r.Failures, f)
+	if cfg.DumpDir == "" {
+		return
+	}
+
+	d := &dump{Failure: *f, Options: cfg.Options, Histories: histories}
+	for _, h := range histories {
+		d.Events = append(d.Events, h.Events())
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(cfg.DumpDir, 0755); err != nil {
+		return
+	}
+	name := filepath.Join(cfg.DumpDir, fmt.Sprintf("sim-%s.json", f.Seed))
+	if err := ioutil.WriteFile(name, data, 0644); err == nil {
+		f.Dump = name
+	}
+}
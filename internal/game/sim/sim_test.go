@@ -0,0 +1,125 @@
+package sim
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-mahjong-server/internal/game"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/protocol"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetLevel(log.PanicLevel)
+}
+
+// 两个座位随机决策, 两个座位使用机器人策略
+func mixed(r *rng.Rand, seat int) game.Decider {
+	if seat%2 == 0 {
+		return Random(r)
+	}
+	return Robot()
+}
+
+// 每种玩法模拟的场数, 例如 go test ./internal/game/sim -sim.games=5000
+var simGames = flag.Int("sim.games", 100, "number of games per ruleset")
+
+func games(t *testing.T) int {
+	if testing.Short() {
+		return 50
+	}
+	return *simGames
+}
+
+func TestRulesets(t *testing.T) {
+	cases := []struct {
+		name string
+		opts *protocol.DeskOptions
+		fans []string
+	}{
+		{"xuezhan", &protocol.DeskOptions{Mode: 4, MaxRound: 4, MaxFan: 3, Pinghu: true}, []string{"清一色", "杠上花", "海底"}},
+		{"xuezhan-trios", &protocol.DeskOptions{Mode: 3, MaxRound: 4, MaxFan: 3, Menqing: true}, []string{"清一色", "门清"}},
+		{"xueliu", &protocol.DeskOptions{Mode: 4, MaxRound: 4, MaxFan: 3, Pinghu: true, Rule: game.RuleXueLiu, HuanSanZhang: true}, []string{"清一色", "杠上花"}},
+		{"tuidaohu", &protocol.DeskOptions{Mode: 4, MaxRound: 4, MaxFan: 3, Rule: game.RuleTuiDaoHu}, []string{"混一色", "碰碰胡"}},
+		{"duo", &protocol.DeskOptions{Mode: 2, MaxRound: 4, MaxFan: 3, Pinghu: true, DuoHonor: true}, []string{"碰碰胡"}},
+	}
+
+	dir := filepath.Join(os.TempDir(), "mahjong-sim")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			report := Run(&Config{Options: c.opts, Games: games(t), Seed: c.name, DumpDir: dir, Decider: mixed})
+			t.Log(report)
+			for _, f := range report.Failures {
+				t.Errorf("seed=%s round=%d reason=%s dump=%s", f.Seed, f.Round, f.Reason, f.Dump)
+			}
+			if testing.Short() {
+				return
+			}
+			for _, fan := range c.fans {
+				if report.Fans[fan] == 0 {
+					t.Errorf("fan %s never occurred", fan)
+				}
+			}
+		})
+	}
+}
+
+// 相同的种子得到相同的牌局
+func TestReplay(t *testing.T) {
+	cfg := &Config{Options: &protocol.DeskOptions{Mode: 4, MaxRound: 4, MaxFan: 3}, Decider: mixed}
+	a, err := Replay(cfg, "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Replay(cfg, "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range a.Rounds {
+		ha, hb := a.Rounds[i].History, b.Rounds[i].History
+		if len(ha.Do) != len(hb.Do) || ha.Seed != hb.Seed {
+			t.Fatalf("round %d: do=%d/%d seed=%s/%s", i, len(ha.Do), len(hb.Do), ha.Seed, hb.Seed)
+		}
+		for j := range ha.Do {
+			if ha.Do[j].OpType != hb.Do[j].OpType || len(ha.Do[j].TileIDs) != len(hb.Do[j].TileIDs) {
+				t.Fatalf("round %d op %d: %+v != %+v", i, j, ha.Do[j], hb.Do[j])
+			}
+		}
+	}
+}
+
+// 预设牌墙: 按顺序发牌, 庄家多摸一张
+func TestPresetWall(t *testing.T) {
+	wall := make(mahjong.Tiles, 108)
+	for i := range wall {
+		wall[i] = 107 - i
+	}
+
+	result, err := game.Simulate(&game.SimConfig{
+		Options: &protocol.DeskOptions{Mode: 4, MaxRound: 1, MaxFan: 3},
+		Seed:    "wall",
+		Wall:    wall,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	duan := result.Rounds[0].History.DuanPai
+	for i, info := range duan.AccountInfo {
+		for j, id := range info.OnHand[:13] {
+			if expected := wall[i*13+j]; id != expected {
+				t.Fatalf("player %d tile %d = %d, expected %d", i, j, id, expected)
+			}
+		}
+	}
+
+	if _, err := game.Simulate(&game.SimConfig{Options: &protocol.DeskOptions{Mode: 4, MaxRound: 1}, Wall: wall[1:]}); err == nil {
+		t.Fatal("wall with wrong size should be rejected")
+	}
+}
@@ -0,0 +1,207 @@
+package game
+
+import (
+	"fmt"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/rng"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/protocol"
+)
+
+// 模拟牌局: 不依赖nano会话和数据库, 所有座位都是机器人, 决策由Decider完成,
+// 牌桌的所有流程(打牌, 碰杠胡, 转雨, 查叫, 结算)与真实牌局相同, 用于规则的回归测试
+
+// Seat 模拟牌局中玩家做决策时可见的状态
+type Seat struct {
+	Uid  int64
+	Turn int
+	Que  int   // 定缺的花色, 0表示不需要定缺
+	Hand []int // 手牌ID
+}
+
+// Decider 根据提示中的可选操作做出选择, 返回nil时使用机器人策略
+type Decider func(seat Seat, ops []protocol.Op) *protocol.OpChoosed
+
+// 使用机器人策略, 模拟牌局中不等待思考时间
+func robotDecider(Seat, []protocol.Op) *protocol.OpChoosed { return nil }
+
+// SimConfig 模拟牌局的配置
+type SimConfig struct {
+	Options  *protocol.DeskOptions
+	Seed     string        // 第n局的随机数种子为"Seed/n", 为空时随机生成
+	Wall     mahjong.Tiles // 每局使用的预设牌墙, 为空时根据种子洗牌
+	Deciders []Decider     // 每个座位的决策, 为空时使用机器人策略
+}
+
+// SimRound 单局的模拟结果
+type SimRound struct {
+	Round      int
+	Seed       string
+	Normal     bool             // 是否正常结束
+	History    *history.History // 回放, 包含单局结算
+	KnownTiles map[int]int      // 已经摸出的麻将: index -> count
+	TileCount  int              // 结束时手牌, 碰杠, 出牌和牌墙中不同麻将的数量
+	TotalTiles int              // 牌墙麻将总数
+	IllegalOps int              // 本局决策返回的非法操作次数
+	Scores     map[int64]int    // 到本局为止的场统计总分
+}
+
+// SimResult 一场模拟牌局的结果
+type SimResult struct {
+	Seed   string
+	Rounds []*SimRound
+}
+
+type simHooks struct {
+	seed        string
+	wall        mahjong.Tiles
+	onRoundOver func(d *Desk)
+}
+
+// 模拟牌局不写数据库
+type simStore struct{}
+
+func (simStore) insertDesk(desk *model.Desk) error                           { return nil }
+func (simStore) updateDesk(desk *model.Desk) error                           { return nil }
+func (simStore) insertHistory(h *history.History) error                      { return nil }
+func (simStore) loseCoin(uid, count int64, consume *model.CardConsume) error { return nil }
+func (simStore) settleGold(ledgers []*model.GoldLedger) error                { return nil }
+func (simStore) incrRanks(stats []*model.RankStat) error                     { return nil }
+func (simStore) clubLoseBalance(clubId, count int64, consume *model.CardConsume) error {
+	return nil
+}
+
+// 本局的随机数, 模拟牌局使用由种子和局数确定的随机数
+func (d *Desk) roundRand() *rng.Rand {
+	if d.sim != nil {
+		return rng.NewWithSeed(fmt.Sprintf("%s/%d", d.sim.seed, d.round))
+	}
+	return newRand()
+}
+
+// 本局的牌墙, 模拟牌局可以使用预设的牌墙
+func (d *Desk) roundWall() mahjong.Tiles {
+	if d.sim != nil && len(d.sim.wall) > 0 {
+		wall := make(mahjong.Tiles, len(d.sim.wall))
+		copy(wall, d.sim.wall)
+		return wall
+	}
+	return d.rules.Wall(d.opts, d.rand)
+}
+
+// 模拟牌局的决策, 非法的选择记录后使用机器人策略代替
+func (p *Player) simDecide(ops []protocol.Op) *protocol.OpChoosed {
+	seat := Seat{Uid: p.Uid(), Turn: p.turn, Que: p.ctx.Que, Hand: p.handTiles().Ids()}
+	op := p.decide(seat, ops)
+	if op == nil {
+		return p.robotDecide(ops)
+	}
+	if err := p.validateOp(op); err != nil {
+		p.recordIllegalOp(op, err)
+		return p.robotDecide(ops)
+	}
+	return op
+}
+
+// Simulate 同步执行一场完整的模拟牌局, 直到打完所有局数
+func Simulate(cfg *SimConfig) (*SimResult, error) {
+	opts := *cfg.Options
+	if !verifyOptions(&opts) {
+		return nil, errutil.ErrIllegalParameter
+	}
+
+	seed := cfg.Seed
+	if seed == "" {
+		seed = rng.New().Seed()
+	}
+	if len(cfg.Wall) > 0 {
+		r, _ := rulesetFor(&opts)
+		if len(cfg.Wall) != r.TileCount(&opts) {
+			return nil, errutil.ErrIllegalParameter
+		}
+	}
+
+	result := &SimResult{Seed: seed}
+	d := NewDesk(room.Number("sim-"+seed), &opts, -1)
+	d.store = simStore{}
+	d.checkpoints = nil
+	d.sim = &simHooks{
+		seed: seed,
+		wall: cfg.Wall,
+		onRoundOver: func(d *Desk) {
+			result.Rounds = append(result.Rounds, d.simRound())
+		},
+	}
+
+	d.do(func() {
+		if err := d.robotJoin(0); err != nil {
+			d.logger.Error(err)
+			return
+		}
+		d.creator = d.players[0].Uid()
+		for i, p := range d.players {
+			p.decide = robotDecider
+			if i < len(cfg.Deciders) && cfg.Deciders[i] != nil {
+				p.decide = cfg.Deciders[i]
+			}
+		}
+	})
+
+	// 每一局在一个任务中同步执行完成, 最后一局结束后牌桌销毁
+	for round := 0; round < opts.MaxRound && !d.isDestroy(); round++ {
+		d.do(func() {
+			d.checkStart()
+			if len(d.players) > 0 {
+				d.qiPaiFinished(d.players[0].Uid())
+			}
+		})
+	}
+	d.do(d.destroy)
+
+	return result, nil
+}
+
+// 收集单局结束时的状态, 在roundOver中调用
+func (d *Desk) simRound() *SimRound {
+	r := &SimRound{
+		Round:      int(d.round),
+		Seed:       d.rand.Seed(),
+		Normal:     d.status() == constant.DeskStatusRoundOver,
+		History:    d.snapshot,
+		KnownTiles: map[int]int{},
+		TotalTiles: d.totalTileCount(),
+		Scores:     map[int64]int{},
+	}
+	for index, count := range d.knownTiles {
+		r.KnownTiles[index] = count
+	}
+
+	ids := map[int]bool{}
+	for _, t := range d.allTiles[d.nextTileIndex:] {
+		ids[t.Id] = true
+	}
+	for _, p := range d.players {
+		for _, tiles := range []mahjong.Mahjong{p.onHand, p.pongKong, p.chiTiles, p.chupai} {
+			for _, t := range tiles {
+				ids[t.Id] = true
+			}
+		}
+		for _, id := range p.huTiles {
+			ids[id] = true
+		}
+		r.IllegalOps += p.illegalOps
+	}
+	r.TileCount = len(ids)
+
+	for uid, records := range d.matchStats {
+		for _, record := range records {
+			r.Scores[uid] += record.TotalScore
+		}
+	}
+	return r
+}
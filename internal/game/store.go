@@ -0,0 +1,156 @@
+package game
+
+import (
+	"go-mahjong-server/db"
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+)
+
+// 牌桌数据的持久化, 默认写入数据库, 测试时可以替换为不依赖数据库的实现
+type deskStore interface {
+	insertDesk(desk *model.Desk) error
+	updateDesk(desk *model.Desk) error
+	insertHistory(h *history.History) error
+	clubLoseBalance(clubId, count int64, consume *model.CardConsume) error
+	loseCoin(uid, count int64, consume *model.CardConsume) error
+	settleGold(ledgers []*model.GoldLedger) error
+	incrRanks(stats []*model.RankStat) error
+}
+
+var store deskStore = dbStore{}
+
+type dbStore struct{}
+
+func (dbStore) insertDesk(desk *model.Desk) error {
+	return db.InsertDesk(desk)
+}
+
+func (dbStore) updateDesk(desk *model.Desk) error {
+	return db.UpdateDesk(desk)
+}
+
+func (dbStore) insertHistory(h *history.History) error {
+	return h.Save()
+}
+
+func (dbStore) clubLoseBalance(clubId, count int64, consume *model.CardConsume) error {
+	return db.ClubLoseBalance(clubId, count, consume)
+}
+
+// 扣除玩家房卡并记录消费数据
+func (dbStore) loseCoin(uid, count int64, consume *model.CardConsume) error {
+	u, err := db.QueryUser(uid)
+	if err != nil {
+		return err
+	}
+
+	u.Coin -= count
+	if err := db.UpdateUser(u); err != nil {
+		return err
+	}
+
+	return db.Insert(consume)
+}
+
+func (dbStore) settleGold(ledgers []*model.GoldLedger) error {
+	return db.SettleGold(ledgers)
+}
+
+func (dbStore) incrRanks(stats []*model.RankStat) error {
+	return db.IncrRankStats(stats)
+}
+
+// 比赛数据的持久化, 测试时可以替换为不依赖数据库的实现
+type tournamentStore interface {
+	tournaments(day string) ([]*model.Tournament, error)
+	tournamentPlayers(tid int64) ([]*model.TournamentPlayer, error)
+	insertTournament(t *model.Tournament) error
+	updateTournament(t *model.Tournament) error
+	signUp(tp *model.TournamentPlayer, l *model.GoldLedger) error
+	updatePlayers(players []*model.TournamentPlayer) error
+	settle(t *model.Tournament, players []*model.TournamentPlayer, ledgers []*model.GoldLedger) error
+}
+
+func (dbStore) tournaments(day string) ([]*model.Tournament, error) {
+	return db.QueryTournaments(day)
+}
+
+func (dbStore) tournamentPlayers(tid int64) ([]*model.TournamentPlayer, error) {
+	return db.QueryTournamentPlayers(tid)
+}
+
+func (dbStore) insertTournament(t *model.Tournament) error {
+	return db.InsertTournament(t)
+}
+
+func (dbStore) updateTournament(t *model.Tournament) error {
+	return db.UpdateTournament(t)
+}
+
+func (dbStore) signUp(tp *model.TournamentPlayer, l *model.GoldLedger) error {
+	return db.SignUpTournament(tp, l)
+}
+
+func (dbStore) updatePlayers(players []*model.TournamentPlayer) error {
+	if len(players) == 0 {
+		return nil
+	}
+	return db.UpdateTournamentPlayers(players)
+}
+
+func (dbStore) settle(t *model.Tournament, players []*model.TournamentPlayer, ledgers []*model.GoldLedger) error {
+	return db.SettleTournament(t, players, ledgers)
+}
+
+// 排行榜查询, 测试时可以替换为不依赖数据库的实现
+type rankStore interface {
+	ranks(metric int, period string, clubId int64, offset, limit int) ([]*model.RankStat, error)
+	rankStat(uid int64, metric int, period string, clubId int64) (*model.RankStat, error)
+	rankOf(st *model.RankStat) (int, error)
+}
+
+func (dbStore) ranks(metric int, period string, clubId int64, offset, limit int) ([]*model.RankStat, error) {
+	return db.QueryRanks(metric, period, clubId, db.RankingDesc, offset, limit)
+}
+
+func (dbStore) rankStat(uid int64, metric int, period string, clubId int64) (*model.RankStat, error) {
+	return db.QueryRankStat(uid, metric, period, clubId)
+}
+
+func (dbStore) rankOf(st *model.RankStat) (int, error) {
+	return db.RankOf(st, db.RankingDesc)
+}
+
+// 邮件数据的持久化, 测试时可以替换为不依赖数据库的实现
+type mailStore interface {
+	insertMail(m *model.Mail) error
+	mails(uid, now int64, limit int) ([]*model.Mail, error)
+	mailStates(uid int64, ids []int64) ([]*model.MailState, error)
+	readMails(uid int64, ids []int64, now int64) error
+	deleteMails(uid int64, ids []int64, now int64) error
+	claimMail(uid int64, m *model.Mail, now int64) (bool, int64, error)
+}
+
+func (dbStore) insertMail(m *model.Mail) error {
+	return db.InsertMail(m)
+}
+
+func (dbStore) mails(uid, now int64, limit int) ([]*model.Mail, error) {
+	return db.QueryMails(uid, now, limit)
+}
+
+func (dbStore) mailStates(uid int64, ids []int64) ([]*model.MailState, error) {
+	return db.QueryMailStates(uid, ids)
+}
+
+func (dbStore) readMails(uid int64, ids []int64, now int64) error {
+	return db.ReadMails(uid, ids, now)
+}
+
+func (dbStore) deleteMails(uid int64, ids []int64, now int64) error {
+	return db.DeleteMails(uid, ids, now)
+}
+
+func (dbStore) claimMail(uid int64, m *model.Mail, now int64) (bool, int64, error) {
+	return db.ClaimMail(uid, m, now)
+}
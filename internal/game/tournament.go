@@ -0,0 +1,846 @@
+package game
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/component"
+	"github.com/lonng/nano/scheduler"
+	"github.com/lonng/nano/session"
+	"github.com/spf13/viper"
+)
+
+// 每日比赛: 初级/高级/大师赛每天定时开始, 开始之前开放报名, 报名费(金币)计入奖池.
+// 比赛分为多轮, 每轮按累计分数排序后每4人一桌, 人数不足的牌桌由机器人补齐, 打完固定局数后一轮结束.
+// 所有牌桌结束后按累计分数淘汰, 剩余不超过一桌时进行决赛, 决赛结束后按名次从奖池中发放奖励.
+// 开始时人数不足则取消比赛并退还报名费. 比赛和参赛玩家保存在数据库中, 重启后继续未完成的比赛.
+// 比赛数据只在nano逻辑协程中访问
+
+type tournamentLevel struct {
+	key    string // 配置文件中的名字
+	title  string
+	start  time.Duration // 每天开始的时间(从0点开始)
+	signup time.Duration // 开始之前开放报名的时间
+	fee    int64         // 报名费(金币)
+}
+
+var (
+	tournamentLevels = map[int]*tournamentLevel{
+		protocol.DailyMatchLevelJunior: {key: "junior", title: "初级赛", start: 20 * time.Hour, signup: time.Hour, fee: 1000},
+		protocol.DailyMatchLevelSenior: {key: "senior", title: "高级赛", start: 21 * time.Hour, signup: time.Hour, fee: 5000},
+		protocol.DailyMatchLevelMaster: {key: "master", title: "大师赛", start: 22 * time.Hour, signup: time.Hour, fee: 20000},
+	}
+	tournamentMinPlayers = 4                 // 开赛的最少人数
+	tournamentStageRound = 4                 // 每轮比赛的局数
+	tournamentAdvance    = 50                // 每轮晋级的比例(%)
+	tournamentRake       = 10                // 奖池抽水比例(%)
+	tournamentPrizes     = []int{50, 30, 20} // 前几名分配奖池的比例(%)
+)
+
+const (
+	tournamentTickInterval   = time.Second
+	tournamentRoundInterval  = 10 * time.Second // 每局结束后等待玩家准备的时间
+	tournamentPrepareTimeout = 15 * time.Second // 理牌和定缺的超时时间
+)
+
+const (
+	tournamentNotSignUpMessage = "当前不在报名时间"
+	tournamentJoinedMessage    = "你已经报名了该比赛"
+	tournamentFeeMessage       = "金币不足%d, 不能报名该比赛"
+	tournamentDeskMessage      = "比赛牌桌不能%s"
+)
+
+// 比赛的牌桌, 打完本轮的局数后销毁
+type deskTournament struct {
+	id    int64
+	stage int
+	final bool
+}
+
+type tournament struct {
+	*model.Tournament
+	level   *tournamentLevel
+	players map[int64]*model.TournamentPlayer
+	desks   map[*Desk]bool // 本轮还没有结束的牌桌
+
+	settling *tournamentSettlement // 结算失败, 等待下一次tick重试
+}
+
+// 比赛结束或者取消时的结算, 写入数据库之后才修改内存中的比赛状态
+type tournamentSettlement struct {
+	status     int
+	finishedAt int64
+	players    []*model.TournamentPlayer
+	ledgers    []*model.GoldLedger
+}
+
+type TournamentManager struct {
+	component.Base
+	tournaments map[int64]*tournament // 今天的比赛以及之前未结束的比赛
+	store       tournamentStore
+	now         func() time.Time
+}
+
+var defaultTournamentManager = NewTournamentManager()
+
+func NewTournamentManager() *TournamentManager {
+	return &TournamentManager{
+		tournaments: map[int64]*tournament{},
+		store:       dbStore{},
+		now:         time.Now,
+	}
+}
+
+// 读取数据库中未完成的比赛, DeskManager.AfterInit已经从检查点恢复了比赛的牌桌
+func (m *TournamentManager) AfterInit() {
+	m.load()
+
+	scheduler.NewTimer(tournamentTickInterval, func() {
+		m.tick()
+	})
+}
+
+// 读取比赛配置, 未配置的项使用默认值
+func loadTournamentConfig() {
+	if n := viper.GetInt("tournament.min_players"); n > 0 {
+		tournamentMinPlayers = n
+	}
+	if round := viper.GetInt("tournament.stage_round"); round > 0 {
+		tournamentStageRound = round
+	}
+	if advance := viper.GetInt("tournament.advance"); advance > 0 && advance < 100 {
+		tournamentAdvance = advance
+	}
+	if viper.Get("tournament.rake") != nil {
+		if rake := viper.GetInt("tournament.rake"); rake >= 0 && rake <= 100 {
+			tournamentRake = rake
+		} else {
+			logger.Warnf("比赛抽水比例错误: %d, 使用默认比例: %d", rake, tournamentRake)
+		}
+	}
+	if list := viper.GetStringSlice("tournament.prizes"); len(list) > 0 {
+		prizes, total := []int{}, 0
+		for _, v := range list {
+			pct, err := strconv.Atoi(v)
+			if err != nil || pct < 0 {
+				prizes = nil
+				break
+			}
+			prizes, total = append(prizes, pct), total+pct
+		}
+		if prizes != nil && total <= 100 {
+			tournamentPrizes = prizes
+		} else {
+			logger.Warnf("比赛奖励比例错误: %v, 使用默认比例: %v", list, tournamentPrizes)
+		}
+	}
+	for _, lv := range tournamentLevels {
+		prefix := "tournament." + lv.key
+		if start := viper.GetString(prefix + ".start"); start != "" {
+			if t, err := time.Parse("15:04", start); err == nil {
+				lv.start = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+			} else {
+				logger.Warnf("比赛开始时间错误: %s=%s", prefix, start)
+			}
+		}
+		if signup := viper.GetInt(prefix + ".signup"); signup > 0 {
+			lv.signup = time.Duration(signup) * time.Minute
+		}
+		if fee := viper.GetInt64(prefix + ".fee"); fee > 0 {
+			lv.fee = fee
+		}
+	}
+}
+
+// 比赛牌桌的选项, 每轮打固定的局数
+func tournamentOptions() *protocol.DeskOptions {
+	return &protocol.DeskOptions{
+		Mode:     ModeFours,
+		Rule:     RuleXueZhan,
+		MaxRound: tournamentStageRound,
+		MaxFan:   3,
+		Pinghu:   true,
+	}
+}
+
+// 当天的开始时间
+func (lv *tournamentLevel) startAt(now time.Time) time.Time {
+	y, mon, day := now.Date()
+	return time.Date(y, mon, day, 0, 0, 0, 0, now.Location()).Add(lv.start)
+}
+
+func tournamentDay(now time.Time) string {
+	return now.Format("20060102")
+}
+
+// 每轮晋级的人数: 按比例晋级并补齐整桌, 至少晋级一桌
+func tournamentAdvanceCount(n int) int {
+	c := (n*tournamentAdvance/100 + 3) / 4 * 4
+	if c < 4 {
+		c = 4
+	}
+	if c >= n {
+		c = (n - 1) / 4 * 4
+	}
+	return c
+}
+
+// 奖池扣除抽水后按名次分配, 舍去的零头归系统
+func tournamentPrizePool(pool int64) int64 {
+	return pool * int64(100-tournamentRake) / 100
+}
+
+func tournamentPrize(pool int64, rank int) int64 {
+	if rank < 1 || rank > len(tournamentPrizes) {
+		return 0
+	}
+	return tournamentPrizePool(pool) * int64(tournamentPrizes[rank-1]) / 100
+}
+
+// 按累计分数排序, 分数相同时先报名的在前
+func rankTournamentPlayers(players []*model.TournamentPlayer) {
+	sort.Slice(players, func(i, j int) bool {
+		if players[i].Score != players[j].Score {
+			return players[i].Score > players[j].Score
+		}
+		return players[i].Id < players[j].Id
+	})
+}
+
+// 比赛中还没有被淘汰的玩家, 按累计分数排序
+func (t *tournament) active() []*model.TournamentPlayer {
+	list := []*model.TournamentPlayer{}
+	for _, tp := range t.players {
+		if tp.Status == protocol.TournamentPlayerStatusPlaying {
+			list = append(list, tp)
+		}
+	}
+	rankTournamentPlayers(list)
+	return list
+}
+
+func (t *tournament) list() []*model.TournamentPlayer {
+	list := make([]*model.TournamentPlayer, 0, len(t.players))
+	for _, tp := range t.players {
+		list = append(list, tp)
+	}
+	rankTournamentPlayers(list)
+	return list
+}
+
+func (m *TournamentManager) find(level int, day string) *tournament {
+	for _, t := range m.tournaments {
+		if t.Level == level && t.Day == day {
+			return t
+		}
+	}
+	return nil
+}
+
+func (m *TournamentManager) progress(t *tournament, uid int64) protocol.TournamentProgress {
+	pg := protocol.TournamentProgress{
+		ID:       t.Id,
+		Level:    t.Level,
+		Title:    t.level.title,
+		Status:   t.Status,
+		StartAt:  t.StartAt,
+		Fee:      t.Fee,
+		Pool:     tournamentPrizePool(t.Pool),
+		Stage:    t.Stage,
+		RoomType: protocol.RoomTypeDailyMatch,
+		Players:  len(t.active()),
+	}
+	if pg.Players <= 4 && t.Status == protocol.TournamentStatusRunning {
+		pg.RoomType = protocol.RoomTypeFinalMatch
+	}
+	if tp, ok := t.players[uid]; ok {
+		pg.Joined = true
+		pg.PlayerStatus = tp.Status
+		pg.Score = tp.Score
+		pg.Rank = tp.Rank
+		pg.Prize = tp.Prize
+	}
+	return pg
+}
+
+// 推送比赛进度, 不在线的玩家登录后通过List查询
+func (m *TournamentManager) push(t *tournament, uid int64, info *protocol.TableInfo) {
+	p, ok := defaultManager.player(uid)
+	if !ok {
+		return
+	}
+	s := p.currentSession()
+	if s == nil {
+		return
+	}
+	pg := m.progress(t, uid)
+	pg.TableInfo = info
+	s.Push(protocol.RouteTournamentProgress, &pg)
+}
+
+// 通知被淘汰或者完成比赛的玩家退出比赛
+func (m *TournamentManager) pushEnd(t *tournament, uid int64) {
+	m.push(t, uid, nil)
+	if p, ok := defaultManager.player(uid); ok {
+		if s := p.currentSession(); s != nil {
+			s.Push("onPlayerExit", &protocol.ExitResponse{AccountId: uid, IsExit: true, ExitType: protocol.ExitTypeDailyMatchEnd, DeskPos: -1})
+		}
+	}
+}
+
+// List 今天的所有比赛以及当前玩家的比赛进度
+func (m *TournamentManager) List(s *session.Session, _ []byte) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	resp := &protocol.TournamentListResponse{Tournaments: []protocol.TournamentProgress{}}
+	ids := make([]int64, 0, len(m.tournaments))
+	for id := range m.tournaments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		resp.Tournaments = append(resp.Tournaments, m.progress(m.tournaments[id], p.Uid()))
+	}
+	return s.Response(resp)
+}
+
+// Apply 报名今天的比赛, DailyMatchType为比赛等级, 报名时扣除报名费
+func (m *TournamentManager) Apply(s *session.Session, req *protocol.ApplyForDailyMatchRequest) error {
+	p, err := playerWithSession(s)
+	if err != nil {
+		return err
+	}
+
+	lv, ok := tournamentLevels[req.DailyMatchType]
+	if !ok {
+		return errutil.ErrIllegalParameter
+	}
+	t := m.find(req.DailyMatchType, tournamentDay(m.now()))
+	if t == nil || t.Status != protocol.TournamentStatusSignUp || t.settling != nil {
+		return s.Response(&protocol.TournamentApplyResponse{Code: errorCode, Error: tournamentNotSignUpMessage})
+	}
+
+	uid := p.Uid()
+	if _, ok := t.players[uid]; ok {
+		return s.Response(&protocol.TournamentApplyResponse{Code: errorCode, Error: tournamentJoinedMessage, Progress: m.progress(t, uid)})
+	}
+	if p.goldBalance() < t.Fee {
+		return s.Response(&protocol.TournamentApplyResponse{
+			Code:  errutil.Code(errutil.ErrGoldNotEnough),
+			Error: fmt.Sprintf(tournamentFeeMessage, t.Fee),
+		})
+	}
+
+	now := m.now().Unix()
+	tp := &model.TournamentPlayer{
+		TournamentId: t.Id,
+		Uid:          uid,
+		Name:         p.name,
+		Status:       protocol.TournamentPlayerStatusPlaying,
+		CreatedAt:    now,
+	}
+	l := &model.GoldLedger{
+		Uid:          uid,
+		Type:         model.GoldLedgerTypeTournamentFee,
+		Change:       -t.Fee,
+		TournamentId: t.Id,
+		CreatedAt:    now,
+	}
+	if err := m.store.signUp(tp, l); err != nil {
+		logger.Errorf("报名比赛失败, UID=%d, 比赛=%d, Error=%v", uid, t.Id, err)
+		return s.Response(&protocol.TournamentApplyResponse{Code: errutil.Code(err), Error: err.Error()})
+	}
+
+	t.players[uid] = tp
+	t.Pool += t.Fee
+	p.setGold(l.Balance)
+	s.Push(protocol.RouteGoldChange, &protocol.GoldChangeInformation{Gold: l.Balance})
+	logger.Infof("玩家报名比赛: UID=%d, %s, 报名人数=%d", uid, lv.title, len(t.players))
+
+	return s.Response(&protocol.TournamentApplyResponse{Progress: m.progress(t, uid)})
+}
+
+func (m *TournamentManager) tick() {
+	now := m.now()
+	day := tournamentDay(now)
+
+	// 报名开始时创建今天的比赛, 服务器在开始时间之后启动时不再创建
+	for level, lv := range tournamentLevels {
+		startAt := lv.startAt(now)
+		if now.Before(startAt.Add(-lv.signup)) || !now.Before(startAt) || m.find(level, day) != nil {
+			continue
+		}
+		m.create(level, day, startAt)
+	}
+
+	for id, t := range m.tournaments {
+		if t.settling != nil {
+			m.settle(t)
+			continue
+		}
+		switch t.Status {
+		case protocol.TournamentStatusSignUp:
+			if !now.Before(time.Unix(t.StartAt, 0)) {
+				m.begin(t)
+			}
+		case protocol.TournamentStatusFinished, protocol.TournamentStatusCancelled:
+			// 之前的比赛不再显示
+			if t.Day != day {
+				delete(m.tournaments, id)
+			}
+		}
+	}
+}
+
+func (m *TournamentManager) create(level int, day string, startAt time.Time) {
+	lv := tournamentLevels[level]
+	mt := &model.Tournament{
+		Level:     level,
+		Day:       day,
+		Status:    protocol.TournamentStatusSignUp,
+		Fee:       lv.fee,
+		StartAt:   startAt.Unix(),
+		CreatedAt: m.now().Unix(),
+	}
+	if err := m.store.insertTournament(mt); err != nil {
+		logger.Errorf("创建比赛失败: %s, Error=%v", lv.title, err)
+		return
+	}
+
+	m.tournaments[mt.Id] = &tournament{
+		Tournament: mt,
+		level:      lv,
+		players:    map[int64]*model.TournamentPlayer{},
+		desks:      map[*Desk]bool{},
+	}
+	logger.Infof("开放比赛报名: %s, 比赛=%d, 开始时间=%s", lv.title, mt.Id, startAt.Format("2006-01-02 15:04"))
+}
+
+// 比赛开始, 人数不足时取消比赛
+func (m *TournamentManager) begin(t *tournament) {
+	if len(t.players) < tournamentMinPlayers {
+		m.cancel(t)
+		return
+	}
+
+	t.Status = protocol.TournamentStatusRunning
+	logger.Infof("比赛开始: %s, 比赛=%d, 人数=%d", t.level.title, t.Id, len(t.players))
+	m.startStage(t)
+}
+
+// 取消比赛并退还报名费
+func (m *TournamentManager) cancel(t *tournament) {
+	now := m.now().Unix()
+	players := t.list()
+	ledgers := []*model.GoldLedger{}
+	for _, tp := range players {
+		tp.Status = protocol.TournamentPlayerStatusRefunded
+		ledgers = append(ledgers, &model.GoldLedger{
+			Uid:          tp.Uid,
+			Type:         model.GoldLedgerTypeTournamentRefund,
+			Change:       t.Fee,
+			TournamentId: t.Id,
+			CreatedAt:    now,
+		})
+	}
+	t.settling = &tournamentSettlement{
+		status:     protocol.TournamentStatusCancelled,
+		finishedAt: now,
+		players:    players,
+		ledgers:    ledgers,
+	}
+
+	logger.Infof("比赛人数不足, 取消比赛: %s, 比赛=%d, 人数=%d", t.level.title, t.Id, len(players))
+	m.settle(t)
+}
+
+// 开始新的一轮, 按累计分数分组入座
+func (m *TournamentManager) startStage(t *tournament) {
+	t.Stage++
+	if err := m.store.updateTournament(t.Tournament); err != nil {
+		logger.Errorf("更新比赛状态失败, 比赛=%d, Error=%v", t.Id, err)
+	}
+
+	active := t.active()
+	logger.Infof("比赛第%d轮开始: 比赛=%d, 人数=%d", t.Stage, t.Id, len(active))
+	m.seat(t, active)
+}
+
+// 玩家每4人一桌入座, 已经在其他牌桌上的玩家本轮弃权, 所有玩家都弃权时直接结束本轮
+func (m *TournamentManager) seat(t *tournament, players []*model.TournamentPlayer) {
+	final := len(t.active()) <= 4
+	seated := []*Player{}
+	forfeits := []*model.TournamentPlayer{}
+	for _, tp := range players {
+		p := m.player(tp)
+		if p == nil {
+			tp.Stage = t.Stage
+			forfeits = append(forfeits, tp)
+			m.push(t, tp.Uid, nil)
+			continue
+		}
+		seated = append(seated, p)
+	}
+	if len(forfeits) > 0 {
+		logger.Infof("比赛第%d轮弃权: 比赛=%d, 人数=%d", t.Stage, t.Id, len(forfeits))
+		if err := m.store.updatePlayers(forfeits); err != nil {
+			logger.Errorf("更新参赛玩家失败, 比赛=%d, Error=%v", t.Id, err)
+		}
+	}
+
+	for i := 0; i < len(seated); i += 4 {
+		end := i + 4
+		if end > len(seated) {
+			end = len(seated)
+		}
+		m.createDesk(t, seated[i:end], final)
+	}
+
+	if len(t.desks) == 0 {
+		m.endStage(t)
+	}
+}
+
+// 参赛玩家, 不在线的玩家创建没有session的玩家数据, 登录时绑定. 已经在其他牌桌上时返回nil
+func (m *TournamentManager) player(tp *model.TournamentPlayer) *Player {
+	p, ok := defaultManager.player(tp.Uid)
+	if !ok {
+		p = newOfflinePlayer(tp.Uid, tp.Name)
+		defaultManager.setPlayer(tp.Uid, p)
+	}
+	if p.currentDesk() != nil {
+		return nil
+	}
+	return p
+}
+
+func (m *TournamentManager) createDesk(t *tournament, players []*Player, final bool) {
+	no := nextRoomNumber()
+	d := NewDesk(no, tournamentOptions(), -1)
+	d.createdAt = m.now().Unix()
+	d.tournament = &deskTournament{id: t.Id, stage: t.Stage, final: final}
+	defaultDeskManager.setDesk(no, d)
+	t.desks[d] = true
+
+	uids := make([]int64, 0, len(players))
+	for _, p := range players {
+		uids = append(uids, p.Uid())
+		if s := p.currentSession(); s != nil {
+			leaveObserving(p, s)
+		}
+	}
+	d.logger.Infof("创建比赛牌桌: 比赛=%d, 第%d轮, 玩家=%v", t.Id, t.Stage, uids)
+
+	d.post(func() {
+		for _, p := range players {
+			d.seatTournamentPlayer(p)
+		}
+		if len(d.players) < d.totalPlayerCount() {
+			if err := d.robotJoin(0); err != nil {
+				d.logger.Errorf("比赛牌桌添加机器人失败, Error=%v", err)
+			}
+		}
+		d.syncDeskStatus()
+
+		info := d.tableInfo()
+		logicTask(func() {
+			for _, uid := range uids {
+				m.push(t, uid, &info)
+			}
+		})
+		d.checkStart()
+	})
+}
+
+// 牌桌打完本轮的局数(或者中断)后累计分数, 在nano逻辑协程中调用
+func (m *TournamentManager) deskFinished(d *Desk, scores map[int64]int) {
+	t, ok := m.tournaments[d.tournament.id]
+	if !ok || !t.desks[d] {
+		return
+	}
+	delete(t.desks, d)
+
+	changed := []*model.TournamentPlayer{}
+	for uid, score := range scores {
+		tp, ok := t.players[uid]
+		if !ok || tp.Status != protocol.TournamentPlayerStatusPlaying || tp.Stage >= t.Stage {
+			continue
+		}
+		tp.Score += score
+		tp.Stage = t.Stage
+		changed = append(changed, tp)
+	}
+	if err := m.store.updatePlayers(changed); err != nil {
+		logger.Errorf("更新参赛玩家失败, 比赛=%d, Error=%v", t.Id, err)
+	}
+	for _, tp := range changed {
+		m.push(t, tp.Uid, nil)
+	}
+
+	if len(t.desks) == 0 {
+		m.endStage(t)
+	}
+}
+
+// 本轮所有牌桌结束, 淘汰累计分数靠后的玩家, 剩余不超过一桌时比赛结束
+func (m *TournamentManager) endStage(t *tournament) {
+	active := t.active()
+	if len(active) <= 4 {
+		m.finish(t)
+		return
+	}
+
+	n := tournamentAdvanceCount(len(active))
+	for i, tp := range active {
+		tp.Rank = i + 1
+		if i >= n {
+			tp.Status = protocol.TournamentPlayerStatusEliminated
+		}
+	}
+	if err := m.store.updatePlayers(active); err != nil {
+		logger.Errorf("更新参赛玩家失败, 比赛=%d, Error=%v", t.Id, err)
+	}
+	logger.Infof("比赛第%d轮结束: 比赛=%d, 晋级=%d, 淘汰=%d", t.Stage, t.Id, n, len(active)-n)
+
+	for _, tp := range active[n:] {
+		m.pushEnd(t, tp.Uid)
+	}
+	m.startStage(t)
+}
+
+// 比赛结束, 按名次发放奖励
+func (m *TournamentManager) finish(t *tournament) {
+	now := m.now().Unix()
+	active := t.active()
+	ledgers := []*model.GoldLedger{}
+	for i, tp := range active {
+		tp.Rank = i + 1
+		tp.Status = protocol.TournamentPlayerStatusFinished
+		tp.Prize = tournamentPrize(t.Pool, tp.Rank)
+		if tp.Prize <= 0 {
+			continue
+		}
+		ledgers = append(ledgers, &model.GoldLedger{
+			Uid:          tp.Uid,
+			Type:         model.GoldLedgerTypeTournamentPrize,
+			Change:       tp.Prize,
+			TournamentId: t.Id,
+			CreatedAt:    now,
+		})
+	}
+	t.settling = &tournamentSettlement{
+		status:     protocol.TournamentStatusFinished,
+		finishedAt: now,
+		players:    active,
+		ledgers:    ledgers,
+	}
+
+	logger.Infof("比赛结束: %s, 比赛=%d, 奖池=%d", t.level.title, t.Id, t.Pool)
+	m.settle(t)
+}
+
+// 比赛结束或者取消时发放金币, 通知所有参赛玩家. 结算成功之后才修改比赛状态,
+// 失败时保留在结算中由tick重试, 重启后按数据库中的状态重新结束比赛
+func (m *TournamentManager) settle(t *tournament) {
+	st := t.settling
+	mt := *t.Tournament
+	mt.Status, mt.FinishedAt = st.status, st.finishedAt
+	for _, l := range st.ledgers {
+		l.Id = 0 // 失败的事务已经回滚, 重试时重新插入流水
+	}
+	if err := m.store.settle(&mt, st.players, st.ledgers); err != nil {
+		logger.Errorf("比赛结算失败, 比赛=%d, Error=%v", t.Id, err)
+		return
+	}
+
+	t.settling = nil
+	t.Status, t.FinishedAt = st.status, st.finishedAt
+	for _, l := range st.ledgers {
+		p, ok := defaultManager.player(l.Uid)
+		if !ok {
+			continue
+		}
+		p.setGold(l.Balance)
+		if s := p.currentSession(); s != nil {
+			s.Push(protocol.RouteGoldChange, &protocol.GoldChangeInformation{Gold: l.Balance})
+		}
+	}
+
+	for _, tp := range st.players {
+		m.pushEnd(t, tp.Uid)
+	}
+}
+
+// 读取数据库中今天的比赛和未结束的比赛, 进行中的比赛继续当前这一轮
+func (m *TournamentManager) load() {
+	list, err := m.store.tournaments(tournamentDay(m.now()))
+	if err != nil {
+		logger.Errorf("读取比赛失败, Error=%v", err)
+		return
+	}
+
+	for _, mt := range list {
+		lv, ok := tournamentLevels[mt.Level]
+		if !ok {
+			continue
+		}
+		players, err := m.store.tournamentPlayers(mt.Id)
+		if err != nil {
+			logger.Errorf("读取参赛玩家失败, 比赛=%d, Error=%v", mt.Id, err)
+			continue
+		}
+
+		t := &tournament{
+			Tournament: mt,
+			level:      lv,
+			players:    map[int64]*model.TournamentPlayer{},
+			desks:      map[*Desk]bool{},
+		}
+		for _, tp := range players {
+			t.players[tp.Uid] = tp
+		}
+		m.tournaments[mt.Id] = t
+
+		if mt.Status == protocol.TournamentStatusRunning {
+			m.resume(t)
+		}
+	}
+
+	logger.Infof("读取比赛数量: %d", len(m.tournaments))
+}
+
+// 继续进行中的比赛: 从检查点恢复的牌桌继续本轮, 本轮还没有完成的其他玩家重新入座
+func (m *TournamentManager) resume(t *tournament) {
+	seated := map[int64]bool{}
+	for _, d := range defaultDeskManager.desks {
+		if d.tournament == nil || d.tournament.id != t.Id || d.tournament.stage != t.Stage {
+			continue
+		}
+		ok := d.do(func() {
+			for _, p := range d.players {
+				seated[p.Uid()] = true
+			}
+			d.continueTournament()
+		})
+		if ok {
+			t.desks[d] = true
+		}
+	}
+
+	rest := []*model.TournamentPlayer{}
+	for _, tp := range t.active() {
+		if tp.Stage < t.Stage && !seated[tp.Uid] {
+			rest = append(rest, tp)
+		}
+	}
+	logger.Infof("继续比赛: 比赛=%d, 第%d轮, 恢复的牌桌=%d, 重新入座=%d", t.Id, t.Stage, len(t.desks), len(rest))
+	m.seat(t, rest)
+}
+
+// 比赛的玩家入座并准备, 不在线的玩家按照断线处理, 由托管完成牌局
+func (d *Desk) seatTournamentPlayer(p *Player) {
+	uid := p.Uid()
+	d.players = append(d.players, p)
+	p.setDesk(d, len(d.players)-1)
+	d.roundStats[uid] = &history.Record{}
+	d.prepare.ready(uid)
+
+	if s := p.currentSession(); s != nil {
+		d.group.Add(s)
+	} else {
+		d.dissolve.updateOnlineStatus(uid, false)
+	}
+}
+
+// 比赛不等待玩家准备, 每局结束后不在线的玩家直接准备, 在线的玩家超时后自动准备
+func (d *Desk) scheduleTournamentRound() {
+	for _, p := range d.players {
+		if !d.dissolve.isOnline(p.Uid()) {
+			d.prepare.ready(p.Uid())
+		}
+	}
+
+	round := atomic.LoadUint32(&d.round)
+	scheduler.NewAfterTimer(tournamentRoundInterval, func() {
+		d.post(func() {
+			if atomic.LoadUint32(&d.round) != round || d.status() != constant.DeskStatusCleaned {
+				return
+			}
+			for _, p := range d.players {
+				d.prepare.ready(p.Uid())
+			}
+			d.syncDeskStatus()
+			d.checkStart()
+		})
+	})
+}
+
+// 比赛不等待玩家理牌和定缺, 超时后自动完成
+func (d *Desk) scheduleAutoPrepare() {
+	round := atomic.LoadUint32(&d.round)
+	scheduler.NewAfterTimer(tournamentPrepareTimeout, func() {
+		d.post(func() {
+			if atomic.LoadUint32(&d.round) == round {
+				d.autoPrepare()
+			}
+		})
+	})
+}
+
+func (d *Desk) autoPrepare() {
+	switch d.status() {
+	case constant.DeskStatusDuanPai:
+		for _, p := range d.players {
+			if d.prepare.isSorted(p.Uid()) {
+				continue
+			}
+			if err := d.qiPaiFinished(p.Uid()); err != nil {
+				d.logger.Error(err)
+				return
+			}
+		}
+		d.scheduleAutoPrepare()
+
+	case constant.DeskStatusHuanSanZhang:
+		// 换三张有自己的超时, 完成后等待定缺
+		d.scheduleAutoPrepare()
+
+	case constant.DeskStatusQiPai:
+		for _, p := range d.players {
+			if p.ctx.Que < 1 {
+				d.dingQue(p, p.robotQue())
+			}
+		}
+	}
+}
+
+// 从检查点恢复后继续比赛, 在牌桌协程中调用
+func (d *Desk) continueTournament() {
+	switch d.status() {
+	case constant.DeskStatusCreate, constant.DeskStatusCleaned:
+		d.scheduleTournamentRound()
+	case constant.DeskStatusDuanPai, constant.DeskStatusHuanSanZhang, constant.DeskStatusQiPai:
+		d.scheduleAutoPrepare()
+	}
+}
+
+// 牌桌销毁时通知比赛累计本轮分数, 中断的牌桌只计算已经完成的局
+func (d *Desk) reportTournament() {
+	scores := map[int64]int{}
+	for uid, r := range d.matchStats.Result() {
+		scores[uid] = r.TotalScore
+	}
+	logicTask(func() { defaultTournamentManager.deskFinished(d, scores) })
+}
@@ -0,0 +1,469 @@
+package game
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"go-mahjong-server/db/model"
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/scheduler"
+)
+
+// 比赛数据只在测试协程(nano逻辑协程)中访问, 保存副本模拟数据库
+type memTournamentStore struct {
+	seq     int64
+	rows    map[int64]model.Tournament
+	players map[int64]model.TournamentPlayer
+	ledgers []model.GoldLedger
+	gold    map[int64]int64
+	failure error // 模拟结算时数据库出错
+}
+
+func newMemTournamentStore() *memTournamentStore {
+	return &memTournamentStore{
+		rows:    map[int64]model.Tournament{},
+		players: map[int64]model.TournamentPlayer{},
+		gold:    map[int64]int64{},
+	}
+}
+
+func (m *memTournamentStore) tournaments(day string) ([]*model.Tournament, error) {
+	list := []*model.Tournament{}
+	for _, t := range m.rows {
+		if t.Day == day || t.Status == protocol.TournamentStatusSignUp || t.Status == protocol.TournamentStatusRunning {
+			t := t
+			list = append(list, &t)
+		}
+	}
+	return list, nil
+}
+
+func (m *memTournamentStore) tournamentPlayers(tid int64) ([]*model.TournamentPlayer, error) {
+	list := []*model.TournamentPlayer{}
+	for _, tp := range m.players {
+		if tp.TournamentId == tid {
+			tp := tp
+			list = append(list, &tp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+func (m *memTournamentStore) insertTournament(t *model.Tournament) error {
+	m.seq++
+	t.Id = m.seq
+	m.rows[t.Id] = *t
+	return nil
+}
+
+func (m *memTournamentStore) updateTournament(t *model.Tournament) error {
+	mt := m.rows[t.Id]
+	mt.Status, mt.Stage, mt.FinishedAt = t.Status, t.Stage, t.FinishedAt
+	m.rows[t.Id] = mt
+	return nil
+}
+
+func (m *memTournamentStore) changeGold(l *model.GoldLedger) error {
+	if m.gold[l.Uid]+l.Change < 0 {
+		return errutil.ErrGoldNotEnough
+	}
+	m.gold[l.Uid] += l.Change
+	l.Balance = m.gold[l.Uid]
+	m.ledgers = append(m.ledgers, *l)
+	return nil
+}
+
+func (m *memTournamentStore) signUp(tp *model.TournamentPlayer, l *model.GoldLedger) error {
+	if err := m.changeGold(l); err != nil {
+		return err
+	}
+	m.seq++
+	tp.Id = m.seq
+	m.players[tp.Id] = *tp
+	mt := m.rows[tp.TournamentId]
+	mt.Pool -= l.Change
+	m.rows[tp.TournamentId] = mt
+	return nil
+}
+
+func (m *memTournamentStore) updatePlayers(players []*model.TournamentPlayer) error {
+	for _, tp := range players {
+		m.players[tp.Id] = *tp
+	}
+	return nil
+}
+
+func (m *memTournamentStore) settle(t *model.Tournament, players []*model.TournamentPlayer, ledgers []*model.GoldLedger) error {
+	if m.failure != nil {
+		return m.failure
+	}
+	for _, l := range ledgers {
+		if err := m.changeGold(l); err != nil {
+			return err
+		}
+	}
+	m.updatePlayers(players)
+	return m.updateTournament(t)
+}
+
+func (m *memTournamentStore) player(tid, uid int64) model.TournamentPlayer {
+	for _, tp := range m.players {
+		if tp.TournamentId == tid && tp.Uid == uid {
+			return tp
+		}
+	}
+	return model.TournamentPlayer{}
+}
+
+func TestTournamentAdvanceCount(t *testing.T) {
+	cases := map[int]int{5: 4, 8: 4, 9: 4, 12: 8, 16: 8, 17: 8, 30: 16, 64: 32}
+	for n, expected := range cases {
+		if c := tournamentAdvanceCount(n); c != expected {
+			t.Fatalf("advance(%d)=%d, expected %d", n, c, expected)
+		}
+	}
+
+	// 奖池扣除10%抽水后按50/30/20分配
+	for rank, expected := range map[int]int64{1: 225, 2: 135, 3: 90, 4: 0} {
+		if prize := tournamentPrize(500, rank); prize != expected {
+			t.Fatalf("prize(%d)=%d, expected %d", rank, prize, expected)
+		}
+	}
+}
+
+// 使用内存数据库和固定的时间, 只保留初级赛
+func setupTournamentTest(t *testing.T, now *time.Time) (*TournamentManager, *memTournamentStore, chan scheduler.Task) {
+	setupLoopTest(t)
+	tasks := replaceLogicTask(t)
+
+	levels, prev := tournamentLevels, defaultTournamentManager
+	tournamentLevels = map[int]*tournamentLevel{
+		protocol.DailyMatchLevelJunior: {key: "junior", title: "初级赛", start: 20 * time.Hour, signup: time.Hour, fee: 100},
+	}
+	ms := newMemTournamentStore()
+	m := NewTournamentManager()
+	m.store = ms
+	m.now = func() time.Time { return *now }
+	defaultTournamentManager = m
+	t.Cleanup(func() {
+		tournamentLevels = levels
+		defaultTournamentManager = prev
+	})
+	return m, ms, tasks
+}
+
+// 在线的参赛玩家
+func newTournamentTestPlayer(t *testing.T, ms *memTournamentStore, uid, gold int64) (*sessionEntity, *Player) {
+	s, e, p := newLoopTestSession(t, uid)
+	p.setGold(gold)
+	ms.gold[uid] = gold
+	defaultManager.setPlayer(uid, p)
+	t.Cleanup(func() { defaultManager.offline(uid) })
+	return &sessionEntity{s, e}, p
+}
+
+// 模拟牌桌打完本轮: 写入分数后销毁牌桌, 由牌桌通知比赛累计分数
+func finishTournamentDesk(t *testing.T, tasks chan scheduler.Task, d *Desk, scores map[int64]int) {
+	t.Helper()
+	d.do(func() {
+		rs := history.RoundStats{}
+		for uid, score := range scores {
+			rs[uid] = &history.Record{TotalScore: score}
+		}
+		d.matchStats.Push(rs)
+		d.destroy()
+	})
+	runLogicTasks(t, tasks, 2)
+}
+
+func tournamentDesks(tr *tournament) []*Desk {
+	desks := []*Desk{}
+	for d := range tr.desks {
+		desks = append(desks, d)
+	}
+	return desks
+}
+
+func TestTournament(t *testing.T) {
+	now := time.Date(2026, 10, 16, 18, 0, 0, 0, time.Local)
+	m, ms, tasks := setupTournamentTest(t, &now)
+	level := protocol.DailyMatchLevelJunior
+
+	// 报名开始之前没有比赛
+	m.tick()
+	if len(m.tournaments) != 0 {
+		t.Fatalf("tournaments=%d", len(m.tournaments))
+	}
+
+	now = now.Add(90 * time.Minute)
+	m.tick()
+	tr := m.find(level, "20261016")
+	if tr == nil || tr.Status != protocol.TournamentStatusSignUp || tr.StartAt != now.Add(30*time.Minute).Unix() {
+		t.Fatalf("tournament: %+v", tr)
+	}
+
+	// 5个玩家报名, 扣除报名费
+	players := map[int64]*Player{}
+	entities := map[int64]*sessionEntity{}
+	for uid := int64(61); uid <= 65; uid++ {
+		se, p := newTournamentTestPlayer(t, ms, uid, 1000)
+		if err := m.Apply(se.s, &protocol.ApplyForDailyMatchRequest{DailyMatchType: level}); err != nil {
+			t.Fatal(err)
+		}
+		resp, ok := se.e.lastResponse().(*protocol.TournamentApplyResponse)
+		if !ok || resp.Code != 0 || !resp.Progress.Joined || p.goldBalance() != 900 {
+			t.Fatalf("apply response: %+v gold=%d", se.e.lastResponse(), p.goldBalance())
+		}
+		players[uid], entities[uid] = p, se
+	}
+	if tr.Pool != 500 || ms.rows[tr.Id].Pool != 500 {
+		t.Fatalf("pool=%d", tr.Pool)
+	}
+
+	// 重复报名和金币不足
+	if err := m.Apply(entities[61].s, &protocol.ApplyForDailyMatchRequest{DailyMatchType: level}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := entities[61].e.lastResponse().(*protocol.TournamentApplyResponse); resp.Code != errorCode || players[61].goldBalance() != 900 {
+		t.Fatalf("apply again: %+v", resp)
+	}
+	poor, _ := newTournamentTestPlayer(t, ms, 66, 50)
+	if err := m.Apply(poor.s, &protocol.ApplyForDailyMatchRequest{DailyMatchType: level}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := poor.e.lastResponse().(*protocol.TournamentApplyResponse); resp.Code != errutil.Code(errutil.ErrGoldNotEnough) {
+		t.Fatalf("apply without gold: %+v", resp)
+	}
+
+	// 比赛开始: 5个玩家分为两桌, 人数不足的牌桌由机器人补齐
+	now = now.Add(30 * time.Minute)
+	m.tick()
+	if tr.Status != protocol.TournamentStatusRunning || tr.Stage != 1 || len(tr.desks) != 2 {
+		t.Fatalf("status=%d stage=%d desks=%d", tr.Status, tr.Stage, len(tr.desks))
+	}
+	runLogicTasks(t, tasks, 2)
+	for uid, p := range players {
+		d := p.currentDesk()
+		if d == nil || d.tournament == nil || d.tournament.id != tr.Id || d.tournament.final {
+			t.Fatalf("player %d should be seated at a tournament desk", uid)
+		}
+		if c := entities[uid].e.pushCount(protocol.RouteTournamentProgress); c != 1 {
+			t.Fatalf("player %d progress count=%d", uid, c)
+		}
+	}
+	for _, d := range tournamentDesks(tr) {
+		var count int
+		d.do(func() { count = len(d.players) })
+		if count != 4 {
+			t.Fatalf("desk players=%d", count)
+		}
+	}
+
+	// 第一轮结束, 累计分数最低的玩家被淘汰, 剩余4人进入决赛
+	stage1 := map[int64]int{61: 10, 62: 5, 63: -5, 64: -10, 65: -20}
+	for _, d := range tournamentDesks(tr) {
+		scores := map[int64]int{}
+		d.do(func() {
+			for _, p := range d.players {
+				if s, ok := stage1[p.Uid()]; ok {
+					scores[p.Uid()] = s
+				}
+			}
+		})
+		finishTournamentDesk(t, tasks, d, scores)
+	}
+	if tr.Stage != 2 || len(tr.desks) != 1 {
+		t.Fatalf("stage=%d desks=%d", tr.Stage, len(tr.desks))
+	}
+	if tp := ms.player(tr.Id, 65); tp.Status != protocol.TournamentPlayerStatusEliminated || tp.Rank != 5 || tp.Score != -20 {
+		t.Fatalf("eliminated player: %+v", tp)
+	}
+	if players[65].currentDesk() != nil || entities[65].e.pushCount("onPlayerExit") != 1 {
+		t.Fatal("eliminated player should leave the tournament")
+	}
+
+	runLogicTasks(t, tasks, 1)
+	final := tournamentDesks(tr)[0]
+	if !final.tournament.final || final.tournament.stage != 2 {
+		t.Fatalf("final desk: %+v", final.tournament)
+	}
+	for uid := int64(61); uid <= 64; uid++ {
+		if players[uid].currentDesk() != final {
+			t.Fatalf("player %d should be seated at the final desk", uid)
+		}
+	}
+
+	// 决赛结束, 按累计分数排名发放奖励
+	finishTournamentDesk(t, tasks, final, map[int64]int{61: 0, 62: 8, 63: -3, 64: -5})
+	if tr.Status != protocol.TournamentStatusFinished || len(tr.desks) != 0 {
+		t.Fatalf("status=%d", tr.Status)
+	}
+	expected := map[int64]struct {
+		rank int
+		gold int64
+	}{62: {1, 1125}, 61: {2, 1035}, 63: {3, 990}, 64: {4, 900}, 65: {5, 900}}
+	for uid, e := range expected {
+		tp := ms.player(tr.Id, uid)
+		if tp.Rank != e.rank || players[uid].goldBalance() != e.gold || ms.gold[uid] != e.gold {
+			t.Fatalf("player %d: %+v gold=%d", uid, tp, players[uid].goldBalance())
+		}
+	}
+	if mt := ms.rows[tr.Id]; mt.Status != protocol.TournamentStatusFinished || mt.Stage != 2 {
+		t.Fatalf("stored tournament: %+v", mt)
+	}
+
+	// 重启后读取已经结束的比赛, 当天不再创建
+	m2 := NewTournamentManager()
+	m2.store, m2.now = ms, m.now
+	m2.load()
+	m2.tick()
+	if len(m2.tournaments) != 1 || m2.tournaments[tr.Id].Status != protocol.TournamentStatusFinished {
+		t.Fatalf("tournaments=%d", len(m2.tournaments))
+	}
+}
+
+func TestTournamentCancel(t *testing.T) {
+	now := time.Date(2026, 10, 16, 19, 30, 0, 0, time.Local)
+	m, ms, _ := setupTournamentTest(t, &now)
+	level := protocol.DailyMatchLevelJunior
+
+	m.tick()
+	tr := m.find(level, "20261016")
+	se, p := newTournamentTestPlayer(t, ms, 71, 1000)
+	if err := m.Apply(se.s, &protocol.ApplyForDailyMatchRequest{DailyMatchType: level}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 人数不足, 取消比赛并退还报名费
+	now = now.Add(30 * time.Minute)
+	m.tick()
+	if tr.Status != protocol.TournamentStatusCancelled || p.goldBalance() != 1000 || ms.gold[71] != 1000 {
+		t.Fatalf("status=%d gold=%d", tr.Status, p.goldBalance())
+	}
+	if tp := ms.player(tr.Id, 71); tp.Status != protocol.TournamentPlayerStatusRefunded {
+		t.Fatalf("player: %+v", tp)
+	}
+	if p.currentDesk() != nil {
+		t.Fatal("cancelled tournament should not seat players")
+	}
+
+	// 报名已经结束
+	if err := m.Apply(se.s, &protocol.ApplyForDailyMatchRequest{DailyMatchType: level}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := se.e.lastResponse().(*protocol.TournamentApplyResponse); resp.Code != errorCode {
+		t.Fatalf("apply after start: %+v", resp)
+	}
+}
+
+// 结算失败时不修改比赛状态, 下一次tick重试, 重启后按数据库中的状态重新结算
+func TestTournamentSettleRetry(t *testing.T) {
+	now := time.Date(2026, 10, 16, 19, 30, 0, 0, time.Local)
+	m, ms, _ := setupTournamentTest(t, &now)
+	level := protocol.DailyMatchLevelJunior
+
+	m.tick()
+	tr := m.find(level, "20261016")
+	se, p := newTournamentTestPlayer(t, ms, 72, 1000)
+	if err := m.Apply(se.s, &protocol.ApplyForDailyMatchRequest{DailyMatchType: level}); err != nil {
+		t.Fatal(err)
+	}
+
+	ms.failure = errutil.ErrDBOperation
+	now = now.Add(30 * time.Minute)
+	m.tick()
+	if tr.Status != protocol.TournamentStatusSignUp || tr.settling == nil || p.goldBalance() != 900 {
+		t.Fatalf("status=%d gold=%d", tr.Status, p.goldBalance())
+	}
+	if mt := ms.rows[tr.Id]; mt.Status != protocol.TournamentStatusSignUp {
+		t.Fatalf("row: %+v", mt)
+	}
+
+	// 结算中不能报名
+	other, _ := newTournamentTestPlayer(t, ms, 73, 1000)
+	if err := m.Apply(other.s, &protocol.ApplyForDailyMatchRequest{DailyMatchType: level}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := other.e.lastResponse().(*protocol.TournamentApplyResponse); resp.Code != errorCode {
+		t.Fatalf("apply while settling: %+v", resp)
+	}
+
+	// 重启后读取数据库中的比赛, 开始时间已过, 人数不足重新取消
+	restarted := NewTournamentManager()
+	restarted.store = ms
+	restarted.now = m.now
+	restarted.load()
+	restarted.tick()
+	if rt := restarted.tournaments[tr.Id]; rt.Status != protocol.TournamentStatusSignUp || rt.settling == nil {
+		t.Fatalf("restarted: status=%d", rt.Status)
+	}
+
+	ms.failure = nil
+	m.tick()
+	if tr.Status != protocol.TournamentStatusCancelled || tr.settling != nil || p.goldBalance() != 1000 || ms.gold[72] != 1000 {
+		t.Fatalf("status=%d gold=%d", tr.Status, p.goldBalance())
+	}
+	if mt := ms.rows[tr.Id]; mt.Status != protocol.TournamentStatusCancelled || mt.FinishedAt != now.Unix() {
+		t.Fatalf("row: %+v", mt)
+	}
+}
+
+func TestTournamentResume(t *testing.T) {
+	now := time.Date(2026, 10, 16, 20, 10, 0, 0, time.Local)
+	m, ms, tasks := setupTournamentTest(t, &now)
+
+	// 重启之前第一轮已经有4个玩家完成, 1个玩家的牌桌没有恢复
+	mt := &model.Tournament{Level: protocol.DailyMatchLevelJunior, Day: "20261016", Status: protocol.TournamentStatusRunning, Stage: 1, Fee: 100, Pool: 500}
+	ms.insertTournament(mt)
+	for uid := int64(81); uid <= 85; uid++ {
+		tp := &model.TournamentPlayer{TournamentId: mt.Id, Uid: uid, Name: "tester", Status: protocol.TournamentPlayerStatusPlaying, Stage: 1}
+		if uid == 85 {
+			tp.Stage = 0
+		}
+		ms.seq++
+		tp.Id = ms.seq
+		ms.players[tp.Id] = *tp
+		uid := uid
+		t.Cleanup(func() { defaultManager.offline(uid) })
+	}
+
+	m.load()
+	tr := m.tournaments[mt.Id]
+	if tr == nil || len(tr.desks) != 1 {
+		t.Fatal("unfinished player should be seated again")
+	}
+	runLogicTasks(t, tasks, 1)
+
+	// 不在线的玩家也可以入座, 登录后绑定session
+	p, ok := defaultManager.player(85)
+	if !ok {
+		t.Fatal("offline player should be registered")
+	}
+	d := p.currentDesk()
+	if d == nil || d.tournament.stage != 1 {
+		t.Fatal("offline player should be seated")
+	}
+	d.do(func() {
+		if d.dissolve.isOnline(85) || len(d.players) != 4 {
+			t.Errorf("online=%v players=%d", d.dissolve.isOnline(85), len(d.players))
+		}
+	})
+
+	finishTournamentDesk(t, tasks, d, map[int64]int{85: 6})
+	if tr.Stage != 2 || len(tr.desks) != 1 {
+		t.Fatalf("stage=%d desks=%d", tr.Stage, len(tr.desks))
+	}
+	if tp := ms.player(mt.Id, 85); tp.Score != 6 || tp.Stage != 1 {
+		t.Fatalf("player: %+v", tp)
+	}
+	runLogicTasks(t, tasks, 1)
+	for _, d := range tournamentDesks(tr) {
+		destroyDesk(d)
+		defaultDeskManager.setDesk(d.roomNo, nil)
+	}
+}
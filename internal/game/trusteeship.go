@@ -0,0 +1,169 @@
+package game
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/protocol"
+)
+
+// 托管状态下, 自动操作之前的等待时间, 给客户端留出播放动画的时间
+var trusteeshipDelay = time.Second
+
+// 是否处于托管状态
+func (p *Player) isTrusteeship() bool {
+	return atomic.LoadInt32(&p.trusteeship) == 1
+}
+
+// 进入托管, 并通知牌桌上所有玩家
+func (p *Player) enterTrusteeship() {
+	if !atomic.CompareAndSwapInt32(&p.trusteeship, 0, 1) {
+		return
+	}
+
+	p.logger.Info("玩家操作超时，进入托管")
+	if d := p.desk; d != nil && d.group != nil {
+		d.broadcast(protocol.RouteTrusteeship, &protocol.Trusteeship{Uid: p.Uid()})
+		d.emit(p.Uid(), history.EventTrusteeship, &history.Trusteeship{On: true})
+	}
+}
+
+// 取消托管, 并通知牌桌上所有玩家
+func (p *Player) cancelTrusteeship() {
+	if !atomic.CompareAndSwapInt32(&p.trusteeship, 1, 0) {
+		return
+	}
+
+	p.logger.Info("玩家取消托管")
+	if d := p.desk; d != nil && d.group != nil {
+		d.broadcast(protocol.RouteCancelTrusteeship, &protocol.Trusteeship{Uid: p.Uid()})
+		d.emit(p.Uid(), history.EventTrusteeship, &history.Trusteeship{On: false})
+	}
+}
+
+// 等待玩家操作, 超时后进入托管并使用auto生成的操作代替玩家
+// 等待期间继续处理牌桌事件队列中的任务, 第二个返回值为false时表示房间已经解散
+func (p *Player) waitOperation(auto func() *protocol.OpChoosed) (op *protocol.OpChoosed, ok bool) {
+	// 操作完成后提示失效, 不再接受针对该提示的选择
+	defer func() { p.ctx.LastHint = nil }()
+
+	// 记录最终的选择和来源, 包括过
+	source := history.SourcePlayer
+	defer func() {
+		if ok && op != nil {
+			p.desk.emit(p.Uid(), history.EventChoose, &history.Choose{Op: op, Source: source})
+		}
+	}()
+
+	d := p.desk
+	hint := p.ctx.LastHint
+
+	// 模拟牌局直接决策, 不需要等待
+	if p.decide != nil && hint != nil {
+		return p.simDecide(hint.Ops), true
+	}
+
+	var timeout <-chan time.Time
+	switch {
+	case p.isRobot():
+		timeout = time.After(robotThinkTime)
+	case p.isTrusteeship():
+		timeout = time.After(trusteeshipDelay)
+	case operationTimeout > 0:
+		timeout = time.After(operationTimeout)
+	}
+
+	for {
+		select {
+		case op, ok := <-p.chOperation:
+			if !ok {
+				return nil, false
+			}
+			return op, true
+
+		case task := <-d.chTask:
+			d.run(task)
+			if d.isInterrupted() {
+				return nil, false
+			}
+
+		case <-d.die:
+			return nil, false
+
+		case <-timeout:
+			// 机器人根据提示做出选择
+			if p.isRobot() && hint != nil {
+				source = history.SourceRobot
+				op := p.robotDecide(hint.Ops)
+				p.logger.Debugf("机器人选择: OP=%+v", op)
+				return op, true
+			}
+
+			source = history.SourceTrusteeship
+			p.autoOp = true
+			p.enterTrusteeship()
+			op := auto()
+			p.logger.Debugf("玩家托管自动操作: OP=%+v", op)
+			return op, true
+		}
+	}
+}
+
+// 托管出牌: 优先打出定缺花色的牌, 否则打出最新摸到的牌
+func (p *Player) autoChuPai() *protocol.OpChoosed {
+	op := &protocol.OpChoosed{Type: protocol.OptypeChu, TileID: illegalTile}
+
+	if que := p.queTiles(); len(que) > 0 {
+		op.TileID = que[len(que)-1].Id
+		return op
+	}
+
+	for _, t := range p.onHand {
+		if t.Id == p.ctx.NewDrawingID {
+			op.TileID = t.Id
+			return op
+		}
+	}
+
+	if c := len(p.onHand); c > 0 {
+		op.TileID = p.onHand[c-1].Id
+	}
+	return op
+}
+
+// 托管胡牌: 能胡必胡
+func (p *Player) autoHu(tileID int) func() *protocol.OpChoosed {
+	return func() *protocol.OpChoosed {
+		return &protocol.OpChoosed{Type: protocol.OptypeHu, TileID: tileID}
+	}
+}
+
+// 托管碰杠: 一律选择过
+func (p *Player) autoPass() *protocol.OpChoosed {
+	return &protocol.OpChoosed{Type: protocol.OptypePass, TileID: illegalTile}
+}
+
+// 托管检查手牌: 能自摸则胡, 否则过
+func (p *Player) autoCheckHandTiles(ops []protocol.Op) func() *protocol.OpChoosed {
+	return func() *protocol.OpChoosed {
+		for _, op := range ops {
+			if op.Type == protocol.OptypeHu {
+				return &protocol.OpChoosed{Type: protocol.OptypeHu, TileID: p.ctx.NewDrawingID}
+			}
+		}
+		return p.autoPass()
+	}
+}
+
+// 手牌中定缺花色的麻将
+func (p *Player) queTiles() mahjong.Mahjong {
+	tiles := mahjong.Mahjong{}
+	for _, t := range p.onHand {
+		if t.Suit+1 == p.ctx.Que {
+			tiles = append(tiles, t)
+		}
+	}
+	return tiles
+}
@@ -0,0 +1,93 @@
+package game
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/protocol"
+)
+
+func TestTrusteeshipAuto(t *testing.T) {
+	p := newValidateTestPlayer()
+	p.ctx.NewDrawingID = 40
+
+	// 优先打出定缺花色的牌, 没有定缺的牌时打出最新摸到的牌
+	if op := p.autoChuPai(); op.Type != protocol.OptypeChu || op.TileID != 72 {
+		t.Fatalf("auto chu: %+v", op)
+	}
+	p.onHand = mahjong.FromID(mahjong.Tiles{0, 4, 8, 36, 40})
+	if op := p.autoChuPai(); op.TileID != 40 {
+		t.Fatalf("auto chu: %+v", op)
+	}
+
+	// 能胡必胡, 碰杠一律过
+	if op := p.autoHu(36)(); op.Type != protocol.OptypeHu || op.TileID != 36 {
+		t.Fatalf("auto hu: %+v", op)
+	}
+	if op := p.autoCheckHandTiles([]protocol.Op{{Type: protocol.OptypeGang}, {Type: protocol.OptypeHu}})(); op.Type != protocol.OptypeHu || op.TileID != 40 {
+		t.Fatalf("auto check: %+v", op)
+	}
+	if op := p.autoCheckHandTiles([]protocol.Op{{Type: protocol.OptypeGang}})(); op.Type != protocol.OptypePass {
+		t.Fatalf("auto check: %+v", op)
+	}
+}
+
+// 操作超时后进入托管并自动出牌, 玩家主动操作后取消托管
+func TestDeskLoopTrusteeship(t *testing.T) {
+	setupLoopTest(t)
+	_, s, e, p := newPlayingDesk(t, "100020", 4)
+
+	waitFor(t, "进入托管", func() bool { return e.pushCount(protocol.RouteTrusteeship) > 0 })
+	if !p.isTrusteeship() {
+		t.Fatal("player should be in trusteeship after timeout")
+	}
+	waitFor(t, "托管出牌", func() bool {
+		for _, do := range e.received(protocol.RouteTypeDo) {
+			if op := do.v.(*protocol.OpTypeDo); op.OpType == protocol.OptypeChu && len(op.Uid) > 0 && op.Uid[0] == p.Uid() {
+				return true
+			}
+		}
+		return false
+	})
+
+	// 托管中没有等待中的提示时, 玩家的任何选择都取消托管
+	if err := defaultDeskManager.OpChoose(s, &protocol.OpChooseRequest{OpType: protocol.OptypePass, Index: -1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "取消托管", func() bool { return e.pushCount(protocol.RouteCancelTrusteeship) > 0 })
+}
+
+// 托管或者超时自动操作之后迟到的选择不计入非法操作
+func TestTrusteeshipLateChoose(t *testing.T) {
+	setupLoopTest(t)
+	p := newValidateTestPlayer(protocol.Op{Type: protocol.OptypeChu})
+	s, e, _ := newLoopTestSession(t, 21)
+	op := &protocol.OpChoosed{Type: protocol.OptypeChu, TileID: 72}
+
+	p.ctx.LastHint = nil
+	atomic.StoreInt32(&p.trusteeship, 1)
+	p.choose(s, op)
+	if p.isTrusteeship() || p.illegalOps != 0 || e.pushCount(protocol.RouteOpChooseError) != 1 {
+		t.Fatalf("trusteeship=%v illegal=%d", p.isTrusteeship(), p.illegalOps)
+	}
+
+	p.autoOp = true
+	p.choose(s, op)
+	if p.illegalOps != 0 {
+		t.Fatalf("illegal=%d after auto op", p.illegalOps)
+	}
+
+	// 没有托管也没有超时时计入非法操作
+	p.autoOp = false
+	p.choose(s, op)
+	if p.illegalOps != 1 {
+		t.Fatalf("illegal=%d", p.illegalOps)
+	}
+
+	p.ctx.LastHint = &protocol.Hint{Uid: p.Uid(), Ops: []protocol.Op{{Type: protocol.OptypeChu}}}
+	p.choose(s, op)
+	if got := <-p.chOperation; got != op || p.ctx.LastHint != nil {
+		t.Fatalf("op=%+v", got)
+	}
+}
@@ -0,0 +1,148 @@
+package game
+
+import (
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// 非法操作次数达到该值后, 每次非法操作都记录作弊嫌疑日志
+const illegalOpThreshold = 3
+
+// 校验玩家的选择是否与最后一次提示一致
+func (p *Player) validateOp(op *protocol.OpChoosed) error {
+	d := p.desk
+	if d == nil || d.status() != constant.DeskStatusPlaying {
+		return errutil.ErrIllegalDeskStatus
+	}
+
+	hint := p.ctx.LastHint
+	if hint == nil || hint.Uid != p.Uid() {
+		return errutil.ErrNoOutstandingHint
+	}
+
+	// 操作类型必须在提示中
+	var candidates []protocol.Op
+	for _, h := range hint.Ops {
+		if h.Type == op.Type {
+			candidates = append(candidates, h)
+		}
+	}
+	if len(candidates) == 0 {
+		return errutil.ErrIllegalOperation
+	}
+
+	switch op.Type {
+	case protocol.OptypePass:
+		return nil
+
+	case protocol.OptypeChu:
+		return p.validateChuPai(op.TileID)
+
+	case protocol.OptypePeng, protocol.OptypeGang, protocol.OptypeHu:
+		if op.TileID < 0 || op.TileID > mahjong.MaxFlowerID {
+			return errutil.ErrIllegalOperation
+		}
+
+		// 碰杠胡的牌必须是提示中的同一张牌, 相同花色点数的其他牌也不行
+		for _, c := range candidates {
+			for _, id := range c.TileIDs {
+				if id == op.TileID {
+					return nil
+				}
+			}
+		}
+		return errutil.ErrIllegalOperation
+
+	case protocol.OptypeChi:
+		if op.TileID < 0 || op.TileID > mahjong.MaxFlowerID {
+			return errutil.ErrIllegalOperation
+		}
+
+		// 吃牌选择的是顺子的第一张牌
+		index := mahjong.IndexFromID(op.TileID)
+		for _, c := range candidates {
+			if len(c.TileIDs) > 0 && mahjong.IndexFromID(c.TileIDs[0]) == index {
+				return nil
+			}
+		}
+		return errutil.ErrIllegalOperation
+	}
+
+	return errutil.ErrIllegalOperation
+}
+
+// 处理玩家的选择, 在牌桌协程中调用
+func (p *Player) choose(s *session.Session, op *protocol.OpChoosed) {
+	// 玩家主动操作, 取消托管. 托管时等待提示的时间很短, 任何选择都取消托管
+	late := p.isTrusteeship() || p.autoOp
+	p.cancelTrusteeship()
+
+	if err := p.validateOp(op); err != nil {
+		// 托管或者超时自动操作之后迟到的选择不计入非法操作
+		if late && err == errutil.ErrNoOutstandingHint {
+			p.logger.Debugf("自动操作之后收到玩家选择: OP=%+v", op)
+		} else {
+			p.recordIllegalOp(op, err)
+		}
+		s.Push(protocol.RouteOpChooseError, &protocol.OpChooseError{
+			Code:  errutil.Code(err),
+			Error: err.Error(),
+			Hint:  p.ctx.LastHint,
+		})
+		return
+	}
+
+	// 提示已经被响应, 重复提交的选择不再进入牌桌逻辑
+	p.ctx.LastHint = nil
+
+	select {
+	case p.chOperation <- op:
+	default:
+		p.logger.Warnf("玩家还有未处理的操作, 丢弃本次选择: OP=%+v", op)
+	}
+}
+
+// 出牌必须是手牌中的牌, 并且有定缺花色的牌时必须先打缺
+func (p *Player) validateChuPai(tid int) error {
+	var tile *mahjong.Tile
+	for _, t := range p.onHand {
+		if t.Id == tid {
+			tile = t
+			break
+		}
+	}
+	if tile == nil {
+		return errutil.ErrTileNotInHand
+	}
+
+	if que := p.queTiles(); len(que) > 0 && tile.Suit+1 != p.ctx.Que {
+		return errutil.ErrMustDiscardQue
+	}
+	return nil
+}
+
+// 记录玩家的非法操作, 多次非法操作的玩家记录作弊嫌疑
+func (p *Player) recordIllegalOp(op *protocol.OpChoosed, err error) {
+	p.illegalOps++
+	p.logger.Warnf("玩家选择不合法: OP=%+v Error=%v 次数=%d", op, err, p.illegalOps)
+	if d := p.desk; d != nil {
+		d.emit(p.Uid(), history.EventIllegal, &history.Illegal{Op: op, Error: err.Error()})
+	}
+
+	if p.illegalOps < illegalOpThreshold {
+		return
+	}
+
+	p.logger.WithFields(log.Fields{
+		"anticheat": true,
+		"count":     p.illegalOps,
+		"ip":        p.ip,
+	}).Errorf("玩家多次提交非法操作, 疑似作弊: OP=%+v Error=%v 提示=%v 手牌=%v 碰杠=%v",
+		op, err, p.ctx.LastHint, p.handTiles(), p.pgTiles())
+}
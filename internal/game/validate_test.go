@@ -0,0 +1,101 @@
+package game
+
+import (
+	"testing"
+
+	"go-mahjong-server/internal/game/mahjong"
+	"go-mahjong-server/pkg/constant"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/protocol"
+)
+
+func newValidateTestPlayer(hint ...protocol.Op) *Player {
+	d := NewDesk("000000", &protocol.DeskOptions{Mode: ModeFours, MaxRound: 1, MaxFan: 3}, -1)
+	d.setStatus(constant.DeskStatusPlaying)
+
+	p := newRobot()
+	p.robot = false
+	p.setDesk(d, 0)
+	d.players = append(d.players, p)
+
+	// 条: 0-35, 筒: 36-71, 万: 72-107
+	p.onHand = mahjong.FromID(mahjong.Tiles{0, 4, 8, 36, 40, 72})
+	p.ctx.Que = 3 // 缺万
+	p.ctx.LastHint = &protocol.Hint{Uid: p.Uid(), Ops: hint}
+	return p
+}
+
+func TestValidateChuPai(t *testing.T) {
+	p := newValidateTestPlayer(protocol.Op{Type: protocol.OptypeChu})
+
+	cases := []struct {
+		op  *protocol.OpChoosed
+		err error
+	}{
+		{&protocol.OpChoosed{Type: protocol.OptypeChu, TileID: 72}, nil},
+		{&protocol.OpChoosed{Type: protocol.OptypeChu, TileID: 0}, errutil.ErrMustDiscardQue},
+		{&protocol.OpChoosed{Type: protocol.OptypeChu, TileID: 100}, errutil.ErrTileNotInHand},
+		{&protocol.OpChoosed{Type: protocol.OptypePeng, TileID: 0}, errutil.ErrIllegalOperation},
+		{&protocol.OpChoosed{Type: protocol.OptypePass}, errutil.ErrIllegalOperation},
+	}
+
+	for _, c := range cases {
+		if err := p.validateOp(c.op); err != c.err {
+			t.Fatalf("op=%+v expect=%v got=%v", c.op, c.err, err)
+		}
+	}
+}
+
+func TestValidatePengGang(t *testing.T) {
+	p := newValidateTestPlayer(
+		protocol.Op{Type: protocol.OptypePass},
+		protocol.Op{Type: protocol.OptypePeng, TileIDs: []int{37}},
+	)
+
+	cases := []struct {
+		op  *protocol.OpChoosed
+		err error
+	}{
+		{&protocol.OpChoosed{Type: protocol.OptypePass, TileID: -1}, nil},
+		{&protocol.OpChoosed{Type: protocol.OptypePeng, TileID: 37}, nil},
+		{&protocol.OpChoosed{Type: protocol.OptypePeng, TileID: 38}, errutil.ErrIllegalOperation},
+		{&protocol.OpChoosed{Type: protocol.OptypePeng, TileID: 4}, errutil.ErrIllegalOperation},
+		{&protocol.OpChoosed{Type: protocol.OptypeGang, TileID: 37}, errutil.ErrIllegalOperation},
+		{&protocol.OpChoosed{Type: protocol.OptypePeng, TileID: 1000}, errutil.ErrIllegalOperation},
+	}
+
+	for _, c := range cases {
+		if err := p.validateOp(c.op); err != c.err {
+			t.Fatalf("op=%+v expect=%v got=%v", c.op, c.err, err)
+		}
+	}
+}
+
+func TestValidateWithoutHint(t *testing.T) {
+	p := newValidateTestPlayer(protocol.Op{Type: protocol.OptypeChu})
+	op := &protocol.OpChoosed{Type: protocol.OptypeChu, TileID: 72}
+
+	p.ctx.LastHint = nil
+	if err := p.validateOp(op); err != errutil.ErrNoOutstandingHint {
+		t.Fatalf("expect %v got %v", errutil.ErrNoOutstandingHint, err)
+	}
+
+	p.desk.setStatus(constant.DeskStatusRoundOver)
+	if err := p.validateOp(op); err != errutil.ErrIllegalDeskStatus {
+		t.Fatalf("expect %v got %v", errutil.ErrIllegalDeskStatus, err)
+	}
+}
+
+func TestValidateHu(t *testing.T) {
+	p := newValidateTestPlayer(
+		protocol.Op{Type: protocol.OptypePass},
+		protocol.Op{Type: protocol.OptypeHu, TileIDs: []int{40}},
+	)
+
+	if err := p.validateOp(&protocol.OpChoosed{Type: protocol.OptypeHu, TileID: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.validateOp(&protocol.OpChoosed{Type: protocol.OptypeHu, TileID: 41}); err != errutil.ErrIllegalOperation {
+		t.Fatalf("expect %v got %v", errutil.ErrIllegalOperation, err)
+	}
+}
@@ -0,0 +1,146 @@
+package game
+
+import (
+	"go-mahjong-server/protocol"
+
+	"github.com/lonng/nano/session"
+)
+
+// 按接收者过滤的数据视图: 每个玩家只能看到自己的暗牌, 其他玩家只下发数量, 观战者使用uid为0的视图,
+// 看不到任何暗牌. 快照中依然保存完整的数据, 用于回放
+
+// 向牌桌上的玩家广播公开的事件, 同时延迟推送给观战者
+func (d *Desk) broadcast(route string, v interface{}) error {
+	d.observers.publish(route, v)
+	return d.group.Broadcast(route, v)
+}
+
+// 向牌桌上的每个玩家单独推送各自可见的数据
+func (d *Desk) broadcastView(route string, view func(uid int64) interface{}) {
+	for _, p := range d.players {
+		if p.isRobot() {
+			continue
+		}
+
+		uid := p.Uid()
+		err := d.group.Multicast(route, view(uid), func(s *session.Session) bool {
+			return s.UID() == uid
+		})
+		if err != nil {
+			d.logger.Errorf("推送玩家数据视图失败, Route=%s UID=%d Error=%v", route, uid, err)
+		}
+	}
+
+	d.observers.publish(route, view(0))
+}
+
+// 断牌数据: 只包含自己的手牌, 其他玩家只有数量
+func duanPaiView(duan *protocol.DuanPai, uid int64) *protocol.DuanPai {
+	view := &protocol.DuanPai{
+		MarkerID:    duan.MarkerID,
+		Dice1:       duan.Dice1,
+		Dice2:       duan.Dice2,
+		AccountInfo: make([]protocol.DuanPaiInfo, len(duan.AccountInfo)),
+	}
+
+	for i, info := range duan.AccountInfo {
+		view.AccountInfo[i] = protocol.DuanPaiInfo{
+			Uid:    info.Uid,
+			OnHand: []int{},
+			Count:  len(info.OnHand),
+		}
+		if info.Uid == uid {
+			view.AccountInfo[i].OnHand = info.OnHand
+		}
+	}
+
+	return view
+}
+
+// 换三张结果: 只包含自己换出和换入的牌
+func huanSanZhangView(r *protocol.HuanSanZhangResult, uid int64) *protocol.HuanSanZhangResult {
+	view := &protocol.HuanSanZhangResult{
+		Dice1:     r.Dice1,
+		Dice2:     r.Dice2,
+		Direction: r.Direction,
+		Players:   make([]protocol.HuanSanZhangInfo, len(r.Players)),
+	}
+
+	for i, info := range r.Players {
+		view.Players[i] = protocol.HuanSanZhangInfo{Uid: info.Uid, Out: []int{}, In: []int{}}
+		if info.Uid == uid {
+			view.Players[i] = info
+		}
+	}
+
+	return view
+}
+
+// 摸牌数据: 其他玩家摸到的牌不可见
+func moPaiView(mo *protocol.MoPai, uid int64) *protocol.MoPai {
+	if mo.AccountID == uid {
+		return mo
+	}
+
+	hidden := make([]int, len(mo.TileIDs))
+	for i := range hidden {
+		hidden[i] = protocol.HiddenTileID
+	}
+	return &protocol.MoPai{AccountID: mo.AccountID, TileIDs: hidden}
+}
+
+// 同步牌桌时的玩家数据: 隐藏其他玩家的手牌与最新摸到的牌
+func deskPlayerDataView(data protocol.DeskPlayerData, uid int64) protocol.DeskPlayerData {
+	data.HandCount = len(data.HandTiles)
+	if data.Uid == uid {
+		return data
+	}
+
+	data.HandTiles = []int{}
+	data.LatestTile = protocol.HiddenTileID
+	return data
+}
+
+// 同步牌桌时的牌桌数据, 只包含uid可见的手牌, 观战者使用uid为0
+func (d *Desk) syncDeskView(uid int64) *protocol.SyncDesk {
+	data := &protocol.SyncDesk{
+		Status:    d.status(),
+		Players:   []protocol.DeskPlayerData{},
+		ScoreInfo: []protocol.ScoreInfo{},
+	}
+
+	for i, player := range d.players {
+		puid := player.Uid()
+		if i == d.bankerTurn {
+			data.MarkerUid = puid
+		}
+		if i == d.curTurn {
+			data.LastMoPaiUid = puid
+		}
+		// 有可能已经有玩家和牌
+		stats := d.roundOverTilesForPlayer(player)
+		playerData := protocol.DeskPlayerData{
+			Uid:        puid,
+			HandTiles:  stats.Tiles,
+			PGTiles:    player.pgTiles().Ids(),
+			ChuTiles:   player.chuTiles().Ids(),
+			LatestTile: player.ctx.NewDrawingID,
+			HuPai:      player.ctx.WinningID,
+			HuTiles:    player.huTiles,
+			HuType:     player.ctx.ResultType,
+			IsHu:       d.wonPlayers[puid],
+			Que:        player.ctx.Que,
+			Score:      player.score,
+			IsTrustee:  player.isTrusteeship(),
+		}
+		data.Players = append(data.Players, deskPlayerDataView(playerData, uid))
+		data.ScoreInfo = append(data.ScoreInfo, protocol.ScoreInfo{Uid: puid, Score: player.score})
+	}
+
+	data.RestCount = d.remainTileCount()
+	data.Dice1 = d.dice.dice1
+	data.Dice2 = d.dice.dice2
+	data.LastTileId = d.lastTileId
+	data.LastChuPaiUid = d.lastChuPaiUid
+	return data
+}
@@ -0,0 +1,55 @@
+package game
+
+import (
+	"testing"
+
+	"go-mahjong-server/protocol"
+)
+
+func TestDuanPaiView(t *testing.T) {
+	duan := &protocol.DuanPai{
+		MarkerID: 1,
+		AccountInfo: []protocol.DuanPaiInfo{
+			{Uid: 1, OnHand: []int{0, 1, 2}},
+			{Uid: 2, OnHand: []int{3, 4}},
+		},
+	}
+
+	view := duanPaiView(duan, 2)
+	if len(view.AccountInfo[0].OnHand) != 0 || view.AccountInfo[0].Count != 3 {
+		t.Fatalf("other player's hand leaked: %+v", view.AccountInfo[0])
+	}
+	if len(view.AccountInfo[1].OnHand) != 2 || view.AccountInfo[1].Count != 2 {
+		t.Fatalf("own hand missing: %+v", view.AccountInfo[1])
+	}
+
+	// 快照中的原始数据不能被修改
+	if len(duan.AccountInfo[0].OnHand) != 3 {
+		t.Fatalf("original data modified: %+v", duan.AccountInfo[0])
+	}
+}
+
+func TestMoPaiView(t *testing.T) {
+	mo := &protocol.MoPai{AccountID: 1, TileIDs: []int{10}}
+
+	if v := moPaiView(mo, 1); v.TileIDs[0] != 10 {
+		t.Fatalf("own tile hidden: %+v", v)
+	}
+	if v := moPaiView(mo, 2); v.TileIDs[0] != protocol.HiddenTileID {
+		t.Fatalf("other player's tile leaked: %+v", v)
+	}
+}
+
+func TestDeskPlayerDataView(t *testing.T) {
+	data := protocol.DeskPlayerData{Uid: 1, HandTiles: []int{1, 2, 3}, LatestTile: 3}
+
+	own := deskPlayerDataView(data, 1)
+	if len(own.HandTiles) != 3 || own.HandCount != 3 || own.LatestTile != 3 {
+		t.Fatalf("own data wrong: %+v", own)
+	}
+
+	other := deskPlayerDataView(data, 2)
+	if len(other.HandTiles) != 0 || other.HandCount != 3 || other.LatestTile != protocol.HiddenTileID {
+		t.Fatalf("other player's data leaked: %+v", other)
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go-mahjong-server/internal/game/history"
+	"go-mahjong-server/internal/game/history/mjlog"
+	"go-mahjong-server/pkg/errutil"
+	"go-mahjong-server/pkg/whitelist"
+	"go-mahjong-server/protocol"
+
+	"github.com/gorilla/mux"
+	"github.com/lonng/nex"
+)
+
+// MakeHistoryService 客服查询战绩, 回放, 事件日志和导出牌谱, 只允许白名单中的地址访问
+func MakeHistoryService() http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/v1/history/list", nex.Handler(historyListHandler)).Methods("POST")
+	router.Handle("/v1/history/replay", nex.Handler(replayHandler)).Methods("POST")
+	router.Handle("/v1/history/code", nex.Handler(replayCodeHandler)).Methods("POST")
+	router.Handle("/v1/history/events", nex.Handler(historyEventsHandler)).Methods("POST")
+	router.HandleFunc("/v1/history/export", exportHandler).Methods("GET")
+	return staffOnly(router)
+}
+
+func staffOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !whitelist.VerifyIP(ip(r.RemoteAddr)) {
+			logger.Warnf("非白名单地址访问战绩接口: %s", r.RemoteAddr)
+			http.Error(w, errutil.ErrPermissionDenied.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func historyListHandler(req *protocol.HistoryLiteListRequest) (*protocol.HistoryLiteListResponse, error) {
+	list, total, err := history.List(req.DeskID, req.Offset, req.Count)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.HistoryLiteListResponse{Total: int64(total), Data: list}, nil
+}
+
+func replayHandler(req *protocol.HistoryByIDRequest) (*protocol.ReplayResponse, error) {
+	_, r, err := history.Load(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.ReplayResponse{Data: r}, nil
+}
+
+func replayCodeHandler(req *protocol.ReplayCodeRequest) (*protocol.ReplayResponse, error) {
+	_, r, err := history.LoadByCode(req.Code)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.ReplayResponse{Data: r}, nil
+}
+
+// 完整的事件日志包含其他玩家的手牌和提示, 只用于客服处理纠纷
+func historyEventsHandler(req *protocol.HistoryByIDRequest) (*protocol.HistoryEventsResponse, error) {
+	events, err := history.LoadEvents(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.HistoryEventsResponse{Data: events}, nil
+}
+
+// 导出牌谱或者每局分数的汇总, 参数: id(历史记录ID)或者desk_id(牌桌ID), format(json或者csv)
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	deskID, _ := strconv.ParseInt(r.FormValue("desk_id"), 10, 64)
+	if id <= 0 && deskID <= 0 {
+		http.Error(w, errutil.ErrIllegalParameter.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := mjlog.Query(id, deskID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// 先写入缓冲区, 导出失败时可以返回错误
+	output := r.FormValue("format")
+	buf := &bytes.Buffer{}
+	if err := mjlog.Write(buf, output, list); err != nil {
+		logger.Warnf("导出牌谱失败: ID=%d, DeskID=%d, Error=%v", id, deskID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if output == mjlog.OutputCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=history-%d-%d.csv", deskID, id))
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.Write(buf.Bytes())
+}
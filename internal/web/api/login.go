@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"go-mahjong-server/db"
+	"go-mahjong-server/pkg/token"
 	"go-mahjong-server/protocol"
 
 	"go-mahjong-server/db/model"
@@ -132,8 +133,8 @@ func guestLoginHandler(r *http.Request, data *protocol.LoginRequest) (*protocol.
 
 	resp := &protocol.LoginResponse{
 		Uid:      user.Id,
-		HeadUrl:  "http://wx.qlogo.cn/mmopen/s962LEwpLxhQSOnarDnceXjSxVGaibMRsvRM4EIWic0U6fQdkpqz4Vr8XS8D81QKfyYuwjwm2M2ibsFY8mia8ic51ww/0",
-		Sex:      1,
+		HeadUrl:  protocol.DefaultHeadUrl,
+		Sex:      protocol.SexTypeMale,
 		IP:       host,
 		Port:     port,
 		FangKa:   user.Coin,
@@ -145,6 +146,9 @@ func guestLoginHandler(r *http.Request, data *protocol.LoginRequest) (*protocol.
 	}
 	resp.Name = fmt.Sprintf("G%d", resp.Uid)
 
+	// 签发登录游戏服务器的token
+	resp.Token, resp.ExpireAt = token.Issue(user.Id)
+
 	// 插入登陆记录
 	device := protocol.Device{
 		IP:     ip(r.RemoteAddr),
@@ -4,13 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
 	"go-mahjong-server/db"
 	"go-mahjong-server/internal/web/api"
 	"go-mahjong-server/pkg/algoutil"
+	"go-mahjong-server/pkg/cluster"
 	"go-mahjong-server/pkg/whitelist"
 	"go-mahjong-server/protocol"
 
@@ -21,9 +20,13 @@ import (
 
 // type Closer func()
 
-var logger = log.WithField("component", "http")
+var (
+	logger = log.WithField("component", "http")
+	server *http.Server
+)
 
-func dbStartup() func() {
+// StartupDatabase 连接数据库, 返回关闭数据库的函数
+func StartupDatabase() func() {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?%s",
 		viper.GetString("database.username"),
 		viper.GetString("database.password"),
@@ -70,17 +73,20 @@ func startupService() http.Handler {
 
 	nex.Before(logRequest)
 	mux.Handle("/v1/user/", api.MakeLoginService())
+	mux.Handle("/v1/history/", api.MakeHistoryService())
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(webDir))))
 	mux.Handle("/ping", nex.Handler(pongHandler))
 
+	// 集群节点之间的内部接口
+	if cluster.Enabled() {
+		mux.Handle(cluster.PathPrefix, cluster.Handler())
+	}
+
 	return algoutil.AccessControl(algoutil.OptionControl(mux))
 }
 
+// Startup 启动web服务器, 不阻塞
 func Startup() {
-	// setup database
-	closer := dbStartup()
-	defer closer()
-
 	// enable white list
 	enableWhiteList()
 
@@ -92,21 +98,30 @@ func Startup() {
 	)
 
 	logger.Infof("Web service addr: %s(enable ssl: %v)", addr, enableSSL)
+	server = &http.Server{Addr: addr, Handler: startupService()}
 	go func() {
 		// http service
-		mux := startupService()
+		var err error
 		if enableSSL {
-			log.Fatal(http.ListenAndServeTLS(addr, cert, key, mux))
+			err = server.ListenAndServeTLS(cert, key)
 		} else {
-			log.Fatal(http.ListenAndServe(addr, mux))
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
 	}()
+}
+
+// Shutdown 停止接收新的请求, 等待正在处理的请求完成
+func Shutdown(timeout time.Duration) {
+	if server == nil {
+		return
+	}
 
-	sg := make(chan os.Signal)
-	signal.Notify(sg, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL)
-	// stop server
-	select {
-	case s := <-sg:
-		log.Infof("got signal: %s", s.String())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("关闭web服务器失败: %v", err)
 	}
 }
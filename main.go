@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"os"
 	"runtime/pprof"
-	"sync"
 	"time"
 
 	"go-mahjong-server/internal/game"
 	"go-mahjong-server/internal/web"
+	"go-mahjong-server/pkg/async"
+	"go-mahjong-server/pkg/cluster"
+	"go-mahjong-server/pkg/room"
+	"go-mahjong-server/pkg/token"
 
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
@@ -33,25 +36,37 @@ func main() {
 			Value: "./configs/config.toml",
 			Usage: "load configuration from `FILE`",
 		},
+		cli.IntFlag{
+			Name:  "node, n",
+			Usage: "cluster node id, overrides cluster.node in the configuration",
+		},
 		cli.BoolFlag{
 			Name:  "cpuprofile",
 			Usage: "enable cpu profile",
 		},
 	}
 
+	app.Commands = []cli.Command{exportCommand}
+
 	app.Action = serve
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func serve(c *cli.Context) error {
+func loadConfig(path string) {
 	viper.SetConfigType("toml")
-	viper.SetConfigFile(c.String("config"))
+	viper.SetConfigFile(path)
 	viper.ReadInConfig()
 
 	log.SetFormatter(&log.TextFormatter{DisableColors: true})
 	if viper.GetBool("core.debug") {
 		log.SetLevel(log.DebugLevel)
 	}
+}
+
+func serve(c *cli.Context) error {
+	loadConfig(c.String("config"))
 
 	if c.Bool("cpuprofile") {
 		filename := fmt.Sprintf("cpuprofile-%d.pprof", time.Now().Unix())
@@ -63,12 +78,34 @@ func serve(c *cli.Context) error {
 		defer pprof.StopCPUProfile()
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	// web服务器签发token, 游戏服务器校验token, 需要在启动服务之前设置
+	token.Setup(viper.GetString("token.secret"), time.Duration(viper.GetInt("token.expires"))*time.Second)
+
+	// 集群模式下使用节点配置的地址, 同一台机器上可以使用--node启动多个节点
+	node := viper.GetInt("cluster.node")
+	if c.IsSet("node") {
+		node = c.Int("node")
+	}
+	if err := cluster.Setup(node, viper.GetStringSlice("cluster.nodes"), viper.GetString("cluster.secret"), viper.GetString("token.secret")); err != nil {
+		return err
+	}
+	if n := cluster.Self(); n != nil {
+		room.SetNode(n.ID)
+		viper.Set("game-server.host", n.Host())
+		viper.Set("game-server.port", n.Port())
+		viper.Set("webserver.addr", n.Web)
+		log.Infof("集群节点: %d, 游戏服务器: %s, web服务器: %s", n.ID, n.Game, n.Web)
+	}
 
-	go func() { defer wg.Done(); game.Startup() }() // game server
-	go func() { defer wg.Done(); web.Startup() }()  // web server
+	closer := web.StartupDatabase()
+	web.Startup()  // web server
+	game.Startup() // game server, 收到退出信号后排空牌桌再返回
 
-	wg.Wait()
+	// 停止web服务, 等待异步任务和数据库队列写完后关闭数据库
+	web.Shutdown(10 * time.Second)
+	if !async.Wait(30 * time.Second) {
+		log.Warn("等待异步任务超时")
+	}
+	closer()
 	return nil
 }
@@ -1,6 +1,13 @@
 package async
 
-import "github.com/sirupsen/logrus"
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var wg sync.WaitGroup
 
 func pcall(fn func()) {
 	defer func() {
@@ -13,5 +20,25 @@ func pcall(fn func()) {
 }
 
 func Run(fn func()) {
-	go pcall(fn)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pcall(fn)
+	}()
+}
+
+// Wait 等待所有异步任务完成, 超时返回false
+func Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
@@ -0,0 +1,222 @@
+//Package cluster 多个游戏服务器节点组成集群
+//
+//每个节点同时运行web服务器和游戏服务器, 房间号的第一位是创建房间的节点编号,
+//加入房间时如果房间不在当前节点, 客户端连接房间所在的节点后重新请求.
+//加入/重新加入/观战不在节点之间转发: nano的会话只存在于客户端连接的节点, 转发需要网关代理整个会话,
+//因此返回房间所在节点的地址(YXDeskRedirect), 由客户端重新连接.
+//踢人, 充值通知和系统广播通过web服务器的内部接口发送到所有节点, 内部接口使用集群密钥校验
+package cluster
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-mahjong-server/pkg/errutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PathPrefix   = "/cluster/" // 内部接口路径前缀
+	secretHeader = "X-Cluster-Secret"
+	maxNodeID    = 9
+)
+
+//Node 集群中的一个节点
+type Node struct {
+	ID   int
+	Game string // 游戏服务器地址, 客户端连接
+	Web  string // web服务器地址, 客户端登录和节点之间的内部调用
+}
+
+//Host 游戏服务器的主机地址
+func (n *Node) Host() string {
+	host, _, _ := net.SplitHostPort(n.Game)
+	return host
+}
+
+//Port 游戏服务器的端口
+func (n *Node) Port() int {
+	_, port, _ := net.SplitHostPort(n.Game)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+var (
+	self   int
+	nodes  = map[int]*Node{}
+	secret string
+	client = &http.Client{Timeout: 5 * time.Second}
+
+	mu       sync.RWMutex
+	handlers = map[string]func(data []byte) error{}
+)
+
+//Setup 设置当前节点编号和所有节点, id为0时为单机模式
+//节点配置格式: 编号/游戏服务器地址/web服务器地址, 例如 1/192.168.3.141:33251/192.168.3.141:12307
+//集群模式下必须配置集群密钥和token密钥, 所有节点使用相同的token密钥才能校验其他节点签发的token
+func Setup(id int, cfg []string, key, tokenKey string) error {
+	all := map[int]*Node{}
+	for _, c := range cfg {
+		parts := strings.Split(c, "/")
+		if len(parts) != 3 {
+			return fmt.Errorf("无效的节点配置: %s", c)
+		}
+		nid, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || nid < 1 || nid > maxNodeID {
+			return fmt.Errorf("节点编号必须是1-%d: %s", maxNodeID, c)
+		}
+		if _, ok := all[nid]; ok {
+			return fmt.Errorf("重复的节点编号: %d", nid)
+		}
+		n := &Node{ID: nid, Game: strings.TrimSpace(parts[1]), Web: strings.TrimSpace(parts[2])}
+		if _, _, err := net.SplitHostPort(n.Game); err != nil {
+			return fmt.Errorf("无效的游戏服务器地址: %s", c)
+		}
+		all[nid] = n
+	}
+
+	if id != 0 {
+		if _, ok := all[id]; !ok {
+			return fmt.Errorf("节点%d不在节点列表中", id)
+		}
+		if key == "" {
+			return errors.New("集群模式必须配置集群密钥(cluster.secret)")
+		}
+		if tokenKey == "" {
+			return errors.New("集群模式必须配置token密钥(token.secret), 所有节点使用相同的密钥")
+		}
+	}
+
+	self, nodes, secret = id, all, key
+	return nil
+}
+
+//Enabled 是否是集群模式
+func Enabled() bool {
+	return self != 0
+}
+
+//Self 当前节点, 单机模式返回nil
+func Self() *Node {
+	return nodes[self]
+}
+
+//Lookup 查找节点
+func Lookup(id int) (*Node, bool) {
+	n, ok := nodes[id]
+	return n, ok
+}
+
+//Nodes 所有节点, 按编号排序
+func Nodes() []*Node {
+	result := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		result = append(result, n)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+//Handle 注册内部接口, 其他节点调用Broadcast时执行
+func Handle(route string, fn func(data []byte) error) {
+	mu.Lock()
+	handlers[route] = fn
+	mu.Unlock()
+}
+
+//Handler 内部接口的http处理器, 挂载在web服务器的PathPrefix下
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || secret == "" ||
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(secret)) != 1 {
+			http.Error(w, errutil.ErrPermissionDenied.Error(), http.StatusForbidden)
+			return
+		}
+
+		mu.RLock()
+		fn, ok := handlers[strings.TrimPrefix(r.URL.Path, PathPrefix)]
+		mu.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fn(data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+//Call 调用指定节点的内部接口
+func Call(n *Node, route string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+n.Web+PathPrefix+route, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(secretHeader, secret)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("节点%d: %s %s", n.ID, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+//Broadcast 并发调用除当前节点以外所有节点的内部接口, 返回第一个错误
+func Broadcast(route string, v interface{}) error {
+	var (
+		wg    sync.WaitGroup
+		errMu sync.Mutex
+		first error
+	)
+	for _, n := range nodes {
+		if n.ID == self {
+			continue
+		}
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			if err := Call(n, route, v); err != nil {
+				log.Errorf("集群调用失败: 节点=%d, 接口=%s, Error=%v", n.ID, route, err)
+				errMu.Lock()
+				if first == nil {
+					first = err
+				}
+				errMu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	return first
+}
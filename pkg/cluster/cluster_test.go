@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	defer Setup(0, nil, "", "")
+
+	cases := []struct {
+		id  int
+		cfg []string
+		ok  bool
+	}{
+		{0, nil, true},
+		{1, []string{"1/127.0.0.1:33251/127.0.0.1:12307", "2/127.0.0.1:33252/127.0.0.1:12308"}, true},
+		{3, []string{"1/127.0.0.1:33251/127.0.0.1:12307"}, false},
+		{1, []string{"1/127.0.0.1:33251"}, false},
+		{10, []string{"10/127.0.0.1:33251/127.0.0.1:12307"}, false},
+		{1, []string{"1/127.0.0.1:33251/127.0.0.1:12307", "1/127.0.0.1:33252/127.0.0.1:12308"}, false},
+		{1, []string{"1/127.0.0.1/127.0.0.1:12307"}, false},
+	}
+	for i, c := range cases {
+		if err := Setup(c.id, c.cfg, "secret", "token"); (err == nil) != c.ok {
+			t.Fatalf("case %d: err=%v, expected ok=%v", i, err, c.ok)
+		}
+	}
+
+	// 集群模式必须配置集群密钥和token密钥
+	if err := Setup(1, cases[1].cfg, "", "token"); err == nil {
+		t.Fatal("empty cluster secret should fail")
+	}
+	if err := Setup(1, cases[1].cfg, "secret", ""); err == nil {
+		t.Fatal("empty token secret should fail")
+	}
+	if err := Setup(0, nil, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	Setup(2, cases[1].cfg, "secret", "token")
+	if !Enabled() || Self().ID != 2 || Self().Host() != "127.0.0.1" || Self().Port() != 33252 {
+		t.Fatalf("self=%+v", Self())
+	}
+	if ns := Nodes(); len(ns) != 2 || ns[0].ID != 1 {
+		t.Fatalf("nodes=%+v", ns)
+	}
+}
+
+// 同一台机器上的三个节点, 广播到其他两个节点
+func TestBroadcast(t *testing.T) {
+	defer Setup(0, nil, "", "")
+
+	var received int32
+	Handle("test", func(data []byte) error {
+		v := map[string]int{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		atomic.AddInt32(&received, int32(v["n"]))
+		return nil
+	})
+
+	var cfg []string
+	for i := 1; i <= 3; i++ {
+		srv := httptest.NewServer(Handler())
+		defer srv.Close()
+		cfg = append(cfg, fmt.Sprintf("%d/127.0.0.1:%d/%s", i, 33250+i, strings.TrimPrefix(srv.URL, "http://")))
+	}
+	if err := Setup(1, cfg, "secret", "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Broadcast("test", map[string]int{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Fatalf("received=%d, expected 2", n)
+	}
+
+	if err := Broadcast("unknown", nil); err == nil {
+		t.Fatal("unknown route should fail")
+	}
+
+	// 密钥不同的节点不能调用内部接口
+	req := httptest.NewRequest(http.MethodPost, PathPrefix+"test", strings.NewReader(`{"n":1}`))
+	req.Header.Set(secretHeader, "wrong")
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status=%d, expected %d", w.Code, http.StatusForbidden)
+	}
+
+	// 没有密钥的请求也不能调用
+	req = httptest.NewRequest(http.MethodPost, PathPrefix+"test", strings.NewReader(`{"n":1}`))
+	w = httptest.NewRecorder()
+	Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status=%d, expected %d", w.Code, http.StatusForbidden)
+	}
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Fatalf("received=%d, expected 2", n)
+	}
+}
@@ -29,6 +29,8 @@ const (
 	DeskStatusDestory
 	//已经清洗,即为下一轮准备好
 	DeskStatusCleaned
+	//换三张, 在齐牌之后定缺之前, 新增状态放在最后, 不影响已有状态的值
+	DeskStatusHuanSanZhang
 )
 
 var stringify = [...]string{
@@ -40,6 +42,7 @@ var stringify = [...]string{
 	DeskStatusInterruption: "游戏终/中止",
 	DeskStatusDestory:      "已销毁",
 	DeskStatusCleaned:      "已清洗",
+	DeskStatusHuanSanZhang: "换三张",
 }
 
 func (s DeskStatus) String() string {
@@ -2,9 +2,11 @@ package crypto
 
 import (
 	"crypto"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
@@ -186,3 +188,11 @@ func MD5Digest(data []byte) []byte {
 
 	return h.Sum(nil)
 }
+
+//HMACSHA256Digest generate a keyed digest
+func HMACSHA256Digest(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+
+	return h.Sum(nil)
+}
@@ -50,6 +50,18 @@ const (
 	yxProductionNotFound
 	yxRequestPrePayIDFailed
 	YXDeskNotFound
+	yxDeskFull
+	yxNoOutstandingHint
+	yxIllegalOperation
+	yxTileNotInHand
+	yxMustDiscardQue
+	yxTokenExpired
+	YXDeskRedirect // 房间在集群的其他节点
+	yxHistoryNotFound
+	yxIllegalReplayCode
+	yxIllegalSnapshot
+	yxObserverFull
+	yxGoldNotEnough
 )
 
 var errs = map[error]int{
@@ -96,4 +108,15 @@ var errs = map[error]int{
 	ErrProductionNotFound:    yxProductionNotFound,
 	ErrRequestPrePayIDFailed: yxRequestPrePayIDFailed,
 	ErrDeskNotFound:          YXDeskNotFound,
+	ErrDeskFull:              yxDeskFull,
+	ErrNoOutstandingHint:     yxNoOutstandingHint,
+	ErrIllegalOperation:      yxIllegalOperation,
+	ErrTileNotInHand:         yxTileNotInHand,
+	ErrMustDiscardQue:        yxMustDiscardQue,
+	ErrTokenExpired:          yxTokenExpired,
+	ErrHistoryNotFound:       yxHistoryNotFound,
+	ErrIllegalReplayCode:     yxIllegalReplayCode,
+	ErrIllegalSnapshot:       yxIllegalSnapshot,
+	ErrObserverFull:          yxObserverFull,
+	ErrGoldNotEnough:         yxGoldNotEnough,
 }
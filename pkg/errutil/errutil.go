@@ -54,6 +54,17 @@ var (
 	ErrProductionNotFound    = errors.New("production not found")
 	ErrRequestPrePayIDFailed = errors.New("request prepay id failed")
 	ErrAccountExists         = errors.New("account exists")
+	ErrDeskFull              = errors.New("desk is full")
+	ErrNoOutstandingHint     = errors.New("no outstanding hint")
+	ErrIllegalOperation      = errors.New("illegal operation")
+	ErrTileNotInHand         = errors.New("tile not in hand")
+	ErrMustDiscardQue        = errors.New("must discard que tiles first")
+	ErrTokenExpired          = errors.New("token expired")
+	ErrHistoryNotFound       = errors.New("history not found")
+	ErrIllegalReplayCode     = errors.New("illegal replay code")
+	ErrIllegalSnapshot       = errors.New("illegal history snapshot")
+	ErrObserverFull          = errors.New("observers are full")
+	ErrGoldNotEnough         = errors.New("gold not enough")
 )
 
 //Code code for the error
@@ -0,0 +1,97 @@
+//Package rng 牌桌使用的随机数生成器
+//
+//随机数由种子确定: 使用SHA-256(种子)作为密钥的AES-256-CTR密钥流, 生产环境的种子来自crypto/rand,
+//测试或者回放时使用指定的种子可以得到完全相同的随机序列
+//
+//Rand不是并发安全的, 每张牌桌在自己的协程中使用独立的Rand
+package rng
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+type Rand struct {
+	seed   string
+	stream cipher.Stream
+	buf    [8]byte
+	pos    uint64 // 已经生成的64位随机数个数
+}
+
+//New 使用密码学安全的随机种子创建随机数生成器
+func New() *Rand {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return NewWithSeed(hex.EncodeToString(buf))
+}
+
+//NewWithSeed 使用指定的种子创建随机数生成器, 相同的种子产生相同的随机序列
+func NewWithSeed(seed string) *Rand {
+	key := sha256.Sum256([]byte(seed))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return &Rand{
+		seed:   seed,
+		stream: cipher.NewCTR(block, make([]byte, aes.BlockSize)),
+	}
+}
+
+//NewAt 使用种子创建随机数生成器, 并跳过前pos个64位随机数, 用于从检查点恢复随机数生成器的状态
+func NewAt(seed string, pos uint64) *Rand {
+	r := NewWithSeed(seed)
+	for r.pos < pos {
+		r.Uint64()
+	}
+	return r
+}
+
+//Seed 随机数种子, 保存在牌局回放中
+func (r *Rand) Seed() string {
+	return r.seed
+}
+
+//Pos 已经生成的64位随机数个数, 与种子一起确定随机数生成器的状态
+func (r *Rand) Pos() uint64 {
+	return r.pos
+}
+
+//Uint64 均匀分布的64位随机数
+func (r *Rand) Uint64() uint64 {
+	for i := range r.buf {
+		r.buf[i] = 0
+	}
+	r.stream.XORKeyStream(r.buf[:], r.buf[:])
+	r.pos++
+	return binary.LittleEndian.Uint64(r.buf[:])
+}
+
+//Intn 返回[0, n)中均匀分布的随机数, 拒绝采样避免取模带来的偏差
+func (r *Rand) Intn(n int) int {
+	if n <= 0 {
+		panic("rng: invalid argument to Intn")
+	}
+
+	max := uint64(n)
+	limit := ^uint64(0) - (^uint64(0)%max+1)%max
+	for {
+		if v := r.Uint64(); v <= limit {
+			return int(v % max)
+		}
+	}
+}
+
+//Shuffle Fisher–Yates洗牌, 所有排列出现的概率相同
+func (r *Rand) Shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, r.Intn(i+1))
+	}
+}
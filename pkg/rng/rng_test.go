@@ -0,0 +1,78 @@
+package rng
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	a, b := NewWithSeed("desk-100001"), NewWithSeed("desk-100001")
+	for i := 0; i < 100; i++ {
+		if x, y := a.Intn(108), b.Intn(108); x != y {
+			t.Fatalf("step %d: %d != %d", i, x, y)
+		}
+	}
+
+	r := New()
+	replay := NewWithSeed(r.Seed())
+	if x, y := r.Uint64(), replay.Uint64(); x != y {
+		t.Fatalf("replay %d != %d", x, y)
+	}
+	if New().Seed() == r.Seed() {
+		t.Fatal("seeds should be different")
+	}
+}
+
+func TestNewAt(t *testing.T) {
+	r := NewWithSeed("checkpoint")
+	for i := 0; i < 37; i++ {
+		r.Intn(108)
+	}
+
+	restored := NewAt(r.Seed(), r.Pos())
+	if restored.Pos() != r.Pos() {
+		t.Fatalf("pos %d != %d", restored.Pos(), r.Pos())
+	}
+	for i := 0; i < 100; i++ {
+		if x, y := r.Uint64(), restored.Uint64(); x != y {
+			t.Fatalf("step %d: %d != %d", i, x, y)
+		}
+	}
+}
+
+func TestIntn(t *testing.T) {
+	r := NewWithSeed("intn")
+	for _, n := range []int{1, 2, 6, 7, 108} {
+		for i := 0; i < 1000; i++ {
+			if v := r.Intn(n); v < 0 || v >= n {
+				t.Fatalf("Intn(%d)=%d", n, v)
+			}
+		}
+	}
+}
+
+// 卡方检验: 4张牌的24种排列出现的次数应该均匀
+func TestShuffleUniform(t *testing.T) {
+	const samples = 24000
+	r := NewWithSeed("shuffle")
+	counts := map[string]int{}
+	for i := 0; i < samples; i++ {
+		tiles := []int{0, 1, 2, 3}
+		r.Shuffle(len(tiles), func(i, j int) { tiles[i], tiles[j] = tiles[j], tiles[i] })
+		counts[fmt.Sprint(tiles)]++
+	}
+	if len(counts) != 24 {
+		t.Fatalf("permutations=%d, expected 24", len(counts))
+	}
+
+	expected := float64(samples) / 24
+	chi2 := 0.0
+	for _, c := range counts {
+		d := float64(c) - expected
+		chi2 += d * d / expected
+	}
+	// 自由度23, p=0.001的临界值为49.73
+	if chi2 > 49.73 {
+		t.Fatalf("chi2=%.2f, shuffle is biased: %v", chi2, counts)
+	}
+}
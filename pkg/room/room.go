@@ -1,11 +1,10 @@
 package room
 
 import (
-	"math/rand"
 	"sync"
-	"time"
 
 	"go-mahjong-server/db"
+	"go-mahjong-server/pkg/rng"
 )
 
 const (
@@ -15,15 +14,15 @@ const (
 type Number string
 type numberManager struct {
 	lock sync.Mutex
+	rand *rng.Rand
+	node int // 集群模式下房间号的第一位是节点编号, 0表示单机模式
 }
 
 var rn *numberManager
 var numbers = [...]byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9'}
 
 func init() {
-	rn = &numberManager{}
-
-	rand.Seed(time.Now().Unix())
+	rn = &numberManager{rand: rng.New()}
 }
 
 func (rn *numberManager) next() Number {
@@ -33,7 +32,10 @@ func (rn *numberManager) next() Number {
 
 	for {
 		for i := 0; i < roomNoLen; i++ {
-			no[i] = numbers[rand.Intn(10)]
+			no[i] = numbers[rn.rand.Intn(10)]
+		}
+		if rn.node > 0 {
+			no[0] = numbers[rn.node]
 		}
 		temp := Number(no)
 		dn := string(no)
@@ -48,6 +50,21 @@ func (rn *numberManager) remove(no Number) {
 	//rn.noPool.Remove(string(no))
 }
 
+//SetNode 设置当前节点编号(1-9), 之后生成的房间号都以节点编号开头
+func SetNode(id int) {
+	rn.lock.Lock()
+	rn.node = id
+	rn.lock.Unlock()
+}
+
+//Node 创建房间的节点编号
+func (n Number) Node() int {
+	if len(n) == 0 || n[0] < '0' || n[0] > '9' {
+		return 0
+	}
+	return int(n[0] - '0')
+}
+
 func Next() Number {
 	return rn.next()
 }
@@ -8,3 +8,12 @@ func TestNext(t *testing.T) {
 		//t.Log(Next())
 	}
 }
+
+func TestNumberNode(t *testing.T) {
+	cases := map[Number]int{"123456": 1, "923456": 9, "023456": 0, "": 0, "a23456": 0}
+	for no, expected := range cases {
+		if n := no.Node(); n != expected {
+			t.Fatalf("%s: node=%d, expected %d", no, n, expected)
+		}
+	}
+}
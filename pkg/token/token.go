@@ -0,0 +1,109 @@
+//Package token issue and verify the signed login token
+//
+//token格式: base64(uid:过期时间戳).base64(HMAC-SHA256签名)
+//由web服务器登录时签发, 游戏服务器登录和重连时校验
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-mahjong-server/pkg/crypto"
+	"go-mahjong-server/pkg/errutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultExpires = 6 * time.Hour
+
+var (
+	secret  []byte
+	expires = defaultExpires
+	now     = time.Now
+)
+
+//Setup 设置签名密钥和过期时间, 密钥为空时生成随机密钥(仅适用于单进程部署)
+func Setup(key string, exp time.Duration) {
+	if key == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		key = string(buf)
+		log.Warn("未配置token签名密钥, 使用随机密钥, 重启后已签发的token将失效")
+	}
+	secret = []byte(key)
+
+	if exp <= 0 {
+		exp = defaultExpires
+	}
+	expires = exp
+}
+
+//Issue 为玩家签发token, 返回token和过期时间戳
+func Issue(uid int64) (string, int64) {
+	expireAt := now().Add(expires).Unix()
+	payload := []byte(fmt.Sprintf("%d:%d", uid, expireAt))
+	sign := crypto.HMACSHA256Digest(secret, payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sign), expireAt
+}
+
+//Parse 校验token的签名和过期时间, 返回token所属的玩家
+func Parse(tk string) (int64, error) {
+	if len(secret) == 0 {
+		return 0, errutil.ErrInitFailed
+	}
+
+	parts := strings.Split(tk, ".")
+	if len(parts) != 2 {
+		return 0, errutil.ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, errutil.ErrInvalidToken
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, errutil.ErrInvalidToken
+	}
+	if !hmac.Equal(sign, crypto.HMACSHA256Digest(secret, payload)) {
+		return 0, errutil.ErrInvalidToken
+	}
+
+	fields := strings.Split(string(payload), ":")
+	if len(fields) != 2 {
+		return 0, errutil.ErrInvalidToken
+	}
+	uid, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, errutil.ErrInvalidToken
+	}
+	expireAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, errutil.ErrInvalidToken
+	}
+	if now().Unix() > expireAt {
+		return 0, errutil.ErrTokenExpired
+	}
+
+	return uid, nil
+}
+
+//Verify 校验token是否属于指定的玩家
+func Verify(tk string, uid int64) error {
+	owner, err := Parse(tk)
+	if err != nil {
+		return err
+	}
+	if owner != uid {
+		return errutil.ErrTokenMismatchUser
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go-mahjong-server/pkg/errutil"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	Setup("test-secret", time.Hour)
+
+	tk, expireAt := Issue(10086)
+	if expireAt <= time.Now().Unix() {
+		t.Fatalf("expire at %d is in the past", expireAt)
+	}
+
+	uid, err := Parse(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != 10086 {
+		t.Fatalf("uid=%d, expected 10086", uid)
+	}
+
+	if err := Verify(tk, 10086); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(tk, 10087); err != errutil.ErrTokenMismatchUser {
+		t.Fatalf("err=%v, expected %v", err, errutil.ErrTokenMismatchUser)
+	}
+}
+
+func TestTamperedToken(t *testing.T) {
+	Setup("test-secret", time.Hour)
+	tk, _ := Issue(10086)
+
+	forged, _ := Issue(1)
+	parts := strings.Split(tk, ".")
+	forgedParts := strings.Split(forged, ".")
+
+	cases := []string{
+		"",
+		"abc",
+		forgedParts[0] + "." + parts[1],
+		tk + "x",
+	}
+	for _, c := range cases {
+		if _, err := Parse(c); err != errutil.ErrInvalidToken {
+			t.Fatalf("token=%q err=%v, expected %v", c, err, errutil.ErrInvalidToken)
+		}
+	}
+
+	// 更换密钥后之前的token失效
+	Setup("another-secret", time.Hour)
+	if _, err := Parse(tk); err != errutil.ErrInvalidToken {
+		t.Fatalf("err=%v, expected %v", err, errutil.ErrInvalidToken)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	Setup("test-secret", time.Minute)
+	defer func() { now = time.Now }()
+
+	tk, _ := Issue(10086)
+	now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := Parse(tk); err != errutil.ErrTokenExpired {
+		t.Fatalf("err=%v, expected %v", err, errutil.ErrTokenExpired)
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+const (
+	RouteGoldChange    = "onGoldChange"
+	RouteClassicSettle = "onClassicSettle"
+)
+
+// 进入金币场, 服务器选择一张有空位的牌桌入座, 没有空位时创建新的牌桌
+type ClassicJoinRequest struct {
+	Level int `json:"level"` // ClassicLevelJunior ~ ClassicLevelMaster
+}
+
+type ClassicJoinResponse struct {
+	Code      int       `json:"code"`
+	Error     string    `json:"error"`
+	Level     int       `json:"level"`
+	Base      int64     `json:"base"` // 底注
+	Min       int64     `json:"min"`  // 入场最低金币
+	TableInfo TableInfo `json:"tableInfo"`
+}
+
+type ClassicLevelInfo struct {
+	Level   int   `json:"level"`
+	Base    int64 `json:"base"`
+	Min     int64 `json:"min"`
+	Players int   `json:"players"` // 正在游戏的人数
+}
+
+type ClassicLevelsResponse struct {
+	Rake   int                `json:"rake"` // 抽水比例(%)
+	Levels []ClassicLevelInfo `json:"levels"`
+}
+
+type GoldChangeInformation struct {
+	Gold int64 `json:"gold"`
+}
+
+type ClassicSettleItem struct {
+	Uid    int64 `json:"uid"`
+	Change int64 `json:"change"` // 金币变化, 已经扣除抽水
+	Rake   int64 `json:"rake"`
+	Gold   int64 `json:"gold"` // 结算后的金币
+}
+
+// 金币场每局的金币结算, 在onRoundEnd之前推送
+type ClassicSettle struct {
+	Base  int64               `json:"base"`
+	Items []ClassicSettleItem `json:"items"`
+}
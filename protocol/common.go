@@ -182,6 +182,13 @@ type Hint struct {
 	Uid   int64 `json:"uid"`
 }
 
+//玩家选择不合法, 附带当前的提示以便客户端重新选择
+type OpChooseError struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+	Hint  *Hint  `json:"hint"`
+}
+
 func (h *Hint) String() string {
 	return fmt.Sprintf("UID=%d, Ops=%+v, Tings=%+v", h.Uid, h.Ops, h.Tings)
 }
@@ -72,6 +72,13 @@ const (
 	ExitTypeRepeatLogin          = 5
 )
 
+// 换三张的方向, 由骰子点数决定
+const (
+	HuanSanZhangClockwise        = 1 // 顺时针, 换给上家
+	HuanSanZhangCounterClockwise = 2 // 逆时针, 换给下家
+	HuanSanZhangAcross           = 3 // 对家互换, 只有四人牌桌
+)
+
 const (
 	DeskStatusZb      = 1
 	DeskStatusDq      = 2
@@ -85,6 +92,9 @@ const (
 	HuTypePei
 )
 
+// 没有绑定三方账号的玩家使用的默认头像
+const DefaultHeadUrl = "http://wx.qlogo.cn/mmopen/s962LEwpLxhQSOnarDnceXjSxVGaibMRsvRM4EIWic0U6fQdkpqz4Vr8XS8D81QKfyYuwjwm2M2ibsFY8mia8ic51ww/0"
+
 const (
 	SexTypeUnknown = 0
 	SexTypeMale    = 1
@@ -123,6 +133,7 @@ const (
 	OptypeGang    = 3
 	OptypeHu      = 4
 	OptypePass    = 5
+	OptypeChi     = 6 // 吃, TileIDs为组成顺子的三张牌, 选择时Index为顺子中第一张牌的ID
 
 	OptyMoPai = 500 //摸牌
 	//以下三种杠的分类主要用以解决上面的 OptypeGang分类不细致,导致抢杠等操作处理麻烦的问题
@@ -132,6 +143,9 @@ const (
 	OptypeBaGang   = 1024
 )
 
+// 其他玩家不可见的牌使用此ID代替
+const HiddenTileID = -1
+
 // 番型
 const (
 	FanXingQingYiSe      = 1  // "清一色"
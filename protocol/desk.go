@@ -41,6 +41,40 @@ type DingQue struct {
 	Que int `json:"que"`
 }
 
+// 换三张: 玩家选择换出的三张同花色手牌
+type HuanSanZhangRequest struct {
+	Tiles []int `json:"mjs"`
+}
+
+type HuanSanZhangChosen struct {
+	Uid int64 `json:"acId"`
+}
+
+// 换三张提示, 包含推荐换出的牌
+type HuanSanZhangHint struct {
+	Tiles []int `json:"mjs"`
+}
+
+type HuanSanZhangInfo struct {
+	Uid int64 `json:"acId"`
+	Out []int `json:"out"` //换出的牌
+	In  []int `json:"in"`  //换入的牌
+}
+
+// 换三张结果, 其他玩家换出和换入的牌不可见
+type HuanSanZhangResult struct {
+	Dice1     int                `json:"dice1"`
+	Dice2     int                `json:"dice2"`
+	Direction int                `json:"direction"`
+	Players   []HuanSanZhangInfo `json:"players"`
+}
+
+// 断线重连时的换三张状态
+type HuanSanZhangSync struct {
+	Chosen bool  `json:"chosen"` //是否已经选择
+	Tiles  []int `json:"mjs"`    //已经选择的牌, 未选择时为推荐的牌
+}
+
 type DeskBasicInfo struct {
 	DeskID string `json:"deskId"`
 	Title  string `json:"title"`
@@ -56,6 +90,7 @@ type ScoreInfo struct {
 type DuanPaiInfo struct {
 	Uid    int64 `json:"acId"`
 	OnHand []int `json:"mjs"`
+	Count  int   `json:"count"` //手牌数量, 其他玩家的手牌只下发数量
 }
 
 type DuanPai struct {
@@ -77,6 +112,11 @@ type OpTypeDo struct {
 	TileIDs []int   `json:"mjs"`
 }
 
+// 托管状态变化
+type Trusteeship struct {
+	Uid int64 `json:"acId"`
+}
+
 type MoPai struct {
 	AccountID int64 `json:"acId"`
 	TileIDs   []int `json:"mjids"`
@@ -123,6 +163,13 @@ type HuInfo struct {
 	TotalWinScore int         `json:"totalWinScore"` //赢的所有输家的总分数
 }
 
+// 血流成河: 玩家胡牌结算后, 胡的牌从手牌中移出, 继续摸牌打牌
+type HuContinue struct {
+	Uid     int64 `json:"acId"`
+	HuTiles []int `json:"huPais"` //已经胡的所有牌
+	HuCount int   `json:"huCount"`
+}
+
 type HandTilesInfo struct {
 	Uid    int64 `json:"acId"`
 	Tiles  []int `json:"shouPai"`
@@ -147,14 +194,17 @@ type RoundOverStats struct {
 type DeskPlayerData struct {
 	Uid        int64 `json:"acId"`
 	HandTiles  []int `json:"shouPaiIds"`
+	HandCount  int   `json:"shouPaiCnt"` //手牌数量, 其他玩家的手牌只下发数量
 	ChuTiles   []int `json:"chuPaiIds"`
 	PGTiles    []int `json:"gangInfos"`
 	LatestTile int   `json:"lastTile"`
 	IsHu       bool  `json:"isHu"`
 	HuPai      int   `json:"huPai"`
+	HuTiles    []int `json:"huPais"` //血流成河中已经胡的牌
 	HuType     int   `json:"huType"`
 	Que        int   `json:"que"`
 	Score      int   `json:"score"`
+	IsTrustee  bool  `json:"isTrustee"` //是否托管中
 }
 
 type SyncDesk struct {
@@ -169,6 +219,7 @@ type SyncDesk struct {
 	Hint          *Hint               `json:"hint"`
 	LastTileId    int                 `json:"lastChuPaiId"`
 	LastChuPaiUid int64               `json:"lastChuPaiUid"`
+	HuanSanZhang  *HuanSanZhangSync   `json:"huanSanZhang,omitempty"`
 }
 
 type DeskOptions struct {
@@ -185,6 +236,14 @@ type DeskOptions struct {
 	Pengpeng bool `json:"pengpeng"` // 碰碰胡两番
 	Pinghu   bool `json:"pinghu"`   // 点炮可平胡
 	Yaojiu   bool `json:"yaojiu"`   // 全幺九
+
+	HuanSanZhang bool `json:"huanSanZhang"` // 换三张
+
+	// 二人模式
+	DuoSuits int  `json:"duoSuits"` // 使用的花色数量: 1(万), 2(筒万), 为0时只使用万
+	DuoHonor bool `json:"duoHonor"` // 加入东南西北中发白
+
+	Rule string `json:"rule"` // 玩法规则: xuezhan(血战到底), xueliu(血流成河), tuidaohu(推倒胡), 为空时使用血战到底
 }
 
 type CreateDeskRequest struct {
@@ -200,10 +259,8 @@ type CreateDeskResponse struct {
 }
 
 type ReConnect struct {
-	Uid     int64  `json:"uid"`
-	Name    string `json:"name"`
-	HeadUrl string `json:"headUrl"`
-	Sex     int    `json:"sex"`
+	Uid   int64  `json:"uid"`
+	Token string `json:"token"` //web服务器登录时签发的token
 }
 
 type DeskListRequest struct {
@@ -298,3 +355,23 @@ type PlayRecordingVoice struct {
 type ClientInitCompletedRequest struct {
 	IsReEnter bool `json:"isReenter"`
 }
+
+// 添加机器人, Count为0时补满空位
+type AddRobotRequest struct {
+	DeskNo string `json:"deskId"`
+	Count  int    `json:"count"`
+}
+
+// 观战, 观战者不占用座位, 只接收延迟推送的公开事件
+type ObserveDeskRequest struct {
+	DeskNo string `json:"deskId"`
+}
+
+type ObserveDeskResponse struct {
+	Code      int       `json:"code"`
+	Error     string    `json:"error"`
+	TableInfo TableInfo `json:"tableInfo"`
+	Delay     int       `json:"delay"`     // 观战延迟(秒)
+	Observers int       `json:"observers"` // 当前观战人数
+	Node      *NodeInfo `json:"node,omitempty"`
+}
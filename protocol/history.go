@@ -1,5 +1,7 @@
 package protocol
 
+import "encoding/json"
+
 type HistoryListRequest struct {
 	DeskID int64 `json:"desk_id"`
 	Offset int   `json:"offset"`
@@ -34,6 +36,7 @@ type HistoryLite struct {
 	ScoreChange1 int    `json:"score_change1"`
 	ScoreChange2 int    `json:"score_change2"`
 	ScoreChange3 int    `json:"score_change3"`
+	ReplayCode   string `json:"replay_code"` //回放码
 }
 
 type History struct {
@@ -57,3 +60,59 @@ type HistoryByIDResponse struct {
 	Code int      `json:"code"`
 	Data *History `json:"data"`
 }
+
+type ReplayCodeRequest struct {
+	Code string `json:"code"` //回放码
+}
+
+// 回放中一个玩家在某一步之后的状态
+type ReplayPlayer struct {
+	Uid      int64   `json:"acId"`
+	Name     string  `json:"name"`
+	Hand     []int   `json:"shouPai"`
+	Discards []int   `json:"chuPai"`
+	Melds    [][]int `json:"pgPai"` //碰, 杠, 吃
+	HuTiles  []int   `json:"huPai"`
+	Score    int     `json:"score"` //本局到这一步为止的分数
+}
+
+// 回放的一步, Type为duanPai(发牌), huanSanZhang(换三张), do(玩家操作), end(结算)
+type ReplayStep struct {
+	Type    string          `json:"type"`
+	Action  *OpTypeDo       `json:"action,omitempty"`
+	Players []*ReplayPlayer `json:"players"`
+}
+
+type Replay struct {
+	HistoryLite
+	Seed  string          `json:"seed"`
+	End   *RoundOverStats `json:"end,omitempty"`
+	Steps []*ReplayStep   `json:"steps"`
+}
+
+type ReplayResponse struct {
+	Code  int     `json:"code"`
+	Error string  `json:"error,omitempty"`
+	Data  *Replay `json:"data"`
+}
+
+// 牌局事件, 按发生顺序追加, Actor为0表示牌桌
+type HistoryEvent struct {
+	Seq   int             `json:"seq"`
+	At    int64           `json:"at"` //毫秒时间戳
+	Actor int64           `json:"actor"`
+	Type  string          `json:"type"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// 一局完整的事件日志, Version为事件格式的版本
+type HistoryEvents struct {
+	Version int             `json:"version"`
+	Events  []*HistoryEvent `json:"events"`
+}
+
+type HistoryEventsResponse struct {
+	Code  int            `json:"code"`
+	Error string         `json:"error,omitempty"`
+	Data  *HistoryEvents `json:"data"`
+}
@@ -69,6 +69,8 @@ type LoginResponse struct {
 	Messages []string     `json:"messages"`
 	ClubList []ClubItem   `json:"clubList"`
 	Debug    int          `json:"debug"`
+	Token    string       `json:"token"`    //登录游戏服务器使用的token
+	ExpireAt int64        `json:"expireAt"` //token过期时间
 }
 
 type LoginToGameServerResponse struct {
@@ -79,13 +81,10 @@ type LoginToGameServerResponse struct {
 	FangKa   int    `json:"fangka"`
 }
 
+// 玩家信息和房卡从数据库中读取, 不再信任客户端发送的数据
 type LoginToGameServerRequest struct {
-	Name    string `json:"name"`
-	Uid     int64  `json:"uid"`
-	HeadUrl string `json:"headUrl"`
-	Sex     int    `json:"sex"` //[0]未知 [1]男 [2]女
-	FangKa  int    `json:"fangka"`
-	IP      string `json:"ip"`
+	Uid   int64  `json:"uid"`
+	Token string `json:"token"` //web服务器登录时签发的token
 }
 
 type EncryptTest struct {
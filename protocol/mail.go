@@ -0,0 +1,58 @@
+package protocol
+
+const (
+	RouteMailNotify = "onMailNotify" // 登录或者收到新邮件时推送未读邮件数量
+)
+
+// 邮件类型
+const (
+	MailKindSystem = 1 // 系统邮件
+	MailKindAdmin  = 2 // 管理员发送的邮件
+)
+
+// 邮件的接收范围
+const (
+	MailScopeUser = 1 // 单个玩家
+	MailScopeClub = 2 // 俱乐部的所有成员
+	MailScopeAll  = 3 // 所有玩家
+)
+
+type Mail struct {
+	ID        int64  `json:"id"`
+	Kind      int    `json:"kind"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	Coin      int64  `json:"coin"` // 附件: 房卡数量, 0表示没有附件
+	Read      bool   `json:"read"`
+	Claimed   bool   `json:"claimed"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpireAt  int64  `json:"expireAt"`
+}
+
+type MailListResponse struct {
+	Mails  []Mail `json:"mails"`
+	Unread int    `json:"unread"`
+}
+
+type MailNotify struct {
+	Unread int `json:"unread"`
+}
+
+// 已读/领取/删除的结果
+type MailOperateResponse struct {
+	Code    int     `json:"code"`
+	Error   string  `json:"error"`
+	Unread  int     `json:"unread"`
+	Claimed []int64 `json:"claimed"` // 本次领取附件的邮件
+	Coin    int64   `json:"coin"`    // 领取之后的房卡数量
+}
+
+// 管理员发送邮件
+type SendMailRequest struct {
+	Scope      int    `json:"scope"`
+	Target     int64  `json:"target"` // 玩家UID或者俱乐部ID, 发送给所有玩家时忽略
+	Title      string `json:"title"`
+	Content    string `json:"content"`
+	Coin       int64  `json:"coin"`
+	ExpireDays int    `json:"expireDays"` // 有效期(天), 0表示使用默认有效期
+}
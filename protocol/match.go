@@ -0,0 +1,25 @@
+package protocol
+
+// 匹配状态
+const (
+	MatchStatusWaiting   = 1 // 匹配中
+	MatchStatusMatched   = 2 // 匹配成功, 已经入座
+	MatchStatusTimeout   = 3 // 匹配超时
+	MatchStatusCancelled = 4 // 取消匹配
+)
+
+const RouteMatchStatus = "onMatchStatus"
+
+// 快速匹配, 相同人数模式和玩法的玩家按匹配分分组
+type MatchRequest struct {
+	Mode int    `json:"mode"`
+	Rule string `json:"rule"` // 为空时使用血战到底
+}
+
+type MatchStatus struct {
+	Status    int        `json:"status"`
+	Waited    int        `json:"waited"` // 已经等待的时间(秒)
+	Queued    int        `json:"queued"` // 队列中相同模式和玩法的人数
+	Range     int        `json:"range"`  // 当前可以接受的匹配分差距
+	TableInfo *TableInfo `json:"tableInfo,omitempty"`
+}
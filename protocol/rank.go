@@ -0,0 +1,25 @@
+package protocol
+
+// 排行榜类型
+const (
+	RankTypeScore = 1 // 累计输赢分数
+	RankTypeWins  = 2 // 胡牌次数
+	RankTypeCard  = 3 // 房卡消耗
+)
+
+// 排行榜周期
+const (
+	RankPeriodDaily  = 1
+	RankPeriodWeekly = 2
+	RankPeriodAll    = 3
+)
+
+type RankInfoResponse struct {
+	Code   int    `json:"code"`
+	Error  string `json:"error"`
+	Type   int    `json:"type"`
+	Period int    `json:"period"`
+	ClubId int64  `json:"clubId"`
+	Ranks  []Rank `json:"ranks"`
+	Self   Rank   `json:"self"` // 当前玩家的排名
+}
@@ -5,13 +5,16 @@ import (
 )
 
 type GetRankInfoRequest struct {
-	IsSelf bool `json:"isself"`
-	Start  int  `json:"start"`
-	Len    int  `json:"len"`
+	IsSelf bool  `json:"isself"` // 只查询自己的排名
+	Start  int   `json:"start"`
+	Len    int   `json:"len"`
+	Type   int   `json:"type"`   // RankTypeScore ~ RankTypeCard
+	Period int   `json:"period"` // RankPeriodDaily ~ RankPeriodAll
+	ClubId int64 `json:"clubId"` // 俱乐部排行榜, 0表示全服
 }
 
 type MailOperateRequest struct {
-	MailIDs []int64 `json:"mailids"`
+	MailIDs []int64 `json:"mailids"` // 为空时操作所有邮件
 }
 
 type ApplyForDailyMatchRequest struct {
@@ -34,8 +37,21 @@ type ReJoinDeskRequest struct {
 }
 
 type ReJoinDeskResponse struct {
-	Code  int    `json:"code"`
-	Error string `json:"error"`
+	Code  int       `json:"code"`
+	Error string    `json:"error"`
+	Node  *NodeInfo `json:"node,omitempty"`
+}
+
+// 集群模式下房间所在节点的地址, 客户端连接该节点并登录后重新请求
+type NodeInfo struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+// 重新进入的房间在其他节点
+type DeskRedirect struct {
+	DeskNo string    `json:"deskId"`
+	Node   *NodeInfo `json:"node"`
 }
 
 type ReEnterDeskRequest struct {
@@ -67,6 +83,7 @@ type JoinDeskResponse struct {
 	Code      int       `json:"code"`
 	Error     string    `json:"error"`
 	TableInfo TableInfo `json:"tableInfo"`
+	Node      *NodeInfo `json:"node,omitempty"`
 }
 
 type DestoryDeskRequest struct {
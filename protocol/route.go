@@ -3,4 +3,13 @@ package protocol
 const (
 	RouteOpTypeHint = "onOpTypeHint"
 	RouteTypeDo     = "onOpTypeDo"
+
+	RouteTrusteeship       = "onTrusteeship"       // 玩家进入托管
+	RouteCancelTrusteeship = "onCancelTrusteeship" // 玩家取消托管
+	RouteOpChooseError     = "onOpChooseError"     // 玩家选择不合法
+	RouteHuContinue        = "onHuContinue"        // 血流成河: 玩家胡牌后继续打牌
+
+	RouteHuanSanZhangHint   = "onHuanSanZhangHint"   // 开始换三张
+	RouteHuanSanZhangChosen = "onHuanSanZhangChosen" // 玩家已经选择换三张的牌
+	RouteHuanSanZhang       = "onHuanSanZhang"       // 换三张结果
 )
@@ -110,6 +110,7 @@ type Rank struct {
 	Uid   int64  `json:"uid"`
 	Name  string `json:"name"`
 	Value int64  `json:"value"`
+	Rank  int    `json:"rank"` // 名次, 0表示未上榜
 }
 
 type CommonStatsItem struct {
@@ -0,0 +1,51 @@
+package protocol
+
+const (
+	RouteTournamentProgress = "onTournamentProgress"
+)
+
+// 比赛状态
+const (
+	TournamentStatusSignUp    = 1 // 报名中
+	TournamentStatusRunning   = 2 // 进行中
+	TournamentStatusFinished  = 3 // 已结束
+	TournamentStatusCancelled = 4 // 人数不足取消, 退还报名费
+)
+
+// 参赛玩家状态
+const (
+	TournamentPlayerStatusPlaying    = 1 // 比赛中
+	TournamentPlayerStatusEliminated = 2 // 已淘汰
+	TournamentPlayerStatusFinished   = 3 // 完成决赛
+	TournamentPlayerStatusRefunded   = 4 // 比赛取消, 已退还报名费
+)
+
+// 比赛进度, 报名/每轮开始/淘汰/比赛结束时推送, 也用于比赛列表
+type TournamentProgress struct {
+	ID           int64      `json:"id"`
+	Level        int        `json:"level"` // DailyMatchLevelJunior ~ DailyMatchLevelMaster
+	Title        string     `json:"title"`
+	Status       int        `json:"status"`
+	StartAt      int64      `json:"startAt"`
+	Fee          int64      `json:"fee"`  // 报名费(金币)
+	Pool         int64      `json:"pool"` // 奖池, 已经扣除抽水
+	Stage        int        `json:"stage"`
+	RoomType     int        `json:"roomType"` // RoomTypeDailyMatch 或者决赛 RoomTypeFinalMatch
+	Players      int        `json:"players"`  // 剩余的参赛人数
+	Joined       bool       `json:"joined"`   // 当前玩家是否报名
+	PlayerStatus int        `json:"playerStatus"`
+	Score        int        `json:"score"` // 累计分数
+	Rank         int        `json:"rank"`
+	Prize        int64      `json:"prize"`
+	TableInfo    *TableInfo `json:"tableInfo,omitempty"` // 本轮入座的牌桌
+}
+
+type TournamentApplyResponse struct {
+	Code     int                `json:"code"`
+	Error    string             `json:"error"`
+	Progress TournamentProgress `json:"progress"`
+}
+
+type TournamentListResponse struct {
+	Tournaments []TournamentProgress `json:"tournaments"`
+}